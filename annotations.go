@@ -0,0 +1,318 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EPUB highlight stored as a record instead of being written into the
+// chapter file. Href is the chapter path relative to the package directory
+// and CFI the range selector of the highlighted text (see epubcfi.js).
+type EPUBAnnotationStruct struct {
+	Id        int64  `json:"id"`
+	FileName  string `json:"fileName"`
+	Href      string `json:"href"`
+	CFI       string `json:"cfi"`
+	Quote     string `json:"quote"`
+	Color     string `json:"color"`
+	Note      string `json:"note"`
+	CreatedOn string `json:"createdOn"`
+	UpdatedOn string `json:"updatedOn"`
+}
+
+// Imported annotations keep their creation time
+func (e *Env) _InsertEPUBAnnotation(userId int64, bookId int64, annotation EPUBAnnotationStruct) int64 {
+	createdOn := annotation.CreatedOn
+	if createdOn == "" {
+		createdOn = _GetCurrentTime()
+	}
+
+	stmt, err := e.db.Prepare("INSERT INTO `epub_annotation` (user_id, book_id, spine_href, cfi, quote, color, note, created_on, updated_on) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	CheckError(err)
+
+	res, err := stmt.Exec(userId, bookId, annotation.Href, annotation.CFI, annotation.Quote, annotation.Color, annotation.Note, createdOn, createdOn)
+	CheckError(err)
+
+	id, err := res.LastInsertId()
+	CheckError(err)
+
+	return id
+}
+
+func (e *Env) _GetEPUBAnnotations(userId int64, bookId int64, href string) []EPUBAnnotationStruct {
+	query := "SELECT `id`, `spine_href`, `cfi`, `quote`, `color`, `note`, `created_on`, `updated_on` FROM `epub_annotation` WHERE `user_id` = ? AND `book_id` = ?"
+	args := []interface{}{userId, bookId}
+	if href != "" {
+		query += " AND `spine_href` = ?"
+		args = append(args, href)
+	}
+
+	rows, err := e.db.Query(query+" ORDER BY `id`", args...)
+	CheckError(err)
+
+	annotations := []EPUBAnnotationStruct{}
+	for rows.Next() {
+		annotation := EPUBAnnotationStruct{}
+		err := rows.Scan(&annotation.Id, &annotation.Href, &annotation.CFI, &annotation.Quote, &annotation.Color, &annotation.Note, &annotation.CreatedOn, &annotation.UpdatedOn)
+		CheckError(err)
+
+		annotations = append(annotations, annotation)
+	}
+	rows.Close()
+
+	return annotations
+}
+
+// Update a column of an annotation owned by the user. Returns false if the
+// annotation doesn't exist or belongs to someone else.
+func (e *Env) _UpdateEPUBAnnotation(userId int64, id int64, column string, value string) bool {
+	stmt, err := e.db.Prepare("UPDATE `epub_annotation` SET " + column + "=?, updated_on=? WHERE id=? AND user_id=?")
+	CheckError(err)
+
+	res, err := stmt.Exec(value, _GetCurrentTime(), id, userId)
+	CheckError(err)
+
+	count, err := res.RowsAffected()
+	CheckError(err)
+
+	return count > 0
+}
+
+func (e *Env) PostEPUBAnnotation(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		annotation := EPUBAnnotationStruct{}
+		err := c.BindJSON(&annotation)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		bookId, format, _ := e._GetBookInfo(annotation.FileName)
+		if bookId == 0 || format != "epub" {
+			c.String(404, "Book not found")
+			return
+		}
+
+		if !e._CanAnnotateBook(userId, bookId) {
+			c.String(403, "You can't highlight this book")
+			return
+		}
+
+		if annotation.Href == "" || annotation.CFI == "" {
+			c.String(400, "Missing chapter or selector")
+			return
+		}
+
+		id := e._InsertEPUBAnnotation(userId, bookId, annotation)
+
+		c.String(200, strconv.Itoa(int(id)))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) GetEPUBAnnotations(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		fileName := c.Query("fileName")
+		href := c.Query("href")
+
+		userId := e._GetUserId(email.(string))
+		bookId, _, _ := e._GetBookInfo(fileName)
+		if !e._CanAccessBook(userId, bookId) {
+			c.String(404, "Book not found")
+			return
+		}
+
+		c.JSON(200, e._GetEPUBAnnotations(userId, bookId, href))
+	} else {
+		c.JSON(200, "Not signed in")
+	}
+}
+
+type EPUBAnnotationUpdateStruct struct {
+	Id    int64  `json:"id"`
+	Color string `json:"color"`
+	Note  string `json:"note"`
+}
+
+func (e *Env) PostEPUBAnnotationColor(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		update := EPUBAnnotationUpdateStruct{}
+		err := c.BindJSON(&update)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		if !e._UpdateEPUBAnnotation(userId, update.Id, "color", update.Color) {
+			c.String(404, "Highlight not found")
+			return
+		}
+
+		c.String(200, "Highlight updated successfully")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) PostEPUBAnnotationNote(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		update := EPUBAnnotationUpdateStruct{}
+		err := c.BindJSON(&update)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		if !e._UpdateEPUBAnnotation(userId, update.Id, "note", update.Note) {
+			c.String(404, "Highlight not found")
+			return
+		}
+
+		c.String(200, "Highlight updated successfully")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) DeleteEPUBAnnotation(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		update := EPUBAnnotationUpdateStruct{}
+		err := c.BindJSON(&update)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		stmt, err := e.db.Prepare("DELETE FROM `epub_annotation` WHERE id=? AND user_id=?")
+		CheckError(err)
+
+		res, err := stmt.Exec(update.Id, userId)
+		CheckError(err)
+
+		count, err := res.RowsAffected()
+		CheckError(err)
+
+		if count == 0 {
+			c.String(404, "Highlight not found")
+			return
+		}
+
+		e._DeleteHighlightComments(HighlightTypeEPUB, update.Id)
+
+		c.String(200, "Highlight deleted successfully")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+// Chapter path inside the EPUB archive for a chapter URL of the viewer, e.g.
+// /uploads/book/OEBPS/Text/ch1.xhtml -> OEBPS/Text/ch1.xhtml. Returns an empty
+// string if the URL doesn't point inside the book, or if the path would be
+// read as an option by unzip.
+func _GetEPUBArchivePath(fileName string, chapterURL string) string {
+	prefix := "/uploads/" + strings.Split(fileName, ".epub")[0] + "/"
+	if !strings.HasPrefix(chapterURL, prefix) {
+		return ""
+	}
+
+	archivePath := path.Clean(strings.TrimPrefix(chapterURL, prefix))
+	if archivePath == "." || strings.HasPrefix(archivePath, "..") || strings.HasPrefix(archivePath, "-") || path.IsAbs(archivePath) {
+		return ""
+	}
+
+	return archivePath
+}
+
+// Extract a chapter again from the uploaded EPUB, undoing highlights which
+// were written into the file by older versions.
+func _RestoreEPUBChapter(fileName string, archivePath string) error {
+	if strings.HasPrefix(archivePath, "-") {
+		return fmt.Errorf("invalid chapter path: %s", archivePath)
+	}
+	fileNameWithoutExtension := strings.Split(fileName, ".epub")[0]
+
+	cmd := exec.Command("unzip", "-o", "./uploads/"+fileName, archivePath, "-d", "uploads/"+fileNameWithoutExtension+"/")
+	return cmd.Run()
+}
+
+type EPUBLegacyHighlightsStruct struct {
+	FileName    string                 `json:"fileName"`
+	ChapterURL  string                 `json:"chapterURL"`
+	Annotations []EPUBAnnotationStruct `json:"annotations"`
+}
+
+// Highlights saved before annotation records existed are part of the chapter
+// HTML. The viewer converts them to annotations of the user opening the
+// chapter, then the original chapter is restored from the EPUB.
+func (e *Env) PostEPUBLegacyHighlights(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		legacy := EPUBLegacyHighlightsStruct{}
+		err := c.BindJSON(&legacy)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		bookId, format, _ := e._GetBookInfo(legacy.FileName)
+		if bookId == 0 || format != "epub" {
+			c.String(404, "Book not found")
+			return
+		}
+
+		// Highlights written into the chapters were made by the owner
+		if e._GetBookPermission(userId, bookId) != SharePermissionOwner {
+			c.String(403, "Only the owner of the book can migrate its highlights")
+			return
+		}
+
+		archivePath := _GetEPUBArchivePath(legacy.FileName, legacy.ChapterURL)
+		if archivePath == "" {
+			c.String(400, "Invalid chapter")
+			return
+		}
+
+		for _, annotation := range legacy.Annotations {
+			if annotation.CFI == "" {
+				continue
+			}
+			e._InsertEPUBAnnotation(userId, bookId, annotation)
+		}
+
+		err = _RestoreEPUBChapter(legacy.FileName, archivePath)
+		if err != nil {
+			fmt.Println(err)
+			c.String(500, "Could not restore the chapter")
+			return
+		}
+
+		c.String(200, "Highlights migrated successfully")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
@@ -0,0 +1,621 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/gin-gonic/gin"
+)
+
+// Authors are kept per user and linked to their books with a role. The
+// author column of the book table keeps the names of the authors, which is
+// what the rest of the app shows and indexes.
+const (
+	AuthorRoleAuthor     = "author"
+	AuthorRoleEditor     = "editor"
+	AuthorRoleTranslator = "translator"
+)
+
+type BookAuthorStruct struct {
+	Id       int64  `json:"id"`
+	Name     string `json:"name"`
+	SortName string `json:"sortName"`
+	Role     string `json:"role"`
+}
+
+type AuthorLinkStruct struct {
+	Name string
+	URL  string
+}
+
+var authorSeparatorRegexp = regexp.MustCompile(`(?i)\s*(?:;|&|\sand\s)\s*`)
+
+// Role of an OPF creator from its MARC relator code. Other contributors,
+// such as illustrators, aren't kept.
+func _AuthorRole(relator string) string {
+	switch strings.ToLower(strings.TrimSpace(relator)) {
+	case "", "aut":
+		return AuthorRoleAuthor
+	case "edt":
+		return AuthorRoleEditor
+	case "trl":
+		return AuthorRoleTranslator
+	}
+	return ""
+}
+
+var authorParticles = map[string]bool{
+	"da": true, "de": true, "del": true, "della": true, "der": true, "di": true,
+	"du": true, "la": true, "le": true, "van": true, "von": true,
+}
+
+// "J.R.R. Tolkien" is sorted as "Tolkien, J.R.R.". Names with a comma are
+// already in sort order.
+func _AuthorSortName(name string) string {
+	name = strings.TrimSpace(name)
+	if strings.Contains(name, ",") {
+		return name
+	}
+
+	fields := strings.Fields(name)
+	if len(fields) < 2 {
+		return name
+	}
+
+	last := len(fields) - 1
+	suffix := ""
+	switch strings.ToLower(strings.TrimSuffix(fields[last], ".")) {
+	case "jr", "sr", "ii", "iii", "iv":
+		if len(fields) > 2 {
+			suffix = " " + fields[last]
+			last -= 1
+		}
+	}
+
+	// Particles belong to the last name, as in "Le Guin" or "van Gogh"
+	first := last
+	for first > 1 && authorParticles[strings.ToLower(fields[first-1])] {
+		first -= 1
+	}
+
+	return strings.Join(fields[first:last+1], " ") + ", " + strings.Join(fields[:first], " ") + suffix
+}
+
+// Names separated by ";", "&" or "and". "unknown" is the placeholder used
+// for books without an author.
+func _SplitAuthorNames(s string) []string {
+	names := []string{}
+	for _, name := range authorSeparatorRegexp.Split(s, -1) {
+		name = strings.TrimSpace(name)
+		if name != "" && !strings.EqualFold(name, "unknown") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func _AuthorsWithRole(names []string, role string) []BookAuthorStruct {
+	authors := []BookAuthorStruct{}
+	for _, name := range names {
+		authors = append(authors, BookAuthorStruct{Name: name, Role: role})
+	}
+	return authors
+}
+
+// Names of the authors of a book as stored in book.author
+func _AuthorString(authors []BookAuthorStruct) string {
+	var names []string
+	for _, author := range authors {
+		if author.Role == AuthorRoleAuthor {
+			names = append(names, author.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "unknown"
+	}
+	return strings.Join(names, " & ")
+}
+
+// Creators of an EPUB with their role and sort name, from the opf:role and
+// opf:file-as attributes of EPUB 2 or the refining meta of EPUB 3
+func _EPUBAuthors(opfMetadata OPFMetadataStruct) []BookAuthorStruct {
+	refines := map[string]map[string]string{}
+	for _, meta := range opfMetadata.Metadata.Meta {
+		if meta.Refines == "" {
+			continue
+		}
+		id := strings.TrimPrefix(meta.Refines, "#")
+		if refines[id] == nil {
+			refines[id] = map[string]string{}
+		}
+		refines[id][meta.Property] = strings.TrimSpace(meta.Value)
+	}
+
+	authors := []BookAuthorStruct{}
+	for _, creator := range opfMetadata.Metadata.Creators {
+		name := strings.TrimSpace(creator.Name)
+		if name == "" {
+			continue
+		}
+
+		relator, sortName := creator.Role, creator.FileAs
+		if creator.Id != "" {
+			if value, ok := refines[creator.Id]["role"]; ok {
+				relator = value
+			}
+			if value, ok := refines[creator.Id]["file-as"]; ok {
+				sortName = value
+			}
+		}
+
+		role := _AuthorRole(relator)
+		if role == "" {
+			continue
+		}
+		authors = append(authors, BookAuthorStruct{Name: name, SortName: strings.TrimSpace(sortName), Role: role})
+	}
+
+	return authors
+}
+
+func (e *Env) _FindAuthorId(userId int64, name string) int64 {
+	rows, err := e.db.Query("SELECT `id` FROM `author` WHERE `user_id` = ? AND LOWER(`name`) = LOWER(?)", userId, name)
+	CheckError(err)
+
+	var authorId int64
+	if rows.Next() {
+		err := rows.Scan(&authorId)
+		CheckError(err)
+	}
+	rows.Close()
+
+	return authorId
+}
+
+func (e *Env) _FindOrCreateAuthor(userId int64, name string, sortName string) int64 {
+	authorId := e._FindAuthorId(userId, name)
+	if authorId != 0 {
+		return authorId
+	}
+
+	if sortName == "" {
+		sortName = _AuthorSortName(name)
+	}
+
+	stmt, err := e.db.Prepare("INSERT INTO `author` (user_id, name, sort_name, created_on) VALUES (?, ?, ?, ?)")
+	CheckError(err)
+
+	res, err := stmt.Exec(userId, name, sortName, _GetCurrentTime())
+	CheckError(err)
+
+	authorId, err = res.LastInsertId()
+	CheckError(err)
+
+	return authorId
+}
+
+func (e *Env) _GetBookAuthors(bookId int64) []BookAuthorStruct {
+	rows, err := e.db.Query("SELECT `author`.`id`, `author`.`name`, `author`.`sort_name`, `book_author`.`role`"+
+		" FROM `book_author` JOIN `author` ON `author`.`id` = `book_author`.`author_id`"+
+		" WHERE `book_author`.`book_id` = ? ORDER BY `book_author`.`position`", bookId)
+	CheckError(err)
+
+	authors := []BookAuthorStruct{}
+	for rows.Next() {
+		author := BookAuthorStruct{}
+		err := rows.Scan(&author.Id, &author.Name, &author.SortName, &author.Role)
+		CheckError(err)
+
+		authors = append(authors, author)
+	}
+	rows.Close()
+
+	return authors
+}
+
+// Links to the author pages of the authors of a book, for the library grid
+func (e *Env) _GetBookAuthorLinks(bookId int64) []AuthorLinkStruct {
+	links := []AuthorLinkStruct{}
+	for _, author := range e._GetBookAuthors(bookId) {
+		if author.Role == AuthorRoleAuthor {
+			links = append(links, AuthorLinkStruct{
+				Name: author.Name,
+				URL:  "/author/" + strconv.Itoa(int(author.Id)),
+			})
+		}
+	}
+	return links
+}
+
+// Replace the authors linked to a book. The author column isn't changed.
+func (e *Env) _LinkBookAuthors(userId int64, bookId int64, authors []BookAuthorStruct) {
+	stmt, err := e.db.Prepare("DELETE FROM `book_author` WHERE book_id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	stmt, err = e.db.Prepare("INSERT OR IGNORE INTO `book_author` (book_id, author_id, role, position) VALUES (?, ?, ?, ?)")
+	CheckError(err)
+
+	for position, author := range authors {
+		authorId := e._FindOrCreateAuthor(userId, author.Name, author.SortName)
+
+		_, err = stmt.Exec(bookId, authorId, author.Role, position)
+		CheckError(err)
+	}
+
+	e._DeleteOrphanAuthors(userId)
+}
+
+// Authors left without books after a book is deleted or edited
+func (e *Env) _DeleteOrphanAuthors(userId int64) {
+	stmt, err := e.db.Prepare("DELETE FROM `author` WHERE user_id=? AND id NOT IN (SELECT author_id FROM book_author)")
+	CheckError(err)
+
+	_, err = stmt.Exec(userId)
+	CheckError(err)
+}
+
+// Books were uploaded with a single author string. Link the names in it to
+// authors, leaving the string as it is.
+func (e *Env) _MigrateBookAuthors() {
+	rows, err := e.db.Query("SELECT `id`, `author`, `user_id` FROM `book` WHERE `id` NOT IN (SELECT `book_id` FROM `book_author`)")
+	CheckError(err)
+
+	type bookAuthor struct {
+		bookId, userId int64
+		author         string
+	}
+	var books []bookAuthor
+	for rows.Next() {
+		book := bookAuthor{}
+		err := rows.Scan(&book.bookId, &book.author, &book.userId)
+		CheckError(err)
+
+		books = append(books, book)
+	}
+	rows.Close()
+
+	for _, book := range books {
+		authors := _AuthorsWithRole(_SplitAuthorNames(book.author), AuthorRoleAuthor)
+		if len(authors) > 0 {
+			e._LinkBookAuthors(book.userId, book.bookId, authors)
+		}
+	}
+}
+
+// Write the names of the linked authors back to the author column of a book
+// and update its search entry, which is keyed by the author string in bleve
+func (e *Env) _SyncBookAuthorString(bookId int64) {
+	rows, err := e.db.Query("SELECT `title`, `author`, `cover`, `url`, `user_id` FROM `book` WHERE `id` = ?", bookId)
+	CheckError(err)
+
+	var (
+		title, oldAuthor, cover, url string
+		userId                       int64
+	)
+	if rows.Next() {
+		err := rows.Scan(&title, &oldAuthor, &cover, &url, &userId)
+		CheckError(err)
+	}
+	rows.Close()
+
+	author := _AuthorString(e._GetBookAuthors(bookId))
+	if author == oldAuthor {
+		return
+	}
+
+	stmt, err := e.db.Prepare("UPDATE `book` SET author=? WHERE id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(author, bookId)
+	CheckError(err)
+
+	if EnableES == "0" {
+		index, err := bleve.Open(path.Join(DBPath, "lr_index.bleve"))
+		if err != nil {
+			return
+		}
+		index.Delete(_GetBleveIndexId(userId, bookId, title, oldAuthor, cover, url))
+
+		message := e._GetBleveBook(userId, bookId, title, author, cover, url)
+		index.Index(message.Id, message)
+		err = index.Close()
+		CheckError(err)
+	} else {
+		b, err := json.Marshal(BookMetadataEditStruct{Doc: BMESDoc{Title: title, Author: author, Cover: cover}})
+		CheckError(err)
+
+		PostJSON(ESPath+"/lr_index/book_info/"+strconv.Itoa(int(userId))+"_"+strconv.Itoa(int(bookId))+"/_update", b)
+	}
+}
+
+type AuthorStruct struct {
+	Id       int64  `json:"id"`
+	UserId   int64  `json:"-"`
+	Name     string `json:"name"`
+	SortName string `json:"sortName"`
+	URL      string `json:"url"`
+}
+
+func (e *Env) _GetAuthor(authorId int64) (AuthorStruct, bool) {
+	rows, err := e.db.Query("SELECT `id`, `user_id`, `name`, `sort_name` FROM `author` WHERE `id` = ?", authorId)
+	CheckError(err)
+
+	author := AuthorStruct{}
+	found := false
+	if rows.Next() {
+		err := rows.Scan(&author.Id, &author.UserId, &author.Name, &author.SortName)
+		CheckError(err)
+
+		author.URL = "/author/" + strconv.Itoa(int(author.Id))
+		found = true
+	}
+	rows.Close()
+
+	return author, found
+}
+
+// Authors of the user, by sort name
+func (e *Env) _GetAuthors(userId int64) []AuthorStruct {
+	rows, err := e.db.Query("SELECT `id`, `user_id`, `name`, `sort_name` FROM `author` WHERE `user_id` = ? ORDER BY LOWER(`sort_name`)", userId)
+	CheckError(err)
+
+	authors := []AuthorStruct{}
+	for rows.Next() {
+		author := AuthorStruct{}
+		err := rows.Scan(&author.Id, &author.UserId, &author.Name, &author.SortName)
+		CheckError(err)
+
+		author.URL = "/author/" + strconv.Itoa(int(author.Id))
+		authors = append(authors, author)
+	}
+	rows.Close()
+
+	return authors
+}
+
+// Authors of the books in the library of a user whose name matches a search
+func (e *Env) _SearchAuthors(userId int64, term string) []AuthorStruct {
+	condition, args := e._GetLibraryCondition(userId)
+	args = append(args, "%"+term+"%", "%"+term+"%")
+
+	rows, err := e.db.Query("SELECT `id`, `user_id`, `name`, `sort_name` FROM `author` WHERE `id` IN"+
+		" (SELECT `author_id` FROM `book_author` WHERE `book_id` IN (SELECT `id` FROM `book` WHERE "+condition+"))"+
+		" AND (`name` LIKE ? OR `sort_name` LIKE ?) ORDER BY LOWER(`sort_name`) LIMIT 5", args...)
+	CheckError(err)
+
+	authors := []AuthorStruct{}
+	for rows.Next() {
+		author := AuthorStruct{}
+		err := rows.Scan(&author.Id, &author.UserId, &author.Name, &author.SortName)
+		CheckError(err)
+
+		author.URL = "/author/" + strconv.Itoa(int(author.Id))
+		authors = append(authors, author)
+	}
+	rows.Close()
+
+	return authors
+}
+
+func (e *Env) GetAuthor(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+		authorId, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+
+		author, ok := e._GetAuthor(authorId)
+		if !ok {
+			c.String(404, "Author not found")
+			return
+		}
+
+		// Books of the author in the library of the user, series in order
+		condition, args := e._GetLibraryCondition(userId)
+		rows, err := e.db.Query("SELECT `id`, `title`, `url`, `cover` FROM `book` WHERE "+condition+
+			" AND `id` IN (SELECT `book_id` FROM `book_author` WHERE `author_id` = ?)"+
+			" ORDER BY `series` = '', LOWER(`series`), `series_index`, LOWER(`title`)", append(args, author.Id)...)
+		CheckError(err)
+
+		b := BookStructList{}
+		var bookIds []int64
+		for rows.Next() {
+			var (
+				bookId int64
+				book   BookStruct
+			)
+			err := rows.Scan(&bookId, &book.Title, &book.URL, &book.Cover)
+			CheckError(err)
+
+			b = append(b, book)
+			bookIds = append(bookIds, bookId)
+		}
+		rows.Close()
+
+		isOwner := author.UserId == userId
+		if len(b) == 0 && !isOwner {
+			c.String(404, "Author not found")
+			return
+		}
+
+		// Roles other than author are shown with the title
+		for i, bookId := range bookIds {
+			for _, bookAuthor := range e._GetBookAuthors(bookId) {
+				if bookAuthor.Id == author.Id && bookAuthor.Role != AuthorRoleAuthor {
+					b[i].Title += " (" + bookAuthor.Role + ")"
+				}
+			}
+		}
+
+		otherAuthors := []AuthorStruct{}
+		if isOwner {
+			for _, other := range e._GetAuthors(userId) {
+				if other.Id != author.Id {
+					otherAuthors = append(otherAuthors, other)
+				}
+			}
+		}
+
+		c.HTML(302, "author.html", gin.H{
+			"author":             author,
+			"isOwner":            isOwner,
+			"booksCount":         len(b),
+			"otherAuthors":       otherAuthors,
+			"booksList":          _ConstructBooksWithCount(&b, 6),
+			"booksListMedium":    _ConstructBooksWithCount(&b, 3),
+			"booksListSmall":     _ConstructBooksWithCount(&b, 2),
+			"booksListXtraSmall": b,
+		})
+	} else {
+		c.Redirect(302, "/signin")
+	}
+}
+
+func (e *Env) _GetAuthorBookIds(authorId int64) []int64 {
+	rows, err := e.db.Query("SELECT `book_id` FROM `book_author` WHERE `author_id` = ?", authorId)
+	CheckError(err)
+
+	var bookIds []int64
+	for rows.Next() {
+		var bookId int64
+		err := rows.Scan(&bookId)
+		CheckError(err)
+
+		bookIds = append(bookIds, bookId)
+	}
+	rows.Close()
+
+	return bookIds
+}
+
+type AuthorPostStruct struct {
+	Id       int64  `json:"id"`
+	Name     string `json:"name"`
+	SortName string `json:"sortName"`
+}
+
+// Rename an author or change their sort name
+func (e *Env) PostAuthor(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		post := AuthorPostStruct{}
+		err := c.BindJSON(&post)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		author, ok := e._GetAuthor(post.Id)
+		if !ok || author.UserId != userId {
+			c.String(404, "Author not found")
+			return
+		}
+
+		post.Name = strings.TrimSpace(post.Name)
+		post.SortName = strings.TrimSpace(post.SortName)
+		if post.Name == "" {
+			c.String(400, "Author name is empty")
+			return
+		}
+		if post.SortName == "" {
+			post.SortName = _AuthorSortName(post.Name)
+		}
+
+		if existingId := e._FindAuthorId(userId, post.Name); existingId != 0 && existingId != author.Id {
+			c.String(400, "Another author has this name, merge them instead")
+			return
+		}
+
+		stmt, err := e.db.Prepare("UPDATE `author` SET name=?, sort_name=? WHERE id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(post.Name, post.SortName, author.Id)
+		CheckError(err)
+
+		for _, bookId := range e._GetAuthorBookIds(author.Id) {
+			e._SyncBookAuthorString(bookId)
+		}
+
+		c.String(200, "Author saved successfully")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+type AuthorMergeStruct struct {
+	Id     int64 `json:"id"`
+	IntoId int64 `json:"intoId"`
+}
+
+// Merge a duplicate author into another one: their books are linked to the
+// remaining author and the duplicate is deleted
+func (e *Env) PostMergeAuthors(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		merge := AuthorMergeStruct{}
+		err := c.BindJSON(&merge)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		author, ok := e._GetAuthor(merge.Id)
+		into, intoOk := e._GetAuthor(merge.IntoId)
+		if !ok || !intoOk || author.UserId != userId || into.UserId != userId || author.Id == into.Id {
+			c.String(404, "Author not found")
+			return
+		}
+
+		bookIds := e._GetAuthorBookIds(author.Id)
+
+		// A book linked to both with the same role keeps a single link
+		stmt, err := e.db.Prepare("UPDATE OR IGNORE `book_author` SET author_id=? WHERE author_id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(into.Id, author.Id)
+		CheckError(err)
+
+		stmt, err = e.db.Prepare("DELETE FROM `book_author` WHERE author_id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(author.Id)
+		CheckError(err)
+
+		stmt, err = e.db.Prepare("DELETE FROM `author` WHERE id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(author.Id)
+		CheckError(err)
+
+		for _, bookId := range bookIds {
+			e._SyncBookAuthorString(bookId)
+		}
+
+		c.String(200, into.URL)
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
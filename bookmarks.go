@@ -0,0 +1,211 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Named place in a book, independent of highlights. PDFs use the page, EPUBs
+// the spine index and the CFI of the element at the top of the window.
+type BookmarkStruct struct {
+	Id         int64  `json:"id"`
+	FileName   string `json:"fileName"`
+	Name       string `json:"name"`
+	Page       int64  `json:"page"`
+	SpineIndex int64  `json:"spineIndex"`
+	CFI        string `json:"cfi"`
+	CreatedOn  string `json:"createdOn"`
+	UpdatedOn  string `json:"updatedOn"`
+	Date       string `json:"date"`
+}
+
+func _DefaultBookmarkName(format string, bookmark BookmarkStruct) string {
+	if format == "pdf" {
+		return "Page " + strconv.Itoa(int(bookmark.Page))
+	}
+	return "Chapter " + strconv.Itoa(int(bookmark.SpineIndex+1))
+}
+
+// Bookmarks of a user in a book, in reading order
+func (e *Env) _GetBookmarks(userId int64, bookId int64) []BookmarkStruct {
+	rows, err := e.db.Query("SELECT `id`, `name`, `page`, `spine_index`, `cfi`, `created_on`, `updated_on` FROM `bookmark` WHERE `user_id` = ? AND `book_id` = ? ORDER BY `id`", userId, bookId)
+	CheckError(err)
+
+	bookmarks := []BookmarkStruct{}
+	for rows.Next() {
+		bookmark := BookmarkStruct{}
+		err := rows.Scan(&bookmark.Id, &bookmark.Name, &bookmark.Page, &bookmark.SpineIndex, &bookmark.CFI, &bookmark.CreatedOn, &bookmark.UpdatedOn)
+		CheckError(err)
+
+		bookmark.Date = _FormatDate(bookmark.CreatedOn)
+		bookmarks = append(bookmarks, bookmark)
+	}
+	rows.Close()
+
+	sort.SliceStable(bookmarks, func(i, j int) bool {
+		a, b := bookmarks[i], bookmarks[j]
+		if a.Page != b.Page {
+			return a.Page < b.Page
+		}
+		return _ComparePositions(_EPUBCFIPosition(a.CFI), _EPUBCFIPosition(b.CFI)) < 0
+	})
+
+	return bookmarks
+}
+
+func (e *Env) GetBookmarks(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		fileName := c.Query("fileName")
+
+		userId := e._GetUserId(email.(string))
+		bookId, _, _ := e._GetBookInfo(fileName)
+		if !e._CanAccessBook(userId, bookId) {
+			c.String(404, "Book not found")
+			return
+		}
+
+		c.JSON(200, e._GetBookmarks(userId, bookId))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) PostBookmark(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		bookmark := BookmarkStruct{}
+		err := c.BindJSON(&bookmark)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+		bookId, format, _ := e._GetBookInfo(bookmark.FileName)
+		if !e._CanAccessBook(userId, bookId) {
+			c.String(404, "Book not found")
+			return
+		}
+
+		// Same fields as the reading progress: the page of an EPUB is its
+		// spine index + 1
+		if format == "pdf" {
+			if bookmark.Page < 1 {
+				bookmark.Page = 1
+			}
+			bookmark.SpineIndex = 0
+			bookmark.CFI = ""
+		} else {
+			if bookmark.SpineIndex < 0 {
+				bookmark.SpineIndex = 0
+			}
+			bookmark.Page = bookmark.SpineIndex + 1
+		}
+
+		bookmark.Name = strings.TrimSpace(bookmark.Name)
+		if bookmark.Name == "" {
+			bookmark.Name = _DefaultBookmarkName(format, bookmark)
+		}
+
+		createdOn := _GetCurrentTime()
+
+		stmt, err := e.db.Prepare("INSERT INTO `bookmark` (user_id, book_id, name, page, spine_index, cfi, created_on, updated_on) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+		CheckError(err)
+
+		_, err = stmt.Exec(userId, bookId, bookmark.Name, bookmark.Page, bookmark.SpineIndex, bookmark.CFI, createdOn, createdOn)
+		CheckError(err)
+
+		c.JSON(200, e._GetBookmarks(userId, bookId))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+type BookmarkUpdateStruct struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func (e *Env) PostBookmarkName(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		update := BookmarkUpdateStruct{}
+		err := c.BindJSON(&update)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		update.Name = strings.TrimSpace(update.Name)
+		if update.Name == "" {
+			c.String(400, "Bookmark name is empty")
+			return
+		}
+
+		stmt, err := e.db.Prepare("UPDATE `bookmark` SET name=?, updated_on=? WHERE id=? AND user_id=?")
+		CheckError(err)
+
+		res, err := stmt.Exec(update.Name, _GetCurrentTime(), update.Id, userId)
+		CheckError(err)
+
+		count, err := res.RowsAffected()
+		CheckError(err)
+
+		if count == 0 {
+			c.String(404, "Bookmark not found")
+			return
+		}
+
+		c.String(200, "Bookmark renamed successfully")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) DeleteBookmark(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		update := BookmarkUpdateStruct{}
+		err := c.BindJSON(&update)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		stmt, err := e.db.Prepare("DELETE FROM `bookmark` WHERE id=? AND user_id=?")
+		CheckError(err)
+
+		res, err := stmt.Exec(update.Id, userId)
+		CheckError(err)
+
+		count, err := res.RowsAffected()
+		CheckError(err)
+
+		if count == 0 {
+			c.String(404, "Bookmark not found")
+			return
+		}
+
+		c.String(200, "Bookmark deleted successfully")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
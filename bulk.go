@@ -0,0 +1,489 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/gin-gonic/gin"
+)
+
+// Actions that can be applied to many books at once
+const (
+	BulkActionDelete     = "delete"
+	BulkActionCollection = "collection"
+	BulkActionTags       = "tags"
+	BulkActionStatus     = "status"
+	BulkActionMetadata   = "metadata"
+	BulkActionReindex    = "reindex"
+	BulkActionDownload   = "download"
+)
+
+// Batches up to this size are done before responding, larger ones run as a
+// background job
+const bulkInlineLimit = 20
+
+// Finished jobs, and their zip, are kept this long
+const bulkJobLifetime = 24 * time.Hour
+
+type BulkPostStruct struct {
+	Action    string   `json:"action"`
+	FileNames []string `json:"fileNames"`
+	// Collection to add the books to
+	Collection int64 `json:"collection"`
+	// Comma separated, added to, removed from or replacing the tags of each
+	// book depending on tagMode
+	Tags    string `json:"tags"`
+	TagMode string `json:"tagMode"`
+	// Reading status, empty to clear it
+	Status string `json:"status"`
+}
+
+type BulkResultStruct struct {
+	FileName string `json:"fileName"`
+	Title    string `json:"title"`
+	Ok       bool   `json:"ok"`
+	Message  string `json:"message"`
+}
+
+type BulkJobStruct struct {
+	Id          int64              `json:"id"`
+	Action      string             `json:"action"`
+	Running     bool               `json:"running"`
+	Total       int64              `json:"total"`
+	Done        int64              `json:"done"`
+	Failed      int64              `json:"failed"`
+	Results     []BulkResultStruct `json:"results"`
+	DownloadURL string             `json:"downloadURL"`
+	StartedOn   string             `json:"startedOn"`
+	CompletedOn string             `json:"completedOn"`
+
+	userId    int64
+	zipPath   string
+	completed time.Time
+}
+
+var (
+	bulkMutex  sync.Mutex
+	bulkJobs   = map[int64]*BulkJobStruct{}
+	bulkLastId int64
+)
+
+func _NewBulkJob(userId int64, action string, total int64) int64 {
+	bulkMutex.Lock()
+	defer bulkMutex.Unlock()
+
+	for id, job := range bulkJobs {
+		if !job.Running && time.Since(job.completed) > bulkJobLifetime {
+			if job.zipPath != "" {
+				os.Remove(job.zipPath)
+			}
+			delete(bulkJobs, id)
+		}
+	}
+
+	bulkLastId += 1
+	bulkJobs[bulkLastId] = &BulkJobStruct{
+		Id:        bulkLastId,
+		Action:    action,
+		Running:   true,
+		Total:     total,
+		Results:   []BulkResultStruct{},
+		StartedOn: _GetCurrentTime(),
+		userId:    userId,
+	}
+
+	return bulkLastId
+}
+
+func _UpdateBulkJob(id int64, update func(job *BulkJobStruct)) {
+	bulkMutex.Lock()
+	defer bulkMutex.Unlock()
+
+	update(bulkJobs[id])
+}
+
+// Copy of a job started by the user
+func _GetBulkJob(userId int64, id int64) (BulkJobStruct, bool) {
+	bulkMutex.Lock()
+	defer bulkMutex.Unlock()
+
+	job, ok := bulkJobs[id]
+	if !ok || job.userId != userId {
+		return BulkJobStruct{}, false
+	}
+
+	status := *job
+	status.Results = append([]BulkResultStruct{}, job.Results...)
+
+	return status, true
+}
+
+func _BulkTags(tags []string, changed []string, mode string) []string {
+	switch mode {
+	case "replace":
+		return changed
+	case "remove":
+		removed := map[string]bool{}
+		for _, tag := range changed {
+			removed[strings.ToLower(tag)] = true
+		}
+
+		kept := []string{}
+		for _, tag := range tags {
+			if !removed[strings.ToLower(tag)] {
+				kept = append(kept, tag)
+			}
+		}
+		return kept
+	}
+	return append(tags, changed...)
+}
+
+func _AddBookToZip(w *zip.Writer, fileName string) error {
+	file, err := os.Open(path.Join("./uploads", fileName))
+	if err != nil {
+		return errors.New("book file is missing from ./uploads")
+	}
+	defer file.Close()
+
+	// Books are compressed already
+	entry, err := w.CreateHeader(&zip.FileHeader{Name: fileName, Method: zip.Store})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, file)
+	return err
+}
+
+func _RemoveBleveBook(book ReindexBookStruct) error {
+	if EnableES != "0" {
+		return nil
+	}
+
+	index, err := bleve.Open(path.Join(DBPath, "lr_index.bleve"))
+	if err != nil {
+		return err
+	}
+
+	err = index.Delete(_GetBleveIndexId(book.UserId, book.Id, book.Title, book.Author, book.Cover, book.URL))
+	CheckError(err)
+
+	return index.Close()
+}
+
+// Read the title, authors and details from the book file again, replacing
+// the edited ones. The cover is kept.
+func (e *Env) _ReextractBookMetadata(book ReindexBookStruct) error {
+	filePath := path.Join("./uploads", book.FileName)
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return errors.New("book file is missing from ./uploads")
+	}
+
+	var (
+		title   string
+		authors []BookAuthorStruct
+		details BookDetailsStruct
+	)
+	if book.Format == "epub" {
+		opfMetadata, _ := _LoadEPUBPackage(book.FileName)
+		if len(opfMetadata.Spine.ItemRef.IdRef) == 0 {
+			return errors.New("unable to read the EPUB package")
+		}
+
+		title = opfMetadata.Metadata.Title
+		authors = _EPUBAuthors(opfMetadata)
+		details = _EPUBBookDetails(opfMetadata)
+	} else {
+		pdfTitle, author, _ := _GetPDFInfo(filePath)
+
+		title = pdfTitle
+		if title == "" {
+			title = book.FileName
+		}
+		if author == "" {
+			author = "unknown"
+		}
+
+		authors = _AuthorsWithRole(_SplitAuthorNames(author), AuthorRoleAuthor)
+		details = _GetPDFDetails(filePath)
+	}
+
+	// The bleve document id contains the title and author
+	err := _RemoveBleveBook(book)
+	if err != nil {
+		return err
+	}
+
+	e._LinkBookAuthors(book.UserId, book.Id, authors)
+	author := _AuthorString(authors)
+
+	stmt, err := e.db.Prepare("UPDATE `book` SET title=?, author=? WHERE id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(title, author, book.Id)
+	CheckError(err)
+
+	e._SetBookDetails(book.Id, details)
+	e._DeleteOrphanAuthors(book.UserId)
+
+	book.Title = title
+	book.Author = author
+
+	return e._ReindexBook(book)
+}
+
+func (e *Env) _ApplyBulkAction(userId int64, post BulkPostStruct, fileName string, zipWriter *zip.Writer) (string, error) {
+	bookId, _, _ := e._GetBookInfo(fileName)
+	if bookId == 0 {
+		return "", errors.New("Book not found")
+	}
+
+	permission := e._GetBookPermission(userId, bookId)
+	if permission == "" {
+		return "", errors.New("Book not found")
+	}
+
+	book, _ := e._GetReindexBook(bookId)
+
+	// Readers of a shared book can only set their reading status and
+	// download it
+	if permission != SharePermissionOwner && post.Action != BulkActionStatus && post.Action != BulkActionDownload {
+		return book.Title, errors.New("Only the owner can change this book")
+	}
+
+	switch post.Action {
+	case BulkActionDelete:
+		e._TrashBook(bookId)
+	case BulkActionCollection:
+		e._AddCollectionBooks(post.Collection, []int64{bookId})
+	case BulkActionTags:
+		details := e._GetBookDetails(bookId)
+		details.Tags = _BulkTags(details.Tags, _ParseTags(post.Tags), post.TagMode)
+		e._SetBookDetails(bookId, details)
+
+		return book.Title, e._ReindexBook(book)
+	case BulkActionStatus:
+		e._SetReadingStatus(userId, bookId, post.Status)
+	case BulkActionMetadata:
+		err := e._ReextractBookMetadata(book)
+		if err != nil {
+			return book.Title, err
+		}
+
+		title, _, _ := e._GetBook(bookId)
+		return title, nil
+	case BulkActionReindex:
+		return book.Title, e._ReindexBook(book)
+	case BulkActionDownload:
+		return book.Title, _AddBookToZip(zipWriter, book.FileName)
+	}
+
+	return book.Title, nil
+}
+
+// A failing book is reported in the results and doesn't stop the batch
+func (e *Env) _ApplyBulkActionSafely(userId int64, post BulkPostStruct, fileName string, zipWriter *zip.Writer) (title string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	return e._ApplyBulkAction(userId, post, fileName, zipWriter)
+}
+
+func (e *Env) _RunBulkJob(id int64, userId int64, post BulkPostStruct) {
+	var (
+		zipFile   *os.File
+		zipWriter *zip.Writer
+	)
+	if post.Action == BulkActionDownload {
+		var err error
+		zipFile, err = ioutil.TempFile("", "libreread-bulk-")
+		CheckError(err)
+
+		zipWriter = zip.NewWriter(zipFile)
+	}
+
+	for _, fileName := range post.FileNames {
+		title, err := e._ApplyBulkActionSafely(userId, post, fileName, zipWriter)
+		if err != nil {
+			fmt.Println(fileName + ": " + err.Error())
+		}
+
+		_UpdateBulkJob(id, func(job *BulkJobStruct) {
+			result := BulkResultStruct{FileName: fileName, Title: title, Ok: err == nil}
+			if err != nil {
+				result.Message = err.Error()
+				job.Failed += 1
+			}
+			job.Results = append(job.Results, result)
+			job.Done += 1
+		})
+	}
+
+	var zipPath string
+	if zipWriter != nil {
+		err := zipWriter.Close()
+		CheckError(err)
+
+		err = zipFile.Close()
+		CheckError(err)
+
+		zipPath = zipFile.Name()
+	}
+
+	_UpdateBulkJob(id, func(job *BulkJobStruct) {
+		if zipPath != "" {
+			job.zipPath = zipPath
+			job.DownloadURL = "/bulk-jobs/" + strconv.Itoa(int(id)) + "/download"
+		}
+		job.Running = false
+		job.CompletedOn = _GetCurrentTime()
+		job.completed = time.Now()
+	})
+}
+
+func (e *Env) PostBulkBooks(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		post := BulkPostStruct{}
+		err := c.BindJSON(&post)
+		if err != nil {
+			c.String(400, "Invalid bulk request")
+			return
+		}
+
+		userId := e._GetUserId(email.(string))
+
+		switch post.Action {
+		case BulkActionDelete:
+			if os.Getenv("LIBREREAD_DEMO_SERVER") == "1" {
+				c.String(403, "Deleting book is disabled in the demo server.")
+				return
+			}
+		case BulkActionCollection:
+			if e._GetCollectionOwner(post.Collection) != userId {
+				c.String(404, "Collection not found")
+				return
+			}
+		case BulkActionTags:
+			switch post.TagMode {
+			case "":
+				post.TagMode = "add"
+			case "add", "remove", "replace":
+			default:
+				c.String(400, "Invalid tag mode "+post.TagMode)
+				return
+			}
+		case BulkActionStatus:
+			if post.Status != "" && !_IsValidReadingStatus(post.Status) {
+				c.String(400, "Invalid reading status")
+				return
+			}
+		case BulkActionMetadata, BulkActionReindex, BulkActionDownload:
+		default:
+			c.String(400, "Invalid action "+post.Action)
+			return
+		}
+
+		// Each book once, in the order they were selected
+		seen := map[string]bool{}
+		fileNames := []string{}
+		for _, fileName := range post.FileNames {
+			if fileName != "" && !seen[fileName] {
+				seen[fileName] = true
+				fileNames = append(fileNames, fileName)
+			}
+		}
+		if len(fileNames) == 0 {
+			c.String(400, "No books selected")
+			return
+		}
+		post.FileNames = fileNames
+
+		id := _NewBulkJob(userId, post.Action, int64(len(fileNames)))
+
+		if len(fileNames) > bulkInlineLimit {
+			go e._RunBulkJob(id, userId, post)
+
+			job, _ := _GetBulkJob(userId, id)
+			c.JSON(202, job)
+			return
+		}
+
+		e._RunBulkJob(id, userId, post)
+
+		job, _ := _GetBulkJob(userId, id)
+		c.JSON(200, job)
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) GetBulkJob(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		job, ok := _GetBulkJob(userId, id)
+		if !ok {
+			c.String(404, "Job not found")
+			return
+		}
+
+		c.JSON(200, job)
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) GetBulkJobDownload(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+		job, ok := _GetBulkJob(userId, id)
+		if !ok || job.zipPath == "" {
+			c.String(404, "Download not found")
+			return
+		}
+
+		c.Header("Content-Disposition", "attachment; filename=\"libreread-books-"+job.StartedOn+".zip\"")
+		c.File(job.zipPath)
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
@@ -19,8 +19,17 @@ along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
 
 package main
 
-import libreread "github.com/LibreRead/server"
+import (
+	"os"
+
+	libreread "github.com/LibreRead/server"
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		libreread.Reindex(os.Args[2:])
+		return
+	}
+
 	libreread.StartServer()
 }
@@ -0,0 +1,357 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Book of a collection, in the order chosen by the owner
+type CollectionBookStruct struct {
+	BookId   int64  `json:"bookId"`
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	Cover    string `json:"cover"`
+	Position int64  `json:"position"`
+}
+
+func (e *Env) _GetCollectionBooks(collectionId int64) []CollectionBookStruct {
+	rows, err := e.db.Query("SELECT `book`.`id`, `book`.`title`, `book`.`url`, `book`.`cover`, `collection_book`.`position`"+
+		" FROM `collection_book` JOIN `book` ON `book`.`id` = `collection_book`.`book_id`"+
+		" WHERE `collection_book`.`collection_id` = ? AND `book`.`deleted_on` = '' ORDER BY `collection_book`.`position`, `collection_book`.`id`", collectionId)
+	CheckError(err)
+
+	books := []CollectionBookStruct{}
+	for rows.Next() {
+		book := CollectionBookStruct{}
+		err := rows.Scan(&book.BookId, &book.Title, &book.URL, &book.Cover, &book.Position)
+		CheckError(err)
+
+		books = append(books, book)
+	}
+	rows.Close()
+
+	return books
+}
+
+// Append books to the end of a collection. Books already in it are skipped.
+func (e *Env) _AddCollectionBooks(collectionId int64, bookIds []int64) {
+	var position int64
+	err := e.db.QueryRow("SELECT COALESCE(MAX(`position`), -1) + 1 FROM `collection_book` WHERE `collection_id` = ?", collectionId).Scan(&position)
+	CheckError(err)
+
+	stmt, err := e.db.Prepare("INSERT OR IGNORE INTO `collection_book` (collection_id, book_id, position, added_on) VALUES (?, ?, ?, ?)")
+	CheckError(err)
+
+	addedOn := _GetCurrentTime()
+	for _, bookId := range bookIds {
+		res, err := stmt.Exec(collectionId, bookId, position, addedOn)
+		CheckError(err)
+
+		count, err := res.RowsAffected()
+		CheckError(err)
+
+		position += count
+	}
+}
+
+// Only the books of the user can be added to their collections
+func (e *Env) _FilterOwnBooks(userId int64, bookIds []int64) []int64 {
+	var own []int64
+	for _, bookId := range bookIds {
+		if e._GetBookOwner(bookId) == userId {
+			own = append(own, bookId)
+		}
+	}
+	return own
+}
+
+// Collections used to keep their books as comma separated ids in
+// collection.books. Move them to the collection_book table in the order they
+// were added and empty the column, so each collection is migrated once.
+func (e *Env) _MigrateCollectionBooks() {
+	rows, err := e.db.Query("SELECT `id`, `books` FROM `collection` WHERE `books` != ''")
+	CheckError(err)
+
+	collections := map[int64]string{}
+	for rows.Next() {
+		var (
+			id    int64
+			books string
+		)
+		err := rows.Scan(&id, &books)
+		CheckError(err)
+
+		collections[id] = books
+	}
+	rows.Close()
+
+	if len(collections) == 0 {
+		return
+	}
+
+	fmt.Println("Migrating the books of " + strconv.Itoa(len(collections)) + " collections")
+
+	for id, books := range collections {
+		var bookIds []int64
+		for _, book := range strings.Split(books, ",") {
+			bookId, err := strconv.ParseInt(strings.TrimSpace(book), 10, 64)
+			if err == nil {
+				bookIds = append(bookIds, bookId)
+			}
+		}
+		e._AddCollectionBooks(id, bookIds)
+
+		stmt, err := e.db.Prepare("UPDATE `collection` SET books='' WHERE id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(id)
+		CheckError(err)
+	}
+}
+
+// Cover of a collection, taken from one of its books
+func (e *Env) _SetCollectionCover(collectionId int64, bookId int64) {
+	rows, err := e.db.Query("SELECT `cover` FROM `book` WHERE `id` = ?", bookId)
+	CheckError(err)
+
+	var cover string
+	if rows.Next() {
+		err := rows.Scan(&cover)
+		CheckError(err)
+	}
+	rows.Close()
+
+	stmt, err := e.db.Prepare("UPDATE `collection` SET cover=? WHERE id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(cover, collectionId)
+	CheckError(err)
+}
+
+func (e *Env) GetEditCollection(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+		collectionId, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+
+		rows, err := e.db.Query("SELECT `title`, `description`, `cover` FROM `collection` WHERE `id` = ? AND `user_id` = ?", collectionId, userId)
+		CheckError(err)
+
+		var (
+			title       string
+			description string
+			cover       string
+			found       bool
+		)
+		if rows.Next() {
+			var nullCover sql.NullString
+			err := rows.Scan(&title, &description, &nullCover)
+			CheckError(err)
+
+			cover = nullCover.String
+			found = true
+		}
+		rows.Close()
+
+		if !found {
+			c.String(404, "Collection not found")
+			return
+		}
+
+		books := e._GetCollectionBooks(collectionId)
+		inCollection := map[int64]bool{}
+		for _, book := range books {
+			inCollection[book.BookId] = true
+		}
+
+		rows, err = e.db.Query("SELECT `id`, `title`, `url`, `cover` FROM `book` WHERE `user_id` = ? AND `deleted_on` = '' ORDER BY `title`", userId)
+		CheckError(err)
+
+		otherBooks := []CollectionBookStruct{}
+		for rows.Next() {
+			book := CollectionBookStruct{}
+			err := rows.Scan(&book.BookId, &book.Title, &book.URL, &book.Cover)
+			CheckError(err)
+
+			if !inCollection[book.BookId] {
+				otherBooks = append(otherBooks, book)
+			}
+		}
+		rows.Close()
+
+		c.HTML(302, "edit_collection.html", gin.H{
+			"id":          collectionId,
+			"title":       title,
+			"description": description,
+			"cover":       cover,
+			"books":       books,
+			"otherBooks":  otherBooks,
+		})
+	} else {
+		c.Redirect(302, "/signin")
+	}
+}
+
+type CollectionUpdateStruct struct {
+	Id          int64  `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// Book whose cover becomes the cover of the collection, 0 to keep it
+	CoverBookId int64 `json:"coverBookId"`
+}
+
+func (e *Env) PostCollectionUpdate(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		update := CollectionUpdateStruct{}
+		err := c.BindJSON(&update)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+		if e._GetCollectionOwner(update.Id) != userId {
+			c.String(404, "Collection not found")
+			return
+		}
+
+		update.Title = strings.TrimSpace(update.Title)
+		if update.Title == "" {
+			c.String(400, "Collection title is empty")
+			return
+		}
+
+		stmt, err := e.db.Prepare("UPDATE `collection` SET title=?, description=? WHERE id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(update.Title, update.Description, update.Id)
+		CheckError(err)
+
+		if update.CoverBookId != 0 {
+			if e._GetBookOwner(update.CoverBookId) != userId {
+				c.String(400, "Invalid cover")
+				return
+			}
+			e._SetCollectionCover(update.Id, update.CoverBookId)
+		}
+
+		c.String(200, "Collection updated successfully")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+type CollectionBooksPostStruct struct {
+	Id    int64   `json:"id"`
+	Books []int64 `json:"books"`
+}
+
+// Add books to the end of a collection
+func (e *Env) PostCollectionBooks(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		post := CollectionBooksPostStruct{}
+		err := c.BindJSON(&post)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+		if e._GetCollectionOwner(post.Id) != userId {
+			c.String(404, "Collection not found")
+			return
+		}
+
+		e._AddCollectionBooks(post.Id, e._FilterOwnBooks(userId, post.Books))
+
+		c.JSON(200, e._GetCollectionBooks(post.Id))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) PostCollectionBooksRemove(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		post := CollectionBooksPostStruct{}
+		err := c.BindJSON(&post)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+		if e._GetCollectionOwner(post.Id) != userId {
+			c.String(404, "Collection not found")
+			return
+		}
+
+		stmt, err := e.db.Prepare("DELETE FROM `collection_book` WHERE collection_id=? AND book_id=?")
+		CheckError(err)
+
+		for _, bookId := range post.Books {
+			_, err = stmt.Exec(post.Id, bookId)
+			CheckError(err)
+		}
+
+		c.JSON(200, e._GetCollectionBooks(post.Id))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+// Set the order of the books of a collection. Books missing from the list
+// keep their relative order after the listed ones.
+func (e *Env) PostCollectionReorder(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		post := CollectionBooksPostStruct{}
+		err := c.BindJSON(&post)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+		if e._GetCollectionOwner(post.Id) != userId {
+			c.String(404, "Collection not found")
+			return
+		}
+
+		order := post.Books
+		listed := map[int64]bool{}
+		for _, bookId := range order {
+			listed[bookId] = true
+		}
+		for _, book := range e._GetCollectionBooks(post.Id) {
+			if !listed[book.BookId] {
+				order = append(order, book.BookId)
+			}
+		}
+
+		stmt, err := e.db.Prepare("UPDATE `collection_book` SET position=? WHERE collection_id=? AND book_id=?")
+		CheckError(err)
+
+		for position, bookId := range order {
+			_, err = stmt.Exec(position, post.Id, bookId)
+			CheckError(err)
+		}
+
+		c.JSON(200, e._GetCollectionBooks(post.Id))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
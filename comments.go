@@ -0,0 +1,481 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Discussion threads on highlights. The note of a highlight stays the
+// highlighter's own annotation; comments are written by everyone who can
+// read the book, in Markdown, and may reply to other comments. Edited
+// comments keep their earlier bodies as revisions.
+
+const (
+	HighlightTypePDF  = "pdf"
+	HighlightTypeEPUB = "epub"
+)
+
+type HighlightCommentStruct struct {
+	Id        int64  `json:"id"`
+	ParentId  int64  `json:"parentId"`
+	UserId    int64  `json:"userId"`
+	Author    string `json:"author"`
+	Body      string `json:"body"`
+	HTML      string `json:"html"`
+	Deleted   bool   `json:"deleted"`
+	Edited    bool   `json:"edited"`
+	Own       bool   `json:"own"`
+	CreatedOn string `json:"createdOn"`
+	UpdatedOn string `json:"updatedOn"`
+	Date      string `json:"date"`
+}
+
+type HighlightCommentRevisionStruct struct {
+	Body      string `json:"body"`
+	HTML      string `json:"html"`
+	CreatedOn string `json:"createdOn"`
+	Date      string `json:"date"`
+}
+
+// Whether the user can read a book, their own or shared with them (see
+// sharing.go). Highlights of a book are visible to all of its readers and can
+// be discussed by those allowed to annotate it.
+func (e *Env) _CanAccessBook(userId int64, bookId int64) bool {
+	return e._GetBookPermission(userId, bookId) != ""
+}
+
+// Book and author of a PDF highlight or an EPUB annotation. Returns 0 when
+// the highlight doesn't exist.
+func (e *Env) _GetHighlightBook(highlightType string, highlightId int64) (int64, int64) {
+	var query string
+	switch highlightType {
+	case HighlightTypePDF:
+		query = "SELECT `book_id`, `user_id` FROM `pdf_highlighter` WHERE `id` = ?"
+	case HighlightTypeEPUB:
+		query = "SELECT `book_id`, `user_id` FROM `epub_annotation` WHERE `id` = ?"
+	default:
+		return 0, 0
+	}
+
+	rows, err := e.db.Query(query, highlightId)
+	CheckError(err)
+
+	var bookId, userId int64
+	if rows.Next() {
+		err := rows.Scan(&bookId, &userId)
+		CheckError(err)
+	}
+	rows.Close()
+
+	return bookId, userId
+}
+
+func (e *Env) _CanAccessHighlight(userId int64, highlightType string, highlightId int64) bool {
+	bookId, _ := e._GetHighlightBook(highlightType, highlightId)
+	return bookId != 0 && e._CanAccessBook(userId, bookId)
+}
+
+func (e *Env) _GetHighlightComments(userId int64, highlightType string, highlightId int64) []HighlightCommentStruct {
+	rows, err := e.db.Query("SELECT `highlight_comment`.`id`, `highlight_comment`.`parent_id`, `highlight_comment`.`user_id`,"+
+		" COALESCE(`user`.`name`, ''), `highlight_comment`.`body`, `highlight_comment`.`deleted`, `highlight_comment`.`created_on`,"+
+		" `highlight_comment`.`updated_on`, (SELECT COUNT(*) FROM `highlight_comment_revision`"+
+		" WHERE `highlight_comment_revision`.`comment_id` = `highlight_comment`.`id`)"+
+		" FROM `highlight_comment` LEFT JOIN `user` ON `user`.`id` = `highlight_comment`.`user_id`"+
+		" WHERE `highlight_comment`.`highlight_type` = ? AND `highlight_comment`.`highlight_id` = ?"+
+		" ORDER BY `highlight_comment`.`id`", highlightType, highlightId)
+	CheckError(err)
+
+	comments := []HighlightCommentStruct{}
+	for rows.Next() {
+		var (
+			comment   HighlightCommentStruct
+			deleted   int64
+			revisions int64
+		)
+		err := rows.Scan(&comment.Id, &comment.ParentId, &comment.UserId, &comment.Author, &comment.Body, &deleted,
+			&comment.CreatedOn, &comment.UpdatedOn, &revisions)
+		CheckError(err)
+
+		comment.Deleted = deleted == 1
+		comment.Edited = revisions > 0
+		comment.Own = comment.UserId == userId
+		comment.Date = _FormatTime(comment.CreatedOn)
+		if !comment.Deleted {
+			comment.HTML = _RenderMarkdown(comment.Body)
+		}
+
+		comments = append(comments, comment)
+	}
+	rows.Close()
+
+	return comments
+}
+
+// Comment with its highlight, for edits and deletes
+func (e *Env) _GetHighlightComment(commentId int64) (HighlightCommentStruct, string, int64) {
+	rows, err := e.db.Query("SELECT `id`, `parent_id`, `user_id`, `body`, `deleted`, `created_on`, `updated_on`,"+
+		" `highlight_type`, `highlight_id` FROM `highlight_comment` WHERE `id` = ?", commentId)
+	CheckError(err)
+
+	var (
+		comment       HighlightCommentStruct
+		highlightType string
+		highlightId   int64
+	)
+	if rows.Next() {
+		var deleted int64
+		err := rows.Scan(&comment.Id, &comment.ParentId, &comment.UserId, &comment.Body, &deleted, &comment.CreatedOn,
+			&comment.UpdatedOn, &highlightType, &highlightId)
+		CheckError(err)
+
+		comment.Deleted = deleted == 1
+	}
+	rows.Close()
+
+	return comment, highlightType, highlightId
+}
+
+func (e *Env) _DeleteHighlightCommentRows(where string, args ...interface{}) {
+	stmt, err := e.db.Prepare("DELETE FROM `highlight_comment_revision` WHERE `comment_id` IN (SELECT `id` FROM `highlight_comment` WHERE " + where + ")")
+	CheckError(err)
+
+	_, err = stmt.Exec(args...)
+	CheckError(err)
+
+	stmt, err = e.db.Prepare("DELETE FROM `highlight_comment` WHERE " + where)
+	CheckError(err)
+
+	_, err = stmt.Exec(args...)
+	CheckError(err)
+}
+
+// Remove the thread of a deleted highlight
+func (e *Env) _DeleteHighlightComments(highlightType string, highlightId interface{}) {
+	e._DeleteHighlightCommentRows("`highlight_type` = ? AND `highlight_id` = ?", highlightType, highlightId)
+}
+
+// Remove the threads on all highlights of a book
+func (e *Env) _DeleteBookHighlightComments(bookId int64) {
+	e._DeleteHighlightCommentRows("(`highlight_type` = ? AND `highlight_id` IN (SELECT `id` FROM `pdf_highlighter` WHERE `book_id` = ?))"+
+		" OR (`highlight_type` = ? AND `highlight_id` IN (SELECT `id` FROM `epub_annotation` WHERE `book_id` = ?))",
+		HighlightTypePDF, bookId, HighlightTypeEPUB, bookId)
+}
+
+func (e *Env) GetHighlightComments(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		highlightType := c.Query("type")
+		highlightId, _ := strconv.ParseInt(c.Query("id"), 10, 64)
+		if !e._CanAccessHighlight(userId, highlightType, highlightId) {
+			c.JSON(404, "Highlight not found")
+			return
+		}
+
+		c.JSON(200, e._GetHighlightComments(userId, highlightType, highlightId))
+	} else {
+		c.JSON(200, "Not signed in")
+	}
+}
+
+type HighlightCommentPostStruct struct {
+	Type        string `json:"type"`
+	HighlightId int64  `json:"highlightId"`
+	ParentId    int64  `json:"parentId"`
+	Body        string `json:"body"`
+}
+
+func (e *Env) PostHighlightComment(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		post := HighlightCommentPostStruct{}
+		err := c.BindJSON(&post)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		if !e._CanAccessHighlight(userId, post.Type, post.HighlightId) {
+			c.String(404, "Highlight not found")
+			return
+		}
+
+		if bookId, _ := e._GetHighlightBook(post.Type, post.HighlightId); !e._CanAnnotateBook(userId, bookId) {
+			c.String(403, "You can't comment in this book")
+			return
+		}
+
+		post.Body = strings.TrimSpace(post.Body)
+		if post.Body == "" {
+			c.String(400, "Comment is empty")
+			return
+		}
+
+		if post.ParentId != 0 {
+			parent, highlightType, highlightId := e._GetHighlightComment(post.ParentId)
+			if parent.Id == 0 || highlightType != post.Type || highlightId != post.HighlightId {
+				c.String(400, "Invalid reply")
+				return
+			}
+		}
+
+		createdOn := _GetCurrentTime()
+
+		stmt, err := e.db.Prepare("INSERT INTO `highlight_comment` (highlight_type, highlight_id, parent_id, user_id, body, created_on, updated_on) VALUES (?, ?, ?, ?, ?, ?, ?)")
+		CheckError(err)
+
+		_, err = stmt.Exec(post.Type, post.HighlightId, post.ParentId, userId, post.Body, createdOn, createdOn)
+		CheckError(err)
+
+		c.JSON(200, e._GetHighlightComments(userId, post.Type, post.HighlightId))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+type HighlightCommentEditStruct struct {
+	Id   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+// Change the body of a comment of the user. The previous body is kept as a
+// revision.
+func (e *Env) PostHighlightCommentEdit(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		edit := HighlightCommentEditStruct{}
+		err := c.BindJSON(&edit)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		comment, highlightType, highlightId := e._GetHighlightComment(edit.Id)
+		if comment.Id == 0 || comment.UserId != userId || comment.Deleted {
+			c.String(404, "Comment not found")
+			return
+		}
+
+		edit.Body = strings.TrimSpace(edit.Body)
+		if edit.Body == "" {
+			c.String(400, "Comment is empty")
+			return
+		}
+
+		if edit.Body != comment.Body {
+			stmt, err := e.db.Prepare("INSERT INTO `highlight_comment_revision` (comment_id, body, created_on) VALUES (?, ?, ?)")
+			CheckError(err)
+
+			_, err = stmt.Exec(comment.Id, comment.Body, comment.UpdatedOn)
+			CheckError(err)
+
+			stmt, err = e.db.Prepare("UPDATE `highlight_comment` SET body=?, updated_on=? WHERE id=?")
+			CheckError(err)
+
+			_, err = stmt.Exec(edit.Body, _GetCurrentTime(), comment.Id)
+			CheckError(err)
+		}
+
+		c.JSON(200, e._GetHighlightComments(userId, highlightType, highlightId))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+// Earlier bodies of a comment, newest first
+func (e *Env) GetHighlightCommentHistory(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		commentId, _ := strconv.ParseInt(c.Query("id"), 10, 64)
+		comment, highlightType, highlightId := e._GetHighlightComment(commentId)
+		if comment.Id == 0 || !e._CanAccessHighlight(userId, highlightType, highlightId) {
+			c.JSON(404, "Comment not found")
+			return
+		}
+
+		rows, err := e.db.Query("SELECT `body`, `created_on` FROM `highlight_comment_revision` WHERE `comment_id` = ? ORDER BY `id` DESC", comment.Id)
+		CheckError(err)
+
+		revisions := []HighlightCommentRevisionStruct{}
+		for rows.Next() {
+			revision := HighlightCommentRevisionStruct{}
+			err := rows.Scan(&revision.Body, &revision.CreatedOn)
+			CheckError(err)
+
+			revision.HTML = _RenderMarkdown(revision.Body)
+			revision.Date = _FormatTime(revision.CreatedOn)
+			revisions = append(revisions, revision)
+		}
+		rows.Close()
+
+		c.JSON(200, revisions)
+	} else {
+		c.JSON(200, "Not signed in")
+	}
+}
+
+// Delete a comment of the user. Comments with replies are only marked as
+// deleted so the thread stays readable.
+func (e *Env) DeleteHighlightComment(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		edit := HighlightCommentEditStruct{}
+		err := c.BindJSON(&edit)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		comment, highlightType, highlightId := e._GetHighlightComment(edit.Id)
+		if comment.Id == 0 || comment.UserId != userId {
+			c.String(404, "Comment not found")
+			return
+		}
+
+		var replies int64
+		err = e.db.QueryRow("SELECT COUNT(*) FROM `highlight_comment` WHERE `parent_id` = ?", comment.Id).Scan(&replies)
+		CheckError(err)
+
+		if replies > 0 {
+			stmt, err := e.db.Prepare("DELETE FROM `highlight_comment_revision` WHERE comment_id=?")
+			CheckError(err)
+
+			_, err = stmt.Exec(comment.Id)
+			CheckError(err)
+
+			stmt, err = e.db.Prepare("UPDATE `highlight_comment` SET body='', deleted=1, updated_on=? WHERE id=?")
+			CheckError(err)
+
+			_, err = stmt.Exec(_GetCurrentTime(), comment.Id)
+			CheckError(err)
+		} else {
+			e._DeleteHighlightCommentRows("`id` = ?", comment.Id)
+		}
+
+		c.JSON(200, e._GetHighlightComments(userId, highlightType, highlightId))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+// Highlight of another reader of a book. Anchors are set for PDF highlights,
+// Href and CFI for EPUB annotations.
+type SharedHighlightStruct struct {
+	Id       int64                      `json:"id"`
+	Type     string                     `json:"type"`
+	Author   string                     `json:"author"`
+	Color    string                     `json:"color"`
+	Quote    string                     `json:"quote"`
+	Note     string                     `json:"note"`
+	Href     string                     `json:"href"`
+	CFI      string                     `json:"cfi"`
+	Anchors  []PDFHighlightAnchorStruct `json:"anchors"`
+	Comments int64                      `json:"comments"`
+}
+
+func (e *Env) _GetSharedHighlights(userId int64, bookId int64, format string, href string) []SharedHighlightStruct {
+	var (
+		query string
+		args  = []interface{}{bookId, userId}
+	)
+	if format == "pdf" {
+		query = "SELECT `pdf_highlighter`.`id`, `pdf_highlighter`.`user_id`, COALESCE(`user`.`name`, ''), `pdf_highlighter`.`highlight_color`," +
+			" '', `pdf_highlighter`.`highlight_comment`, '', '' FROM `pdf_highlighter` LEFT JOIN `user` ON `user`.`id` = `pdf_highlighter`.`user_id`" +
+			" WHERE `pdf_highlighter`.`book_id` = ? AND `pdf_highlighter`.`user_id` != ?"
+	} else {
+		query = "SELECT `epub_annotation`.`id`, `epub_annotation`.`user_id`, COALESCE(`user`.`name`, ''), `epub_annotation`.`color`," +
+			" `epub_annotation`.`quote`, `epub_annotation`.`note`, `epub_annotation`.`spine_href`, `epub_annotation`.`cfi`" +
+			" FROM `epub_annotation` LEFT JOIN `user` ON `user`.`id` = `epub_annotation`.`user_id`" +
+			" WHERE `epub_annotation`.`book_id` = ? AND `epub_annotation`.`user_id` != ?"
+		if href != "" {
+			query += " AND `epub_annotation`.`spine_href` = ?"
+			args = append(args, href)
+		}
+	}
+
+	rows, err := e.db.Query(query, args...)
+	CheckError(err)
+
+	var (
+		highlights []SharedHighlightStruct
+		authors    []int64
+	)
+	for rows.Next() {
+		var authorId int64
+		highlight := SharedHighlightStruct{Type: format}
+		err := rows.Scan(&highlight.Id, &authorId, &highlight.Author, &highlight.Color, &highlight.Quote, &highlight.Note,
+			&highlight.Href, &highlight.CFI)
+		CheckError(err)
+
+		highlights = append(highlights, highlight)
+		authors = append(authors, authorId)
+	}
+	rows.Close()
+
+	// Highlights of users who can't read the book anymore stay hidden
+	shared := []SharedHighlightStruct{}
+	for i, highlight := range highlights {
+		if !e._CanAccessBook(authors[i], bookId) {
+			continue
+		}
+
+		highlight.Anchors = []PDFHighlightAnchorStruct{}
+		if format == "pdf" {
+			highlight.Anchors = e._GetPDFHighlightAnchors(highlight.Id)
+
+			var quote []string
+			for _, anchor := range highlight.Anchors {
+				quote = append(quote, anchor.Quote)
+			}
+			highlight.Quote = strings.Join(quote, " ")
+		}
+
+		err := e.db.QueryRow("SELECT COUNT(*) FROM `highlight_comment` WHERE `highlight_type` = ? AND `highlight_id` = ? AND `deleted` = 0",
+			highlight.Type, highlight.Id).Scan(&highlight.Comments)
+		CheckError(err)
+
+		shared = append(shared, highlight)
+	}
+
+	return shared
+}
+
+// Highlights of the other readers of a book, for the viewers. EPUB
+// annotations can be limited to a chapter with href.
+func (e *Env) GetSharedHighlights(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		bookId, format, _ := e._GetBookInfo(c.Query("fileName"))
+		if bookId == 0 || !e._CanAccessBook(userId, bookId) {
+			c.JSON(404, "Book not found")
+			return
+		}
+
+		c.JSON(200, e._GetSharedHighlights(userId, bookId, format, c.Query("href")))
+	} else {
+		c.JSON(200, "Not signed in")
+	}
+}
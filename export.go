@@ -0,0 +1,245 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Markdown template used when the user hasn't configured one. It is executed
+// once per book with an ExportBookStruct.
+const DefaultExportTemplate = `# {{.Title}}
+{{- if .Author}}
+
+*{{.Author}}*
+{{- end}}
+{{range .Entries}}
+{{blockquote .Quote}}
+{{- if .Note}}
+
+{{.Note}}
+{{- end}}
+
+— {{.Location}}{{if .Date}}, {{.Date}}{{end}}
+{{end}}`
+
+type ExportBookStruct struct {
+	FileName string
+	Title    string
+	Author   string
+	Entries  []NotebookEntryStruct
+}
+
+// Page of a PDF highlight or chapter of an EPUB annotation
+func (entry NotebookEntryStruct) Location() string {
+	if entry.Format == "pdf" {
+		return "Page " + strconv.Itoa(int(entry.Page))
+	}
+	return entry.Chapter
+}
+
+// YYYYMMDDhhmmss to YYYY-MM-DD hh:mm:ss
+func _FormatTime(t string) string {
+	if len(t) != len(timeLayout) {
+		return ""
+	}
+	return _ParseTime(t).Format("2006-01-02 15:04:05")
+}
+
+var exportTemplateFuncs = template.FuncMap{
+	"blockquote": func(s string) string {
+		return "> " + strings.Join(strings.Split(s, "\n"), "\n> ")
+	},
+	"formatTime": _FormatTime,
+}
+
+func _ParseExportTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultExportTemplate
+	}
+	return template.New("export").Funcs(exportTemplateFuncs).Parse(text)
+}
+
+func (e *Env) _GetExportTemplate(userId int64) string {
+	rows, err := e.db.Query("SELECT `export_template` FROM `user` WHERE `id` = ?", userId)
+	CheckError(err)
+
+	var text string
+	if rows.Next() {
+		err := rows.Scan(&text)
+		CheckError(err)
+	}
+	rows.Close()
+
+	return text
+}
+
+// Group entries by book, keeping their order
+func _GroupExportEntries(entries []NotebookEntryStruct) []ExportBookStruct {
+	var books []ExportBookStruct
+	index := make(map[string]int)
+	for _, entry := range entries {
+		i, ok := index[entry.FileName]
+		if !ok {
+			i = len(books)
+			index[entry.FileName] = i
+			books = append(books, ExportBookStruct{
+				FileName: entry.FileName,
+				Title:    entry.Title,
+				Author:   entry.Author,
+			})
+		}
+		books[i].Entries = append(books[i].Entries, entry)
+	}
+	return books
+}
+
+func _ExportMarkdown(tmpl *template.Template, entries []NotebookEntryStruct) ([]byte, error) {
+	var out bytes.Buffer
+	for i, book := range _GroupExportEntries(entries) {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		err := tmpl.Execute(&out, book)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func _ExportCSV(entries []NotebookEntryStruct) ([]byte, error) {
+	var out bytes.Buffer
+	w := csv.NewWriter(&out)
+	w.Write([]string{"title", "author", "format", "quote", "note", "color", "page", "chapter", "cfi", "created_on", "updated_on", "url"})
+	for _, entry := range entries {
+		page := ""
+		if entry.Page > 0 {
+			page = strconv.Itoa(int(entry.Page))
+		}
+		w.Write([]string{entry.Title, entry.Author, entry.Format, entry.Quote, entry.Note, entry.ColorName, page,
+			entry.Chapter, entry.CFI, _FormatTime(entry.CreatedOn), _FormatTime(entry.UpdatedOn), entry.URL})
+	}
+	w.Flush()
+	return out.Bytes(), w.Error()
+}
+
+var exportFileNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Download highlights and notes of a book (fileName) or of the whole library
+// as Markdown, JSON or CSV. The notebook filters apply.
+func (e *Env) GetExportHighlights(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		filter := _GetNotebookFilter(c)
+		if c.Query("sort") == "" {
+			filter.Sort = NotebookSortPosition
+		}
+		entries := e._GetNotebookEntries(userId, filter)
+
+		name := "libreread-highlights"
+		if filter.FileName != "" && len(entries) > 0 {
+			name = strings.Trim(exportFileNameRegexp.ReplaceAllString(entries[0].Title, "-"), "-") + "-highlights"
+		}
+
+		var (
+			data        []byte
+			err         error
+			contentType string
+			extension   string
+		)
+		switch c.Query("format") {
+		case "json":
+			data, err = json.MarshalIndent(entries, "", "  ")
+			contentType, extension = "application/json; charset=utf-8", ".json"
+		case "csv":
+			data, err = _ExportCSV(entries)
+			contentType, extension = "text/csv; charset=utf-8", ".csv"
+		default:
+			var tmpl *template.Template
+			tmpl, err = _ParseExportTemplate(e._GetExportTemplate(userId))
+			if err == nil {
+				data, err = _ExportMarkdown(tmpl, entries)
+			}
+			contentType, extension = "text/markdown; charset=utf-8", ".md"
+		}
+		if err != nil {
+			CheckError(err)
+			c.String(500, "Could not export highlights: "+err.Error())
+			return
+		}
+
+		c.Header("Content-Disposition", "attachment; filename=\""+name+extension+"\"")
+		c.Data(200, contentType, data)
+	} else {
+		c.Redirect(302, "/signin")
+	}
+}
+
+type ExportTemplateStruct struct {
+	Template string `json:"template"`
+}
+
+// Save the Markdown export template of the user. An empty template restores
+// the default one.
+func (e *Env) PostExportTemplate(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		exportTemplate := ExportTemplateStruct{}
+		err := c.BindJSON(&exportTemplate)
+		CheckError(err)
+
+		if exportTemplate.Template == DefaultExportTemplate {
+			exportTemplate.Template = ""
+		}
+
+		tmpl, err := _ParseExportTemplate(exportTemplate.Template)
+		if err == nil {
+			// Catch references to unknown fields before saving
+			_, err = _ExportMarkdown(tmpl, []NotebookEntryStruct{{Format: "pdf", Page: 1}})
+		}
+		if err != nil {
+			c.String(400, "Invalid template: "+err.Error())
+			return
+		}
+
+		userId := e._GetUserId(email.(string))
+
+		stmt, err := e.db.Prepare("UPDATE `user` SET export_template=? WHERE id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(exportTemplate.Template, userId)
+		CheckError(err)
+
+		c.String(200, "Export template saved.")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
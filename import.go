@@ -0,0 +1,889 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Highlight read from another application. Page is the page number given by
+// the source (0 if unknown) and SpineIndex the EPUB chapter (-1 if unknown).
+// The remaining fields describe the book it was matched to and what
+// happened to it.
+type ImportItemStruct struct {
+	Title      string  `json:"title"`
+	Author     string  `json:"author"`
+	Quote      string  `json:"quote"`
+	Note       string  `json:"note"`
+	Color      string  `json:"color"`
+	Page       int64   `json:"page"`
+	SpineIndex int64   `json:"-"`
+	CreatedOn  string  `json:"createdOn"`
+	FileName   string  `json:"fileName"`
+	BookTitle  string  `json:"bookTitle"`
+	Score      float64 `json:"score"`
+	Status     string  `json:"status"`
+}
+
+const (
+	ImportStatusNew       = "new"
+	ImportStatusImported  = "imported"
+	ImportStatusDuplicate = "duplicate"
+	ImportStatusUnmatched = "unmatched"
+)
+
+type ImportReportStruct struct {
+	Source     string             `json:"source"`
+	DryRun     bool               `json:"dryRun"`
+	Total      int                `json:"total"`
+	Imported   int                `json:"imported"`
+	Duplicates int                `json:"duplicates"`
+	Unmatched  int                `json:"unmatched"`
+	Items      []ImportItemStruct `json:"items"`
+}
+
+// Books need this similarity score (0 to 1) to be matched
+const ImportMatchThreshold = 0.8
+
+var importTimeLayouts = []string{
+	"Monday, January 2, 2006 3:04:05 PM",
+	"Monday, 2 January 2006 15:04:05",
+	"January 2, 2006 3:04:05 PM",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05-07:00",
+	"2006-01-02 15:04:05.999999-07:00",
+	time.RFC3339,
+}
+
+// Time given by an import source in the stored format, the current time if
+// it can't be read
+func _ParseImportTime(s string) string {
+	s = strings.TrimSpace(s)
+	for _, layout := range importTimeLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err == nil {
+			return t.Local().Format(timeLayout)
+		}
+	}
+	return _GetCurrentTime()
+}
+
+// Color of the viewers' palette for a color name used by the source
+func _ImportColor(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, c := range highlightColors {
+		if c.Name == name {
+			return fmt.Sprintf("rgba(%d, %d, %d, 1)", c.RGB[0], c.RGB[1], c.RGB[2])
+		}
+	}
+	return "rgba(154, 154, 8, 1)"
+}
+
+var (
+	kindlePageRegexp     = regexp.MustCompile(`(?i)page (\d+)`)
+	kindleLocationRegexp = regexp.MustCompile(`(?i)location (\d+)(?:-(\d+))?`)
+	kindleAddedRegexp    = regexp.MustCompile(`(?i)added on (.*)$`)
+	kindleAuthorRegexp   = regexp.MustCompile(`^(.*)\(([^()]*)\)\s*$`)
+)
+
+// Kindle My Clippings.txt: entries separated by a line of =, each with the
+// "Title (Author)" line, a line describing the clipping and its text. Notes
+// are attached to the highlight ending at their location.
+func _ParseKindleClippings(data []byte) []ImportItemStruct {
+	type clipping struct {
+		item          ImportItemStruct
+		kind          string
+		locationStart int
+		locationEnd   int
+	}
+
+	var clippings []clipping
+	text := strings.Replace(strings.TrimPrefix(string(data), "\ufeff"), "\r", "", -1)
+	for _, block := range strings.Split(text, "==========") {
+		lines := strings.Split(strings.TrimSpace(block), "\n")
+		if len(lines) < 2 {
+			continue
+		}
+
+		c := clipping{item: ImportItemStruct{SpineIndex: -1}}
+		titleLine := strings.TrimSpace(strings.TrimPrefix(lines[0], "\ufeff"))
+		if m := kindleAuthorRegexp.FindStringSubmatch(titleLine); m != nil {
+			c.item.Title = strings.TrimSpace(m[1])
+			c.item.Author = strings.TrimSpace(m[2])
+		} else {
+			c.item.Title = titleLine
+		}
+
+		meta := lines[1]
+		switch lower := strings.ToLower(meta); {
+		case strings.Contains(lower, "highlight"):
+			c.kind = "highlight"
+		case strings.Contains(lower, "note"):
+			c.kind = "note"
+		default:
+			// Bookmarks and clips without text
+			continue
+		}
+		if m := kindlePageRegexp.FindStringSubmatch(meta); m != nil {
+			c.item.Page, _ = strconv.ParseInt(m[1], 10, 64)
+		}
+		if m := kindleLocationRegexp.FindStringSubmatch(meta); m != nil {
+			c.locationStart, _ = strconv.Atoi(m[1])
+			c.locationEnd = c.locationStart
+			if m[2] != "" {
+				c.locationEnd, _ = strconv.Atoi(m[2])
+			}
+		}
+		if m := kindleAddedRegexp.FindStringSubmatch(meta); m != nil {
+			c.item.CreatedOn = _ParseImportTime(m[1])
+		}
+
+		content := strings.TrimSpace(strings.Join(lines[2:], "\n"))
+		if content == "" {
+			continue
+		}
+		if c.kind == "highlight" {
+			c.item.Quote = content
+		} else {
+			c.item.Note = content
+		}
+		clippings = append(clippings, c)
+	}
+
+	var items []ImportItemStruct
+	for i, c := range clippings {
+		if c.kind == "note" {
+			continue
+		}
+		for _, n := range clippings {
+			if n.kind == "note" && n.item.Title == c.item.Title && n.locationStart >= c.locationStart && n.locationStart <= c.locationEnd {
+				clippings[i].item.Note = n.item.Note
+				break
+			}
+		}
+		items = append(items, clippings[i].item)
+	}
+	return items
+}
+
+func _LuaString(table map[string]interface{}, key string) string {
+	if v, ok := table[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+func _LuaTable(table map[string]interface{}, key string) map[string]interface{} {
+	if v, ok := table[key].(map[string]interface{}); ok {
+		return v
+	}
+	return nil
+}
+
+// Keys of a Lua array in numeric order
+func _LuaArrayKeys(table map[string]interface{}) []string {
+	var keys []string
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := strconv.ParseFloat(keys[i], 64)
+		b, _ := strconv.ParseFloat(keys[j], 64)
+		return a < b
+	})
+	return keys
+}
+
+// Set the page of a PDF highlight or the chapter of an EPUB highlight from a
+// KOReader page, which is a number or an XPointer
+func _SetKOReaderPosition(item *ImportItemStruct, page interface{}) {
+	switch v := page.(type) {
+	case float64:
+		item.Page = int64(v)
+	case string:
+		if m := koreaderFragmentRegexp.FindStringSubmatch(v); m != nil {
+			fragment, _ := strconv.ParseInt(m[1], 10, 64)
+			item.SpineIndex = fragment - 1
+		}
+	}
+}
+
+// KOReader <book>.sdr/metadata.<ext>.lua. Recent versions keep highlights
+// and notes in "annotations", older ones in "highlight" (by page) with the
+// notes in "bookmarks".
+func _ParseKOReaderMetadata(data []byte, fileName string) ([]ImportItemStruct, error) {
+	root, err := _ParseLuaTable(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	title, author := "", ""
+	if props := _LuaTable(root, "doc_props"); props != nil {
+		title = _LuaString(props, "title")
+		author = strings.Replace(_LuaString(props, "authors"), "\n", ", ", -1)
+	}
+	if title == "" {
+		// metadata.epub.lua is stored in <book>.sdr, named after the book
+		docPath := _LuaString(root, "doc_path")
+		if docPath == "" && strings.HasSuffix(path.Dir(fileName), ".sdr") {
+			docPath = strings.TrimSuffix(path.Base(path.Dir(fileName)), ".sdr")
+		}
+		if docPath != "" {
+			title = strings.TrimSuffix(path.Base(docPath), path.Ext(docPath))
+		}
+	}
+
+	var items []ImportItemStruct
+	if annotations := _LuaTable(root, "annotations"); annotations != nil {
+		for _, key := range _LuaArrayKeys(annotations) {
+			annotation, ok := annotations[key].(map[string]interface{})
+			if !ok || _LuaString(annotation, "text") == "" {
+				// Bookmarks have no text
+				continue
+			}
+
+			item := ImportItemStruct{
+				Title:      title,
+				Author:     author,
+				Quote:      _LuaString(annotation, "text"),
+				Note:       _LuaString(annotation, "note"),
+				Color:      _LuaString(annotation, "color"),
+				SpineIndex: -1,
+				CreatedOn:  _ParseImportTime(_LuaString(annotation, "datetime")),
+			}
+			if pageno, ok := annotation["pageno"].(float64); ok {
+				item.Page = int64(pageno)
+			}
+			_SetKOReaderPosition(&item, annotation["page"])
+			items = append(items, item)
+		}
+		return items, nil
+	}
+
+	notes := make(map[string]string)
+	if bookmarks := _LuaTable(root, "bookmarks"); bookmarks != nil {
+		for _, key := range _LuaArrayKeys(bookmarks) {
+			bookmark, ok := bookmarks[key].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			// For highlights "notes" is the highlighted text and "text" the
+			// note, or a generated description when there is none
+			quote, note := _LuaString(bookmark, "notes"), _LuaString(bookmark, "text")
+			if quote != "" && note != "" && !strings.Contains(note, quote) {
+				notes[quote] = note
+			}
+		}
+	}
+
+	if highlight := _LuaTable(root, "highlight"); highlight != nil {
+		for _, page := range _LuaArrayKeys(highlight) {
+			pageHighlights, ok := highlight[page].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for _, key := range _LuaArrayKeys(pageHighlights) {
+				h, ok := pageHighlights[key].(map[string]interface{})
+				if !ok || _LuaString(h, "text") == "" {
+					continue
+				}
+
+				item := ImportItemStruct{
+					Title:      title,
+					Author:     author,
+					Quote:      _LuaString(h, "text"),
+					Note:       notes[_LuaString(h, "text")],
+					Color:      _LuaString(h, "color"),
+					SpineIndex: -1,
+					CreatedOn:  _ParseImportTime(_LuaString(h, "datetime")),
+				}
+				item.Page, _ = strconv.ParseInt(page, 10, 64)
+				_SetKOReaderPosition(&item, h["pos0"])
+				items = append(items, item)
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// Readwise CSV export with the columns Highlight, Book Title, Book Author,
+// Note, Color, Location Type, Location and Highlighted at
+func _ParseReadwiseCSV(data []byte) ([]ImportItemStruct, error) {
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\ufeff"))))
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["highlight"]; !ok {
+		return nil, fmt.Errorf("readwise: missing Highlight column")
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var items []ImportItemStruct
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		item := ImportItemStruct{
+			Title:      field(record, "book title"),
+			Author:     field(record, "book author"),
+			Quote:      field(record, "highlight"),
+			Note:       field(record, "note"),
+			Color:      field(record, "color"),
+			SpineIndex: -1,
+			CreatedOn:  _ParseImportTime(field(record, "highlighted at")),
+		}
+		if item.Quote == "" {
+			continue
+		}
+		if strings.ToLower(field(record, "location type")) == "page" {
+			item.Page, _ = strconv.ParseInt(field(record, "location"), 10, 64)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+var (
+	bracketsRegexp    = regexp.MustCompile(`[(\[][^)\]]*[)\]]`)
+	nonAlphaNumRegexp = regexp.MustCompile(`[^\pL\pN]+`)
+)
+
+func _NormalizeTitle(title string) string {
+	title = strings.ToLower(bracketsRegexp.ReplaceAllString(title, " "))
+	title = strings.TrimSpace(nonAlphaNumRegexp.ReplaceAllString(title, " "))
+	for _, article := range []string{"the ", "a ", "an "} {
+		title = strings.TrimPrefix(title, article)
+	}
+	return title
+}
+
+func _Levenshtein(a []rune, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j] + 1
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+			if previous[j-1]+cost < current[j] {
+				current[j] = previous[j-1] + cost
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func _StringSimilarity(a string, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 0
+	}
+	return 1 - float64(_Levenshtein(ra, rb))/float64(longest)
+}
+
+// Similarity of two titles, ignoring case, punctuation, leading articles
+// and subtitles
+func _TitleSimilarity(a string, b string) float64 {
+	score := _StringSimilarity(_NormalizeTitle(a), _NormalizeTitle(b))
+
+	mainTitle := func(title string) string {
+		if i := strings.IndexAny(title, ":;"); i > 0 {
+			title = title[:i]
+		}
+		return _NormalizeTitle(title)
+	}
+	if s := _StringSimilarity(mainTitle(a), mainTitle(b)); s > score {
+		score = s
+	}
+
+	// One title contains the other, e.g. a series name added by the source
+	na, nb := _NormalizeTitle(a), _NormalizeTitle(b)
+	if len(na) >= 5 && len(nb) >= 5 && (strings.Contains(na, nb) || strings.Contains(nb, na)) && score < 0.9 {
+		score = 0.9
+	}
+	return score
+}
+
+// Share of the name parts of the shorter author found in the other, so
+// "Tolkien, J. R. R." matches "J.R.R. Tolkien"
+func _AuthorSimilarity(a string, b string) float64 {
+	tokens := func(s string) []string {
+		var parts []string
+		for _, part := range strings.Fields(nonAlphaNumRegexp.ReplaceAllString(strings.ToLower(s), " ")) {
+			if utf8.RuneCountInString(part) > 1 {
+				parts = append(parts, part)
+			}
+		}
+		return parts
+	}
+
+	ta, tb := tokens(a), tokens(b)
+	if len(ta) > len(tb) {
+		ta, tb = tb, ta
+	}
+	if len(ta) == 0 {
+		return 0
+	}
+
+	found := 0
+	for _, t := range ta {
+		for _, u := range tb {
+			if t == u {
+				found++
+				break
+			}
+		}
+	}
+	return float64(found) / float64(len(ta))
+}
+
+type importBookStruct struct {
+	id       int64
+	title    string
+	author   string
+	fileName string
+	format   string
+	filePath string
+}
+
+func (e *Env) _GetImportBooks(userId int64) []importBookStruct {
+	rows, err := e.db.Query("SELECT `id`, `title`, `author`, `filename`, `format`, `file_path` FROM `book` WHERE `user_id` = ? AND `deleted_on` = ''", userId)
+	CheckError(err)
+
+	var books []importBookStruct
+	for rows.Next() {
+		book := importBookStruct{}
+		err := rows.Scan(&book.id, &book.title, &book.author, &book.fileName, &book.format, &book.filePath)
+		CheckError(err)
+
+		books = append(books, book)
+	}
+	rows.Close()
+
+	return books
+}
+
+// Book of the library best matching a title and author, and its score
+func _MatchImportBook(books []importBookStruct, title string, author string) (*importBookStruct, float64) {
+	var (
+		best      *importBookStruct
+		bestScore float64
+	)
+	for i := range books {
+		score := _TitleSimilarity(title, books[i].title)
+		if author != "" && books[i].author != "" {
+			score = 0.75*score + 0.25*_AuthorSimilarity(author, books[i].author)
+		}
+		if score > bestScore {
+			best, bestScore = &books[i], score
+		}
+	}
+	return best, bestScore
+}
+
+func (e *Env) _HasHighlightQuote(userId int64, bookId int64, format string, quote string) bool {
+	var query string
+	if format == "pdf" {
+		query = "SELECT COUNT(*) FROM `pdf_highlight_anchor` JOIN `pdf_highlighter` ON `pdf_highlighter`.`id` = `pdf_highlight_anchor`.`highlighter_id`" +
+			" WHERE `pdf_highlighter`.`user_id` = ? AND `pdf_highlighter`.`book_id` = ? AND `pdf_highlight_anchor`.`quote` = ?"
+	} else {
+		query = "SELECT COUNT(*) FROM `epub_annotation` WHERE `user_id` = ? AND `book_id` = ? AND `quote` = ?"
+	}
+
+	var count int64
+	err := e.db.QueryRow(query, userId, bookId, quote).Scan(&count)
+	CheckError(err)
+
+	return count > 0
+}
+
+// Text of every page of a PDF, split on the form feeds written by pdftotext
+func _GetPDFPagesText(filePath string) []string {
+	cmd := exec.Command("pdftotext", "-enc", "UTF-8", filePath, "-")
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	err := cmd.Run()
+	if err != nil {
+		CheckError(err)
+		return nil
+	}
+
+	var pages []string
+	for _, page := range strings.Split(out.String(), "\f") {
+		pages = append(pages, _StripWhitespace(page))
+	}
+	return pages
+}
+
+// Anchor of a quote in a PDF: the page containing it (trying the given page
+// first) and its offsets in the page text (see PDFHighlightAnchorStruct).
+// Without a match the anchor keeps the given page and has no offsets.
+func _LocatePDFQuote(pages []string, quote string, page int64) PDFHighlightAnchorStruct {
+	anchor := PDFHighlightAnchorStruct{Page: page, Quote: quote, Start: -1, End: -1}
+	if anchor.Page <= 0 {
+		anchor.Page = 1
+	}
+
+	stripped := _StripWhitespace(quote)
+	order := make([]int, 0, len(pages))
+	if page > 0 && int(page) <= len(pages) {
+		order = append(order, int(page)-1)
+	}
+	for i := range pages {
+		if i != int(page)-1 {
+			order = append(order, i)
+		}
+	}
+
+	for _, i := range order {
+		if pos := strings.Index(pages[i], stripped); pos >= 0 && stripped != "" {
+			anchor.Page = int64(i + 1)
+			anchor.Start = int64(utf8.RuneCountInString(pages[i][:pos]))
+			anchor.End = anchor.Start + int64(utf8.RuneCountInString(stripped))
+			break
+		}
+	}
+	return anchor
+}
+
+// Text content of the body of an XHTML chapter, as the viewer's DOM sees it,
+// and the CFI step of the body element
+func _GetChapterBodyText(content []byte) (string, int) {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var (
+		text     bytes.Buffer
+		depth    int
+		children int
+		bodyStep int
+		inBody   bool
+	)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			// Element children of <html>
+			if depth == 2 {
+				children++
+				if t.Name.Local == "body" {
+					bodyStep = children * 2
+					inBody = true
+				}
+			}
+		case xml.EndElement:
+			if depth == 2 && t.Name.Local == "body" {
+				inBody = false
+			}
+			depth--
+		case xml.CharData:
+			if inBody {
+				text.Write(t)
+			}
+		}
+	}
+	return text.String(), bodyStep
+}
+
+// UTF-16 offsets (as counted by the DOM) of a quote in a text, ignoring
+// whitespace. Returns -1 if the quote isn't found.
+func _FindQuoteOffsets(text string, quote string) (int, int) {
+	var (
+		stripped []rune
+		offsets  []int
+		unit     int
+	)
+	for _, r := range text {
+		width := 1
+		if r >= 0x10000 {
+			width = 2
+		}
+		if !unicode.IsSpace(r) {
+			stripped = append(stripped, r)
+			offsets = append(offsets, unit)
+		}
+		unit += width
+	}
+
+	strippedQuote := _StripWhitespace(quote)
+	pos := strings.Index(string(stripped), strippedQuote)
+	if pos < 0 || strippedQuote == "" {
+		return -1, -1
+	}
+
+	start := utf8.RuneCountInString(string(stripped)[:pos])
+	end := start + utf8.RuneCountInString(strippedQuote) - 1
+	last := 1
+	if stripped[end] >= 0x10000 {
+		last = 2
+	}
+	return offsets[start], offsets[end] + last
+}
+
+// Chapter hrefs of an EPUB in spine order
+func (e *Env) _GetEPUBSpineHrefs(fileName string) []string {
+	val, err := e.RedisClient.Get(fileName).Result()
+	if err != nil {
+		CheckError(err)
+		return nil
+	}
+
+	opfMetadata := OPFMetadataStruct{}
+	json.Unmarshal([]byte(val), &opfMetadata)
+
+	var hrefs []string
+	for _, idRef := range opfMetadata.Spine.ItemRef.IdRef {
+		href := ""
+		for i, id := range opfMetadata.Manifest.Item.Id {
+			if id == idRef && i < len(opfMetadata.Manifest.Item.Href) {
+				href = opfMetadata.Manifest.Item.Href[i]
+				break
+			}
+		}
+		hrefs = append(hrefs, href)
+	}
+	return hrefs
+}
+
+// Annotation of a quote in an EPUB: its chapter (trying the given spine
+// index first) and a range CFI over the text of the chapter body. Without a
+// match the annotation has the given chapter, if any, and no CFI.
+func _LocateEPUBQuote(packagePath string, hrefs []string, quote string, spineIndex int64) EPUBAnnotationStruct {
+	annotation := EPUBAnnotationStruct{Quote: quote}
+	if spineIndex >= 0 && int(spineIndex) < len(hrefs) {
+		annotation.Href = hrefs[spineIndex]
+	}
+
+	order := make([]int, 0, len(hrefs))
+	if spineIndex >= 0 && int(spineIndex) < len(hrefs) {
+		order = append(order, int(spineIndex))
+	}
+	for i := range hrefs {
+		if i != int(spineIndex) {
+			order = append(order, i)
+		}
+	}
+
+	for _, i := range order {
+		content, err := ioutil.ReadFile(path.Join(packagePath, hrefs[i]))
+		if err != nil {
+			continue
+		}
+
+		text, bodyStep := _GetChapterBodyText(content)
+		start, end := _FindQuoteOffsets(text, quote)
+		if start < 0 || bodyStep == 0 {
+			continue
+		}
+
+		annotation.Href = hrefs[i]
+		annotation.CFI = fmt.Sprintf("epubcfi(/6/%d!/%d,:%d,:%d)", (i+1)*2, bodyStep, start, end)
+		break
+	}
+	return annotation
+}
+
+func (e *Env) _ImportHighlight(userId int64, book importBookStruct, item ImportItemStruct, pdfPages map[string][]string, spineHrefs map[string][]string) {
+	if book.format == "pdf" {
+		pages, ok := pdfPages[book.fileName]
+		if !ok {
+			pages = _GetPDFPagesText(book.filePath)
+			pdfPages[book.fileName] = pages
+		}
+
+		id := e._InsertPDFHighlight(book.id, userId, _ImportColor(item.Color), item.Note, item.CreatedOn)
+		e._InsertPDFHighlightAnchor(id, _LocatePDFQuote(pages, item.Quote, item.Page))
+		return
+	}
+
+	hrefs, ok := spineHrefs[book.fileName]
+	if !ok {
+		hrefs = e._GetEPUBSpineHrefs(book.fileName)
+		spineHrefs[book.fileName] = hrefs
+	}
+
+	annotation := _LocateEPUBQuote(book.filePath, hrefs, item.Quote, item.SpineIndex)
+	annotation.Color = _ImportColor(item.Color)
+	annotation.Note = item.Note
+	annotation.CreatedOn = item.CreatedOn
+	e._InsertEPUBAnnotation(userId, book.id, annotation)
+}
+
+// Match the items to books of the user and store them as highlights, unless
+// dryRun is set. Items already highlighted in the book are skipped.
+func (e *Env) _ImportHighlights(userId int64, items []ImportItemStruct, dryRun bool) ImportReportStruct {
+	report := ImportReportStruct{DryRun: dryRun, Total: len(items), Items: []ImportItemStruct{}}
+
+	books := e._GetImportBooks(userId)
+	seen := make(map[string]bool)
+	pdfPages := make(map[string][]string)
+	spineHrefs := make(map[string][]string)
+	for _, item := range items {
+		if item.CreatedOn == "" {
+			item.CreatedOn = _GetCurrentTime()
+		}
+
+		book, score := _MatchImportBook(books, item.Title, item.Author)
+		item.Score = float64(int(score*100)) / 100
+		if book == nil || score < ImportMatchThreshold {
+			item.Status = ImportStatusUnmatched
+			report.Unmatched++
+			report.Items = append(report.Items, item)
+			continue
+		}
+		item.FileName = book.fileName
+		item.BookTitle = book.title
+
+		key := book.fileName + "\n" + item.Quote
+		if seen[key] || e._HasHighlightQuote(userId, book.id, book.format, item.Quote) {
+			item.Status = ImportStatusDuplicate
+			report.Duplicates++
+			report.Items = append(report.Items, item)
+			continue
+		}
+		seen[key] = true
+
+		if dryRun {
+			item.Status = ImportStatusNew
+		} else {
+			e._ImportHighlight(userId, *book, item, pdfPages, spineHrefs)
+			item.Status = ImportStatusImported
+			report.Imported++
+		}
+		report.Items = append(report.Items, item)
+	}
+
+	return report
+}
+
+// Import highlights from an uploaded file. The source (kindle, koreader or
+// readwise) is guessed from the file name if it isn't given. With dryRun the
+// report only shows what would be imported.
+func (e *Env) PostImportHighlights(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		file, header, err := c.Request.FormFile("file")
+		if err != nil {
+			c.String(400, "Choose a file to import")
+			return
+		}
+		defer file.Close()
+
+		data, err := ioutil.ReadAll(file)
+		CheckError(err)
+
+		source := c.PostForm("source")
+		if source == "" {
+			switch strings.ToLower(path.Ext(header.Filename)) {
+			case ".lua":
+				source = "koreader"
+			case ".csv":
+				source = "readwise"
+			default:
+				source = "kindle"
+			}
+		}
+
+		var items []ImportItemStruct
+		switch source {
+		case "kindle":
+			items = _ParseKindleClippings(data)
+		case "koreader":
+			items, err = _ParseKOReaderMetadata(data, header.Filename)
+		case "readwise":
+			items, err = _ParseReadwiseCSV(data)
+		default:
+			c.String(400, "Unknown source")
+			return
+		}
+		if err != nil {
+			c.String(400, "Could not read the file: "+err.Error())
+			return
+		}
+
+		userId := e._GetUserId(email.(string))
+
+		report := e._ImportHighlights(userId, items, c.PostForm("dryRun") == "true")
+		report.Source = source
+
+		c.JSON(200, report)
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
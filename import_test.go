@@ -0,0 +1,379 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"io/ioutil"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func readImportSample(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(path.Join("testdata/import", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Time of a source given in UTC, in the local time the import stores
+func localImportTime(year int, month time.Month, day, hour, min, sec int) string {
+	return time.Date(year, month, day, hour, min, sec, 0, time.UTC).Local().Format(timeLayout)
+}
+
+// Items without a readable time get the current time, which want leaves empty
+func checkImportItems(t *testing.T, name string, got []ImportItemStruct, want []ImportItemStruct) {
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d items, want %d: %+v", name, len(got), len(want), got)
+		return
+	}
+	for i := range got {
+		if want[i].CreatedOn == "" {
+			if len(got[i].CreatedOn) != len(timeLayout) {
+				t.Errorf("%s: item %d has time %q, want the current time", name, i, got[i].CreatedOn)
+			}
+			got[i].CreatedOn = ""
+		}
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("%s: item %d:\n got %+v\nwant %+v", name, i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseKindleClippings(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  []ImportItemStruct
+	}{
+		{
+			// Windows line endings and byte order mark, a note attached to
+			// the highlight it falls in, a bookmark and an empty highlight
+			name:  "My Clippings.txt",
+			input: readImportSample(t, "My Clippings.txt"),
+			want: []ImportItemStruct{
+				{
+					Title:      "Dune (Dune Chronicles, Book 1)",
+					Author:     "Frank Herbert",
+					Quote:      "I must not fear. Fear is the mind-killer.",
+					Note:       "The litany against fear",
+					Page:       8,
+					SpineIndex: -1,
+					CreatedOn:  time.Date(2019, 3, 4, 21, 15, 2, 0, time.Local).Format(timeLayout),
+				},
+				{
+					Title:      "Meditations",
+					Quote:      "You have power over your mind - not outside events.\nRealize this, and you will find strength.",
+					SpineIndex: -1,
+					CreatedOn:  time.Date(2019, 3, 5, 7, 5, 9, 0, time.Local).Format(timeLayout),
+				},
+				{
+					Title:      "Meditations",
+					Quote:      "The soul becomes dyed with the colour of its thoughts.",
+					SpineIndex: -1,
+				},
+			},
+		},
+		{
+			name:  "empty file",
+			input: []byte(""),
+		},
+		{
+			name:  "not a clippings file",
+			input: []byte("just some text\nwithout separators"),
+		},
+		{
+			name:  "truncated entry",
+			input: []byte("Dune (Frank Herbert)\n==========\nDune (Frank Herbert)\n- Your Highlight on page 3 | Location 40"),
+		},
+		{
+			name:  "note outside of any highlight",
+			input: []byte("Dune (Frank Herbert)\n- Your Highlight on page 3 | Location 40-41 | Added on Monday, March 4, 2019 9:15:02 PM\n\nA quote\n==========\nDune (Frank Herbert)\n- Your Note on page 9 | Location 90 | Added on Monday, March 4, 2019 9:16:02 PM\n\nA stray note\n=========="),
+			want: []ImportItemStruct{{
+				Title:      "Dune",
+				Author:     "Frank Herbert",
+				Quote:      "A quote",
+				Page:       3,
+				SpineIndex: -1,
+				CreatedOn:  time.Date(2019, 3, 4, 21, 15, 2, 0, time.Local).Format(timeLayout),
+			}},
+		},
+	}
+
+	for _, test := range tests {
+		checkImportItems(t, test.name, _ParseKindleClippings(test.input), test.want)
+	}
+}
+
+func TestParseKOReaderMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		fileName string
+		want     []ImportItemStruct
+	}{
+		{
+			// Recent versions: annotations with an XPointer page
+			name:     "metadata.epub.lua",
+			input:    readImportSample(t, "metadata.epub.lua"),
+			fileName: "1984.sdr/metadata.epub.lua",
+			want: []ImportItemStruct{
+				{
+					Title:      "Nineteen Eighty-Four",
+					Author:     "George Orwell",
+					Quote:      "It was a bright cold day in April, and the clocks were striking thirteen.",
+					Note:       "Opening line",
+					Color:      "yellow",
+					Page:       12,
+					SpineIndex: 2,
+					CreatedOn:  time.Date(2024, 1, 15, 10, 30, 0, 0, time.Local).Format(timeLayout),
+				},
+				{
+					Title:      "Nineteen Eighty-Four",
+					Author:     "George Orwell",
+					Quote:      "War is peace.\nFreedom is slavery.\nIgnorance is \"strength\".",
+					Color:      "red",
+					Page:       88,
+					SpineIndex: 9,
+					CreatedOn:  time.Date(2024, 1, 16, 8, 0, 0, 0, time.Local).Format(timeLayout),
+				},
+			},
+		},
+		{
+			// Older versions: highlights by page, notes in the bookmarks.
+			// The title comes from the .sdr folder.
+			name:     "metadata.pdf.lua",
+			input:    readImportSample(t, "Dune.sdr/metadata.pdf.lua"),
+			fileName: "Dune.sdr/metadata.pdf.lua",
+			want: []ImportItemStruct{
+				{
+					Title:      "Dune",
+					Author:     "Frank Herbert, Brian Herbert",
+					Quote:      "Fear is the mind-killer.",
+					Note:       "The litany against fear",
+					Page:       9,
+					SpineIndex: -1,
+					CreatedOn:  time.Date(2019, 5, 1, 20, 0, 0, 0, time.Local).Format(timeLayout),
+				},
+				{
+					Title:      "Dune",
+					Author:     "Frank Herbert, Brian Herbert",
+					Quote:      "The spice must flow.",
+					Color:      "green",
+					Page:       10,
+					SpineIndex: -1,
+					CreatedOn:  time.Date(2019, 5, 2, 21, 0, 0, 0, time.Local).Format(timeLayout),
+				},
+			},
+		},
+		{
+			name:     "title from the document path",
+			input:    []byte(`return { ["doc_path"] = "/books/Foo Bar.epub", ["annotations"] = { { ["text"] = "x", ["page"] = 5 } } }`),
+			fileName: "metadata.epub.lua",
+			want:     []ImportItemStruct{{Title: "Foo Bar", Quote: "x", Page: 5, SpineIndex: -1}},
+		},
+		{
+			name:     "entries which aren't highlights",
+			input:    []byte(`return { ["annotations"] = { "not a table", { ["pageno"] = 3 }, { ["text"] = "" } } }`),
+			fileName: "metadata.epub.lua",
+		},
+		{
+			name:     "no highlights",
+			input:    []byte(`return { ["doc_props"] = { ["title"] = "Empty" } }`),
+			fileName: "metadata.epub.lua",
+		},
+	}
+
+	for _, test := range tests {
+		items, err := _ParseKOReaderMetadata(test.input, test.fileName)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		checkImportItems(t, test.name, items, test.want)
+	}
+
+	for _, input := range []string{"", "return {", "return 42", "return { [\"annotations\"] = { [1] = { [\"text\"] = \"unterminated } } }"} {
+		if _, err := _ParseKOReaderMetadata([]byte(input), "metadata.epub.lua"); err == nil {
+			t.Errorf("_ParseKOReaderMetadata(%q) returned no error", input)
+		}
+	}
+}
+
+func TestParseReadwiseCSV(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  []ImportItemStruct
+	}{
+		{
+			// Byte order mark, a quoted multi-line highlight, a row without
+			// highlight and a short row
+			name:  "readwise.csv",
+			input: readImportSample(t, "readwise.csv"),
+			want: []ImportItemStruct{
+				{
+					Title:      "Deep Work",
+					Author:     "Cal Newport",
+					Quote:      "Clarity about what matters provides clarity about what does not.\nIt is the \"deep work\" that counts.",
+					Note:       "Read again",
+					Color:      "yellow",
+					Page:       42,
+					SpineIndex: -1,
+					CreatedOn:  localImportTime(2021, 6, 1, 12, 0, 0),
+				},
+				{
+					Title:      "Deep Work",
+					Author:     "Cal Newport",
+					Quote:      "Who you are is what you focus on.",
+					SpineIndex: -1,
+					CreatedOn:  localImportTime(2021, 6, 2, 8, 30, 0),
+				},
+				{
+					Title:      "Digital Minimalism",
+					Quote:      "Short row",
+					SpineIndex: -1,
+				},
+			},
+		},
+		{
+			name:  "columns in another order",
+			input: []byte("Book Title,Highlight,Location Type,Location\nDune,The spice must flow.,Page,10\n"),
+			want:  []ImportItemStruct{{Title: "Dune", Quote: "The spice must flow.", Page: 10, SpineIndex: -1}},
+		},
+		{
+			name:  "only the header",
+			input: []byte("Highlight,Book Title\n"),
+		},
+	}
+
+	for _, test := range tests {
+		items, err := _ParseReadwiseCSV(test.input)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		checkImportItems(t, test.name, items, test.want)
+	}
+
+	for _, input := range []string{"", "Title,Author\nDune,Frank Herbert\n", "Highlight,Book Title\n\"unterminated,Dune\n"} {
+		if _, err := _ParseReadwiseCSV([]byte(input)); err == nil {
+			t.Errorf("_ParseReadwiseCSV(%q) returned no error", input)
+		}
+	}
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"The Hobbit", "hobbit"},
+		{"A Game of Thrones", "game of thrones"},
+		{"An Unexpected Journey", "unexpected journey"},
+		{"Dune (Dune Chronicles, Book 1)", "dune"},
+		{"Thinking, Fast and Slow", "thinking fast and slow"},
+		{"Les Misérables [Illustrated]", "les misérables"},
+		{"  Theory of Everything  ", "theory of everything"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := _NormalizeTitle(test.title); got != test.want {
+			t.Errorf("_NormalizeTitle(%q) = %q, want %q", test.title, got, test.want)
+		}
+	}
+}
+
+func TestAuthorSimilarity(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want float64
+	}{
+		{"J.R.R. Tolkien", "Tolkien, J. R. R.", 1},
+		{"Frank Herbert", "Frank Herbert, Brian Herbert", 1},
+		{"Ursula K. Le Guin", "Ursula Le Guin", 1},
+		{"Jane Austen", "Charlotte Brontë", 0},
+		{"Jane Austen", "Jane Smith", 0.5},
+		{"", "Jane Austen", 0},
+	}
+
+	for _, test := range tests {
+		if got := _AuthorSimilarity(test.a, test.b); got != test.want {
+			t.Errorf("_AuthorSimilarity(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestMatchImportBook(t *testing.T) {
+	tests := []struct {
+		name         string
+		title        string
+		author       string
+		bookTitle    string
+		bookAuthor   string
+		matched      bool
+		minimumScore float64
+	}{
+		{"same title and author", "Dune", "Frank Herbert", "Dune", "Frank Herbert", true, 1},
+		{"leading article and case", "the hobbit", "", "The Hobbit", "J.R.R. Tolkien", true, 1},
+		{"series in brackets", "Dune (Dune Chronicles, Book 1)", "Frank Herbert", "Dune", "Frank Herbert", true, 1},
+		{"subtitle", "Dune: Deluxe Edition", "", "Dune", "", true, 1},
+		{"title contained in the other", "The Hobbit, or There and Back Again", "J. R. R. Tolkien", "The Hobbit", "Tolkien, J.R.R.", true, 0.9},
+		{"typo", "Neuromancr", "William Gibson", "Neuromancer", "William Gibson", true, 0.9},
+		{"author written differently", "The Fellowship of the Ring", "Tolkien, J. R. R.", "The Fellowship of the Ring", "J.R.R. Tolkien", true, 1},
+		{"same title by another author", "Emma", "Jane Austen", "Emma", "Alexander McCall Smith", false, 0},
+		{"another book of the series", "Dune Messiah", "Frank Herbert", "Dune", "Frank Herbert", false, 0},
+		{"short titles aren't contained", "It", "", "It Ends with Us", "", false, 0},
+		{"different book", "Deep Work", "Cal Newport", "Digital Minimalism", "Cal Newport", false, 0},
+		{"empty title", "", "", "Dune", "Frank Herbert", false, 0},
+	}
+
+	for _, test := range tests {
+		books := []importBookStruct{{id: 1, title: test.bookTitle, author: test.bookAuthor}}
+		_, score := _MatchImportBook(books, test.title, test.author)
+		if matched := score >= ImportMatchThreshold; matched != test.matched {
+			t.Errorf("%s: score %.3f, want matched %v", test.name, score, test.matched)
+		}
+		if score < test.minimumScore {
+			t.Errorf("%s: score %.3f, want at least %v", test.name, score, test.minimumScore)
+		}
+	}
+
+	// The best match of the library is picked
+	books := []importBookStruct{
+		{id: 1, title: "Dune", author: "Frank Herbert"},
+		{id: 2, title: "Dune Messiah", author: "Frank Herbert"},
+		{id: 3, title: "Children of Dune", author: "Frank Herbert"},
+	}
+	for title, id := range map[string]int64{"Dune Messiah": 2, "Children of Dune": 3, "Dune": 1} {
+		book, _ := _MatchImportBook(books, title, "Frank Herbert")
+		if book == nil || book.id != id {
+			t.Errorf("_MatchImportBook(%q) = %+v, want book %d", title, book, id)
+		}
+	}
+
+	if book, score := _MatchImportBook(nil, "Dune", ""); book != nil || score != 0 {
+		t.Errorf("_MatchImportBook in an empty library = %+v, %v", book, score)
+	}
+}
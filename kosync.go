@@ -0,0 +1,432 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// KOReader identifies a document either by a partial MD5 of the file
+// ("binary") or by the MD5 of its file name ("filename"). Both are stored
+// for every book so either setting of the KOReader sync plugin works. Once
+// metadata is written into the file, the partial MD5 of the original file
+// is kept too ("original"), so devices with the original copy keep syncing.
+const (
+	KOSyncMethodBinary   = "binary"
+	KOSyncMethodFileName = "filename"
+	KOSyncMethodOriginal = "original"
+)
+
+// Progress as sent and received by the KOReader sync plugin. Progress is a
+// page number for PDFs and an XPointer for EPUBs. Percentage is 0 to 1.
+type KOSyncProgressStruct struct {
+	Document   string          `json:"document"`
+	Progress   json.RawMessage `json:"progress,omitempty"`
+	Percentage float64         `json:"percentage"`
+	Device     string          `json:"device"`
+	DeviceId   string          `json:"device_id"`
+	Timestamp  int64           `json:"timestamp,omitempty"`
+}
+
+// Chapter of an EPUB XPointer, e.g. /body/DocFragment[12]/body/p[3]/text().42
+var koreaderFragmentRegexp = regexp.MustCompile(`DocFragment\[(\d+)\]`)
+
+func _KOSyncError(c *gin.Context, status int, code int, message string) {
+	c.JSON(status, gin.H{
+		"code":    code,
+		"message": message,
+	})
+}
+
+// Same sampling as KOReader's util.partialMD5: 1024 bytes at offsets 0 and
+// 1024 << 2i for i from 0 to 10, stopping at the end of the file.
+func _KOReaderPartialMD5(filePath string) string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		CheckError(err)
+		return ""
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	sample := make([]byte, 1024)
+	for i := -1; i <= 10; i++ {
+		var offset int64
+		if i >= 0 {
+			offset = 1024 << uint(2*i)
+		}
+
+		n, err := file.ReadAt(sample, offset)
+		if n == 0 {
+			break
+		}
+		hash.Write(sample[:n])
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func _MD5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store the KOReader document hashes of an uploaded book
+func (e *Env) _UpdateKOSyncDocuments(bookId int64, fileName string) {
+	documents := map[string]string{
+		KOSyncMethodBinary:   _KOReaderPartialMD5("./uploads/" + fileName),
+		KOSyncMethodFileName: _MD5Hex(fileName),
+	}
+
+	for method, document := range documents {
+		if document == "" {
+			continue
+		}
+
+		stmt, err := e.db.Prepare("INSERT OR REPLACE INTO `kosync_document` (book_id, document, method) VALUES (?, ?, ?)")
+		CheckError(err)
+
+		_, err = stmt.Exec(bookId, document, method)
+		CheckError(err)
+	}
+}
+
+// Keep the hash of the original file of a book, which was copied to
+// versionPath before its metadata was first written into the file
+func (e *Env) _KeepOriginalKOSyncDocument(bookId int64, versionPath string) {
+	document := _KOReaderPartialMD5(versionPath)
+	if document == "" {
+		return
+	}
+
+	stmt, err := e.db.Prepare("INSERT OR IGNORE INTO `kosync_document` (book_id, document, method) VALUES (?, ?, ?)")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId, document, KOSyncMethodOriginal)
+	CheckError(err)
+}
+
+// Hash the books of a user, including the trashed ones, and the books shared
+// with them which were uploaded before KOReader sync existed
+func (e *Env) _UpdateMissingKOSyncDocuments(userId int64) int64 {
+	condition, args := e._GetLibraryCondition(userId)
+	args = append([]interface{}{userId}, args...)
+	rows, err := e.db.Query("SELECT `id`, `filename` FROM `book` WHERE (`user_id` = ? OR `id` IN (SELECT `id` FROM `book` WHERE "+condition+"))"+
+		" AND `id` NOT IN (SELECT `book_id` FROM `kosync_document`)", args...)
+	CheckError(err)
+
+	books := make(map[int64]string)
+	for rows.Next() {
+		var (
+			bookId   int64
+			fileName string
+		)
+		err := rows.Scan(&bookId, &fileName)
+		CheckError(err)
+
+		books[bookId] = fileName
+	}
+	rows.Close()
+
+	for bookId, fileName := range books {
+		e._UpdateKOSyncDocuments(bookId, fileName)
+	}
+
+	return int64(len(books))
+}
+
+func (e *Env) _QueryKOSyncBook(userId int64, document string) (int64, string, string) {
+	condition, args := e._GetLibraryCondition(userId)
+	args = append([]interface{}{document}, args...)
+	rows, err := e.db.Query("SELECT `book`.`id`, `book`.`filename`, `book`.`format` FROM `kosync_document`"+
+		" JOIN `book` ON `book`.`id` = `kosync_document`.`book_id`"+
+		" WHERE `kosync_document`.`document` = ? AND `book`.`id` IN (SELECT `id` FROM `book` WHERE "+condition+")"+
+		" ORDER BY `book`.`user_id` = ? DESC", append(args, userId)...)
+	CheckError(err)
+
+	var (
+		bookId   int64
+		fileName string
+		format   string
+	)
+	if rows.Next() {
+		err := rows.Scan(&bookId, &fileName, &format)
+		CheckError(err)
+	}
+	rows.Close()
+
+	return bookId, fileName, format
+}
+
+// Book in the library of the user matching a KOReader document hash, their
+// own copy first if the same file was also shared with them. Returns 0 if
+// the document is not in the library or is in the trash.
+func (e *Env) _GetKOSyncBook(userId int64, document string) (int64, string, string) {
+	bookId, fileName, format := e._QueryKOSyncBook(userId, document)
+	if bookId == 0 && e._UpdateMissingKOSyncDocuments(userId) > 0 {
+		bookId, fileName, format = e._QueryKOSyncBook(userId, document)
+	}
+
+	return bookId, fileName, format
+}
+
+func (e *Env) _SetKOSyncPassword(email string, password string) {
+	keyHash := ""
+	if password != "" {
+		// KOReader sends the MD5 of the password as the auth key
+		hashedKey, err := bcrypt.GenerateFromPassword([]byte(_MD5Hex(password)), bcrypt.DefaultCost)
+		CheckError(err)
+
+		keyHash = string(hashedKey)
+	}
+
+	stmt, err := e.db.Prepare("UPDATE `user` SET kosync_key_hash=? WHERE email=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(keyHash, email)
+	CheckError(err)
+}
+
+// User id for the x-auth-user (email) and x-auth-key headers. Returns 0 if
+// the credentials don't match.
+func (e *Env) _KOSyncAuthorize(c *gin.Context) int64 {
+	email := c.GetHeader("x-auth-user")
+	key := c.GetHeader("x-auth-key")
+	if email == "" || key == "" {
+		return 0
+	}
+
+	rows, err := e.db.Query("SELECT `id`, `kosync_key_hash` FROM `user` WHERE `email` = ?", email)
+	CheckError(err)
+
+	var (
+		userId  int64
+		keyHash string
+	)
+	if rows.Next() {
+		err := rows.Scan(&userId, &keyHash)
+		CheckError(err)
+	}
+	rows.Close()
+
+	if userId == 0 || keyHash == "" {
+		return 0
+	}
+
+	if _CompareHashAndPassword([]byte(keyHash), []byte(key)) != nil {
+		return 0
+	}
+
+	return userId
+}
+
+// Accounts are created in LibreRead, KOReader only logs in with the email
+// and the KOReader sync password set in the settings page.
+func (e *Env) KOSyncCreateUser(c *gin.Context) {
+	_KOSyncError(c, 402, 2002, "Registration is disabled. Set a KOReader sync password in the LibreRead settings and log in with your email.")
+}
+
+func (e *Env) KOSyncAuthUser(c *gin.Context) {
+	if e._KOSyncAuthorize(c) == 0 {
+		_KOSyncError(c, 401, 2001, "Unauthorized")
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"authorized": "OK",
+	})
+}
+
+// KOReader sends the page of a PDF as a number and the XPointer of an EPUB
+// as a string
+func _KOSyncProgressString(progress json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(progress, &s); err == nil {
+		return s
+	}
+
+	var n float64
+	if err := json.Unmarshal(progress, &n); err == nil {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+
+	return ""
+}
+
+// Convert a KOReader position to the position used by the web viewers
+func (e *Env) _KOSyncToReadingProgress(fileName string, format string, progress string, percentage float64) ReadingProgressStruct {
+	readingProgress := ReadingProgressStruct{
+		FileName: fileName,
+	}
+
+	if format == "pdf" {
+		page, err := strconv.ParseFloat(progress, 64)
+		CheckError(err)
+
+		readingProgress.Page = int64(page)
+		return readingProgress
+	}
+
+	match := koreaderFragmentRegexp.FindStringSubmatch(progress)
+	if match != nil {
+		fragment, err := strconv.ParseInt(match[1], 10, 64)
+		CheckError(err)
+
+		readingProgress.SpineIndex = fragment - 1
+	}
+
+	// XPointers can't be resolved without rendering the chapter, so the
+	// position within the chapter is estimated from the book percentage.
+	length := e._GetBookLength(fileName, format)
+	scroll := percentage*float64(length) - float64(readingProgress.SpineIndex)
+	if scroll < 0 {
+		scroll = 0
+	} else if scroll > 1 {
+		scroll = 1
+	}
+	readingProgress.Scroll = scroll
+
+	return readingProgress
+}
+
+// Convert a web viewer position to a KOReader position
+func _ReadingProgressToKOSync(format string, progress ReadingProgressStruct) string {
+	if format == "pdf" {
+		return strconv.FormatInt(progress.Page, 10)
+	}
+
+	return fmt.Sprintf("/body/DocFragment[%d]", progress.SpineIndex+1)
+}
+
+func (e *Env) _GetKOSyncProgress(userId int64, document string) (KOSyncProgressStruct, bool) {
+	rows, err := e.db.Query("SELECT `progress`, `percentage`, `device`, `device_id`, `timestamp` FROM `kosync_progress` WHERE `user_id` = ? AND `document` = ?", userId, document)
+	CheckError(err)
+
+	progress := KOSyncProgressStruct{
+		Document: document,
+	}
+	var progressString string
+	found := false
+	if rows.Next() {
+		err := rows.Scan(&progressString, &progress.Percentage, &progress.Device, &progress.DeviceId, &progress.Timestamp)
+		CheckError(err)
+		found = true
+	}
+	rows.Close()
+
+	progress.Progress, err = json.Marshal(progressString)
+	CheckError(err)
+
+	return progress, found
+}
+
+func (e *Env) KOSyncUpdateProgress(c *gin.Context) {
+	userId := e._KOSyncAuthorize(c)
+	if userId == 0 {
+		_KOSyncError(c, 401, 2001, "Unauthorized")
+		return
+	}
+
+	progress := KOSyncProgressStruct{}
+	err := c.BindJSON(&progress)
+	if err != nil {
+		_KOSyncError(c, 403, 2003, "Invalid request")
+		return
+	}
+
+	progressString := _KOSyncProgressString(progress.Progress)
+	if progress.Document == "" || progressString == "" {
+		_KOSyncError(c, 403, 2003, "Invalid request")
+		return
+	}
+
+	timestamp := time.Now().Unix()
+	bookId, fileName, format := e._GetKOSyncBook(userId, progress.Document)
+
+	stmt, err := e.db.Prepare("INSERT OR REPLACE INTO `kosync_progress` (user_id, book_id, document, progress, percentage, device, device_id, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	CheckError(err)
+
+	_, err = stmt.Exec(userId, bookId, progress.Document, progressString, progress.Percentage, progress.Device, progress.DeviceId, timestamp)
+	CheckError(err)
+
+	if bookId != 0 {
+		readingProgress := e._KOSyncToReadingProgress(fileName, format, progressString, progress.Percentage)
+		e._RecordReadingProgress(userId, bookId, format, readingProgress)
+	}
+
+	c.JSON(200, gin.H{
+		"document":  progress.Document,
+		"timestamp": timestamp,
+	})
+}
+
+func (e *Env) KOSyncGetProgress(c *gin.Context) {
+	userId := e._KOSyncAuthorize(c)
+	if userId == 0 {
+		_KOSyncError(c, 401, 2001, "Unauthorized")
+		return
+	}
+
+	document := c.Param("document")
+	progress, found := e._GetKOSyncProgress(userId, document)
+
+	// Return the web reader position if it is more recent than the last
+	// position sent by KOReader
+	bookId, _, format := e._GetKOSyncBook(userId, document)
+	if bookId != 0 {
+		readingProgress, hasProgress := e._GetReadingProgress(userId, bookId)
+		if hasProgress {
+			updatedOn, err := time.ParseInLocation("20060102150405", readingProgress.UpdatedOn, time.Local)
+			CheckError(err)
+
+			if err == nil && updatedOn.Unix() > progress.Timestamp {
+				progress.Progress, err = json.Marshal(_ReadingProgressToKOSync(format, readingProgress))
+				CheckError(err)
+
+				progress.Percentage = readingProgress.Percentage / 100
+				progress.Device = "LibreRead"
+				progress.DeviceId = "libreread"
+				progress.Timestamp = updatedOn.Unix()
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		c.JSON(200, gin.H{})
+		return
+	}
+
+	c.JSON(200, progress)
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Orders of the library list
+const (
+	LibrarySortAdded    = "added"
+	LibrarySortTitle    = "title"
+	LibrarySortAuthor   = "author"
+	LibrarySortRead     = "read"
+	LibrarySortProgress = "progress"
+)
+
+const defaultLibraryPageSize = 18
+
+// Page sizes offered on the home page. Multiples of 6 fill the grid rows.
+var libraryPageSizes = []int64{12, 18, 24, 36, 48, 96}
+
+// How a user browses the library: order, filters and page size. Stored as
+// JSON in user.library_view.
+type LibraryViewStruct struct {
+	Sort       string `json:"sort"`
+	Order      string `json:"order"`
+	Format     string `json:"format"`
+	Status     string `json:"status"`
+	Tag        string `json:"tag"`
+	Collection int64  `json:"collection"`
+	PageSize   int64  `json:"pageSize"`
+}
+
+// Position of a book in the library list, used as keyset pagination cursor
+type LibraryCursorStruct struct {
+	Key interface{} `json:"k"`
+	Id  int64       `json:"id"`
+}
+
+// Which page of the library to show. A cursor, when set, is used instead of
+// the offset so that large libraries don't have to skip rows.
+type LibraryPageStruct struct {
+	Offset int64
+	After  string
+	Before string
+}
+
+type LibraryCollectionStruct struct {
+	Id    int64
+	Title string
+	// Books can only be added to own collections
+	Own bool
+}
+
+func _DefaultLibraryView() LibraryViewStruct {
+	return LibraryViewStruct{
+		Sort:     LibrarySortAdded,
+		Order:    "desc",
+		PageSize: defaultLibraryPageSize,
+	}
+}
+
+// Newest, last read and furthest read first, names alphabetically
+func _DefaultLibraryOrder(sort string) string {
+	switch sort {
+	case LibrarySortTitle, LibrarySortAuthor:
+		return "asc"
+	}
+	return "desc"
+}
+
+func _CleanLibraryView(view LibraryViewStruct) (LibraryViewStruct, error) {
+	switch view.Sort {
+	case "":
+		view.Sort = LibrarySortAdded
+	case LibrarySortAdded, LibrarySortTitle, LibrarySortAuthor, LibrarySortRead, LibrarySortProgress:
+	default:
+		return view, errors.New("Invalid sort " + view.Sort)
+	}
+
+	switch view.Order {
+	case "":
+		view.Order = _DefaultLibraryOrder(view.Sort)
+	case "asc", "desc":
+	default:
+		return view, errors.New("Invalid order " + view.Order)
+	}
+
+	switch view.Format {
+	case "", "pdf", "epub":
+	default:
+		return view, errors.New("Invalid format " + view.Format)
+	}
+
+	if view.Status != "" && view.Status != SmartStatusUnread && !_IsValidReadingStatus(view.Status) {
+		return view, errors.New("Invalid reading status")
+	}
+
+	if view.PageSize == 0 {
+		view.PageSize = defaultLibraryPageSize
+	}
+	validSize := false
+	for _, size := range libraryPageSizes {
+		if view.PageSize == size {
+			validSize = true
+		}
+	}
+	if !validSize {
+		return view, errors.New("Invalid page size")
+	}
+
+	return view, nil
+}
+
+func (e *Env) _GetLibraryView(userId int64) LibraryViewStruct {
+	rows, err := e.db.Query("SELECT `library_view` FROM `user` WHERE `id` = ?", userId)
+	CheckError(err)
+
+	var text string
+	if rows.Next() {
+		err := rows.Scan(&text)
+		CheckError(err)
+	}
+	rows.Close()
+
+	view := _DefaultLibraryView()
+	if text == "" || json.Unmarshal([]byte(text), &view) != nil {
+		return _DefaultLibraryView()
+	}
+
+	// A view saved by an older version may no longer be valid
+	view, err = _CleanLibraryView(view)
+	if err != nil {
+		return _DefaultLibraryView()
+	}
+	if view.Collection != 0 && !e._CanViewCollection(userId, view.Collection) {
+		view.Collection = 0
+	}
+
+	return view
+}
+
+func (e *Env) _CanViewCollection(userId int64, collectionId int64) bool {
+	var count int64
+	err := e.db.QueryRow("SELECT COUNT(*) FROM `collection` WHERE `id` = ? AND (`user_id` = ?"+
+		" OR `id` IN (SELECT `collection_id` FROM `book_share` WHERE `user_id` = ?))", collectionId, userId, userId).Scan(&count)
+	CheckError(err)
+
+	return count > 0
+}
+
+// Value the library is ordered by, as an expression on the book table
+func _LibrarySortExpression(userId int64, sort string) (string, []interface{}) {
+	switch sort {
+	case LibrarySortTitle:
+		return "LOWER(`title`)", nil
+	case LibrarySortAuthor:
+		// Sort name of the first author, the author text for books without
+		// linked authors
+		return "LOWER(COALESCE((SELECT `author`.`sort_name` FROM `book_author`" +
+			" JOIN `author` ON `author`.`id` = `book_author`.`author_id`" +
+			" WHERE `book_author`.`book_id` = `book`.`id`" +
+			" ORDER BY `book_author`.`role` != '" + AuthorRoleAuthor + "', `book_author`.`position` LIMIT 1), `book`.`author`, ''))", nil
+	case LibrarySortRead:
+		return "MAX(COALESCE((SELECT `updated_on` FROM `reading_progress` WHERE `reading_progress`.`user_id` = ? AND `reading_progress`.`book_id` = `book`.`id`), '')," +
+				" COALESCE((SELECT MAX(`date_read`) FROM `currently_reading` WHERE `currently_reading`.`user_id` = ? AND `currently_reading`.`book_id` = `book`.`id`), ''))",
+			[]interface{}{userId, userId}
+	case LibrarySortProgress:
+		// Books never opened come after the ones at 0%
+		return "COALESCE((SELECT `percentage` FROM `reading_progress` WHERE `reading_progress`.`user_id` = ? AND `reading_progress`.`book_id` = `book`.`id`), -1)",
+			[]interface{}{userId}
+	}
+	return "`id`", nil
+}
+
+// WHERE condition on the book table for the library filters
+func _LibraryFilterCondition(userId int64, view LibraryViewStruct) (string, []interface{}) {
+	condition := ""
+	var args []interface{}
+
+	rules := []SmartRuleStruct{}
+	if view.Format != "" {
+		rules = append(rules, SmartRuleStruct{Field: "format", Operator: "equals", Value: view.Format})
+	}
+	if view.Status != "" {
+		rules = append(rules, SmartRuleStruct{Field: "status", Operator: "equals", Value: view.Status})
+	}
+	if view.Tag != "" {
+		rules = append(rules, SmartRuleStruct{Field: "tag", Operator: "equals", Value: view.Tag})
+	}
+	for _, rule := range rules {
+		ruleCondition, ruleArgs, err := _SmartRuleCondition(userId, rule)
+		CheckError(err)
+
+		condition += " AND " + ruleCondition
+		args = append(args, ruleArgs...)
+	}
+
+	if view.Collection != 0 {
+		condition += " AND `id` IN (SELECT `book_id` FROM `collection_book` WHERE `collection_id` = ?)"
+		args = append(args, view.Collection)
+	}
+
+	return condition, args
+}
+
+func _EncodeLibraryCursor(key interface{}, id int64) string {
+	if b, ok := key.([]byte); ok {
+		key = string(b)
+	}
+	data, err := json.Marshal(LibraryCursorStruct{Key: key, Id: id})
+	CheckError(err)
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func _DecodeLibraryCursor(s string) (LibraryCursorStruct, error) {
+	cursor := LibraryCursorStruct{}
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return cursor, err
+	}
+
+	switch cursor.Key.(type) {
+	case string, float64:
+		return cursor, nil
+	}
+	return cursor, errors.New("Invalid cursor")
+}
+
+// Distinct tags of the books in the user's library
+func (e *Env) _GetLibraryTags(userId int64) []string {
+	condition, args := e._GetLibraryCondition(userId)
+	rows, err := e.db.Query("SELECT DISTINCT `tag` FROM `book_tag` WHERE `book_id` IN (SELECT `id` FROM `book` WHERE "+condition+")"+
+		" ORDER BY LOWER(`tag`)", args...)
+	CheckError(err)
+
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		err := rows.Scan(&tag)
+		CheckError(err)
+
+		tags = append(tags, tag)
+	}
+	rows.Close()
+
+	return tags
+}
+
+// Own collections and the ones shared with the user
+func (e *Env) _GetLibraryCollections(userId int64) []LibraryCollectionStruct {
+	rows, err := e.db.Query("SELECT `id`, `title`, `user_id` = ? FROM `collection` WHERE `user_id` = ?"+
+		" OR `id` IN (SELECT `collection_id` FROM `book_share` WHERE `user_id` = ?) ORDER BY LOWER(`title`)", userId, userId, userId)
+	CheckError(err)
+
+	collections := []LibraryCollectionStruct{}
+	for rows.Next() {
+		collection := LibraryCollectionStruct{}
+		err := rows.Scan(&collection.Id, &collection.Title, &collection.Own)
+		CheckError(err)
+
+		collections = append(collections, collection)
+	}
+	rows.Close()
+
+	return collections
+}
+
+func _GetLibraryPage(c *gin.Context, view LibraryViewStruct, pagination int64) LibraryPageStruct {
+	return LibraryPageStruct{
+		Offset: (pagination - 1) * view.PageSize,
+		After:  c.Query("after"),
+		Before: c.Query("before"),
+	}
+}
+
+func (e *Env) PostLibraryView(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		view := LibraryViewStruct{}
+		err := c.BindJSON(&view)
+		if err != nil {
+			c.String(400, "Invalid library view")
+			return
+		}
+
+		view, err = _CleanLibraryView(view)
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
+
+		userId := e._GetUserId(email.(string))
+
+		if view.Collection != 0 && !e._CanViewCollection(userId, view.Collection) {
+			c.String(400, "Invalid collection")
+			return
+		}
+
+		data, err := json.Marshal(view)
+		CheckError(err)
+
+		stmt, err := e.db.Prepare("UPDATE `user` SET library_view=? WHERE id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(string(data), userId)
+		CheckError(err)
+
+		c.String(200, "Library view saved.")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
@@ -55,45 +55,75 @@ type Env struct {
 }
 
 const (
-	PORT_DEFAULT           = "8080"
-	PORT_ENV               = "LIBREREAD_PORT"
-	DBPATH_ENV             = "LIBREREAD_DB_PATH"
-	DBPATH_DEFAULT         = "."
-	ENABLE_ES_ENV          = "LIBREREAD_ELASTICSEARCH"
-	ENABLE_ES_DEFAULT      = "0"
-	ESPATH_ENV             = "LIBREREAD_ES_PATH"
-	ESPATH_DEFAULT         = "http://localhost:9200"
-	REDISPATH_ENV          = "LIBREREAD_REDIS_PATH"
-	REDISPATH_DEFAULT      = "localhost:6379"
-	REDIS_PASSWORD_ENV     = "LIBREREAD_REDIS_PASSWORD"
-	REDIS_PASSWORD_DEFAULT = ""
-	ASSETPATH_ENV          = "LIBREREAD_ASSET_PATH"
-	ASSETPATH_DEFAULT      = "."
-	DOMAIN_ADDRESS_ENV     = "LIBREREAD_DOMAIN_ADDRESS"
-	DOMAIN_ADDRESS_DEFAULT = ""
-	SMTP_SERVER_ENV        = "LIBREREAD_SMTP_SERVER"
-	SMTP_SERVER_DEFAULT    = ""
-	SMTP_PORT_ENV          = "LIBREREAD_SMTP_PORT"
-	SMTP_PORT_DEFAULT      = ""
-	SMTP_ADDRESS_ENV       = "LIBREREAD_SMTP_ADDRESS"
-	SMTP_ADDRESS_DEFAULT   = ""
-	SMTP_PASSWORD_ENV      = "LIBREREAD_SMTP_PASSWORD"
-	SMTP_PASSWORD_DEFAULT  = ""
+	PORT_DEFAULT               = "8080"
+	PORT_ENV                   = "LIBREREAD_PORT"
+	DBPATH_ENV                 = "LIBREREAD_DB_PATH"
+	DBPATH_DEFAULT             = "."
+	ENABLE_ES_ENV              = "LIBREREAD_ELASTICSEARCH"
+	ENABLE_ES_DEFAULT          = "0"
+	ESPATH_ENV                 = "LIBREREAD_ES_PATH"
+	ESPATH_DEFAULT             = "http://localhost:9200"
+	REDISPATH_ENV              = "LIBREREAD_REDIS_PATH"
+	REDISPATH_DEFAULT          = "localhost:6379"
+	REDIS_PASSWORD_ENV         = "LIBREREAD_REDIS_PASSWORD"
+	REDIS_PASSWORD_DEFAULT     = ""
+	ASSETPATH_ENV              = "LIBREREAD_ASSET_PATH"
+	ASSETPATH_DEFAULT          = "."
+	DOMAIN_ADDRESS_ENV         = "LIBREREAD_DOMAIN_ADDRESS"
+	DOMAIN_ADDRESS_DEFAULT     = ""
+	SMTP_SERVER_ENV            = "LIBREREAD_SMTP_SERVER"
+	SMTP_SERVER_DEFAULT        = ""
+	SMTP_PORT_ENV              = "LIBREREAD_SMTP_PORT"
+	SMTP_PORT_DEFAULT          = ""
+	SMTP_ADDRESS_ENV           = "LIBREREAD_SMTP_ADDRESS"
+	SMTP_ADDRESS_DEFAULT       = ""
+	SMTP_PASSWORD_ENV          = "LIBREREAD_SMTP_PASSWORD"
+	SMTP_PASSWORD_DEFAULT      = ""
+	METADATA_PROVIDERS_ENV     = "LIBREREAD_METADATA_PROVIDERS"
+	METADATA_PROVIDERS_DEFAULT = "openlibrary,googlebooks"
+	GOOGLE_BOOKS_KEY_ENV       = "LIBREREAD_GOOGLE_BOOKS_KEY"
+	GOOGLE_BOOKS_KEY_DEFAULT   = ""
+	METADATA_FIXTURES_ENV      = "LIBREREAD_METADATA_FIXTURES"
+	METADATA_FIXTURES_DEFAULT  = ""
+	METADATA_RECORD_ENV        = "LIBREREAD_METADATA_RECORD"
+	METADATA_RECORD_DEFAULT    = "0"
+	TRASH_DAYS_ENV             = "LIBREREAD_TRASH_DAYS"
+	TRASH_DAYS_DEFAULT         = "30"
+	WATCH_DIR_ENV              = "LIBREREAD_WATCH_DIR"
+	WATCH_DIR_DEFAULT          = ""
+	WATCH_USER_ENV             = "LIBREREAD_WATCH_USER"
+	WATCH_USER_DEFAULT         = ""
+	WATCH_INTERVAL_ENV         = "LIBREREAD_WATCH_INTERVAL"
+	WATCH_INTERVAL_DEFAULT     = "60"
+	WATCH_AFTER_IMPORT_ENV     = "LIBREREAD_WATCH_AFTER_IMPORT"
+	WATCH_AFTER_IMPORT_DEFAULT = "keep"
+	ADMIN_EMAILS_ENV           = "LIBREREAD_ADMIN_EMAILS"
+	ADMIN_EMAILS_DEFAULT       = ""
 )
 
 var (
-	DBPath        = DBPATH_DEFAULT
-	EnableES      = ENABLE_ES_DEFAULT
-	ESPath        = ESPATH_DEFAULT
-	RedisPath     = REDISPATH_DEFAULT
-	RedisPassword = REDIS_PASSWORD_DEFAULT
-	ServerPort    = PORT_DEFAULT
-	AssetPath     = ASSETPATH_DEFAULT
-	DomainAddress = DOMAIN_ADDRESS_DEFAULT
-	SMTPServer    = SMTP_SERVER_DEFAULT
-	SMTPPort      = SMTP_PORT_DEFAULT
-	SMTPAddress   = SMTP_ADDRESS_DEFAULT
-	SMTPPassword  = SMTP_PASSWORD_DEFAULT
+	DBPath              = DBPATH_DEFAULT
+	EnableES            = ENABLE_ES_DEFAULT
+	ESPath              = ESPATH_DEFAULT
+	RedisPath           = REDISPATH_DEFAULT
+	RedisPassword       = REDIS_PASSWORD_DEFAULT
+	ServerPort          = PORT_DEFAULT
+	AssetPath           = ASSETPATH_DEFAULT
+	DomainAddress       = DOMAIN_ADDRESS_DEFAULT
+	SMTPServer          = SMTP_SERVER_DEFAULT
+	SMTPPort            = SMTP_PORT_DEFAULT
+	SMTPAddress         = SMTP_ADDRESS_DEFAULT
+	SMTPPassword        = SMTP_PASSWORD_DEFAULT
+	MetadataProviders   = METADATA_PROVIDERS_DEFAULT
+	GoogleBooksKey      = GOOGLE_BOOKS_KEY_DEFAULT
+	MetadataFixturePath = METADATA_FIXTURES_DEFAULT
+	MetadataRecord      = METADATA_RECORD_DEFAULT
+	TrashDays           = TRASH_DAYS_DEFAULT
+	WatchDir            = WATCH_DIR_DEFAULT
+	WatchUser           = WATCH_USER_DEFAULT
+	WatchInterval       = WATCH_INTERVAL_DEFAULT
+	WatchAfterImport    = WATCH_AFTER_IMPORT_DEFAULT
+	AdminEmails         = ADMIN_EMAILS_DEFAULT
 )
 
 func init() {
@@ -110,6 +140,16 @@ func init() {
 	SMTPPort = _GetEnv(SMTP_PORT_ENV, SMTP_PORT_DEFAULT)
 	SMTPAddress = _GetEnv(SMTP_ADDRESS_ENV, SMTP_ADDRESS_DEFAULT)
 	SMTPPassword = _GetEnv(SMTP_PASSWORD_ENV, SMTP_PASSWORD_DEFAULT)
+	MetadataProviders = _GetEnv(METADATA_PROVIDERS_ENV, METADATA_PROVIDERS_DEFAULT)
+	GoogleBooksKey = _GetEnv(GOOGLE_BOOKS_KEY_ENV, GOOGLE_BOOKS_KEY_DEFAULT)
+	MetadataFixturePath = _GetEnv(METADATA_FIXTURES_ENV, METADATA_FIXTURES_DEFAULT)
+	MetadataRecord = _GetEnv(METADATA_RECORD_ENV, METADATA_RECORD_DEFAULT)
+	TrashDays = _GetEnv(TRASH_DAYS_ENV, TRASH_DAYS_DEFAULT)
+	WatchDir = _GetEnv(WATCH_DIR_ENV, WATCH_DIR_DEFAULT)
+	WatchUser = _GetEnv(WATCH_USER_ENV, WATCH_USER_DEFAULT)
+	WatchInterval = _GetEnv(WATCH_INTERVAL_ENV, WATCH_INTERVAL_DEFAULT)
+	WatchAfterImport = _GetEnv(WATCH_AFTER_IMPORT_ENV, WATCH_AFTER_IMPORT_DEFAULT)
+	AdminEmails = _GetEnv(ADMIN_EMAILS_ENV, ADMIN_EMAILS_DEFAULT)
 
 	fmt.Printf("Database Path: %s\n", DBPath)
 	fmt.Printf("Enable Elasticsearch: %s\n", EnableES)
@@ -120,6 +160,15 @@ func init() {
 	fmt.Printf("SMTP server: %s\n", SMTPServer)
 	fmt.Printf("SMTP port: %s\n", SMTPPort)
 	fmt.Printf("SMTP address: %s\n", SMTPAddress)
+	fmt.Printf("Metadata providers: %s\n", MetadataProviders)
+	if MetadataFixturePath != "" {
+		fmt.Printf("Metadata fixtures: %s\n", MetadataFixturePath)
+	}
+	fmt.Printf("Trash days: %s\n", TrashDays)
+	fmt.Printf("Administrators: %s\n", AdminEmails)
+	if WatchDir != "" {
+		fmt.Printf("Watch folder: %s (user %s, every %ss, %s files after import)\n", WatchDir, WatchUser, WatchInterval, WatchAfterImport)
+	}
 }
 
 func StartServer() {
@@ -143,6 +192,261 @@ func StartServer() {
 	// Close sqlite3 database when all the functions are done
 	defer db.Close()
 
+	// Create the tables and add the columns of newer versions
+	_CreateTables(db)
+
+	// Bleve settings
+	// Check if bleve setting already exists. If not create a new setting.
+	blevePath := path.Join(DBPath, "lr_index.bleve")
+	if _, err := os.Stat(blevePath); os.IsNotExist(err) {
+		mapping := bleve.NewIndexMapping()
+		index, err := bleve.New(blevePath, mapping)
+		CheckError(err)
+		err = index.Close()
+		CheckError(err)
+	}
+
+	// Init Elasticsearch attachment
+	if EnableES == "1" {
+		_InitElasticsearch()
+	}
+
+	// Initiate redis
+	client := _NewRedisClient()
+
+	// Create upload directory if not exist
+	uploadPath := "./uploads/img"
+	if _, err := os.Stat(uploadPath); os.IsNotExist(err) {
+		err = os.MkdirAll(uploadPath, 0755)
+	}
+	if _, err := os.Stat(versionsPath); os.IsNotExist(err) {
+		err = os.MkdirAll(versionsPath, 0755)
+	}
+
+	// Set database and redis environment
+	env := &Env{db: db, RedisClient: client}
+
+	// Convert the data saved by older versions
+	env._MigrateData()
+
+	// Delete the books which have been in the trash for too long
+	go env._PurgeTrashPeriodically()
+
+	// Import the books copied into the watched import folder
+	go env._WatchImportDir()
+
+	// Router
+	r.GET("/", env.GetHomePage)
+	r.GET("/signin", env.GetSignIn)
+	r.POST("/signin", env.PostSignIn)
+	r.GET("/forgot-password", GetForgotPassword)
+	r.POST("/forgot-password", env.PostForgotPassword)
+	r.GET("/reset-password", env.GetResetPassword)
+	r.POST("/reset-password", env.PostResetPassword)
+	r.GET("/signup", env.GetSignUp)
+	r.POST("/signup", env.PostSignUp)
+	r.GET("/confirm-email", env.ConfirmEmail)
+	r.GET("/new-token", env.SendNewToken)
+	r.GET("/signout", GetSignOut)
+	r.POST("/upload", env.UploadBook)
+	r.GET("/book/:bookname", env.SendBook)
+	r.GET("/get-book-metadata", env.GetBookMetaData)
+	r.POST("/edit-book/:bookname", env.EditBook)
+	r.GET("/metadata-lookup", env.GetMetadataLookup)
+	r.POST("/restore-book-file", env.PostRestoreBookFile)
+	r.POST("/delete-book/:bookname", env.DeleteBook)
+	r.GET("/trash", env.GetTrash)
+	r.POST("/restore-book", env.PostRestoreBook)
+	r.POST("/purge-book", env.PostPurgeBook)
+	r.POST("/empty-trash", env.PostEmptyTrash)
+	r.GET("/load-epub-fragment/:bookname/:type", env.SendEPUBFragment)
+	r.GET("/load-epub-fragment-from-id/:bookname/:id", env.SendEPUBFragmentFromId)
+	r.GET("/get-epub-current-page", env.GetEPUBCurrentPage)
+	r.GET("/get-reading-progress", env.GetReadingProgress)
+	r.POST("/post-reading-progress", env.PostReadingProgress)
+	r.POST("/post-reading-session", env.PostReadingSession)
+	r.GET("/get-reading-status", env.GetReadingStatus)
+	r.POST("/post-reading-status", env.PostReadingStatus)
+	r.GET("/get-bookmarks", env.GetBookmarks)
+	r.POST("/post-bookmark", env.PostBookmark)
+	r.POST("/post-bookmark-name", env.PostBookmarkName)
+	r.POST("/delete-bookmark", env.DeleteBookmark)
+	r.GET("/shelf/:status", env.GetShelf)
+	r.GET("/statistics", env.GetStatistics)
+	r.GET("/get-reading-stats", env.GetReadingStats)
+	r.GET("/notebook", env.GetNotebook)
+	r.GET("/get-notebook", env.GetNotebookEntries)
+	r.GET("/export-highlights", env.GetExportHighlights)
+	r.POST("/post-export-template", env.PostExportTemplate)
+	r.POST("/import-highlights", env.PostImportHighlights)
+	r.GET("/cover/:covername", SendBookCover)
+	r.GET("/books/:pagination", env.GetPagination)
+	r.POST("/post-library-view", env.PostLibraryView)
+	r.POST("/bulk-books", env.PostBulkBooks)
+	r.GET("/bulk-jobs/:id", env.GetBulkJob)
+	r.GET("/bulk-jobs/:id/download", env.GetBulkJobDownload)
+	r.GET("/autocomplete", env.GetAutocomplete)
+	r.GET("/collections", env.GetCollections)
+	r.GET("/add-collection", env.GetAddCollection)
+	r.POST("/post-new-collection", env.PostNewCollection)
+	r.GET("/collection/:id", env.GetCollection)
+	r.GET("/delete-collection/:id", env.DeleteCollection)
+	r.GET("/edit-collection/:id", env.GetEditCollection)
+	r.POST("/post-collection-update", env.PostCollectionUpdate)
+	r.POST("/post-collection-books", env.PostCollectionBooks)
+	r.POST("/post-collection-books-remove", env.PostCollectionBooksRemove)
+	r.POST("/post-collection-reorder", env.PostCollectionReorder)
+	r.GET("/author/:id", env.GetAuthor)
+	r.POST("/post-author", env.PostAuthor)
+	r.POST("/merge-authors", env.PostMergeAuthors)
+	r.GET("/smart-collection/:id", env.GetSmartCollection)
+	r.GET("/add-smart-collection", env.GetEditSmartCollection)
+	r.GET("/edit-smart-collection/:id", env.GetEditSmartCollection)
+	r.POST("/post-smart-collection", env.PostSmartCollection)
+	r.GET("/delete-smart-collection/:id", env.DeleteSmartCollection)
+	r.GET("/get-shares", env.GetShares)
+	r.POST("/post-share", env.PostShare)
+	r.POST("/delete-share", env.DeleteShare)
+	r.GET("/get-collection-links", env.GetCollectionLinks)
+	r.POST("/post-collection-link", env.PostCollectionLink)
+	r.POST("/post-collection-link-update", env.PostCollectionLinkUpdate)
+	r.POST("/delete-collection-link", env.DeleteCollectionLink)
+	r.GET("/public/collection/:token", env.GetPublicCollection)
+	r.GET("/public/collection/:token/opds", env.GetPublicCollectionOPDS)
+	r.GET("/public/collection/:token/books/:bookid/cover", env.SendPublicCollectionCover)
+	r.GET("/public/collection/:token/books/:bookid/download", env.SendPublicCollectionBook)
+	r.POST("/post-pdf-highlight", env.PostPDFHighlight)
+	r.GET("/get-pdf-highlights", env.GetPDFHighlights)
+	r.POST("/post-pdf-highlight-color", env.PostPDFHighlightColor)
+	r.POST("/post-pdf-highlight-comment", env.PostPDFHighlightComment)
+	r.POST("/delete-pdf-highlight", env.DeletePDFHighlight)
+	r.POST("/post-epub-annotation", env.PostEPUBAnnotation)
+	r.GET("/get-epub-annotations", env.GetEPUBAnnotations)
+	r.POST("/post-epub-annotation-color", env.PostEPUBAnnotationColor)
+	r.POST("/post-epub-annotation-note", env.PostEPUBAnnotationNote)
+	r.POST("/delete-epub-annotation", env.DeleteEPUBAnnotation)
+	r.POST("/post-epub-legacy-highlights", env.PostEPUBLegacyHighlights)
+	r.GET("/get-shared-highlights", env.GetSharedHighlights)
+	r.GET("/get-highlight-comments", env.GetHighlightComments)
+	r.POST("/post-highlight-comment", env.PostHighlightComment)
+	r.POST("/post-highlight-comment-edit", env.PostHighlightCommentEdit)
+	r.GET("/get-highlight-comment-history", env.GetHighlightCommentHistory)
+	r.POST("/delete-highlight-comment", env.DeleteHighlightComment)
+
+	r.GET("/settings", env.GetSettings)
+	r.POST("/post-settings", env.PostSettings)
+	r.GET("/admin/reindex", env.GetReindexStatus)
+	r.POST("/admin/reindex", env.PostReindex)
+
+	// W3C Web Annotation Protocol
+	r.GET("/annotations/", env.GetWebAnnotationContainer)
+	r.HEAD("/annotations/", env.GetWebAnnotationContainer)
+	r.POST("/annotations/", env.PostWebAnnotation)
+	r.OPTIONS("/annotations/", OptionsWebAnnotation)
+	r.GET("/annotations/:bookname/", env.GetWebAnnotationContainer)
+	r.HEAD("/annotations/:bookname/", env.GetWebAnnotationContainer)
+	r.POST("/annotations/:bookname/", env.PostWebAnnotation)
+	r.OPTIONS("/annotations/:bookname/", OptionsWebAnnotation)
+	r.GET("/annotations/:bookname/:id", env.GetWebAnnotation)
+	r.HEAD("/annotations/:bookname/:id", env.GetWebAnnotation)
+	r.PUT("/annotations/:bookname/:id", env.PutWebAnnotation)
+	r.DELETE("/annotations/:bookname/:id", env.DeleteWebAnnotation)
+	r.OPTIONS("/annotations/:bookname/:id", OptionsWebAnnotation)
+
+	// KOReader sync server (kosync) API
+	r.POST("/users/create", env.KOSyncCreateUser)
+	r.GET("/users/auth", env.KOSyncAuthUser)
+	r.PUT("/syncs/progress", env.KOSyncUpdateProgress)
+	r.GET("/syncs/progress/:document", env.KOSyncGetProgress)
+
+	// Listen and serve
+	port, err := strconv.Atoi(ServerPort)
+	if err != nil {
+		fmt.Println("Invalid port specified")
+		os.Exit(1)
+	}
+	r.Run(fmt.Sprintf(":%d", port))
+}
+
+func _NewRedisClient() *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     RedisPath,
+		Password: RedisPassword, // no password set
+		DB:       0,             // use default DB
+	})
+}
+
+// Create the attachment ingest pipeline and the lr_index index in Elasticsearch
+func _InitElasticsearch() {
+	// Elasticsearch settings
+	type Attachment struct {
+		Field        string `json:"field"`
+		IndexedChars int64  `json:"indexed_chars"`
+	}
+
+	type Processors struct {
+		Attachment Attachment `json:"attachment"`
+	}
+
+	type AttachmentStruct struct {
+		Description string       `json:"description"`
+		Processors  []Processors `json:"processors"`
+	}
+
+	attachment := &AttachmentStruct{
+		Description: "Process documents",
+		Processors: []Processors{
+			Processors{
+				Attachment: Attachment{
+					Field:        "thedata",
+					IndexedChars: -1,
+				},
+			},
+		},
+	}
+
+	fmt.Println(attachment)
+
+	b, err := json.Marshal(attachment)
+	CheckError(err)
+	fmt.Println(b)
+
+	PutJSON(ESPath+"/_ingest/pipeline/attachment", b)
+
+	type Settings struct {
+		NumberOfShards   int64 `json:"number_of_shards"`
+		NumberOfReplicas int64 `json:"number_of_replicas"`
+	}
+
+	type IndexStruct struct {
+		Settings Settings `json:"settings"`
+	}
+
+	// Init Elasticsearch index
+	index := &IndexStruct{
+		Settings{
+			NumberOfShards:   4,
+			NumberOfReplicas: 0,
+		},
+	}
+
+	b, err = json.Marshal(index)
+	CheckError(err)
+	fmt.Println(b)
+
+	PutJSON(ESPath+"/lr_index", b)
+}
+
+func CheckError(err error) {
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Create the tables of the database, adding the columns of newer versions to
+// the tables of an older database. Run by the server and the command line
+// tools.
+func _CreateTables(db *sql.DB) {
 	// Create user table
 	// Table: user
 	// -------------------------------------------------
@@ -157,6 +461,15 @@ func StartServer() {
 	_, err = stmt.Exec()
 	CheckError(err)
 
+	// KOReader sync password, stored as bcrypt hash of its MD5 (the key sent by KOReader)
+	_EnsureColumn(db, "user", "kosync_key_hash", "VARCHAR(255) DEFAULT ''")
+
+	// Markdown template for highlight exports, empty for the default template
+	_EnsureColumn(db, "user", "export_template", "TEXT DEFAULT ''")
+
+	// Sorting, filters and page size of the library, as JSON
+	_EnsureColumn(db, "user", "library_view", "TEXT DEFAULT ''")
+
 	// Create confirm table
 	// Table: confirm
 	// -----------------------------------------------------------------------------------------------------------
@@ -186,6 +499,68 @@ func StartServer() {
 	_, err = stmt.Exec()
 	CheckError(err)
 
+	// Book details, read from the book at upload and editable in EditBook
+	_EnsureColumn(db, "book", "series", "VARCHAR(255) DEFAULT ''")
+	_EnsureColumn(db, "book", "series_index", "REAL DEFAULT 0")
+	_EnsureColumn(db, "book", "language", "VARCHAR(255) DEFAULT ''")
+	_EnsureColumn(db, "book", "publisher", "VARCHAR(255) DEFAULT ''")
+	_EnsureColumn(db, "book", "isbn", "VARCHAR(255) DEFAULT ''")
+	_EnsureColumn(db, "book", "description", "TEXT DEFAULT ''")
+	_EnsureColumn(db, "book", "published_on", "VARCHAR(255) DEFAULT ''")
+
+	// When the book was moved to the trash, empty for books in the library
+	_EnsureColumn(db, "book", "deleted_on", "VARCHAR(255) DEFAULT ''")
+
+	// Create author table. Authors belong to the user who uploaded their books.
+	// Table: author
+	// ----------------------------------------------
+	// Fields: id, user_id, name, sort_name, created_on
+	// ----------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `author` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `user_id` INTEGER NOT NULL, `name` VARCHAR(255) NOT NULL, `sort_name` VARCHAR(255) NOT NULL," +
+		" `created_on` VARCHAR(255) NOT NULL)")
+	CheckError(err)
+
+	_, err = stmt.Exec()
+	CheckError(err)
+
+	// Create book author table, role is author, editor or translator
+	// Table: book_author
+	// ---------------------------------------------
+	// Fields: id, book_id, author_id, role, position
+	// ---------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `book_author` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `book_id` INTEGER NOT NULL, `author_id` INTEGER NOT NULL, `role` VARCHAR(255) NOT NULL," +
+		" `position` INTEGER NOT NULL, UNIQUE (`book_id`, `author_id`, `role`))")
+	CheckError(err)
+
+	_, err = stmt.Exec()
+	CheckError(err)
+
+	// Create book version table, the original files of books whose metadata was written into the file
+	// Table: book_version
+	// ----------------------------------------
+	// Fields: id, book_id, file_path, created_on
+	// ----------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `book_version` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `book_id` INTEGER NOT NULL, `file_path` VARCHAR(255) NOT NULL, `created_on` VARCHAR(255) NOT NULL)")
+	CheckError(err)
+
+	_, err = stmt.Exec()
+	CheckError(err)
+
+	// Create book tag table
+	// Table: book_tag
+	// ------------------------
+	// Fields: id, book_id, tag
+	// ------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `book_tag` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `book_id` INTEGER NOT NULL, `tag` VARCHAR(255) NOT NULL)")
+	CheckError(err)
+
+	_, err = stmt.Exec()
+	CheckError(err)
+
 	// Create currently_reading table
 	// Table: currently_reading
 	// ---------------------------------------
@@ -198,7 +573,8 @@ func StartServer() {
 	_, err = stmt.Exec()
 	CheckError(err)
 
-	// Create collection table
+	// Create collection table. books is only read to migrate older
+	// collections, the books are in collection_book.
 	// Table: collection
 	// ----------------------------------------------
 	// Fields: id, title, description, books, user_id
@@ -211,19 +587,76 @@ func StartServer() {
 	_, err = stmt.Exec()
 	CheckError(err)
 
+	// Create collection book table
+	// Table: collection_book
+	// ----------------------------------------------------------
+	// Fields: id, collection_id, book_id, position, added_on
+	// ----------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `collection_book` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `collection_id` INTEGER NOT NULL, `book_id` INTEGER NOT NULL, `position` INTEGER NOT NULL," +
+		" `added_on` VARCHAR(255) NOT NULL, UNIQUE (`collection_id`, `book_id`))")
+	CheckError(err)
+
+	_, err = stmt.Exec()
+	CheckError(err)
+
+	// Create smart collection table, rules is a JSON array of rules
+	// Table: smart_collection
+	// ---------------------------------------------------------------------
+	// Fields: id, user_id, title, description, rule_match, rules, created_on
+	// ---------------------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `smart_collection` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `user_id` INTEGER NOT NULL, `title` VARCHAR(255) NOT NULL, `description` VARCHAR(1200) NOT NULL," +
+		" `rule_match` VARCHAR(255) NOT NULL, `rules` TEXT NOT NULL, `created_on` VARCHAR(255) NOT NULL)")
+	CheckError(err)
+
+	_, err = stmt.Exec()
+	CheckError(err)
+
+	// Create book share table. Either book_id or collection_id is set.
+	// Table: book_share
+	// ----------------------------------------------------------------------------------
+	// Fields: id, owner_id, user_id, book_id, collection_id, permission, created_on
+	// ----------------------------------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `book_share` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `owner_id` INTEGER NOT NULL, `user_id` INTEGER NOT NULL, `book_id` INTEGER DEFAULT 0," +
+		" `collection_id` INTEGER DEFAULT 0, `permission` VARCHAR(255) NOT NULL, `created_on` VARCHAR(255) NOT NULL)")
+	CheckError(err)
+
+	_, err = stmt.Exec()
+	CheckError(err)
+
+	// Create collection link table, public links to a collection
+	// Table: collection_link
+	// ---------------------------------------------------------------------------------------------
+	// Fields: id, collection_id, user_id, token, expires_on, allow_download, opds, created_on
+	// ---------------------------------------------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `collection_link` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `collection_id` INTEGER NOT NULL, `user_id` INTEGER NOT NULL, `token` VARCHAR(255) NOT NULL UNIQUE," +
+		" `expires_on` VARCHAR(255) DEFAULT '', `allow_download` INTEGER DEFAULT 0, `opds` INTEGER DEFAULT 0," +
+		" `created_on` VARCHAR(255) NOT NULL)")
+	CheckError(err)
+
+	_, err = stmt.Exec()
+	CheckError(err)
+
 	// Create PDF Highlighter table
 	// Table: pdf_highlighter
-	// ----------------------------------------------------------------
-	// Fields: id, book_id, user_id, highlight_color, highlight_comment
-	// ----------------------------------------------------------------
+	// --------------------------------------------------------------------------------------
+	// Fields: id, book_id, user_id, highlight_color, highlight_comment, created_on, updated_on
+	// --------------------------------------------------------------------------------------
 	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `pdf_highlighter` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
 		" `book_id` INTEGER NOT NULL, `user_id` INTEGER NOT NULL, `highlight_color` VARCHAR(255) NOT NULL," +
-		" `highlight_top` VARCHAR(255) NOT NULL, `highlight_comment` VARCHAR(255) NOT NULL)")
+		" `highlight_top` VARCHAR(255) NOT NULL, `highlight_comment` VARCHAR(255) NOT NULL," +
+		" `created_on` VARCHAR(255) DEFAULT '', `updated_on` VARCHAR(255) DEFAULT '')")
 	CheckError(err)
 
 	_, err = stmt.Exec()
 	CheckError(err)
 
+	_EnsureColumn(db, "pdf_highlighter", "created_on", "VARCHAR(255) DEFAULT ''")
+	_EnsureColumn(db, "pdf_highlighter", "updated_on", "VARCHAR(255) DEFAULT ''")
+
 	// Create PDF Highlighter HTML table
 	// Table: pdf_highlighter_detail
 	// ---------------------------------------------------------------
@@ -237,143 +670,188 @@ func StartServer() {
 	_, err = stmt.Exec()
 	CheckError(err)
 
-	// Bleve settings
-	// Check if bleve setting already exists. If not create a new setting.
-	blevePath := path.Join(DBPath, "lr_index.bleve")
-	if _, err := os.Stat(blevePath); os.IsNotExist(err) {
-		mapping := bleve.NewIndexMapping()
-		index, err := bleve.New(blevePath, mapping)
-		CheckError(err)
-		err = index.Close()
-		CheckError(err)
-	}
+	// Create PDF highlight anchor table
+	// Table: pdf_highlight_anchor
+	// ---------------------------------------------------------------------------
+	// Fields: id, highlighter_id, page, quote, start_offset, end_offset, rects
+	// ---------------------------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `pdf_highlight_anchor` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `highlighter_id` INTEGER NOT NULL, `page` INTEGER NOT NULL, `quote` TEXT NOT NULL," +
+		" `start_offset` INTEGER DEFAULT -1, `end_offset` INTEGER DEFAULT -1, `rects` TEXT DEFAULT '[]')")
+	CheckError(err)
 
-	// Init Elasticsearch attachment
-	if EnableES == "1" {
-		// Elasticsearch settings
-		type Attachment struct {
-			Field        string `json:"field"`
-			IndexedChars int64  `json:"indexed_chars"`
-		}
+	_, err = stmt.Exec()
+	CheckError(err)
 
-		type Processors struct {
-			Attachment Attachment `json:"attachment"`
-		}
+	// Create EPUB annotation table
+	// Table: epub_annotation
+	// ----------------------------------------------------------------------------------------------
+	// Fields: id, user_id, book_id, spine_href, cfi, quote, color, note, created_on, updated_on
+	// ----------------------------------------------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `epub_annotation` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `user_id` INTEGER NOT NULL, `book_id` INTEGER NOT NULL, `spine_href` VARCHAR(255) NOT NULL," +
+		" `cfi` VARCHAR(1200) NOT NULL, `quote` TEXT NOT NULL, `color` VARCHAR(255) NOT NULL," +
+		" `note` TEXT DEFAULT '', `created_on` VARCHAR(255) NOT NULL, `updated_on` VARCHAR(255) NOT NULL)")
+	CheckError(err)
 
-		type AttachmentStruct struct {
-			Description string       `json:"description"`
-			Processors  []Processors `json:"processors"`
-		}
+	_, err = stmt.Exec()
+	CheckError(err)
 
-		attachment := &AttachmentStruct{
-			Description: "Process documents",
-			Processors: []Processors{
-				Processors{
-					Attachment: Attachment{
-						Field:        "thedata",
-						IndexedChars: -1,
-					},
-				},
-			},
-		}
+	// Create highlight comment table. highlight_type is pdf or epub, parent_id
+	// is the comment replied to (0 for the start of a thread).
+	// Table: highlight_comment
+	// ------------------------------------------------------------------------------------------------------
+	// Fields: id, highlight_type, highlight_id, parent_id, user_id, body, deleted, created_on, updated_on
+	// ------------------------------------------------------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `highlight_comment` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `highlight_type` VARCHAR(255) NOT NULL, `highlight_id` INTEGER NOT NULL, `parent_id` INTEGER DEFAULT 0," +
+		" `user_id` INTEGER NOT NULL, `body` TEXT NOT NULL, `deleted` INTEGER DEFAULT 0," +
+		" `created_on` VARCHAR(255) NOT NULL, `updated_on` VARCHAR(255) NOT NULL)")
+	CheckError(err)
 
-		fmt.Println(attachment)
+	_, err = stmt.Exec()
+	CheckError(err)
 
-		b, err := json.Marshal(attachment)
-		CheckError(err)
-		fmt.Println(b)
+	// Create highlight comment revision table, the earlier bodies of edited comments
+	// Table: highlight_comment_revision
+	// ---------------------------------------------
+	// Fields: id, comment_id, body, created_on
+	// ---------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `highlight_comment_revision` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `comment_id` INTEGER NOT NULL, `body` TEXT NOT NULL, `created_on` VARCHAR(255) NOT NULL)")
+	CheckError(err)
 
-		PutJSON(ESPath+"/_ingest/pipeline/attachment", b)
+	_, err = stmt.Exec()
+	CheckError(err)
 
-		type Settings struct {
-			NumberOfShards   int64 `json:"number_of_shards"`
-			NumberOfReplicas int64 `json:"number_of_replicas"`
-		}
+	// Create reading progress table
+	// Table: reading_progress
+	// ---------------------------------------------------------------------------------------------------------
+	// Fields: id, user_id, book_id, page, scroll, spine_index, cfi, percentage, created_on, updated_on
+	// ---------------------------------------------------------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `reading_progress` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `user_id` INTEGER NOT NULL, `book_id` INTEGER NOT NULL, `page` INTEGER DEFAULT 0, `scroll` REAL DEFAULT 0," +
+		" `spine_index` INTEGER DEFAULT 0, `cfi` VARCHAR(1200) DEFAULT '', `percentage` REAL DEFAULT 0," +
+		" `created_on` VARCHAR(255) NOT NULL, `updated_on` VARCHAR(255) NOT NULL, UNIQUE (`user_id`, `book_id`))")
+	CheckError(err)
 
-		type IndexStruct struct {
-			Settings Settings `json:"settings"`
-		}
+	_, err = stmt.Exec()
+	CheckError(err)
 
-		// Init Elasticsearch index
-		index := &IndexStruct{
-			Settings{
-				NumberOfShards:   4,
-				NumberOfReplicas: 0,
-			},
-		}
+	// Create bookmark table
+	// Table: bookmark
+	// ------------------------------------------------------------------------------------
+	// Fields: id, user_id, book_id, name, page, spine_index, cfi, created_on, updated_on
+	// ------------------------------------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `bookmark` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `user_id` INTEGER NOT NULL, `book_id` INTEGER NOT NULL, `name` VARCHAR(255) NOT NULL," +
+		" `page` INTEGER DEFAULT 0, `spine_index` INTEGER DEFAULT 0, `cfi` VARCHAR(1200) DEFAULT ''," +
+		" `created_on` VARCHAR(255) NOT NULL, `updated_on` VARCHAR(255) NOT NULL)")
+	CheckError(err)
 
-		b, err = json.Marshal(index)
-		CheckError(err)
-		fmt.Println(b)
+	_, err = stmt.Exec()
+	CheckError(err)
 
-		PutJSON(ESPath+"/lr_index", b)
-	}
+	// Create reading session table
+	// Table: reading_session
+	// ---------------------------------------------------------------------------------------------------------------------
+	// Fields: id, user_id, book_id, started_on, ended_on, duration, start_page, end_page, start_percentage, end_percentage
+	// ---------------------------------------------------------------------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `reading_session` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `user_id` INTEGER NOT NULL, `book_id` INTEGER NOT NULL, `started_on` VARCHAR(255) NOT NULL," +
+		" `ended_on` VARCHAR(255) NOT NULL, `duration` INTEGER DEFAULT 0, `start_page` INTEGER DEFAULT 0," +
+		" `end_page` INTEGER DEFAULT 0, `start_percentage` REAL DEFAULT 0, `end_percentage` REAL DEFAULT 0)")
+	CheckError(err)
 
-	// Initiate redis
-	client := redis.NewClient(&redis.Options{
-		Addr:     RedisPath,
-		Password: RedisPassword, // no password set
-		DB:       0,             // use default DB
-	})
+	_, err = stmt.Exec()
+	CheckError(err)
 
-	// Create upload directory if not exist
-	uploadPath := "./uploads/img"
-	if _, err := os.Stat(uploadPath); os.IsNotExist(err) {
-		err = os.MkdirAll(uploadPath, 0755)
-	}
+	// Create reading status table
+	// Table: reading_status
+	// ---------------------------------------------------------------------------
+	// Fields: id, user_id, book_id, status, date_started, date_finished, updated_on
+	// ---------------------------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `reading_status` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `user_id` INTEGER NOT NULL, `book_id` INTEGER NOT NULL, `status` VARCHAR(255) NOT NULL," +
+		" `date_started` VARCHAR(255) DEFAULT '', `date_finished` VARCHAR(255) DEFAULT ''," +
+		" `updated_on` VARCHAR(255) NOT NULL, UNIQUE (`user_id`, `book_id`))")
+	CheckError(err)
 
-	// Set database and redis environment
-	env := &Env{db: db, RedisClient: client}
-	// Router
-	r.GET("/", env.GetHomePage)
-	r.GET("/signin", env.GetSignIn)
-	r.POST("/signin", env.PostSignIn)
-	r.GET("/forgot-password", GetForgotPassword)
-	r.POST("/forgot-password", env.PostForgotPassword)
-	r.GET("/reset-password", env.GetResetPassword)
-	r.POST("/reset-password", env.PostResetPassword)
-	r.GET("/signup", env.GetSignUp)
-	r.POST("/signup", env.PostSignUp)
-	r.GET("/confirm-email", env.ConfirmEmail)
-	r.GET("/new-token", env.SendNewToken)
-	r.GET("/signout", GetSignOut)
-	r.POST("/upload", env.UploadBook)
-	r.GET("/book/:bookname", env.SendBook)
-	r.GET("/get-book-metadata", env.GetBookMetaData)
-	r.POST("/edit-book/:bookname", env.EditBook)
-	r.GET("/delete-book/:bookname", env.DeleteBook)
-	r.GET("/load-epub-fragment/:bookname/:type", env.SendEPUBFragment)
-	r.GET("/load-epub-fragment-from-id/:bookname/:id", env.SendEPUBFragmentFromId)
-	r.GET("/get-epub-current-page", env.GetEPUBCurrentPage)
-	r.GET("/cover/:covername", SendBookCover)
-	r.GET("/books/:pagination", env.GetPagination)
-	r.GET("/autocomplete", env.GetAutocomplete)
-	r.GET("/collections", env.GetCollections)
-	r.GET("/add-collection", env.GetAddCollection)
-	r.POST("/post-new-collection", env.PostNewCollection)
-	r.GET("/collection/:id", env.GetCollection)
-	r.GET("/delete-collection/:id", env.DeleteCollection)
-	r.POST("/post-pdf-highlight", env.PostPDFHighlight)
-	r.GET("/get-pdf-highlights", env.GetPDFHighlights)
-	r.POST("/post-pdf-highlight-color", env.PostPDFHighlightColor)
-	r.POST("/post-pdf-highlight-comment", env.PostPDFHighlightComment)
-	r.POST("/delete-pdf-highlight", env.DeletePDFHighlight)
-	r.POST("/save-epub-highlight", env.SaveEPUBHighlight)
-	r.GET("/settings", env.GetSettings)
-	r.POST("/post-settings", env.PostSettings)
+	_, err = stmt.Exec()
+	CheckError(err)
 
-	// Listen and serve
-	port, err := strconv.Atoi(ServerPort)
-	if err != nil {
-		fmt.Println("Invalid port specified")
-		os.Exit(1)
-	}
-	r.Run(fmt.Sprintf(":%d", port))
+	_EnsureColumn(db, "reading_status", "date_started", "VARCHAR(255) DEFAULT ''")
+	_EnsureColumn(db, "reading_status", "date_finished", "VARCHAR(255) DEFAULT ''")
+
+	// Create KOReader document table
+	// Table: kosync_document
+	// -------------------------------------
+	// Fields: id, book_id, document, method
+	// -------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `kosync_document` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `book_id` INTEGER NOT NULL, `document` VARCHAR(255) NOT NULL, `method` VARCHAR(255) NOT NULL," +
+		" UNIQUE (`book_id`, `method`))")
+	CheckError(err)
+
+	_, err = stmt.Exec()
+	CheckError(err)
+
+	// Create KOReader progress table
+	// Table: kosync_progress
+	// -------------------------------------------------------------------------------------------
+	// Fields: id, user_id, book_id, document, progress, percentage, device, device_id, timestamp
+	// -------------------------------------------------------------------------------------------
+	stmt, err = db.Prepare("CREATE TABLE IF NOT EXISTS `kosync_progress` (`id` INTEGER PRIMARY KEY AUTOINCREMENT," +
+		" `user_id` INTEGER NOT NULL, `book_id` INTEGER DEFAULT 0, `document` VARCHAR(255) NOT NULL," +
+		" `progress` VARCHAR(1200) NOT NULL, `percentage` REAL DEFAULT 0, `device` VARCHAR(255) DEFAULT ''," +
+		" `device_id` VARCHAR(255) DEFAULT '', `timestamp` INTEGER NOT NULL, UNIQUE (`user_id`, `document`))")
+	CheckError(err)
+
+	_, err = stmt.Exec()
+	CheckError(err)
 }
 
-func CheckError(err error) {
-	if err != nil {
-		fmt.Println(err)
+// Convert the data saved by older versions to the current tables. Run by
+// the server and the command line tools after _CreateTables.
+func (e *Env) _MigrateData() {
+	// Convert PDF highlights saved by older versions
+	e._MigratePDFHighlights()
+
+	// Move the books of older collections to collection_book
+	e._MigrateCollectionBooks()
+
+	// Link the author names of older books to authors
+	e._MigrateBookAuthors()
+}
+
+// Add a column to an existing table, for databases created before the
+// column was introduced.
+func _EnsureColumn(db *sql.DB, table string, column string, definition string) {
+	rows, err := db.Query("PRAGMA table_info(`" + table + "`)")
+	CheckError(err)
+
+	found := false
+	for rows.Next() {
+		var (
+			cid        int64
+			name       string
+			columnType string
+			notNull    int64
+			dfltValue  sql.NullString
+			pk         int64
+		)
+		err := rows.Scan(&cid, &name, &columnType, &notNull, &dfltValue, &pk)
+		CheckError(err)
+
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+
+	if !found {
+		_, err := db.Exec("ALTER TABLE `" + table + "` ADD COLUMN `" + column + "` " + definition)
+		CheckError(err)
 	}
 }
 
@@ -424,6 +902,20 @@ func _GetEmailFromSession(c *gin.Context) interface{} {
 	return session.Get("email")
 }
 
+// Scheme and host the server is reached at, for absolute links. The domain
+// address takes precedence when it is configured.
+func _GetServerURL(c *gin.Context) string {
+	if DomainAddress != "" {
+		return strings.TrimSuffix(DomainAddress, "/")
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
 func (e *Env) _GetUserId(email string) int64 {
 	rows, err := e.db.Query("SELECT `id` FROM `user` WHERE `email` = ?", email)
 	CheckError(err)
@@ -475,8 +967,8 @@ func (e *Env) _GetBookMetaData(fileName string) (string, string, string, string)
 	return title, author, cover, format
 }
 
-func (e *Env) _CheckCurrentlyReading(bookId int64) int64 {
-	rows, err := e.db.Query("SELECT `id` FROM `currently_reading` WHERE `book_id` = ?", bookId)
+func (e *Env) _CheckCurrentlyReading(userId int64, bookId int64) int64 {
+	rows, err := e.db.Query("SELECT `id` FROM `currently_reading` WHERE `book_id` = ? AND `user_id` = ?", bookId, userId)
 	CheckError(err)
 
 	var currentlyReadingId int64
@@ -538,10 +1030,20 @@ func (e *Env) SendBook(c *gin.Context) {
 		// Get book id
 		bookId, format, packagePath := e._GetBookInfo(name)
 
+		// Own book or shared with the user
+		permission := e._GetBookPermission(userId, bookId)
+		if permission == "" {
+			c.String(404, "Book not found")
+			return
+		}
+
 		// Remove dot from ./uploads
 		filePathSplit := strings.Split(packagePath, "./uploads")
 		packagePath = "/uploads" + filePathSplit[1]
 
+		// Get reading position of the user in this book
+		progress, hasProgress := e._GetReadingProgress(userId, bookId)
+
 		var idRef, hrefPath string
 		var currentPage, totalPages int64
 		if format == "epub" {
@@ -551,17 +1053,23 @@ func (e *Env) SendBook(c *gin.Context) {
 			opfMetadata := OPFMetadataStruct{}
 			json.Unmarshal([]byte(val), &opfMetadata)
 
-			val, err = e.RedisClient.Get(name + "...current_page...").Result()
-			CheckError(err)
+			var idRefIndex int64
+			if hasProgress && progress.SpineIndex < int64(len(opfMetadata.Spine.ItemRef.IdRef)) {
+				idRefIndex = progress.SpineIndex
+				currentPage = idRefIndex + 1
+			} else {
+				val, err = e.RedisClient.Get(name + "...current_page...").Result()
+				CheckError(err)
 
-			currentPage, err = strconv.ParseInt(val, 10, 64)
-			CheckError(err)
+				currentPage, err = strconv.ParseInt(val, 10, 64)
+				CheckError(err)
 
-			val, err = e.RedisClient.Get(name + "...current_fragment...").Result()
-			CheckError(err)
+				val, err = e.RedisClient.Get(name + "...current_fragment...").Result()
+				CheckError(err)
 
-			idRefIndex, err := strconv.ParseInt(val, 10, 64)
-			CheckError(err)
+				idRefIndex, err = strconv.ParseInt(val, 10, 64)
+				CheckError(err)
+			}
 
 			idRef = opfMetadata.Spine.ItemRef.IdRef[idRefIndex]
 			id := opfMetadata.Manifest.Item.Id
@@ -580,7 +1088,7 @@ func (e *Env) SendBook(c *gin.Context) {
 		dateRead := _GetCurrentTime()
 
 		// Check if book already exists in currently_reading table
-		currentlyReadingId := e._CheckCurrentlyReading(bookId)
+		currentlyReadingId := e._CheckCurrentlyReading(userId, bookId)
 
 		// Update currently_reading table
 		e._UpdateCurrentlyReading(currentlyReadingId, bookId, userId, dateRead)
@@ -588,17 +1096,23 @@ func (e *Env) SendBook(c *gin.Context) {
 		if format == "pdf" {
 			// Return viewer.html for PDF viewer
 			c.HTML(200, "viewer.html", gin.H{
-				"fileName": name,
+				"fileName":       name,
+				"permission":     permission,
+				"progressPage":   progress.Page,
+				"progressScroll": progress.Scroll,
 			})
 		} else {
 			// Return epub file xhtml file path
 			c.HTML(200, "epub_viewer.html", gin.H{
-				"fileName":    name,
-				"idRef":       idRef,
-				"packagePath": packagePath,
-				"filePath":    hrefPath,
-				"currentPage": currentPage,
-				"totalPages":  totalPages,
+				"fileName":       name,
+				"permission":     permission,
+				"idRef":          idRef,
+				"packagePath":    packagePath,
+				"filePath":       hrefPath,
+				"currentPage":    currentPage,
+				"totalPages":     totalPages,
+				"progressScroll": progress.Scroll,
+				"progressCFI":    progress.CFI,
 			})
 		}
 	}
@@ -608,9 +1122,14 @@ func (e *Env) SendBook(c *gin.Context) {
 }
 
 type GetBookMetadataStruct struct {
-	Title  string `json:"title"`
-	Author string `json:"author"`
-	Cover  string `json:"cover"`
+	Title   string             `json:"title"`
+	Author  string             `json:"author"`
+	Cover   string             `json:"cover"`
+	Status  string             `json:"status"`
+	Authors []BookAuthorStruct `json:"authors"`
+	BookDetailsStruct
+	// The file was rewritten with edited metadata and the original kept
+	HasOriginal bool `json:"hasOriginal"`
 }
 
 func (e *Env) GetBookMetaData(c *gin.Context) {
@@ -631,6 +1150,18 @@ func (e *Env) GetBookMetaData(c *gin.Context) {
 		Cover:  cover,
 	}
 
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+		bookId, _, _ := e._GetBookInfo(name)
+		if e._GetBookPermission(userId, bookId) != "" {
+			bookMetadata.Status = e._GetReadingStatus(userId, bookId).Status
+			bookMetadata.BookDetailsStruct = e._GetBookDetails(bookId)
+			bookMetadata.Authors = e._GetBookAuthors(bookId)
+			bookMetadata.HasOriginal = e._GetOriginalVersion(bookId) != ""
+		}
+	}
+
 	c.JSON(200, bookMetadata)
 }
 
@@ -639,9 +1170,15 @@ type BookMetadataEditStruct struct {
 }
 
 type BMESDoc struct {
-	Title  string `json:"title"`
-	Author string `json:"author"`
-	Cover  string `json:"cover"`
+	Title       string   `json:"title"`
+	Author      string   `json:"author"`
+	Cover       string   `json:"cover"`
+	Tags        []string `json:"tags"`
+	Series      string   `json:"series"`
+	Language    string   `json:"language"`
+	Publisher   string   `json:"publisher"`
+	ISBN        string   `json:"isbn"`
+	Description string   `json:"description"`
 }
 
 func (e *Env) EditBook(c *gin.Context) {
@@ -668,10 +1205,27 @@ func (e *Env) EditBook(c *gin.Context) {
 		}
 		rows.Close()
 
+		permission := e._GetBookPermission(userId, bookId)
+		if permission == "" {
+			c.String(404, "Book not found")
+			return
+		}
+
+		status := c.PostForm("status")
+		if status == "" || _IsValidReadingStatus(status) {
+			e._SetReadingStatus(userId, bookId, status)
+		}
+
+		// The metadata of a shared book can only be changed by its owner
+		if permission != SharePermissionOwner {
+			c.String(200, "Reading status saved successfully")
+			return
+		}
+
 		if EnableES == "0" {
 
 			index, _ := bleve.Open(path.Join(DBPath, "lr_index.bleve"))
-			indexId := strconv.Itoa(int(userId)) + "*****" + strconv.Itoa(int(bookId)) + "*****" + oTitle + "*****" + oAuthor + "*****" + oCover + "*****" + oURL + "*****"
+			indexId := _GetBleveIndexId(userId, bookId, oTitle, oAuthor, oCover, oURL)
 			err = index.Delete(indexId)
 			CheckError(err)
 
@@ -682,7 +1236,22 @@ func (e *Env) EditBook(c *gin.Context) {
 		title := c.PostForm("title")
 		fmt.Println(title)
 
-		author := c.PostForm("author")
+		// Names are separated by "&" or ";". Forms without the editors and
+		// translators keep them.
+		authors := _AuthorsWithRole(_SplitAuthorNames(c.PostForm("author")), AuthorRoleAuthor)
+		if _, ok := c.GetPostForm("editors"); ok {
+			authors = append(authors, _AuthorsWithRole(_SplitAuthorNames(c.PostForm("editors")), AuthorRoleEditor)...)
+			authors = append(authors, _AuthorsWithRole(_SplitAuthorNames(c.PostForm("translators")), AuthorRoleTranslator)...)
+		} else {
+			for _, bookAuthor := range e._GetBookAuthors(bookId) {
+				if bookAuthor.Role != AuthorRoleAuthor {
+					authors = append(authors, bookAuthor)
+				}
+			}
+		}
+		e._LinkBookAuthors(userId, bookId, authors)
+
+		author := _AuthorString(authors)
 		fmt.Println(author)
 
 		stmt, err := e.db.Prepare("update book set title=?, author=? where filename=?")
@@ -691,6 +1260,21 @@ func (e *Env) EditBook(c *gin.Context) {
 		_, err = stmt.Exec(title, author, fileName)
 		CheckError(err)
 
+		// Forms without the details only change the title, author and cover
+		if _, ok := c.GetPostForm("tags"); ok {
+			seriesIndex, _ := strconv.ParseFloat(c.PostForm("seriesIndex"), 64)
+			e._SetBookDetails(bookId, BookDetailsStruct{
+				Tags:        _ParseTags(c.PostForm("tags")),
+				Series:      c.PostForm("series"),
+				SeriesIndex: seriesIndex,
+				Language:    c.PostForm("language"),
+				Publisher:   c.PostForm("publisher"),
+				ISBN:        c.PostForm("isbn"),
+				Description: c.PostForm("description"),
+				PublishedOn: c.PostForm("publishedOn"),
+			})
+		}
+
 		file, _ := c.FormFile("cover")
 		if file != nil {
 			fmt.Println(file.Filename)
@@ -703,29 +1287,42 @@ func (e *Env) EditBook(c *gin.Context) {
 
 			_, err = stmt.Exec(oCover, fileName)
 			CheckError(err)
+		} else if coverURL := c.PostForm("coverURL"); coverURL != "" {
+			// A cover proposed by the metadata lookup
+			cover, err := _SaveLookupCover(fileName, coverURL)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				oCover = cover
+
+				stmt, err := e.db.Prepare("update book set cover=? where filename=?")
+				CheckError(err)
+
+				_, err = stmt.Exec(oCover, fileName)
+				CheckError(err)
+			}
 		}
 
 		if EnableES == "0" {
-			message := struct {
-				Id     string
-				Title  string
-				Author string
-			}{
-				Id:     strconv.Itoa(int(userId)) + "*****" + strconv.Itoa(int(bookId)) + "*****" + title + "*****" + author + "*****" + oCover + "*****" + oURL + "*****",
-				Title:  title,
-				Author: author,
-			}
+			message := e._GetBleveBook(userId, bookId, title, author, oCover, oURL)
 
 			index, _ := bleve.Open(path.Join(DBPath, "lr_index.bleve"))
 			index.Index(message.Id, message)
 			err = index.Close()
 			CheckError(err)
 		} else {
+			details := e._GetBookDetails(bookId)
 			bms := BookMetadataEditStruct{
 				Doc: BMESDoc{
-					Title:  title,
-					Author: author,
-					Cover:  oCover,
+					Title:       title,
+					Author:      author,
+					Cover:       oCover,
+					Tags:        details.Tags,
+					Series:      details.Series,
+					Language:    details.Language,
+					Publisher:   details.Publisher,
+					ISBN:        details.ISBN,
+					Description: details.Description,
 				},
 			}
 
@@ -756,6 +1353,16 @@ func (e *Env) EditBook(c *gin.Context) {
 			}
 		}
 
+		if c.PostForm("writeToFile") == "1" {
+			_, format, _ := e._GetBookInfo(fileName)
+			err := e._WriteBookFile(bookId, fileName, format)
+			if err != nil {
+				fmt.Println(err)
+				c.String(200, "Book metadata saved, but it couldn't be written into the book file: "+err.Error())
+				return
+			}
+		}
+
 		c.String(200, "Book metadata saved successfully")
 	}
 }
@@ -767,12 +1374,159 @@ func DeleteHTTPRequest(url string) {
 	res, err := myClient.Do(req)
 	CheckError(err)
 
-	// Write response.
-	var bufferDelete bytes.Buffer
-	res.Write(&bufferDelete)
+	// Write response.
+	var bufferDelete bytes.Buffer
+	res.Write(&bufferDelete)
+
+	fmt.Println("--- DELETE RESPONSE ---")
+	fmt.Println(string(bufferDelete.Bytes()))
+}
+
+// Remove a book from the search index
+func (e *Env) _RemoveBookFromIndex(book ReindexBookStruct) {
+	if EnableES == "0" {
+		err := _RemoveBleveBook(book)
+		CheckError(err)
+	} else {
+		indexURL := ESPath + "/lr_index/book_info/" + strconv.Itoa(int(book.UserId)) + "_" + strconv.Itoa(int(book.Id))
+		fmt.Println(indexURL)
+
+		DeleteHTTPRequest(indexURL)
+
+		val, err := e.RedisClient.Get(book.FileName + "...total_pages...").Result()
+		CheckError(err)
+
+		totalPages, err := strconv.ParseInt(val, 10, 64)
+		CheckError(err)
+
+		for i := 0; i <= int(totalPages); i++ {
+			indexURL := ESPath + "/lr_index/book_detail/" + strconv.Itoa(int(book.UserId)) + "_" + strconv.Itoa(int(book.Id)) + "_" + strconv.Itoa(i)
+			fmt.Println(indexURL)
+
+			DeleteHTTPRequest(indexURL)
+		}
+	}
+}
+
+// Delete a book of the user for good: its files, Redis keys, search index
+// entries, highlights, the reading state of every user and its place in
+// collections. Returns false when the book couldn't be deleted, nothing else
+// is removed then.
+func (e *Env) _DeleteBook(userId int64, bookId int64) bool {
+	book, ok := e._GetReindexBook(bookId)
+	if !ok {
+		return false
+	}
+
+	stmt, err := e.db.Prepare("delete from book where id=?")
+	CheckError(err)
+	if err != nil {
+		return false
+	}
+
+	res, err := stmt.Exec(bookId)
+	CheckError(err)
+	if err != nil {
+		return false
+	}
+
+	count, err := res.RowsAffected()
+	CheckError(err)
+	if count == 0 {
+		return false
+	}
+
+	stmt, err = e.db.Prepare("delete from book_tag where book_id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	stmt, err = e.db.Prepare("delete from book_author where book_id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	e._DeleteBookVersions(bookId)
+
+	e._DeleteOrphanAuthors(userId)
+
+	stmt, err = e.db.Prepare("delete from kosync_document where book_id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	e._DeleteShares("book_id", bookId)
+
+	stmt, err = e.db.Prepare("delete from collection_book where book_id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	stmt, err = e.db.Prepare("delete from bookmark where book_id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	e._DeleteBookHighlightComments(bookId)
+
+	stmt, err = e.db.Prepare("delete from pdf_highlighter_detail where highlighter_id in (select id from pdf_highlighter where book_id=?)")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	stmt, err = e.db.Prepare("delete from pdf_highlight_anchor where highlighter_id in (select id from pdf_highlighter where book_id=?)")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	stmt, err = e.db.Prepare("delete from pdf_highlighter where book_id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	stmt, err = e.db.Prepare("delete from epub_annotation where book_id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	stmt, err = e.db.Prepare("delete from currently_reading where book_id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	for _, table := range []string{"reading_progress", "reading_session", "reading_status", "kosync_progress"} {
+		stmt, err = e.db.Prepare("delete from " + table + " where book_id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(bookId)
+		CheckError(err)
+	}
+
+	// Collections showing the cover of the book
+	stmt, err = e.db.Prepare("update collection set cover='' where cover=? and cover not in (select cover from book)")
+	CheckError(err)
+
+	_, err = stmt.Exec(book.Cover)
+	CheckError(err)
+
+	e._RemoveBookFromIndex(book)
 
-	fmt.Println("--- DELETE RESPONSE ---")
-	fmt.Println(string(bufferDelete.Bytes()))
+	err = e.RedisClient.Del(book.FileName, book.FileName+"...total_pages...", book.FileName+"...current_page...",
+		book.FileName+"...current_fragment...", book.FileName+"...filepath...").Err()
+	CheckError(err)
+
+	e._RemoveBookFiles(book)
+	return true
 }
 
 func (e *Env) DeleteBook(c *gin.Context) {
@@ -786,64 +1540,20 @@ func (e *Env) DeleteBook(c *gin.Context) {
 			fileName := c.Param("bookname")
 			fmt.Println(fileName)
 
-			var bookId int64
-			var title, author, cover, url string
-			rows, err := e.db.Query("select id, title, author, cover, url from book where filename=?", fileName)
-			CheckError(err)
-
-			for rows.Next() {
-				err = rows.Scan(&bookId, &title, &author, &cover, &url)
-				CheckError(err)
-			}
-			rows.Close()
-
-			stmt, err := e.db.Prepare("delete from book where filename=?")
-			CheckError(err)
-
-			_, err = stmt.Exec(fileName)
-			CheckError(err)
-
-			currentlyReadingId := e._CheckCurrentlyReading(bookId)
-
-			if currentlyReadingId != 0 {
-				stmt, err := e.db.Prepare("delete from currently_reading where book_id=?")
-				CheckError(err)
+			bookId, _, _ := e._GetBookInfo(fileName)
 
-				_, err = stmt.Exec(currentlyReadingId)
-				CheckError(err)
+			// Readers of a shared book can't delete it
+			if bookId == 0 || e._GetBookOwner(bookId) != userId || e._IsBookTrashed(bookId) {
+				c.String(404, "Book not found")
+				return
 			}
 
-			if EnableES == "0" {
-				index, _ := bleve.Open(path.Join(DBPath, "lr_index.bleve"))
-				indexId := strconv.Itoa(int(userId)) + "*****" + strconv.Itoa(int(bookId)) + "*****" + title + "*****" + author + "*****" + cover + "*****" + url + "*****"
-				err = index.Delete(indexId)
-				CheckError(err)
-
-				err = index.Close()
-				CheckError(err)
-			} else {
-				indexURL := ESPath + "/lr_index/book_info/" + strconv.Itoa(int(userId)) + "_" + strconv.Itoa(int(bookId))
-				fmt.Println(indexURL)
-
-				DeleteHTTPRequest(indexURL)
-
-				val, err := e.RedisClient.Get(fileName + "...total_pages...").Result()
-				CheckError(err)
-
-				totalPages, err := strconv.ParseInt(val, 10, 64)
-				CheckError(err)
-
-				for i := 0; i <= int(totalPages); i++ {
-					indexURL := ESPath + "/lr_index/book_detail/" + strconv.Itoa(int(userId)) + "_" + strconv.Itoa(int(bookId)) + "_" + strconv.Itoa(i)
-					fmt.Println(indexURL)
-
-					DeleteHTTPRequest(indexURL)
-				}
-			}
+			e._TrashBook(bookId)
 
-			c.Redirect(302, "/")
+			c.String(200, "Book moved to the trash")
+		} else {
+			c.String(200, "Not signed in")
 		}
-		c.Redirect(302, "/signin")
 	}
 }
 
@@ -1089,15 +1799,22 @@ type QuoteStruct struct {
 // Book Struct
 
 type BookStruct struct {
-	Title string
-	URL   string
-	Cover string
+	Title    string
+	FileName string
+	URL      string
+	Cover    string
+	Authors  []AuthorLinkStruct
+	// Keyset pagination cursor of the book in the library list
+	Cursor string
 }
 
 type BookStructList []BookStruct
 
 func (e *Env) _GetCurrentlyReadingBooks(userId int64) []int64 {
-	rows, err := e.db.Query("SELECT `book_id` FROM `currently_reading` WHERE `user_id` = ? ORDER BY `date_read` DESC LIMIT ?, ?", userId, 0, 12)
+	condition, args := e._GetLibraryCondition(userId)
+	args = append(append([]interface{}{userId}, args...), 0, 12)
+	rows, err := e.db.Query("SELECT `book_id` FROM `currently_reading` WHERE `user_id` = ?"+
+		" AND `book_id` IN (SELECT `id` FROM `book` WHERE "+condition+") ORDER BY `date_read` DESC LIMIT ?, ?", args...)
 	CheckError(err)
 
 	var crBooks []int64
@@ -1136,8 +1853,10 @@ func (e *Env) _GetBook(bookId int64) (string, string, string) {
 	return title, url, cover
 }
 
-func (e *Env) _GetTotalBooksCount(userId int64) int64 {
-	rows, err := e.db.Query("SELECT COUNT(*) AS count FROM `book` WHERE `user_id` = ?", userId)
+func (e *Env) _GetTotalBooksCount(userId int64, view LibraryViewStruct) int64 {
+	condition, args := e._GetLibraryCondition(userId)
+	filter, filterArgs := _LibraryFilterCondition(userId, view)
+	rows, err := e.db.Query("SELECT COUNT(*) AS count FROM `book` WHERE "+condition+filter, append(args, filterArgs...)...)
 	CheckError(err)
 
 	var count int64
@@ -1150,47 +1869,106 @@ func (e *Env) _GetTotalBooksCount(userId int64) int64 {
 	return count
 }
 
-func _GetTotalPages(booksCount int64) int64 {
-	totalPagesFloat := float64(float64(booksCount) / 18.0)
-	totalPagesDecimal := fmt.Sprintf("%.1f", totalPagesFloat)
-
-	var totalPages int64
-	if strings.Split(totalPagesDecimal, ".")[1] == "0" {
-		totalPages = int64(totalPagesFloat)
-	} else {
-		totalPages = int64(totalPagesFloat) + 1
+func _GetTotalPages(booksCount int64, pageSize int64) int64 {
+	totalPages := booksCount / pageSize
+	if booksCount%pageSize != 0 {
+		totalPages += 1
 	}
 
 	return totalPages
 }
 
-func (e *Env) _GetPaginatedBooks(userId int64, limit int64, offset int64) *BookStructList {
-	rows, err := e.db.Query("SELECT `title`, `url`, `cover` FROM `book` WHERE `user_id` = ? ORDER BY `id` DESC LIMIT ? OFFSET ?", userId, limit, offset)
+func (e *Env) _GetPaginatedBooks(userId int64, view LibraryViewStruct, page LibraryPageStruct) *BookStructList {
+	sortExpression, sortArgs := _LibrarySortExpression(userId, view.Sort)
+	condition, args := e._GetLibraryCondition(userId)
+	filter, filterArgs := _LibraryFilterCondition(userId, view)
+	args = append(append(sortArgs, args...), filterArgs...)
+
+	order := "ASC"
+	if view.Order == "desc" {
+		order = "DESC"
+	}
+
+	// Keyset pagination: continue from the book the cursor points at. Going
+	// back reverses the order and the books are flipped afterwards.
+	keyset := ""
+	reverse := false
+	cursorValue := page.After
+	if page.Before != "" {
+		cursorValue = page.Before
+		reverse = true
+	}
+	if cursorValue != "" {
+		cursor, err := _DecodeLibraryCursor(cursorValue)
+		if err == nil {
+			comparison := ">"
+			if (order == "DESC") != reverse {
+				comparison = "<"
+			}
+			keyset = " WHERE (`sort_key` " + comparison + " ? OR (`sort_key` = ? AND `id` " + comparison + " ?))"
+			args = append(args, cursor.Key, cursor.Key, cursor.Id)
+			page.Offset = 0
+		} else {
+			reverse = false
+		}
+	}
+	if reverse {
+		if order == "DESC" {
+			order = "ASC"
+		} else {
+			order = "DESC"
+		}
+	}
+
+	rows, err := e.db.Query("SELECT `id`, `title`, `filename`, `url`, `cover`, `sort_key` FROM"+
+		" (SELECT `id`, `title`, `filename`, `url`, `cover`, "+sortExpression+" AS `sort_key` FROM `book` WHERE "+condition+filter+")"+
+		keyset+" ORDER BY `sort_key` "+order+", `id` "+order+" LIMIT ? OFFSET ?", append(args, view.PageSize, page.Offset)...)
 	CheckError(err)
 
 	books := BookStructList{}
+	var bookIds []int64
 
 	var (
-		title string
-		url   string
-		cover string
+		bookId   int64
+		title    string
+		fileName string
+		url      string
+		cover    string
+		sortKey  interface{}
 	)
 	for rows.Next() {
 		err = rows.Scan(
+			&bookId,
 			&title,
+			&fileName,
 			&url,
 			&cover,
+			&sortKey,
 		)
 		CheckError(err)
 
 		books = append(books, BookStruct{
-			title,
-			url,
-			cover,
+			Title:    title,
+			FileName: fileName,
+			URL:      url,
+			Cover:    cover,
+			Cursor:   _EncodeLibraryCursor(sortKey, bookId),
 		})
+		bookIds = append(bookIds, bookId)
 	}
 	rows.Close()
 
+	if reverse {
+		for i, j := 0, len(books)-1; i < j; i, j = i+1, j-1 {
+			books[i], books[j] = books[j], books[i]
+			bookIds[i], bookIds[j] = bookIds[j], bookIds[i]
+		}
+	}
+
+	for i, bookId := range bookIds {
+		books[i].Authors = e._GetBookAuthorLinks(bookId)
+	}
+
 	return &books
 }
 
@@ -1208,15 +1986,15 @@ func _ConstructBooksWithCount(books *BookStructList, length int64) []BookStructL
 	return booksList
 }
 
-func (e *Env) _ConstructBooksForPagination(userId int64, limit int64, offset int64) (int64, *BookStructList, []BookStructList, []BookStructList, []BookStructList) {
-	// Check total number of rows in book table
-	booksCount := e._GetTotalBooksCount(userId)
+func (e *Env) _ConstructBooksForPagination(userId int64, view LibraryViewStruct, page LibraryPageStruct) (int64, *BookStructList, []BookStructList, []BookStructList, []BookStructList) {
+	// Check total number of books matching the filters
+	booksCount := e._GetTotalBooksCount(userId, view)
 
 	// With Total Books count, Get Total pages required
-	totalPages := _GetTotalPages(booksCount)
+	totalPages := _GetTotalPages(booksCount, view.PageSize)
 
-	// Get 18 books
-	books := e._GetPaginatedBooks(userId, limit, offset)
+	// Get a page of books
+	books := e._GetPaginatedBooks(userId, view, page)
 
 	// Construct books of length 6 for large screen size
 	booksList := _ConstructBooksWithCount(books, 6)
@@ -1257,13 +2035,19 @@ func (e *Env) GetHomePage(c *gin.Context) {
 		for _, bookId := range crBooks {
 			title, url, cover := e._GetBook(bookId)
 			currentlyReadingBooks = append(currentlyReadingBooks, BookStruct{
-				title,
-				url,
-				cover,
+				Title: title,
+				URL:   url,
+				Cover: cover,
 			})
 		}
 
-		totalPages, books, booksList, booksListMedium, booksListSmall := e._ConstructBooksForPagination(userId, 18, 0)
+		view := e._GetLibraryView(userId)
+		totalPages, books, booksList, booksListMedium, booksListSmall := e._ConstructBooksForPagination(userId, view, LibraryPageStruct{})
+
+		var nextCursor string
+		if len(*books) > 0 {
+			nextCursor = (*books)[len(*books)-1].Cursor
+		}
 
 		c.HTML(302, "index.html", gin.H{
 			"q": q,
@@ -1273,6 +2057,11 @@ func (e *Env) GetHomePage(c *gin.Context) {
 			"booksListSmall":        booksListSmall,
 			"booksListXtraSmall":    *books,
 			"totalPages":            totalPages,
+			"nextCursor":            nextCursor,
+			"libraryView":           view,
+			"libraryTags":           e._GetLibraryTags(userId),
+			"libraryCollections":    e._GetLibraryCollections(userId),
+			"libraryPageSizes":      libraryPageSizes,
 		})
 	}
 	c.Redirect(302, "/signin")
@@ -1286,9 +2075,16 @@ func (e *Env) GetPagination(c *gin.Context) {
 
 		userId := e._GetUserId(email.(string))
 
-		offset := (int64(pagination) - 1) * 18
+		view := e._GetLibraryView(userId)
+		page := _GetLibraryPage(c, view, int64(pagination))
+
+		totalPages, books, booksList, booksListMedium, booksListSmall := e._ConstructBooksForPagination(userId, view, page)
 
-		totalPages, books, booksList, booksListMedium, booksListSmall := e._ConstructBooksForPagination(userId, 18, offset)
+		var prevCursor, nextCursor string
+		if len(*books) > 0 {
+			prevCursor = (*books)[0].Cursor
+			nextCursor = (*books)[len(*books)-1].Cursor
+		}
 
 		c.HTML(302, "pagination.html", gin.H{
 			"pagination":         pagination,
@@ -1297,6 +2093,12 @@ func (e *Env) GetPagination(c *gin.Context) {
 			"booksListSmall":     booksListSmall,
 			"booksListXtraSmall": books,
 			"totalPages":         totalPages,
+			"prevCursor":         prevCursor,
+			"nextCursor":         nextCursor,
+			"libraryView":        view,
+			"libraryTags":        e._GetLibraryTags(userId),
+			"libraryCollections": e._GetLibraryCollections(userId),
+			"libraryPageSizes":   libraryPageSizes,
 		})
 	}
 	c.Redirect(302, "/signin")
@@ -1783,11 +2585,35 @@ func (e *Env) _InsertBookRecord(
 	return id
 }
 
+// Document stored in the bleve index. The id carries the book info
+// which is split back in GetAutocomplete.
+type BleveBookStruct struct {
+	Id          string
+	Title       string
+	Author      string
+	Tags        string
+	Series      string
+	Language    string
+	Publisher   string
+	ISBN        string
+	Description string
+}
+
+func _GetBleveIndexId(userId int64, bookId int64, title string, author string, cover string, url string) string {
+	return strconv.Itoa(int(userId)) + "*****" + strconv.Itoa(int(bookId)) + "*****" + title + "*****" + author + "*****" + cover + "*****" + url + "*****"
+}
+
 type BookInfoStruct struct {
-	Title  string `json:"title"`
-	Author string `json:"author"`
-	URL    string `json:"url"`
-	Cover  string `json:"cover"`
+	Title       string   `json:"title"`
+	Author      string   `json:"author"`
+	URL         string   `json:"url"`
+	Cover       string   `json:"cover"`
+	Tags        []string `json:"tags,omitempty"`
+	Series      string   `json:"series,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	Publisher   string   `json:"publisher,omitempty"`
+	ISBN        string   `json:"isbn,omitempty"`
+	Description string   `json:"description,omitempty"`
 }
 
 func _PDFSeparate(path string, filePath string, wg *sync.WaitGroup) error {
@@ -1937,8 +2763,38 @@ type OPFMetadataStruct struct {
 }
 
 type OPFMetadata struct {
-	Title  string `xml:"title"`
-	Author string `xml:"creator"`
+	Title       string          `xml:"title"`
+	Creators    []OPFCreator    `xml:"creator"`
+	Language    string          `xml:"language"`
+	Publisher   string          `xml:"publisher"`
+	Description string          `xml:"description"`
+	Date        string          `xml:"date"`
+	Subjects    []string        `xml:"subject"`
+	Identifiers []OPFIdentifier `xml:"identifier"`
+	Meta        []OPFMeta       `xml:"meta"`
+}
+
+type OPFCreator struct {
+	Id     string `xml:"id,attr"`
+	Role   string `xml:"role,attr"`
+	FileAs string `xml:"file-as,attr"`
+	Name   string `xml:",chardata"`
+}
+
+type OPFIdentifier struct {
+	Scheme string `xml:"scheme,attr"`
+	Value  string `xml:",chardata"`
+}
+
+// <meta name="calibre:series" content="..."/> in EPUB 2,
+// <meta property="belongs-to-collection" id="...">...</meta> in EPUB 3
+type OPFMeta struct {
+	Name     string `xml:"name,attr"`
+	Content  string `xml:"content,attr"`
+	Property string `xml:"property,attr"`
+	Refines  string `xml:"refines,attr"`
+	Id       string `xml:"id,attr"`
+	Value    string `xml:",chardata"`
 }
 
 type OPFSpine struct {
@@ -2096,205 +2952,206 @@ func (e *Env) UploadBook(c *gin.Context) {
 				// Construct filename for the book uploaded
 				fileName := _ConstructFileNameForBook(params["filename"], contentType)
 
-				bookId, _, _ := e._GetBookInfo(fileName)
+				_, message := e._ImportBook(userId, fileName, contentType, mimePart)
+				c.String(200, message)
+			}
+		}
+	}
+}
 
-				if bookId != 0 {
-					c.String(200, fileName+" already exists. ")
-					continue
-				}
+// Add a PDF or EPUB book to the library of a user, as uploaded or found in
+// the watched import folder. The returned book id is 0 when the book was
+// not added, the message says why.
+func (e *Env) _ImportBook(userId int64, fileName string, contentType string, src io.Reader) (int64, string) {
+	if contentType != "application/pdf" && contentType != "application/epub+zip" {
+		return 0, fileName + " is not a PDF or EPUB book. "
+	}
 
-				uploadedOn := _GetCurrentTime()
+	bookId, _, _ := e._GetBookInfo(fileName)
 
-				filePath := "./uploads/" + fileName
+	if bookId != 0 {
+		if e._IsBookTrashed(bookId) {
+			return 0, fileName + " is in the trash, restore it from there. "
+		}
+		return 0, fileName + " already exists. "
+	}
 
-				out, err := os.Create(filePath)
-				CheckError(err)
+	uploadedOn := _GetCurrentTime()
 
-				_, err = io.Copy(out, mimePart)
-				CheckError(err)
+	filePath := "./uploads/" + fileName
 
-				out.Close()
+	out, err := os.Create(filePath)
+	CheckError(err)
 
-				if contentType == "application/pdf" {
+	_, err = io.Copy(out, src)
+	CheckError(err)
 
-					title, author, pages := _GetPDFInfo(filePath)
+	out.Close()
 
-					if title == "" {
-						title = fileName
-					}
+	if contentType == "application/pdf" {
 
-					if author == "" {
-						author = "unknown"
-					}
+		title, author, pages := _GetPDFInfo(filePath)
 
-					fmt.Println("Book title: " + title)
-					fmt.Println("Book author: " + author)
-					fmt.Println("Total pages: " + pages)
+		if title == "" {
+			title = fileName
+		}
 
-					pagesInt, err := strconv.ParseInt(pages, 10, 64)
-					CheckError(err)
+		if author == "" {
+			author = "unknown"
+		}
 
-					err = e.RedisClient.Set(fileName+"...total_pages...", pagesInt, 0).Err()
-					CheckError(err)
+		fmt.Println("Book title: " + title)
+		fmt.Println("Book author: " + author)
+		fmt.Println("Total pages: " + pages)
 
-					url := "/book/" + fileName
-					fmt.Println("Book URL: " + url)
+		pagesInt, err := strconv.ParseInt(pages, 10, 64)
+		CheckError(err)
 
-					coverPath := "./uploads/img/" + fileName
+		err = e.RedisClient.Set(fileName+"...total_pages...", pagesInt, 0).Err()
+		CheckError(err)
 
-					cover := _GeneratePDFCover(fileName, filePath, coverPath)
+		url := "/book/" + fileName
+		fmt.Println("Book URL: " + url)
 
-					fmt.Println("Book cover: " + cover)
+		coverPath := "./uploads/img/" + fileName
 
-					// Insert new book in `book` table
-					bookId := e._InsertBookRecord(title, fileName, filePath, author, url, cover, pagesInt, "pdf", uploadedOn, userId)
-					fmt.Println(bookId)
+		cover := _GeneratePDFCover(fileName, filePath, coverPath)
 
-					if EnableES == "0" {
-						index, err := bleve.Open(path.Join(DBPath, "lr_index.bleve"))
-						CheckError(err)
+		fmt.Println("Book cover: " + cover)
 
-						message := struct {
-							Id     string
-							Title  string
-							Author string
-						}{
-							Id:     strconv.Itoa(int(userId)) + "*****" + strconv.Itoa(int(bookId)) + "*****" + title + "*****" + author + "*****" + cover + "*****" + url + "*****",
-							Title:  title,
-							Author: author,
-						}
+		// Insert new book in `book` table
+		bookId = e._InsertBookRecord(title, fileName, filePath, author, url, cover, pagesInt, "pdf", uploadedOn, userId)
+		fmt.Println(bookId)
 
-						index.Index(message.Id, message)
-						err = index.Close()
-						CheckError(err)
-					} else {
-						// Feed book info to ES
-						bookInfo := BookInfoStruct{
-							Title:  title,
-							Author: author,
-							URL:    url,
-							Cover:  cover,
-						}
+		e._SetBookDetails(bookId, _GetPDFDetails(filePath))
+		e._LinkBookAuthors(userId, bookId, _AuthorsWithRole(_SplitAuthorNames(author), AuthorRoleAuthor))
+
+		e._UpdateKOSyncDocuments(bookId, fileName)
 
-						fmt.Println(bookInfo)
+		if EnableES == "0" {
+			index, err := bleve.Open(path.Join(DBPath, "lr_index.bleve"))
+			CheckError(err)
 
-						indexURL := ESPath + "/lr_index/book_info/" + strconv.Itoa(int(userId)) + "_" + strconv.Itoa(int(bookId))
-						fmt.Println(indexURL)
+			message := e._GetBleveBook(userId, bookId, title, author, cover, url)
 
-						b, err := json.Marshal(bookInfo)
-						CheckError(err)
+			index.Index(message.Id, message)
+			err = index.Close()
+			CheckError(err)
+		} else {
+			// Feed book info to ES
+			bookInfo := e._GetESBookInfo(bookId, title, author, url, cover)
 
-						PutJSON(indexURL, b)
+			fmt.Println(bookInfo)
 
-						// Feed book content to ES
-						go FeedPDFContent(filePath, userId, bookId, title, author, url, cover, pagesInt)
-					}
+			indexURL := ESPath + "/lr_index/book_info/" + strconv.Itoa(int(userId)) + "_" + strconv.Itoa(int(bookId))
+			fmt.Println(indexURL)
 
-					c.String(200, fileName+" uploaded successfully. ")
+			b, err := json.Marshal(bookInfo)
+			CheckError(err)
 
-				} else if contentType == "application/epub+zip" {
-					// Unzip epub in the /uploads directory
-					epubUnzipPath := _EPUBUnzip(filePath, fileName)
-					containerXMLPath := epubUnzipPath + "/META-INF/container.xml"
+			PutJSON(indexURL, b)
 
-					// Fetch rootfile and OPF file path
-					rootFilePath, opfFilePath := _FetchOPFFilePath(epubUnzipPath, containerXMLPath)
+			// Feed book content to ES
+			go FeedPDFContent(filePath, userId, bookId, title, author, url, cover, pagesInt)
+		}
 
-					packagePath := epubUnzipPath
-					rootFilePathSplit := strings.Split(rootFilePath, "/")
-					if len(rootFilePathSplit) > 1 {
-						packagePath = epubUnzipPath + "/" + rootFilePathSplit[0]
-					}
+		return bookId, fileName + " uploaded successfully. "
 
-					// Convert opf file to xml
-					opfXMLPath := _ConvertOpfToXml(opfFilePath)
+	} else if contentType == "application/epub+zip" {
+		// Unzip epub in the /uploads directory
+		epubUnzipPath := _EPUBUnzip(filePath, fileName)
+		containerXMLPath := epubUnzipPath + "/META-INF/container.xml"
 
-					opfMetadata := OPFMetadataStruct{}
-					opfMetadata._FetchEPUBMetadata(opfXMLPath)
+		// Fetch rootfile and OPF file path
+		rootFilePath, opfFilePath := _FetchOPFFilePath(epubUnzipPath, containerXMLPath)
 
-					title := opfMetadata.Metadata.Title
-					author := opfMetadata.Metadata.Author
-					cover := opfMetadata._FetchEPUBCover(packagePath, opfFilePath)
+		packagePath := epubUnzipPath
+		rootFilePathSplit := strings.Split(rootFilePath, "/")
+		if len(rootFilePathSplit) > 1 {
+			packagePath = epubUnzipPath + "/" + rootFilePathSplit[0]
+		}
 
-					fmt.Println("Book title: " + title)
-					fmt.Println("Book author: " + author)
+		// Convert opf file to xml
+		opfXMLPath := _ConvertOpfToXml(opfFilePath)
 
-					// Store opfMetadata in Redis
-					opfJSON, err := json.Marshal(opfMetadata)
-					CheckError(err)
+		opfMetadata := OPFMetadataStruct{}
+		opfMetadata._FetchEPUBMetadata(opfXMLPath)
 
-					err = e.RedisClient.Set(fileName, string(opfJSON), 0).Err()
-					CheckError(err)
+		title := opfMetadata.Metadata.Title
+		authors := _EPUBAuthors(opfMetadata)
+		author := _AuthorString(authors)
+		cover := opfMetadata._FetchEPUBCover(packagePath, opfFilePath)
 
-					totalPages := len(opfMetadata.Spine.ItemRef.IdRef)
-					err = e.RedisClient.Set(fileName+"...total_pages...", totalPages, 0).Err()
-					CheckError(err)
+		fmt.Println("Book title: " + title)
+		fmt.Println("Book author: " + author)
 
-					err = e.RedisClient.Set(fileName+"...current_page...", 1, 0).Err()
-					CheckError(err)
+		// Store opfMetadata in Redis
+		opfJSON, err := json.Marshal(opfMetadata)
+		CheckError(err)
 
-					err = e.RedisClient.Set(fileName+"...current_fragment...", 0, 0).Err()
-					CheckError(err)
+		err = e.RedisClient.Set(fileName, string(opfJSON), 0).Err()
+		CheckError(err)
 
-					// Remove dot from ./uploads
-					packagePathSplit := strings.Split(packagePath, "./uploads")
-					redisPackagePath := "/uploads" + packagePathSplit[1]
+		totalPages := len(opfMetadata.Spine.ItemRef.IdRef)
+		err = e.RedisClient.Set(fileName+"...total_pages...", totalPages, 0).Err()
+		CheckError(err)
 
-					err = e.RedisClient.Set(fileName+"...filepath...", redisPackagePath, 0).Err()
-					CheckError(err)
+		err = e.RedisClient.Set(fileName+"...current_page...", 1, 0).Err()
+		CheckError(err)
 
-					url := "/book/" + fileName
+		err = e.RedisClient.Set(fileName+"...current_fragment...", 0, 0).Err()
+		CheckError(err)
 
-					// Insert new book in `book` table
-					bookId := e._InsertBookRecord(title, fileName, packagePath, author, url, cover, 1, "epub", uploadedOn, userId)
-					fmt.Println(bookId)
+		// Remove dot from ./uploads
+		packagePathSplit := strings.Split(packagePath, "./uploads")
+		redisPackagePath := "/uploads" + packagePathSplit[1]
 
-					if EnableES == "0" {
-						index, err := bleve.Open(path.Join(DBPath, "lr_index.bleve"))
-						CheckError(err)
+		err = e.RedisClient.Set(fileName+"...filepath...", redisPackagePath, 0).Err()
+		CheckError(err)
 
-						message := struct {
-							Id     string
-							Title  string
-							Author string
-						}{
-							Id:     strconv.Itoa(int(userId)) + "*****" + strconv.Itoa(int(bookId)) + "*****" + title + "*****" + author + "*****" + cover + "*****" + url + "*****",
-							Title:  title,
-							Author: author,
-						}
+		url := "/book/" + fileName
 
-						index.Index(message.Id, message)
-						err = index.Close()
-						CheckError(err)
-					} else {
-						// Feed book info to ES
-						bookInfo := BookInfoStruct{
-							Title:  title,
-							Author: author,
-							URL:    url,
-							Cover:  cover,
-						}
+		// Insert new book in `book` table
+		bookId = e._InsertBookRecord(title, fileName, packagePath, author, url, cover, 1, "epub", uploadedOn, userId)
+		fmt.Println(bookId)
 
-						fmt.Println(bookInfo)
+		e._SetBookDetails(bookId, _EPUBBookDetails(opfMetadata))
+		e._LinkBookAuthors(userId, bookId, authors)
 
-						// Feed book info to ES
-						indexURL := ESPath + "/lr_index/book_info/" + strconv.Itoa(int(userId)) + "_" + strconv.Itoa(int(bookId))
-						fmt.Println(indexURL)
+		e._UpdateKOSyncDocuments(bookId, fileName)
 
-						b, err := json.Marshal(bookInfo)
-						CheckError(err)
+		if EnableES == "0" {
+			index, err := bleve.Open(path.Join(DBPath, "lr_index.bleve"))
+			CheckError(err)
 
-						PutJSON(indexURL, b)
+			message := e._GetBleveBook(userId, bookId, title, author, cover, url)
 
-						// Feed book detail to ES
-						go opfMetadata._FeedEPUBContent(packagePath, title, author, cover, url, userId, bookId)
-					}
+			index.Index(message.Id, message)
+			err = index.Close()
+			CheckError(err)
+		} else {
+			// Feed book info to ES
+			bookInfo := e._GetESBookInfo(bookId, title, author, url, cover)
 
-					c.String(200, fileName+" uploaded successfully. ")
-				}
-			}
+			fmt.Println(bookInfo)
+
+			// Feed book info to ES
+			indexURL := ESPath + "/lr_index/book_info/" + strconv.Itoa(int(userId)) + "_" + strconv.Itoa(int(bookId))
+			fmt.Println(indexURL)
+
+			b, err := json.Marshal(bookInfo)
+			CheckError(err)
+
+			PutJSON(indexURL, b)
+
+			// Feed book detail to ES
+			go opfMetadata._FeedEPUBContent(packagePath, title, author, cover, url, userId, bookId)
 		}
+
+		return bookId, fileName + " uploaded successfully. "
 	}
+
+	return 0, ""
 }
 
 // struct for marshalling book info
@@ -2390,6 +3247,7 @@ type BookDetailSource struct {
 type BookSearchResult struct {
 	BookInfo   []BookInfoStruct     `json:"book_info"`
 	BookDetail []BookDetailHitsHits `json:"book_detail"`
+	Authors    []AuthorStruct       `json:"authors"`
 }
 
 func GetJSONPassPayload(url string, payload []byte) []byte {
@@ -2450,17 +3308,18 @@ func (e *Env) GetAutocomplete(c *gin.Context) {
 			bsr := BookSearchResult{
 				BookInfo:   hitsBIS,
 				BookDetail: []BookDetailHitsHits{},
+				Authors:    e._SearchAuthors(e._GetUserId(email.(string)), term),
 			}
 
 			c.JSON(200, bsr)
 		} else {
 			fmt.Println("Searching elasticsearch ...")
 			payloadInfo := &BookInfoPayloadStruct{
-				Source: []string{"title", "author", "url", "cover"},
+				Source: []string{"title", "author", "url", "cover", "tags", "series"},
 				Query: BookInfoQuery{
 					MultiMatch: MultiMatchQuery{
 						Query:  term,
-						Fields: []string{"title", "author"},
+						Fields: []string{"title^3", "author^2", "series^2", "tags^2", "publisher", "isbn", "language", "description"},
 					},
 				},
 			}
@@ -2483,6 +3342,8 @@ func (e *Env) GetAutocomplete(c *gin.Context) {
 					Author: el.Source.Author,
 					URL:    el.Source.URL,
 					Cover:  el.Source.Cover,
+					Tags:   el.Source.Tags,
+					Series: el.Source.Series,
 				})
 			}
 
@@ -2525,6 +3386,7 @@ func (e *Env) GetAutocomplete(c *gin.Context) {
 			bsr := BookSearchResult{
 				BookInfo:   hitsBIS,
 				BookDetail: hitsBDS,
+				Authors:    e._SearchAuthors(e._GetUserId(email.(string)), term),
 			}
 
 			c.JSON(200, bsr)
@@ -2533,11 +3395,9 @@ func (e *Env) GetAutocomplete(c *gin.Context) {
 }
 
 type PDFHighlightStruct struct {
-	PageIndex      []string `json:"pageIndex" binding:"required"`
-	DivIndex       []string `json:"divIndex" binding:"required"`
-	HTMLContent    []string `json:"htmlContent" binding:"required"`
-	FileName       string   `json:"fileName" binding:"required"`
-	HighlightColor string   `json:"highlightColor" binding:"required"`
+	Anchors        []PDFHighlightAnchorStruct `json:"anchors" binding:"required"`
+	FileName       string                     `json:"fileName" binding:"required"`
+	HighlightColor string                     `json:"highlightColor" binding:"required"`
 }
 
 func (e *Env) PostPDFHighlight(c *gin.Context) {
@@ -2553,24 +3413,17 @@ func (e *Env) PostPDFHighlight(c *gin.Context) {
 
 		// Get book id
 		bookId, _, _ := e._GetBookInfo(pdfHighlight.FileName)
+		if !e._CanAnnotateBook(userId, bookId) {
+			c.String(403, "You can't highlight this book")
+			return
+		}
 
-		stmt, err := e.db.Prepare("INSERT INTO `pdf_highlighter` (book_id, user_id, highlight_color, highlight_top, highlight_comment) VALUES (?, ?, ?, ?, ?)")
-		CheckError(err)
-
-		res, err := stmt.Exec(bookId, userId, pdfHighlight.HighlightColor, "", "")
-		CheckError(err)
-
-		id, err := res.LastInsertId()
-		CheckError(err)
+		id := e._InsertPDFHighlight(bookId, userId, pdfHighlight.HighlightColor, "", _GetCurrentTime())
 
 		fmt.Println(id)
 
-		for i := 0; i < len(pdfHighlight.DivIndex); i++ {
-			stmt, err := e.db.Prepare("INSERT INTO `pdf_highlighter_detail` (highlighter_id, page_index, div_index, html_content) VALUES (?, ?, ?, ?)")
-			CheckError(err)
-
-			_, err = stmt.Exec(id, pdfHighlight.PageIndex[i], pdfHighlight.DivIndex[i], pdfHighlight.HTMLContent[i])
-			CheckError(err)
+		for _, anchor := range pdfHighlight.Anchors {
+			e._InsertPDFHighlightAnchor(id, anchor)
 		}
 
 		c.String(200, strconv.Itoa(int(id)))
@@ -2591,18 +3444,34 @@ func (e *Env) DeletePDFHighlight(c *gin.Context) {
 		CheckError(err)
 		fmt.Println(deleteHighlight)
 
-		// Delete highlight record with the given id
-		stmt, err := e.db.Prepare("DELETE FROM `pdf_highlighter` WHERE id=?")
+		// Get user id
+		userId := e._GetUserId(email.(string))
+
+		// Delete highlight record with the given id. Readers of a shared book
+		// can only delete their own highlights.
+		stmt, err := e.db.Prepare("DELETE FROM `pdf_highlighter` WHERE id=? AND user_id=?")
 		CheckError(err)
 
-		_, err = stmt.Exec(deleteHighlight.Id)
+		res, err := stmt.Exec(deleteHighlight.Id, userId)
 		CheckError(err)
 
-		// Delete detail attached to the highlight
-		stmt, err = e.db.Prepare("DELETE FROM `pdf_highlighter_detail` WHERE highlighter_id=?")
+		count, err := res.RowsAffected()
+		CheckError(err)
+
+		if count == 0 {
+			c.String(404, "Highlight not found")
+			return
+		}
+
+		// Delete anchors attached to the highlight
+		stmt, err = e.db.Prepare("DELETE FROM `pdf_highlight_anchor` WHERE highlighter_id=?")
 		CheckError(err)
 
 		_, err = stmt.Exec(deleteHighlight.Id)
+		CheckError(err)
+
+		// Delete the discussion of the highlight
+		e._DeleteHighlightComments(HighlightTypePDF, deleteHighlight.Id)
 
 		c.String(200, "Highlight updated successfully")
 	} else {
@@ -2617,16 +3486,9 @@ type GetPDFHighlightColorComment struct {
 	HighlightComment string `json:"highlight_comment"`
 }
 
-type GetPDFHighlightDetail struct {
-	HId         int64  `json:"hid"`
-	PageIndex   string `json:"page_index"`
-	DivIndex    string `json:"div_index"`
-	HTMLContent string `json:"html_content"`
-}
-
 type PDFHighlightsStruct struct {
-	Color  []GetPDFHighlightColorComment `json:"color"`
-	Detail []GetPDFHighlightDetail       `json:"detail"`
+	Color   []GetPDFHighlightColorComment `json:"color"`
+	Anchors []PDFHighlightAnchorStruct    `json:"anchors"`
 }
 
 func (e *Env) GetPDFHighlights(c *gin.Context) {
@@ -2641,6 +3503,10 @@ func (e *Env) GetPDFHighlights(c *gin.Context) {
 
 		// Get book id
 		bookId, _, _ := e._GetBookInfo(fileName)
+		if !e._CanAccessBook(userId, bookId) {
+			c.String(404, "Book not found")
+			return
+		}
 
 		rows, err := e.db.Query("select id, highlight_color, highlight_top, highlight_comment from pdf_highlighter where book_id = ? and user_id = ?", bookId, userId)
 		CheckError(err)
@@ -2666,33 +3532,14 @@ func (e *Env) GetPDFHighlights(c *gin.Context) {
 			})
 		}
 
-		pdfHighlightDetail := []GetPDFHighlightDetail{}
+		pdfHighlightAnchors := []PDFHighlightAnchorStruct{}
 		for _, v := range pdfHighlightColorComment {
-			rows, err := e.db.Query("select page_index, div_index, html_content from pdf_highlighter_detail where highlighter_id=?", v.Id)
-			CheckError(err)
-
-			for rows.Next() {
-				var (
-					pageIndex   string
-					divIndex    string
-					htmlContent string
-				)
-
-				err := rows.Scan(&pageIndex, &divIndex, &htmlContent)
-				CheckError(err)
-
-				pdfHighlightDetail = append(pdfHighlightDetail, GetPDFHighlightDetail{
-					HId:         v.Id,
-					PageIndex:   pageIndex,
-					DivIndex:    divIndex,
-					HTMLContent: htmlContent,
-				})
-			}
+			pdfHighlightAnchors = append(pdfHighlightAnchors, e._GetPDFHighlightAnchors(v.Id)...)
 		}
 
 		pdfHighlights := PDFHighlightsStruct{
-			Color:  pdfHighlightColorComment,
-			Detail: pdfHighlightDetail,
+			Color:   pdfHighlightColorComment,
+			Anchors: pdfHighlightAnchors,
 		}
 
 		c.JSON(200, pdfHighlights)
@@ -2712,15 +3559,26 @@ func (e *Env) PostPDFHighlightColor(c *gin.Context) {
 		pdfHighlightColor := PDFHighlightColor{}
 		err := c.BindJSON(&pdfHighlightColor)
 		CheckError(err)
-		fmt.Println(pdfHighlightColor)
 
-		// Update highlight color for the given id
-		stmt, err := e.db.Prepare("UPDATE `pdf_highlighter` SET highlight_color=? WHERE id=?")
+		// Get user id
+		userId := e._GetUserId(email.(string))
+
+		// Update highlight color for the given id. Readers of a shared book
+		// can only change their own highlights.
+		stmt, err := e.db.Prepare("UPDATE `pdf_highlighter` SET highlight_color=?, updated_on=? WHERE id=? AND user_id=?")
+		CheckError(err)
+
+		res, err := stmt.Exec(pdfHighlightColor.HighlightColor, _GetCurrentTime(), pdfHighlightColor.Id, userId)
 		CheckError(err)
 
-		_, err = stmt.Exec(pdfHighlightColor.HighlightColor, pdfHighlightColor.Id)
+		count, err := res.RowsAffected()
 		CheckError(err)
 
+		if count == 0 {
+			c.String(404, "Highlight not found")
+			return
+		}
+
 		c.String(200, "Highlight updated successfully")
 	} else {
 		c.String(200, "Not signed in")
@@ -2739,40 +3597,27 @@ func (e *Env) PostPDFHighlightComment(c *gin.Context) {
 		pdfHighlightComment := PDFHighlightComment{}
 		err := c.BindJSON(&pdfHighlightComment)
 		CheckError(err)
-		fmt.Println(pdfHighlightComment)
 
-		// Update highlight comment for the given id
-		stmt, err := e.db.Prepare("UPDATE `pdf_highlighter` SET highlight_top=?, highlight_comment=? WHERE id=?")
-		CheckError(err)
+		// Get user id
+		userId := e._GetUserId(email.(string))
 
-		_, err = stmt.Exec(pdfHighlightComment.Top, pdfHighlightComment.Comment, pdfHighlightComment.Id)
+		// Update highlight comment for the given id. Readers of a shared
+		// book can only change their own highlights.
+		stmt, err := e.db.Prepare("UPDATE `pdf_highlighter` SET highlight_top=?, highlight_comment=?, updated_on=? WHERE id=? AND user_id=?")
 		CheckError(err)
 
-		c.String(200, "Highlight updated successfully")
-	} else {
-		c.String(200, "Not signed in")
-	}
-}
-
-type EPUBHighlightStruct struct {
-	FileName string `json:"fileName"`
-	Href     string `json:"href"`
-	HTML     string `json:"html"`
-}
-
-func (e *Env) SaveEPUBHighlight(c *gin.Context) {
-	email := _GetEmailFromSession(c)
-	if email != nil {
-		epubHighlight := EPUBHighlightStruct{}
-		err := c.BindJSON(&epubHighlight)
+		res, err := stmt.Exec(pdfHighlightComment.Top, pdfHighlightComment.Comment, _GetCurrentTime(), pdfHighlightComment.Id, userId)
 		CheckError(err)
 
-		href := strings.Join(strings.Split(epubHighlight.Href, "/uploads"), "uploads")
-
-		err = ioutil.WriteFile(href, []byte(epubHighlight.HTML), 0644)
+		count, err := res.RowsAffected()
 		CheckError(err)
 
-		c.String(200, "Highlight saved successfully")
+		if count == 0 {
+			c.String(404, "Highlight not found")
+			return
+		}
+
+		c.String(200, "Highlight updated successfully")
 	} else {
 		c.String(200, "Not signed in")
 	}
@@ -2783,6 +3628,8 @@ type CollectionBooks struct {
 	Title       string
 	Description string
 	Cover       string
+	URL         string
+	Smart       bool
 }
 
 func (e *Env) GetCollections(c *gin.Context) {
@@ -2790,7 +3637,8 @@ func (e *Env) GetCollections(c *gin.Context) {
 	if email != nil {
 		userId := e._GetUserId(email.(string))
 
-		rows, err := e.db.Query("select id, title, description, cover from collection where user_id = ?", userId)
+		// Own collections and the ones shared with the user
+		rows, err := e.db.Query("select id, title, description, cover from collection where user_id = ? or id in (select collection_id from book_share where user_id = ?)", userId, userId)
 		CheckError(err)
 
 		collectionBooks := []CollectionBooks{}
@@ -2816,6 +3664,25 @@ func (e *Env) GetCollections(c *gin.Context) {
 				Title:       title,
 				Description: description,
 				Cover:       c,
+				URL:         "/collection/" + strconv.Itoa(int(id)),
+			})
+		}
+		rows.Close()
+
+		// Smart collections take the cover of their first book
+		for _, smart := range e._GetSmartCollections(userId, 0) {
+			var cover string
+			if books := e._GetSmartCollectionBooks(userId, smart); len(books) > 0 {
+				cover = books[0].Cover
+			}
+
+			collectionBooks = append(collectionBooks, CollectionBooks{
+				Id:          smart.Id,
+				Title:       smart.Title,
+				Description: smart.Description,
+				Cover:       cover,
+				URL:         "/smart-collection/" + strconv.Itoa(int(smart.Id)),
+				Smart:       true,
 			})
 		}
 
@@ -2837,7 +3704,7 @@ func (e *Env) GetAddCollection(c *gin.Context) {
 	if email != nil {
 		userId := e._GetUserId(email.(string))
 
-		rows, err := e.db.Query("select id, cover from book where user_id = ?", userId)
+		rows, err := e.db.Query("select id, cover from book where user_id = ? and deleted_on = ''", userId)
 		CheckError(err)
 
 		books := []BooksList{}
@@ -2879,39 +3746,31 @@ func (e *Env) PostNewCollection(c *gin.Context) {
 		err := c.BindJSON(&postCollection)
 		CheckError(err)
 
-		rows, err := e.db.Query("select cover from book where id = ?", postCollection.Books[len(postCollection.Books)-1])
-		CheckError(err)
-
-		var cover string
-		if rows.Next() {
-			err := rows.Scan(&cover)
-			CheckError(err)
+		postCollection.Title = strings.TrimSpace(postCollection.Title)
+		if postCollection.Title == "" {
+			c.String(400, "Collection title is empty")
+			return
 		}
-		fmt.Println(cover)
-		rows.Close()
 
-		var books string
-		for i, num := range postCollection.Books {
-			if i == (len(postCollection.Books) - 1) {
-				books += strconv.Itoa(int(num))
-				break
-			}
-			books += strconv.Itoa(int(num)) + ","
-		}
-		fmt.Println(books)
+		bookIds := e._FilterOwnBooks(userId, postCollection.Books)
 
 		// -----------------------------------------------------
 		// Fields: id, title, description, books, cover, user_id
 		// -----------------------------------------------------
-		stmt, err := e.db.Prepare("INSERT INTO `collection` (title, description, books, cover, user_id) VALUES (?, ?, ?, ?, ?)")
+		stmt, err := e.db.Prepare("INSERT INTO `collection` (title, description, books, cover, user_id) VALUES (?, ?, '', '', ?)")
 		CheckError(err)
 
-		res, err := stmt.Exec(postCollection.Title, postCollection.Description, books, cover, userId)
+		res, err := stmt.Exec(postCollection.Title, postCollection.Description, userId)
 		CheckError(err)
 
 		id, err := res.LastInsertId()
 		CheckError(err)
 
+		e._AddCollectionBooks(id, bookIds)
+		if len(bookIds) > 0 {
+			e._SetCollectionCover(id, bookIds[0])
+		}
+
 		c.String(200, strconv.Itoa(int(id)))
 	} else {
 		c.Redirect(302, "/signin")
@@ -2921,50 +3780,42 @@ func (e *Env) PostNewCollection(c *gin.Context) {
 func (e *Env) GetCollection(c *gin.Context) {
 	email := _GetEmailFromSession(c)
 	if email != nil {
+		userId := e._GetUserId(email.(string))
 		collectionId := c.Param("id")
 
-		rows, err := e.db.Query("select id, title, description, books from collection where id = ?", collectionId)
+		rows, err := e.db.Query("select id, title, description, user_id from collection where id = ?", collectionId)
 		CheckError(err)
 
 		var (
 			id          int64
 			title       string
 			description string
-			cbooks      string
+			ownerId     int64
 		)
 		if rows.Next() {
-			err := rows.Scan(&id, &title, &description, &cbooks)
+			err := rows.Scan(&id, &title, &description, &ownerId)
 			CheckError(err)
 		}
 		rows.Close()
 
-		bookSplit := strings.Split(cbooks, ",")
-		fmt.Println(bookSplit)
-
-		b := BookStructList{}
-		for i := len(bookSplit) - 1; i >= 0; i-- {
-			bookInt, err := strconv.Atoi(bookSplit[i])
-			CheckError(err)
+		var shared int64
+		err = e.db.QueryRow("SELECT COUNT(*) FROM `book_share` WHERE `collection_id` = ? AND `user_id` = ?", id, userId).Scan(&shared)
+		CheckError(err)
 
-			rows, err := e.db.Query("select title, url, cover from book where id = ?", bookInt)
-			CheckError(err)
+		if id == 0 || (ownerId != userId && shared == 0) {
+			c.String(404, "Collection not found")
+			return
+		}
 
-			if rows.Next() {
-				var (
-					title string
-					url   string
-					cover string
-				)
-				err := rows.Scan(&title, &url, &cover)
-				CheckError(err)
+		ownerName, _ := e._GetNameEmailFromUser(ownerId)
 
-				b = append(b, BookStruct{
-					Title: title,
-					URL:   url,
-					Cover: cover,
-				})
-			}
-			rows.Close()
+		b := BookStructList{}
+		for _, book := range e._GetCollectionBooks(id) {
+			b = append(b, BookStruct{
+				Title: book.Title,
+				URL:   book.URL,
+				Cover: book.Cover,
+			})
 		}
 
 		// Construct books of length 6 for large screen size
@@ -2982,6 +3833,8 @@ func (e *Env) GetCollection(c *gin.Context) {
 			"id":                 id,
 			"title":              title,
 			"description":        description,
+			"isOwner":            ownerId == userId,
+			"ownerName":          ownerName,
 			"booksList":          booksList,
 			"booksListMedium":    booksListMedium,
 			"booksListSmall":     booksListSmall,
@@ -2995,14 +3848,35 @@ func (e *Env) GetCollection(c *gin.Context) {
 func (e *Env) DeleteCollection(c *gin.Context) {
 	email := _GetEmailFromSession(c)
 	if email != nil {
-		collectionId := c.Param("id")
+		userId := e._GetUserId(email.(string))
+		collectionId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		CheckError(err)
+
+		stmt, err := e.db.Prepare("delete from collection where id=? and user_id=?")
+		CheckError(err)
 
-		stmt, err := e.db.Prepare("delete from collection where id=?")
+		res, err := stmt.Exec(collectionId, userId)
 		CheckError(err)
 
-		_, err = stmt.Exec(collectionId)
+		count, err := res.RowsAffected()
 		CheckError(err)
 
+		if count > 0 {
+			e._DeleteShares("collection_id", collectionId)
+
+			stmt, err := e.db.Prepare("delete from collection_link where collection_id=?")
+			CheckError(err)
+
+			_, err = stmt.Exec(collectionId)
+			CheckError(err)
+
+			stmt, err = e.db.Prepare("delete from collection_book where collection_id=?")
+			CheckError(err)
+
+			_, err = stmt.Exec(collectionId)
+			CheckError(err)
+		}
+
 		c.Redirect(302, "/collections")
 	} else {
 		c.Redirect(302, "/signin")
@@ -3012,8 +3886,18 @@ func (e *Env) DeleteCollection(c *gin.Context) {
 func (e *Env) GetSettings(c *gin.Context) {
 	email := _GetEmailFromSession(c)
 	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		exportTemplate := e._GetExportTemplate(userId)
+		if exportTemplate == "" {
+			exportTemplate = DefaultExportTemplate
+		}
+
 		c.HTML(302, "settings.html", gin.H{
-			"email": email.(string),
+			"email":          email.(string),
+			"isAdmin":        _IsAdmin(email.(string)),
+			"serverURL":      _GetServerURL(c),
+			"exportTemplate": exportTemplate,
 		})
 	} else {
 		c.Redirect(302, "/signin")
@@ -3021,9 +3905,11 @@ func (e *Env) GetSettings(c *gin.Context) {
 }
 
 type PostSettingsStruct struct {
-	Email          string `json:"email"`
-	ChangePassword bool   `json:"change_password"`
-	Password       string `json:"password"`
+	Email                  string `json:"email"`
+	ChangePassword         bool   `json:"change_password"`
+	Password               string `json:"password"`
+	ChangeKOReaderPassword bool   `json:"change_koreader_password"`
+	KOReaderPassword       string `json:"koreader_password"`
 }
 
 func (e *Env) PostSettings(c *gin.Context) {
@@ -3054,6 +3940,10 @@ func (e *Env) PostSettings(c *gin.Context) {
 				CheckError(err)
 			}
 
+			if postSettings.ChangeKOReaderPassword == true {
+				e._SetKOSyncPassword(postSettings.Email, postSettings.KOReaderPassword)
+			}
+
 			c.String(200, "Successfully updated your settings.")
 		}
 	} else {
@@ -0,0 +1,272 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Reader for the Lua table literals KOReader writes to its metadata.lua
+// files (`return { ["key"] = value, ... }`). Tables become
+// map[string]interface{} with numeric keys formatted as strings, numbers
+// become float64.
+type luaParser struct {
+	s   string
+	pos int
+}
+
+func _ParseLuaTable(s string) (map[string]interface{}, error) {
+	p := &luaParser{s: s}
+	p.skip()
+	if strings.HasPrefix(p.s[p.pos:], "return") {
+		p.pos += len("return")
+	}
+
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+
+	table, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("lua: expected a table")
+	}
+	return table, nil
+}
+
+func (p *luaParser) errorf(message string) error {
+	return errors.New("lua: " + message + " at offset " + strconv.Itoa(p.pos))
+}
+
+// Skip whitespace and comments
+func (p *luaParser) skip() {
+	for p.pos < len(p.s) {
+		switch {
+		case strings.HasPrefix(p.s[p.pos:], "--[["):
+			end := strings.Index(p.s[p.pos:], "]]")
+			if end < 0 {
+				p.pos = len(p.s)
+				return
+			}
+			p.pos += end + 2
+		case strings.HasPrefix(p.s[p.pos:], "--"):
+			end := strings.Index(p.s[p.pos:], "\n")
+			if end < 0 {
+				p.pos = len(p.s)
+				return
+			}
+			p.pos += end + 1
+		case strings.ContainsRune(" \t\r\n", rune(p.s[p.pos])):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *luaParser) value() (interface{}, error) {
+	p.skip()
+	if p.pos >= len(p.s) {
+		return nil, p.errorf("unexpected end")
+	}
+
+	switch c := p.s[p.pos]; {
+	case c == '{':
+		return p.table()
+	case c == '"' || c == '\'':
+		return p.quotedString()
+	case c == '[' && strings.HasPrefix(p.s[p.pos:], "[["):
+		end := strings.Index(p.s[p.pos+2:], "]]")
+		if end < 0 {
+			return nil, p.errorf("unterminated long string")
+		}
+		value := p.s[p.pos+2 : p.pos+2+end]
+		p.pos += end + 4
+		return strings.TrimPrefix(value, "\n"), nil
+	case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		return p.number()
+	default:
+		name := p.name()
+		switch name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "nil":
+			return nil, nil
+		}
+		return nil, p.errorf("unexpected value")
+	}
+}
+
+func (p *luaParser) name() string {
+	start := p.pos
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (p.pos > start && c >= '0' && c <= '9') {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *luaParser) number() (interface{}, error) {
+	start := p.pos
+	for p.pos < len(p.s) && strings.ContainsRune("0123456789+-.eExXabcdefABCDEF", rune(p.s[p.pos])) {
+		p.pos++
+	}
+
+	text := p.s[start:p.pos]
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		n, err := strconv.ParseInt(text[2:], 16, 64)
+		return float64(n), err
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+func (p *luaParser) quotedString() (interface{}, error) {
+	quote := p.s[p.pos]
+	p.pos++
+
+	var b bytes.Buffer
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && p.pos < len(p.s):
+			e := p.s[p.pos]
+			p.pos++
+			switch e {
+			case 'n', '\n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'a':
+				b.WriteByte('\a')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'v':
+				b.WriteByte('\v')
+			default:
+				if e >= '0' && e <= '9' {
+					// Decimal escape of up to three digits
+					end := p.pos
+					for end < len(p.s) && end < p.pos+2 && p.s[end] >= '0' && p.s[end] <= '9' {
+						end++
+					}
+					n, _ := strconv.Atoi(p.s[p.pos-1 : end])
+					b.WriteByte(byte(n))
+					p.pos = end
+				} else {
+					b.WriteByte(e)
+				}
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return nil, p.errorf("unterminated string")
+}
+
+func (p *luaParser) table() (interface{}, error) {
+	// Skip {
+	p.pos++
+
+	table := make(map[string]interface{})
+	index := 1
+	for {
+		p.skip()
+		if p.pos >= len(p.s) {
+			return nil, p.errorf("unterminated table")
+		}
+		if p.s[p.pos] == '}' {
+			p.pos++
+			return table, nil
+		}
+
+		var key string
+		switch {
+		case p.s[p.pos] == '[' && !strings.HasPrefix(p.s[p.pos:], "[["):
+			p.pos++
+			k, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			p.skip()
+			if p.pos >= len(p.s) || p.s[p.pos] != ']' {
+				return nil, p.errorf("expected ]")
+			}
+			p.pos++
+			p.skip()
+			if p.pos >= len(p.s) || p.s[p.pos] != '=' {
+				return nil, p.errorf("expected =")
+			}
+			p.pos++
+			key = _LuaKey(k)
+		default:
+			// name = value, or a positional value
+			start := p.pos
+			name := p.name()
+			p.skip()
+			if name != "" && p.pos < len(p.s) && p.s[p.pos] == '=' && !strings.HasPrefix(p.s[p.pos:], "==") {
+				p.pos++
+				key = name
+			} else {
+				p.pos = start
+				key = strconv.Itoa(index)
+				index++
+			}
+		}
+
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		table[key] = value
+
+		p.skip()
+		if p.pos < len(p.s) && (p.s[p.pos] == ',' || p.s[p.pos] == ';') {
+			p.pos++
+		}
+	}
+}
+
+func _LuaKey(k interface{}) string {
+	switch v := k.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
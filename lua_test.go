@@ -0,0 +1,122 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLuaTable(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]interface{}
+	}{
+		{
+			name:  "bracketed keys",
+			input: `return { ["title"] = "Dune", ["pages"] = 412, ["finished"] = true, ["deleted"] = false, ["cover"] = nil }`,
+			want:  map[string]interface{}{"title": "Dune", "pages": 412.0, "finished": true, "deleted": false, "cover": nil},
+		},
+		{
+			name:  "without return",
+			input: `{ ["a"] = 1 }`,
+			want:  map[string]interface{}{"a": 1.0},
+		},
+		{
+			name:  "positional values, names and numeric keys",
+			input: `return { "a", "b", x = 1, [3] = "c", [1.5] = "d", [true] = "e" }`,
+			want:  map[string]interface{}{"1": "a", "2": "b", "x": 1.0, "3": "c", "1.5": "d", "true": "e"},
+		},
+		{
+			name:  "nested tables with trailing separators",
+			input: "return {\n\ta = { b = { 1, 2, }; },\n\tc = {},\n}",
+			want: map[string]interface{}{
+				"a": map[string]interface{}{"b": map[string]interface{}{"1": 1.0, "2": 2.0}},
+				"c": map[string]interface{}{},
+			},
+		},
+		{
+			name:  "comments",
+			input: "-- we can read Lua syntax here!\nreturn { --[[ a block\ncomment ]] a = 1, -- end of line\n b = 2 }",
+			want:  map[string]interface{}{"a": 1.0, "b": 2.0},
+		},
+		{
+			name:  "escapes",
+			input: `return { s = "line\nnext\t\"quoted\" \\ \65\066\0673", q = 'it\'s', nl = "a\` + "\n" + `b" }`,
+			want:  map[string]interface{}{"s": "line\nnext\t\"quoted\" \\ ABC3", "q": "it's", "nl": "a\nb"},
+		},
+		{
+			name:  "UTF-8 strings",
+			input: `return { ["text"] = "« Ça va ? » — 日本語" }`,
+			want:  map[string]interface{}{"text": "« Ça va ? » — 日本語"},
+		},
+		{
+			name:  "long strings",
+			input: "return { l = [[\nfirst\nsecond]], k = [[no newline]] }",
+			want:  map[string]interface{}{"l": "first\nsecond", "k": "no newline"},
+		},
+		{
+			name:  "numbers",
+			input: `return { -1.5, 2e3, 0x1F, .5, 7 }`,
+			want:  map[string]interface{}{"1": -1.5, "2": 2000.0, "3": 31.0, "4": 0.5, "5": 7.0},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := _ParseLuaTable(test.input)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\n got %#v\nwant %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseLuaTableErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"empty", "", "unexpected end"},
+		{"only a comment", "-- nothing here", "unexpected end"},
+		{"not a table", "return 42", "expected a table"},
+		{"unterminated table", `return { a = 1`, "unterminated table"},
+		{"unterminated nested table", `return { a = { b = 1 }`, "unterminated table"},
+		{"missing ]", `return { ["a" = 1 }`, "expected ]"},
+		{"missing =", `return { ["a"] 1 }`, "expected ="},
+		{"unterminated string", `return { s = "abc }`, "unterminated string"},
+		{"unterminated long string", `return { s = [[abc }`, "unterminated long string"},
+		{"unknown name", `return { a = foo }`, "unexpected value"},
+		{"function call", `return { a = os.time() }`, "unexpected value"},
+		{"bad number", `return { a = 1.2.3 }`, "invalid syntax"},
+	}
+
+	for _, test := range tests {
+		_, err := _ParseLuaTable(test.input)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Renderer for the Markdown subset used in comments: paragraphs, headings,
+// blockquotes, lists, code blocks, code spans, emphasis and links. The input
+// is escaped first, so the output never contains HTML written by the user.
+
+var (
+	markdownHeadingRegexp       = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	markdownUnorderedRegexp     = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	markdownOrderedRegexp       = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	markdownLinkRegexp          = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	markdownStrongRegexp        = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	markdownEmphasisRegexp      = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+	markdownStrikethroughRegexp = regexp.MustCompile(`~~([^~]+)~~`)
+)
+
+// Links may point to the web, to an email address or to a page of this
+// server. "//host" and "/\host" are read by browsers as other hosts, so they
+// don't count as pages of this server.
+func _IsSafeMarkdownLink(target string) bool {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "mailto:") {
+		return true
+	}
+	return strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") && !strings.HasPrefix(target, "/\\")
+}
+
+func _RenderMarkdownInline(s string) string {
+	// Code spans are kept as they are
+	parts := strings.Split(s, "`")
+	for i := range parts {
+		if i%2 == 1 && i < len(parts)-1 {
+			parts[i] = "<code>" + html.EscapeString(parts[i]) + "</code>"
+			continue
+		}
+		if i%2 == 1 {
+			// Unmatched backtick
+			parts[i] = "`" + parts[i]
+		}
+
+		text := html.EscapeString(parts[i])
+		text = markdownLinkRegexp.ReplaceAllStringFunc(text, func(m string) string {
+			match := markdownLinkRegexp.FindStringSubmatch(m)
+			target := html.UnescapeString(match[2])
+			if !_IsSafeMarkdownLink(target) {
+				return match[1]
+			}
+			return "<a href=\"" + html.EscapeString(target) + "\" rel=\"nofollow noopener\" target=\"_blank\">" + match[1] + "</a>"
+		})
+		text = markdownStrongRegexp.ReplaceAllString(text, "<strong>$1$2</strong>")
+		text = markdownEmphasisRegexp.ReplaceAllString(text, "<em>$1$2</em>")
+		text = markdownStrikethroughRegexp.ReplaceAllString(text, "<del>$1</del>")
+		parts[i] = text
+	}
+	return strings.Join(parts, "")
+}
+
+func _RenderMarkdown(s string) string {
+	lines := strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+
+	var (
+		out       bytes.Buffer
+		paragraph []string
+		list      string
+		quote     []string
+	)
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			var rendered []string
+			for _, line := range paragraph {
+				rendered = append(rendered, _RenderMarkdownInline(line))
+			}
+			out.WriteString("<p>" + strings.Join(rendered, "<br>") + "</p>\n")
+			paragraph = nil
+		}
+	}
+	flushList := func() {
+		if list != "" {
+			out.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	flushQuote := func() {
+		if len(quote) > 0 {
+			out.WriteString("<blockquote>" + _RenderMarkdown(strings.Join(quote, "\n")) + "</blockquote>\n")
+			quote = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, ">") {
+			flushParagraph()
+			flushList()
+			quote = append(quote, strings.TrimPrefix(strings.TrimPrefix(trimmed, ">"), " "))
+			continue
+		}
+		flushQuote()
+
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flushParagraph()
+			flushList()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case trimmed == "":
+			flushParagraph()
+			flushList()
+		case markdownHeadingRegexp.MatchString(trimmed):
+			flushParagraph()
+			flushList()
+			match := markdownHeadingRegexp.FindStringSubmatch(trimmed)
+			level := strconv.Itoa(len(match[1]))
+			out.WriteString("<h" + level + ">" + _RenderMarkdownInline(match[2]) + "</h" + level + ">\n")
+		case markdownUnorderedRegexp.MatchString(line) || markdownOrderedRegexp.MatchString(line):
+			flushParagraph()
+			tag, item := "ul", ""
+			if match := markdownUnorderedRegexp.FindStringSubmatch(line); match != nil {
+				item = match[1]
+			} else {
+				tag, item = "ol", markdownOrderedRegexp.FindStringSubmatch(line)[1]
+			}
+			if list != tag {
+				flushList()
+				out.WriteString("<" + tag + ">\n")
+				list = tag
+			}
+			out.WriteString("<li>" + _RenderMarkdownInline(item) + "</li>\n")
+		default:
+			flushList()
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flushQuote()
+	flushParagraph()
+	flushList()
+
+	return out.String()
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import "testing"
+
+func TestRenderMarkdownInline(t *testing.T) {
+	link := func(href, text string) string {
+		return `<a href="` + href + `" rel="nofollow noopener" target="_blank">` + text + `</a>`
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "plain text is escaped",
+			input: `<script>alert("x")</script> & co`,
+			want:  `&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; &amp; co`,
+		},
+		{
+			name:  "emphasis",
+			input: "**bold**, *italic*, _italic_ and ~~struck~~",
+			want:  "<strong>bold</strong>, <em>italic</em>, <em>italic</em> and <del>struck</del>",
+		},
+		{
+			name:  "web and email links",
+			input: "[site](https://example.com/a?b=1&c=2) [plain](http://example.com) [mail](mailto:me@example.com)",
+			want:  link("https://example.com/a?b=1&amp;c=2", "site") + " " + link("http://example.com", "plain") + " " + link("mailto:me@example.com", "mail"),
+		},
+		{
+			name:  "link to a page of the server",
+			input: "[book](/book/dune.pdf)",
+			want:  link("/book/dune.pdf", "book"),
+		},
+		{
+			name:  "javascript link",
+			input: "[click](javascript:alert&#40;1&#41;) [upper](JavaScript:void0)",
+			want:  "click upper",
+		},
+		{
+			name:  "data and relative links",
+			input: "[data](data:text/html,x) [relative](book/dune.pdf)",
+			want:  "data relative",
+		},
+		{
+			name:  "protocol relative link",
+			input: "[evil](//evil.example.com/page)",
+			want:  "evil",
+		},
+		{
+			name:  "backslash after the slash",
+			input: `[evil](/\evil.example.com)`,
+			want:  "evil",
+		},
+		{
+			name:  "quotes in the target",
+			input: `[q](https://example.com/"onmouseover="alert(1))`,
+			want:  link("https://example.com/&#34;onmouseover=&#34;alert(1", "q") + ")",
+		},
+		{
+			name:  "single quotes in the target",
+			input: `[q](/a'b)`,
+			want:  link("/a&#39;b", "q"),
+		},
+		{
+			name:  "code span",
+			input: "run `<b>**x**</b>` now",
+			want:  "run <code>&lt;b&gt;**x**&lt;/b&gt;</code> now",
+		},
+		{
+			name:  "no link inside a code span",
+			input: "`[a](javascript:x)` and `[b](/c)`",
+			want:  "<code>[a](javascript:x)</code> and <code>[b](/c)</code>",
+		},
+		{
+			name:  "unmatched backtick",
+			input: "a `b` c `d *e*",
+			want:  "a <code>b</code> c `d <em>e</em>",
+		},
+		{
+			name:  "single backtick",
+			input: "it`s <ok>",
+			want:  "it`s &lt;ok&gt;",
+		},
+	}
+
+	for _, test := range tests {
+		if got := _RenderMarkdownInline(test.input); got != test.want {
+			t.Errorf("%s:\n got %s\nwant %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "paragraphs and line breaks",
+			input: "one\r\ntwo\n\nthree",
+			want:  "<p>one<br>two</p>\n<p>three</p>\n",
+		},
+		{
+			name:  "heading",
+			input: "## Notes *here*",
+			want:  "<h2>Notes <em>here</em></h2>\n",
+		},
+		{
+			name:  "code block is not rendered",
+			input: "```\n<b>[x](javascript:y)</b>\n```",
+			want:  "<pre><code>&lt;b&gt;[x](javascript:y)&lt;/b&gt;</code></pre>\n",
+		},
+		{
+			name:  "blockquote",
+			input: "> quoted [link](//evil.example.com)",
+			want:  "<blockquote><p>quoted link</p>\n</blockquote>\n",
+		},
+	}
+
+	for _, test := range tests {
+		if got := _RenderMarkdown(test.input); got != test.want {
+			t.Errorf("%s:\n got %q\nwant %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"bytes"
+	"html"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Metadata of a book besides its title, author and cover. Read from the OPF
+// package or the PDF info at upload and editable in EditBook.
+type BookDetailsStruct struct {
+	Tags        []string `json:"tags"`
+	Series      string   `json:"series"`
+	SeriesIndex float64  `json:"seriesIndex"`
+	Language    string   `json:"language"`
+	Publisher   string   `json:"publisher"`
+	ISBN        string   `json:"isbn"`
+	Description string   `json:"description"`
+	// YYYY-MM-DD, or only the year when the day isn't known
+	PublishedOn string `json:"publishedOn"`
+}
+
+var publicationDateRegexp = regexp.MustCompile(`^(\d{4})(-\d{2}(-\d{2})?)?`)
+
+// Tags separated by commas, without duplicates
+func _ParseTags(s string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[strings.ToLower(tag)] {
+			continue
+		}
+		seen[strings.ToLower(tag)] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// Digits of an ISBN-10 or ISBN-13, or an empty string
+func _NormalizeISBN(s string) string {
+	s = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "urn:isbn:")
+
+	var isbn []rune
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			isbn = append(isbn, r)
+		case r == 'x' || r == 'X':
+			isbn = append(isbn, 'X')
+		case r == '-' || r == ' ':
+		default:
+			return ""
+		}
+	}
+	if len(isbn) != 10 && len(isbn) != 13 {
+		return ""
+	}
+	return string(isbn)
+}
+
+func _NormalizePublicationDate(s string) string {
+	return publicationDateRegexp.FindString(strings.TrimSpace(s))
+}
+
+// Plain text of a description which may hold HTML
+func _PlainDescription(s string) string {
+	s = htmlTagRegexp.ReplaceAllString(s, " ")
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
+
+func _CleanBookDetails(details BookDetailsStruct) BookDetailsStruct {
+	details.Tags = _ParseTags(strings.Join(details.Tags, ","))
+	details.Series = strings.TrimSpace(details.Series)
+	if details.Series == "" || details.SeriesIndex < 0 {
+		details.SeriesIndex = 0
+	}
+	details.Language = strings.TrimSpace(details.Language)
+	details.Publisher = strings.TrimSpace(details.Publisher)
+	details.ISBN = _NormalizeISBN(details.ISBN)
+	details.Description = strings.TrimSpace(details.Description)
+	details.PublishedOn = _NormalizePublicationDate(details.PublishedOn)
+	return details
+}
+
+// Details found in the OPF package of an EPUB. The series is read from the
+// EPUB 3 collection meta or from the calibre meta.
+func _EPUBBookDetails(opfMetadata OPFMetadataStruct) BookDetailsStruct {
+	metadata := opfMetadata.Metadata
+	details := BookDetailsStruct{
+		Tags:        metadata.Subjects,
+		Language:    metadata.Language,
+		Publisher:   metadata.Publisher,
+		Description: _PlainDescription(metadata.Description),
+		PublishedOn: metadata.Date,
+	}
+
+	for _, identifier := range metadata.Identifiers {
+		isbn := _NormalizeISBN(identifier.Value)
+		if isbn != "" && (strings.EqualFold(identifier.Scheme, "isbn") || strings.HasPrefix(strings.ToLower(identifier.Value), "urn:isbn:") || details.ISBN == "") {
+			details.ISBN = isbn
+		}
+	}
+
+	var collectionId string
+	for _, meta := range metadata.Meta {
+		switch {
+		case meta.Name == "calibre:series":
+			details.Series = meta.Content
+		case meta.Name == "calibre:series_index":
+			details.SeriesIndex, _ = strconv.ParseFloat(meta.Content, 64)
+		case meta.Property == "belongs-to-collection" && details.Series == "":
+			details.Series = strings.TrimSpace(meta.Value)
+			collectionId = meta.Id
+		}
+	}
+	for _, meta := range metadata.Meta {
+		if collectionId != "" && meta.Property == "group-position" && meta.Refines == "#"+collectionId {
+			details.SeriesIndex, _ = strconv.ParseFloat(strings.TrimSpace(meta.Value), 64)
+		}
+	}
+
+	return _CleanBookDetails(details)
+}
+
+// First value of a Dublin Core or calibre property in XMP metadata
+func _XMPValue(xmp string, name string) string {
+	re := regexp.MustCompile(`(?s)<` + regexp.QuoteMeta(name) + `(?:\s[^>]*)?>(.*?)</` + regexp.QuoteMeta(name) + `>`)
+	match := re.FindStringSubmatch(xmp)
+	if match == nil {
+		return ""
+	}
+
+	value := match[1]
+	if li := regexp.MustCompile(`(?s)<rdf:li[^>]*>(.*?)</rdf:li>`).FindStringSubmatch(value); li != nil {
+		value = li[1]
+	}
+	return strings.TrimSpace(html.UnescapeString(htmlTagRegexp.ReplaceAllString(value, "")))
+}
+
+// Details found in the info dictionary and the XMP metadata of a PDF
+func _GetPDFDetails(filePath string) BookDetailsStruct {
+	details := BookDetailsStruct{}
+
+	var out bytes.Buffer
+	cmd := exec.Command("pdfinfo", filePath)
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return details
+	}
+
+	for _, line := range strings.Split(out.String(), "\n") {
+		field := strings.SplitN(line, ":", 2)
+		if len(field) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(field[1])
+		switch field[0] {
+		case "Keywords":
+			details.Tags = _ParseTags(strings.Replace(value, ";", ",", -1))
+		case "Subject":
+			details.Description = value
+		}
+	}
+
+	out.Reset()
+	cmd = exec.Command("pdfinfo", "-meta", filePath)
+	cmd.Stdout = &out
+	if err := cmd.Run(); err == nil {
+		xmp := out.String()
+		details.Language = _XMPValue(xmp, "dc:language")
+		details.Publisher = _XMPValue(xmp, "dc:publisher")
+		details.PublishedOn = _XMPValue(xmp, "dc:date")
+		details.ISBN = _XMPValue(xmp, "dc:identifier")
+		details.Series = _XMPValue(xmp, "calibreSI:series")
+		details.SeriesIndex, _ = strconv.ParseFloat(_XMPValue(xmp, "calibreSI:series_index"), 64)
+		if description := _XMPValue(xmp, "dc:description"); description != "" {
+			details.Description = description
+		}
+	}
+
+	return _CleanBookDetails(details)
+}
+
+func (e *Env) _GetBookTags(bookId int64) []string {
+	rows, err := e.db.Query("SELECT `tag` FROM `book_tag` WHERE `book_id` = ? ORDER BY `id`", bookId)
+	CheckError(err)
+
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		err := rows.Scan(&tag)
+		CheckError(err)
+
+		tags = append(tags, tag)
+	}
+	rows.Close()
+
+	return tags
+}
+
+func (e *Env) _GetBookDetails(bookId int64) BookDetailsStruct {
+	rows, err := e.db.Query("SELECT `series`, `series_index`, `language`, `publisher`, `isbn`, `description`, `published_on` FROM `book` WHERE `id` = ?", bookId)
+	CheckError(err)
+
+	details := BookDetailsStruct{}
+	if rows.Next() {
+		err := rows.Scan(&details.Series, &details.SeriesIndex, &details.Language, &details.Publisher, &details.ISBN, &details.Description, &details.PublishedOn)
+		CheckError(err)
+	}
+	rows.Close()
+
+	details.Tags = e._GetBookTags(bookId)
+
+	return details
+}
+
+func (e *Env) _SetBookDetails(bookId int64, details BookDetailsStruct) {
+	details = _CleanBookDetails(details)
+
+	stmt, err := e.db.Prepare("UPDATE `book` SET series=?, series_index=?, language=?, publisher=?, isbn=?, description=?, published_on=? WHERE id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(details.Series, details.SeriesIndex, details.Language, details.Publisher, details.ISBN, details.Description, details.PublishedOn, bookId)
+	CheckError(err)
+
+	stmt, err = e.db.Prepare("DELETE FROM `book_tag` WHERE book_id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	stmt, err = e.db.Prepare("INSERT INTO `book_tag` (book_id, tag) VALUES (?, ?)")
+	CheckError(err)
+
+	for _, tag := range details.Tags {
+		_, err = stmt.Exec(bookId, tag)
+		CheckError(err)
+	}
+}
+
+// Document of a book in the bleve index, with its details so they can be
+// searched too
+func (e *Env) _GetBleveBook(userId int64, bookId int64, title string, author string, cover string, url string) BleveBookStruct {
+	details := e._GetBookDetails(bookId)
+
+	return BleveBookStruct{
+		Id:          _GetBleveIndexId(userId, bookId, title, author, cover, url),
+		Title:       title,
+		Author:      author,
+		Tags:        strings.Join(details.Tags, ", "),
+		Series:      details.Series,
+		Language:    details.Language,
+		Publisher:   details.Publisher,
+		ISBN:        details.ISBN,
+		Description: details.Description,
+	}
+}
+
+// Document of a book in the book_info type of Elasticsearch
+func (e *Env) _GetESBookInfo(bookId int64, title string, author string, url string, cover string) BookInfoStruct {
+	details := e._GetBookDetails(bookId)
+
+	return BookInfoStruct{
+		Title:       title,
+		Author:      author,
+		URL:         url,
+		Cover:       cover,
+		Tags:        details.Tags,
+		Series:      details.Series,
+		Language:    details.Language,
+		Publisher:   details.Publisher,
+		ISBN:        details.ISBN,
+		Description: details.Description,
+	}
+}
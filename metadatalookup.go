@@ -0,0 +1,523 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metadata proposed by an online provider for a book. The user picks what to
+// keep in the edit dialog, nothing is saved by the lookup itself.
+type MetadataProposalStruct struct {
+	Provider string   `json:"provider"`
+	Title    string   `json:"title"`
+	Authors  []string `json:"authors"`
+	BookDetailsStruct
+	CoverURL string `json:"coverURL"`
+}
+
+// A lookup is done by ISBN when there is one, otherwise by title and author
+type MetadataQueryStruct struct {
+	ISBN   string
+	Title  string
+	Author string
+}
+
+type MetadataProvider interface {
+	Name() string
+	Search(query MetadataQueryStruct) ([]MetadataProposalStruct, error)
+	// Cover images are only downloaded from the hosts of a provider
+	IsCoverURL(coverURL string) bool
+}
+
+const metadataLookupLimit = 5
+
+// Providers enabled with LIBREREAD_METADATA_PROVIDERS, in the order given
+func _GetMetadataProviders() []MetadataProvider {
+	providers := []MetadataProvider{}
+	for _, name := range strings.Split(MetadataProviders, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "openlibrary":
+			providers = append(providers, OpenLibraryProvider{BaseURL: "https://openlibrary.org"})
+		case "googlebooks":
+			providers = append(providers, GoogleBooksProvider{BaseURL: "https://www.googleapis.com", APIKey: GoogleBooksKey})
+		}
+	}
+	return providers
+}
+
+// Responses of the providers are read from LIBREREAD_METADATA_FIXTURES when
+// it is set, so lookups can run without network access. With
+// LIBREREAD_METADATA_RECORD=1 the live responses are saved there instead.
+func _FetchMetadataURL(rawURL string) ([]byte, error) {
+	fixturePath := ""
+	if MetadataFixturePath != "" {
+		fixturePath = path.Join(MetadataFixturePath, _MetadataFixtureName(rawURL))
+		if MetadataRecord != "1" {
+			data, err := ioutil.ReadFile(fixturePath)
+			if os.IsNotExist(err) {
+				return nil, errors.New("no recorded response for " + _MetadataFixtureName(rawURL))
+			}
+			return data, err
+		}
+	}
+
+	res, err := myClient.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("%s returned %s", res.Request.URL.Host, res.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if fixturePath != "" {
+		err = ioutil.WriteFile(fixturePath, data, 0644)
+		CheckError(err)
+	}
+	return data, nil
+}
+
+var fixtureNameRegexp = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// File name of the recorded response of a URL. API keys are left out so the
+// fixtures can be shared.
+func _MetadataFixtureName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err == nil {
+		q := u.Query()
+		q.Del("key")
+		u.RawQuery = q.Encode()
+		rawURL = u.Host + u.Path + "?" + u.RawQuery
+	}
+
+	name := strings.Trim(fixtureNameRegexp.ReplaceAllString(rawURL, "_"), "_")
+	if len(name) > 100 {
+		sum := sha1.Sum([]byte(rawURL))
+		name = name[:80] + "_" + hex.EncodeToString(sum[:])[:12]
+	}
+	return name
+}
+
+var yearRegexp = regexp.MustCompile(`\b\d{4}\b`)
+
+// Providers give dates such as "2001", "2001-03" or "March 1, 2001"
+func _LookupPublicationDate(s string) string {
+	if date := _NormalizePublicationDate(s); date != "" {
+		return date
+	}
+	return yearRegexp.FindString(s)
+}
+
+func _LookupTitle(title string, subtitle string) string {
+	if subtitle != "" {
+		return title + ": " + subtitle
+	}
+	return title
+}
+
+func _IsCoverHost(coverURL string, hosts ...string) bool {
+	u, err := url.Parse(coverURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return false
+	}
+	for _, host := range hosts {
+		if u.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Open Library (https://openlibrary.org/developers/api)
+type OpenLibraryProvider struct {
+	BaseURL string
+}
+
+type OpenLibraryNameStruct struct {
+	Name string `json:"name"`
+}
+
+type OpenLibraryBookStruct struct {
+	Title       string                  `json:"title"`
+	Subtitle    string                  `json:"subtitle"`
+	Authors     []OpenLibraryNameStruct `json:"authors"`
+	Publishers  []OpenLibraryNameStruct `json:"publishers"`
+	PublishDate string                  `json:"publish_date"`
+	Subjects    []OpenLibraryNameStruct `json:"subjects"`
+	Identifiers struct {
+		ISBN13 []string `json:"isbn_13"`
+		ISBN10 []string `json:"isbn_10"`
+	} `json:"identifiers"`
+	Cover struct {
+		Large  string `json:"large"`
+		Medium string `json:"medium"`
+	} `json:"cover"`
+}
+
+type OpenLibrarySearchStruct struct {
+	Docs []struct {
+		Title            string   `json:"title"`
+		Subtitle         string   `json:"subtitle"`
+		AuthorName       []string `json:"author_name"`
+		FirstPublishYear int      `json:"first_publish_year"`
+		Publisher        []string `json:"publisher"`
+		ISBN             []string `json:"isbn"`
+		Language         []string `json:"language"`
+		Subject          []string `json:"subject"`
+		CoverId          int64    `json:"cover_i"`
+	} `json:"docs"`
+}
+
+func (p OpenLibraryProvider) Name() string {
+	return "Open Library"
+}
+
+func (p OpenLibraryProvider) IsCoverURL(coverURL string) bool {
+	return _IsCoverHost(coverURL, "covers.openlibrary.org")
+}
+
+func (p OpenLibraryProvider) Search(query MetadataQueryStruct) ([]MetadataProposalStruct, error) {
+	if query.ISBN != "" {
+		return p.searchISBN(query.ISBN)
+	}
+
+	params := url.Values{}
+	params.Set("title", query.Title)
+	if query.Author != "" {
+		params.Set("author", query.Author)
+	}
+	params.Set("limit", fmt.Sprint(metadataLookupLimit))
+
+	data, err := _FetchMetadataURL(p.BaseURL + "/search.json?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	result := OpenLibrarySearchStruct{}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	proposals := []MetadataProposalStruct{}
+	for _, doc := range result.Docs {
+		proposal := MetadataProposalStruct{
+			Provider: p.Name(),
+			Title:    _LookupTitle(doc.Title, doc.Subtitle),
+			Authors:  doc.AuthorName,
+		}
+		if len(doc.Publisher) > 0 {
+			proposal.Publisher = doc.Publisher[0]
+		}
+		if doc.FirstPublishYear > 0 {
+			proposal.PublishedOn = fmt.Sprint(doc.FirstPublishYear)
+		}
+		for _, isbn := range doc.ISBN {
+			if isbn = _NormalizeISBN(isbn); len(isbn) == 13 || proposal.ISBN == "" {
+				proposal.ISBN = isbn
+			}
+			if len(proposal.ISBN) == 13 {
+				break
+			}
+		}
+		if len(doc.Language) > 0 {
+			proposal.Language = doc.Language[0]
+		}
+		if len(doc.Subject) > 10 {
+			doc.Subject = doc.Subject[:10]
+		}
+		proposal.Tags = doc.Subject
+		if doc.CoverId > 0 {
+			proposal.CoverURL = fmt.Sprintf("https://covers.openlibrary.org/b/id/%d-L.jpg", doc.CoverId)
+		}
+		proposal.BookDetailsStruct = _CleanBookDetails(proposal.BookDetailsStruct)
+
+		proposals = append(proposals, proposal)
+	}
+	return proposals, nil
+}
+
+func (p OpenLibraryProvider) searchISBN(isbn string) ([]MetadataProposalStruct, error) {
+	params := url.Values{}
+	params.Set("bibkeys", "ISBN:"+isbn)
+	params.Set("format", "json")
+	params.Set("jscmd", "data")
+
+	data, err := _FetchMetadataURL(p.BaseURL + "/api/books?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]OpenLibraryBookStruct{}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	proposals := []MetadataProposalStruct{}
+	book, ok := result["ISBN:"+isbn]
+	if !ok {
+		return proposals, nil
+	}
+
+	proposal := MetadataProposalStruct{
+		Provider: p.Name(),
+		Title:    _LookupTitle(book.Title, book.Subtitle),
+		Authors:  []string{},
+	}
+	for _, author := range book.Authors {
+		proposal.Authors = append(proposal.Authors, author.Name)
+	}
+	if len(book.Publishers) > 0 {
+		proposal.Publisher = book.Publishers[0].Name
+	}
+	proposal.PublishedOn = _LookupPublicationDate(book.PublishDate)
+	for _, subject := range book.Subjects {
+		if len(proposal.Tags) < 10 {
+			proposal.Tags = append(proposal.Tags, subject.Name)
+		}
+	}
+	proposal.ISBN = isbn
+	if len(book.Identifiers.ISBN13) > 0 {
+		proposal.ISBN = book.Identifiers.ISBN13[0]
+	}
+	proposal.CoverURL = book.Cover.Large
+	if proposal.CoverURL == "" {
+		proposal.CoverURL = book.Cover.Medium
+	}
+	proposal.BookDetailsStruct = _CleanBookDetails(proposal.BookDetailsStruct)
+
+	return append(proposals, proposal), nil
+}
+
+// Google Books (https://developers.google.com/books/docs/v1/using). The API
+// key is optional, anonymous requests have a lower quota.
+type GoogleBooksProvider struct {
+	BaseURL string
+	APIKey  string
+}
+
+type GoogleBooksVolumesStruct struct {
+	Items []struct {
+		VolumeInfo struct {
+			Title               string   `json:"title"`
+			Subtitle            string   `json:"subtitle"`
+			Authors             []string `json:"authors"`
+			Publisher           string   `json:"publisher"`
+			PublishedDate       string   `json:"publishedDate"`
+			Description         string   `json:"description"`
+			Categories          []string `json:"categories"`
+			Language            string   `json:"language"`
+			IndustryIdentifiers []struct {
+				Type       string `json:"type"`
+				Identifier string `json:"identifier"`
+			} `json:"industryIdentifiers"`
+			ImageLinks struct {
+				Thumbnail string `json:"thumbnail"`
+			} `json:"imageLinks"`
+		} `json:"volumeInfo"`
+	} `json:"items"`
+}
+
+func (p GoogleBooksProvider) Name() string {
+	return "Google Books"
+}
+
+func (p GoogleBooksProvider) IsCoverURL(coverURL string) bool {
+	return _IsCoverHost(coverURL, "books.google.com", "books.googleusercontent.com")
+}
+
+func (p GoogleBooksProvider) Search(query MetadataQueryStruct) ([]MetadataProposalStruct, error) {
+	q := "isbn:" + query.ISBN
+	if query.ISBN == "" {
+		q = "intitle:" + query.Title
+		if query.Author != "" {
+			q += " inauthor:" + query.Author
+		}
+	}
+
+	params := url.Values{}
+	params.Set("q", q)
+	params.Set("maxResults", fmt.Sprint(metadataLookupLimit))
+	if p.APIKey != "" {
+		params.Set("key", p.APIKey)
+	}
+
+	data, err := _FetchMetadataURL(p.BaseURL + "/books/v1/volumes?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	result := GoogleBooksVolumesStruct{}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	proposals := []MetadataProposalStruct{}
+	for _, item := range result.Items {
+		volume := item.VolumeInfo
+		proposal := MetadataProposalStruct{
+			Provider: p.Name(),
+			Title:    _LookupTitle(volume.Title, volume.Subtitle),
+			Authors:  volume.Authors,
+			BookDetailsStruct: BookDetailsStruct{
+				Tags:        volume.Categories,
+				Language:    volume.Language,
+				Publisher:   volume.Publisher,
+				Description: _PlainDescription(volume.Description),
+				PublishedOn: volume.PublishedDate,
+			},
+		}
+		for _, identifier := range volume.IndustryIdentifiers {
+			if identifier.Type == "ISBN_13" || (identifier.Type == "ISBN_10" && proposal.ISBN == "") {
+				proposal.ISBN = identifier.Identifier
+			}
+		}
+		// Thumbnails are linked over http
+		proposal.CoverURL = strings.Replace(volume.ImageLinks.Thumbnail, "http://", "https://", 1)
+		proposal.BookDetailsStruct = _CleanBookDetails(proposal.BookDetailsStruct)
+
+		proposals = append(proposals, proposal)
+	}
+	return proposals, nil
+}
+
+// Download a cover proposed by a provider to the uploads, returns the cover
+// path stored in the book table
+func _SaveLookupCover(fileName string, coverURL string) (string, error) {
+	allowed := false
+	for _, provider := range _GetMetadataProviders() {
+		if provider.IsCoverURL(coverURL) {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return "", errors.New("cover is not from a metadata provider")
+	}
+
+	data, err := _FetchMetadataURL(coverURL)
+	if err != nil {
+		return "", err
+	}
+
+	var ext string
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		ext = ".jpg"
+	case "image/png":
+		ext = ".png"
+	case "image/gif":
+		ext = ".gif"
+	default:
+		return "", errors.New("cover is not an image")
+	}
+
+	cover := "./uploads/img/" + fileName + "-lookup-" + _GetCurrentTime() + ext
+	err = ioutil.WriteFile(cover, data, 0644)
+	if err != nil {
+		return "", err
+	}
+	return cover, nil
+}
+
+type MetadataLookupStruct struct {
+	Proposals []MetadataProposalStruct `json:"proposals"`
+	Errors    []string                 `json:"errors"`
+}
+
+// Look up a book with the enabled providers. The ISBN, title and author
+// default to the ones of the book.
+func (e *Env) GetMetadataLookup(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		fileName := c.Query("fileName")
+		bookId, _, _ := e._GetBookInfo(fileName)
+		if bookId == 0 || e._GetBookPermission(userId, bookId) != SharePermissionOwner {
+			c.String(404, "Book not found")
+			return
+		}
+
+		title, author, _, _ := e._GetBookMetaData(fileName)
+		query := MetadataQueryStruct{
+			ISBN:   e._GetBookDetails(bookId).ISBN,
+			Title:  title,
+			Author: author,
+		}
+		if isbn, ok := c.GetQuery("isbn"); ok {
+			query.ISBN = _NormalizeISBN(isbn)
+		}
+		if t, ok := c.GetQuery("title"); ok {
+			query.Title = strings.TrimSpace(t)
+		}
+		if a, ok := c.GetQuery("author"); ok {
+			query.Author = strings.TrimSpace(a)
+		}
+		if strings.EqualFold(query.Author, "unknown") {
+			query.Author = ""
+		}
+
+		if query.ISBN == "" && query.Title == "" {
+			c.String(400, "Enter an ISBN or a title to look up")
+			return
+		}
+
+		lookup := MetadataLookupStruct{
+			Proposals: []MetadataProposalStruct{},
+			Errors:    []string{},
+		}
+		for _, provider := range _GetMetadataProviders() {
+			proposals, err := provider.Search(query)
+			if err != nil {
+				fmt.Println(provider.Name(), err)
+				lookup.Errors = append(lookup.Errors, provider.Name()+": "+err.Error())
+				continue
+			}
+			lookup.Proposals = append(lookup.Proposals, proposals...)
+		}
+
+		c.JSON(200, lookup)
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
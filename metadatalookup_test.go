@@ -0,0 +1,263 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Read the provider responses recorded in testdata/metadata
+func useMetadataFixtures() func() {
+	fixturePath, record, providers := MetadataFixturePath, MetadataRecord, MetadataProviders
+	MetadataFixturePath, MetadataRecord, MetadataProviders = "testdata/metadata", "0", METADATA_PROVIDERS_DEFAULT
+	return func() {
+		MetadataFixturePath, MetadataRecord, MetadataProviders = fixturePath, record, providers
+	}
+}
+
+func TestMetadataLookup(t *testing.T) {
+	defer useMetadataFixtures()()
+
+	openLibrary := OpenLibraryProvider{BaseURL: "https://openlibrary.org"}
+	googleBooks := GoogleBooksProvider{BaseURL: "https://www.googleapis.com"}
+	// The key is left out of the recorded file names
+	googleBooksKey := GoogleBooksProvider{BaseURL: "https://www.googleapis.com", APIKey: "secret"}
+
+	tests := []struct {
+		name      string
+		provider  MetadataProvider
+		query     MetadataQueryStruct
+		proposals []MetadataProposalStruct
+	}{
+		{
+			name:     "Open Library by ISBN",
+			provider: openLibrary,
+			query:    MetadataQueryStruct{ISBN: "9780441478125", Title: "ignored"},
+			proposals: []MetadataProposalStruct{{
+				Provider: "Open Library",
+				Title:    "The left hand of darkness",
+				Authors:  []string{"Ursula K. Le Guin"},
+				BookDetailsStruct: BookDetailsStruct{
+					Tags:        []string{"Science fiction", "Gender identity", "Hainish"},
+					Publisher:   "Ace Books",
+					ISBN:        "9780441478125",
+					PublishedOn: "1987",
+				},
+				CoverURL: "https://covers.openlibrary.org/b/id/8244095-L.jpg",
+			}},
+		},
+		{
+			name:      "Open Library unknown ISBN",
+			provider:  openLibrary,
+			query:     MetadataQueryStruct{ISBN: "9780000000002"},
+			proposals: []MetadataProposalStruct{},
+		},
+		{
+			name:     "Open Library by title and author",
+			provider: openLibrary,
+			query:    MetadataQueryStruct{Title: "The Left Hand of Darkness", Author: "Ursula K. Le Guin"},
+			proposals: []MetadataProposalStruct{
+				{
+					Provider: "Open Library",
+					Title:    "The Left Hand of Darkness",
+					Authors:  []string{"Ursula K. Le Guin"},
+					BookDetailsStruct: BookDetailsStruct{
+						Tags: []string{"Science fiction", "Gender identity", "Hainish", "Androgyny", "Interplanetary voyages",
+							"Fiction", "Life on other planets", "Diplomats", "Winter", "Telepathy"},
+						Language:    "eng",
+						Publisher:   "Ace Books",
+						ISBN:        "9780441478125",
+						PublishedOn: "1969",
+					},
+					CoverURL: "https://covers.openlibrary.org/b/id/8244095-L.jpg",
+				},
+				{
+					Provider: "Open Library",
+					Title:    "Ursula K. Le Guin's The left hand of darkness: Bloom's modern critical interpretations",
+					Authors:  []string{"Harold Bloom"},
+					BookDetailsStruct: BookDetailsStruct{
+						Tags:        []string{},
+						Publisher:   "Chelsea House",
+						ISBN:        "1555460852",
+						PublishedOn: "1987",
+					},
+				},
+			},
+		},
+		{
+			name:     "Google Books by ISBN",
+			provider: googleBooks,
+			query:    MetadataQueryStruct{ISBN: "9780441478125"},
+			proposals: []MetadataProposalStruct{{
+				Provider: "Google Books",
+				Title:    "The Left Hand of Darkness: 50th Anniversary Edition",
+				Authors:  []string{"Ursula K. Le Guin"},
+				BookDetailsStruct: BookDetailsStruct{
+					Tags:        []string{"Fiction"},
+					Language:    "en",
+					Publisher:   "Penguin",
+					ISBN:        "9780441478125",
+					Description: "A groundbreaking work of science fiction, The Left Hand of Darkness tells the story of a lone human emissary to Winter & its people.",
+					PublishedOn: "1987-03-15",
+				},
+				CoverURL: "https://books.google.com/books/content?id=1JbgAAAAMAAJ&printsec=frontcover&img=1&zoom=1&source=gbs_api",
+			}},
+		},
+		{
+			name:     "Google Books by title and author",
+			provider: googleBooksKey,
+			query:    MetadataQueryStruct{Title: "The Left Hand of Darkness", Author: "Ursula K. Le Guin"},
+			proposals: []MetadataProposalStruct{
+				{
+					Provider: "Google Books",
+					Title:    "The Left Hand of Darkness",
+					Authors:  []string{"Ursula K. Le Guin"},
+					BookDetailsStruct: BookDetailsStruct{
+						Tags:        []string{"Fiction"},
+						Language:    "en",
+						Publisher:   "Ace Books",
+						ISBN:        "0441478123",
+						PublishedOn: "1976",
+					},
+				},
+				{
+					Provider: "Google Books",
+					Title:    "The Left Hand of Darkness",
+					Authors:  []string{"Ursula K. Le Guin", "David Mitchell"},
+					BookDetailsStruct: BookDetailsStruct{
+						Tags:        []string{"Fiction / Science Fiction / General"},
+						Language:    "en",
+						Publisher:   "Hachette UK",
+						ISBN:        "9781473221628",
+						PublishedOn: "2018-05",
+					},
+					CoverURL: "https://books.google.com/books/content?id=xX3aDwAAQBAJ&printsec=frontcover&img=1&zoom=1&edge=curl&source=gbs_api",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		proposals, err := test.provider.Search(test.query)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(proposals, test.proposals) {
+			t.Errorf("%s:\n got %+v\nwant %+v", test.name, proposals, test.proposals)
+		}
+	}
+}
+
+func TestMetadataLookupWithoutFixture(t *testing.T) {
+	defer useMetadataFixtures()()
+
+	_, err := GoogleBooksProvider{BaseURL: "https://www.googleapis.com"}.Search(MetadataQueryStruct{ISBN: "9780306406157"})
+	if err == nil || !strings.Contains(err.Error(), "no recorded response") {
+		t.Errorf("got %v, want no recorded response", err)
+	}
+}
+
+func TestMetadataCoverHosts(t *testing.T) {
+	openLibrary := OpenLibraryProvider{}
+	googleBooks := GoogleBooksProvider{}
+
+	tests := []struct {
+		provider MetadataProvider
+		coverURL string
+		allowed  bool
+	}{
+		{openLibrary, "https://covers.openlibrary.org/b/id/8244095-L.jpg", true},
+		{openLibrary, "http://covers.openlibrary.org/b/id/8244095-L.jpg", true},
+		{openLibrary, "https://covers.openlibrary.org.example.com/b/id/8244095-L.jpg", false},
+		{openLibrary, "https://example.com/?u=https://covers.openlibrary.org/b/id/8244095-L.jpg", false},
+		{openLibrary, "ftp://covers.openlibrary.org/b/id/8244095-L.jpg", false},
+		{openLibrary, "file:///etc/passwd", false},
+		{openLibrary, "https://books.google.com/books/content?id=1JbgAAAAMAAJ", false},
+		{openLibrary, "", false},
+		{googleBooks, "https://books.google.com/books/content?id=1JbgAAAAMAAJ", true},
+		{googleBooks, "https://books.googleusercontent.com/books/content?id=1JbgAAAAMAAJ", true},
+		{googleBooks, "https://google.com/books/content?id=1JbgAAAAMAAJ", false},
+		{googleBooks, "https://covers.openlibrary.org/b/id/8244095-L.jpg", false},
+	}
+
+	for _, test := range tests {
+		if allowed := test.provider.IsCoverURL(test.coverURL); allowed != test.allowed {
+			t.Errorf("%s IsCoverURL(%q) = %v, want %v", test.provider.Name(), test.coverURL, allowed, test.allowed)
+		}
+	}
+}
+
+func TestSaveLookupCoverRejectsOtherHosts(t *testing.T) {
+	defer useMetadataFixtures()()
+
+	for _, coverURL := range []string{"http://127.0.0.1/cover.jpg", "https://example.com/cover.jpg"} {
+		_, err := _SaveLookupCover("book.epub", coverURL)
+		if err == nil || err.Error() != "cover is not from a metadata provider" {
+			t.Errorf("_SaveLookupCover(%q) = %v, want the cover to be rejected", coverURL, err)
+		}
+	}
+
+	// Covers of a disabled provider are rejected too
+	MetadataProviders = "googlebooks"
+	_, err := _SaveLookupCover("book.epub", "https://covers.openlibrary.org/b/id/8244095-L.jpg")
+	if err == nil {
+		t.Error("cover of a disabled provider was accepted")
+	}
+}
+
+func TestLookupPublicationDate(t *testing.T) {
+	tests := []struct {
+		date string
+		want string
+	}{
+		{"1987", "1987"},
+		{"1987-03", "1987-03"},
+		{"1987-03-15", "1987-03-15"},
+		{"1987-03-15T00:00:00Z", "1987-03-15"},
+		{" 1987-03-15 ", "1987-03-15"},
+		{"March 15, 1987", "1987"},
+		{"Mar 1987", "1987"},
+		{"c1987", ""},
+		{"unknown", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := _LookupPublicationDate(test.date); got != test.want {
+			t.Errorf("_LookupPublicationDate(%q) = %q, want %q", test.date, got, test.want)
+		}
+	}
+}
+
+func TestMetadataFixtureName(t *testing.T) {
+	withKey := _MetadataFixtureName("https://www.googleapis.com/books/v1/volumes?q=isbn%3A9780441478125&maxResults=5&key=secret")
+	withoutKey := _MetadataFixtureName("https://www.googleapis.com/books/v1/volumes?maxResults=5&q=isbn%3A9780441478125")
+	if withKey != withoutKey || strings.Contains(withKey, "secret") {
+		t.Errorf("got %q and %q, want the same name without the key", withKey, withoutKey)
+	}
+
+	long := _MetadataFixtureName("https://openlibrary.org/search.json?title=" + strings.Repeat("a", 200))
+	if len(long) > 100 {
+		t.Errorf("name of %d characters, want at most 100", len(long))
+	}
+}
@@ -0,0 +1,377 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Colors of the highlight menu in the viewers
+var highlightColors = []struct {
+	Name string
+	RGB  [3]int
+}{
+	{"yellow", [3]int{154, 154, 8}},
+	{"orange", [3]int{199, 138, 25}},
+	{"green", [3]int{4, 195, 4}},
+	{"blue", [3]int{93, 93, 255}},
+	{"gray", [3]int{160, 160, 160}},
+	{"turquoise", [3]int{26, 193, 177}},
+	{"purple", [3]int{165, 24, 236}},
+	{"chartreuse", [3]int{113, 193, 32}},
+	{"crimson", [3]int{237, 20, 61}},
+}
+
+var colorComponentRegexp = regexp.MustCompile(`\d+`)
+
+// Name of a highlight color saved by the viewers, e.g. rgba(154, 154, 8, 1)
+// is yellow. Returns an empty string for other colors.
+func _HighlightColorName(color string) string {
+	components := colorComponentRegexp.FindAllString(color, 3)
+	if len(components) < 3 {
+		return ""
+	}
+
+	var rgb [3]int
+	for i, component := range components {
+		rgb[i], _ = strconv.Atoi(component)
+	}
+
+	for _, c := range highlightColors {
+		if c.RGB == rgb {
+			return c.Name
+		}
+	}
+	return ""
+}
+
+// Highlight or note of a PDF or EPUB book. Page is set for PDF highlights,
+// Chapter and CFI for EPUB annotations. URL opens the viewer at the highlight.
+type NotebookEntryStruct struct {
+	Id        int64  `json:"id"`
+	Format    string `json:"format"`
+	FileName  string `json:"fileName"`
+	Title     string `json:"title"`
+	Author    string `json:"author"`
+	Quote     string `json:"quote"`
+	Note      string `json:"note"`
+	Color     string `json:"color"`
+	ColorName string `json:"colorName"`
+	Page      int64  `json:"page"`
+	Chapter   string `json:"chapter"`
+	CFI       string `json:"cfi"`
+	URL       string `json:"url"`
+	CreatedOn string `json:"createdOn"`
+	UpdatedOn string `json:"updatedOn"`
+	Date      string `json:"date"`
+	position  []int64
+}
+
+type NotebookFilterStruct struct {
+	FileName string
+	Color    string
+	From     string
+	To       string
+	Text     string
+	Sort     string
+}
+
+const (
+	NotebookSortPosition = "position"
+	NotebookSortRecent   = "recent"
+)
+
+func _GetNotebookFilter(c *gin.Context) NotebookFilterStruct {
+	filter := NotebookFilterStruct{
+		FileName: c.Query("fileName"),
+		Color:    c.Query("color"),
+		From:     c.Query("from"),
+		To:       c.Query("to"),
+		Text:     c.Query("q"),
+		Sort:     c.Query("sort"),
+	}
+	if filter.Sort != NotebookSortPosition {
+		filter.Sort = NotebookSortRecent
+	}
+	return filter
+}
+
+// Position of an EPUB annotation for sorting: the spine index followed by
+// the steps and the character offset of the start of the range
+func _EPUBCFIPosition(cfi string) []int64 {
+	cfi = strings.TrimSuffix(strings.TrimPrefix(cfi, "epubcfi("), ")")
+	parts := strings.Split(cfi, "!")
+	if len(parts) != 2 {
+		return nil
+	}
+
+	var position []int64
+	spine := strings.Split(parts[0], "/")
+	spineStep, _ := strconv.ParseInt(spine[len(spine)-1], 10, 64)
+	position = append(position, spineStep/2-1)
+
+	sections := strings.Split(parts[1], ",")
+	path := sections[0]
+	if len(sections) == 3 {
+		path += sections[1]
+	}
+
+	offset := int64(0)
+	if i := strings.Index(path, ":"); i >= 0 {
+		offset, _ = strconv.ParseInt(path[i+1:], 10, 64)
+		path = path[:i]
+	}
+	for _, step := range strings.Split(path, "/") {
+		if step == "" {
+			continue
+		}
+		n, _ := strconv.ParseInt(step, 10, 64)
+		position = append(position, n)
+	}
+
+	return append(position, offset)
+}
+
+func _ComparePositions(a []int64, b []int64) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// Viewer URL of the location of an entry. The PDF viewer scrolls to the
+// highlight on the page, the EPUB viewer opens the chapter at the CFI.
+func _GetNotebookEntryURL(bookURL string, entry NotebookEntryStruct) string {
+	if entry.Format == "pdf" {
+		return bookURL + "#page=" + strconv.Itoa(int(entry.Page)) + "&highlight=" + strconv.Itoa(int(entry.Id))
+	}
+	return bookURL + "#page=" + entry.Chapter + "&cfi=" + url.QueryEscape(entry.CFI)
+}
+
+func (e *Env) _GetPDFNotebookEntries(userId int64, fileName string) []NotebookEntryStruct {
+	query := "SELECT `pdf_highlighter`.`id`, `book`.`filename`, `book`.`title`, `book`.`author`, `book`.`url`," +
+		" `pdf_highlighter`.`highlight_color`, `pdf_highlighter`.`highlight_comment`, `pdf_highlighter`.`created_on`," +
+		" `pdf_highlighter`.`updated_on` FROM `pdf_highlighter` JOIN `book` ON `book`.`id` = `pdf_highlighter`.`book_id`" +
+		" WHERE `pdf_highlighter`.`user_id` = ? AND `book`.`deleted_on` = ''"
+	args := []interface{}{userId}
+	if fileName != "" {
+		query += " AND `book`.`filename` = ?"
+		args = append(args, fileName)
+	}
+
+	rows, err := e.db.Query(query, args...)
+	CheckError(err)
+
+	var (
+		entries  []NotebookEntryStruct
+		bookURLs []string
+	)
+	for rows.Next() {
+		var bookURL string
+		entry := NotebookEntryStruct{Format: "pdf"}
+		err := rows.Scan(&entry.Id, &entry.FileName, &entry.Title, &entry.Author, &bookURL, &entry.Color, &entry.Note, &entry.CreatedOn, &entry.UpdatedOn)
+		CheckError(err)
+
+		entries = append(entries, entry)
+		bookURLs = append(bookURLs, bookURL)
+	}
+	rows.Close()
+
+	for i := range entries {
+		var quote []string
+		for _, anchor := range e._GetPDFHighlightAnchors(entries[i].Id) {
+			if entries[i].Page == 0 {
+				entries[i].Page = anchor.Page
+				entries[i].position = []int64{anchor.Page, anchor.Start}
+			}
+			quote = append(quote, anchor.Quote)
+		}
+		entries[i].Quote = strings.Join(quote, " ")
+		entries[i].ColorName = _HighlightColorName(entries[i].Color)
+		entries[i].Date = _FormatDate(entries[i].CreatedOn)
+		entries[i].URL = _GetNotebookEntryURL(bookURLs[i], entries[i])
+	}
+
+	return entries
+}
+
+func (e *Env) _GetEPUBNotebookEntries(userId int64, fileName string) []NotebookEntryStruct {
+	query := "SELECT `epub_annotation`.`id`, `book`.`filename`, `book`.`title`, `book`.`author`, `book`.`url`," +
+		" `epub_annotation`.`spine_href`, `epub_annotation`.`cfi`, `epub_annotation`.`quote`, `epub_annotation`.`color`," +
+		" `epub_annotation`.`note`, `epub_annotation`.`created_on`, `epub_annotation`.`updated_on`" +
+		" FROM `epub_annotation` JOIN `book` ON `book`.`id` = `epub_annotation`.`book_id` WHERE `epub_annotation`.`user_id` = ? AND `book`.`deleted_on` = ''"
+	args := []interface{}{userId}
+	if fileName != "" {
+		query += " AND `book`.`filename` = ?"
+		args = append(args, fileName)
+	}
+
+	rows, err := e.db.Query(query, args...)
+	CheckError(err)
+
+	var entries []NotebookEntryStruct
+	for rows.Next() {
+		var bookURL string
+		entry := NotebookEntryStruct{Format: "epub"}
+		err := rows.Scan(&entry.Id, &entry.FileName, &entry.Title, &entry.Author, &bookURL, &entry.Chapter, &entry.CFI,
+			&entry.Quote, &entry.Color, &entry.Note, &entry.CreatedOn, &entry.UpdatedOn)
+		CheckError(err)
+
+		entry.ColorName = _HighlightColorName(entry.Color)
+		entry.Date = _FormatDate(entry.CreatedOn)
+		entry.position = _EPUBCFIPosition(entry.CFI)
+		entry.URL = _GetNotebookEntryURL(bookURL, entry)
+		entries = append(entries, entry)
+	}
+	rows.Close()
+
+	return entries
+}
+
+// YYYY-MM-DD to the stored time format, at the start or the end of the day
+func _NotebookFilterTime(date string, endOfDay bool) string {
+	date = strings.Replace(date, "-", "", -1)
+	if len(date) != 8 {
+		return ""
+	}
+	if endOfDay {
+		return date + "235959"
+	}
+	return date + "000000"
+}
+
+func _MatchNotebookFilter(entry NotebookEntryStruct, filter NotebookFilterStruct) bool {
+	if filter.Color != "" && entry.ColorName != filter.Color {
+		return false
+	}
+	if from := _NotebookFilterTime(filter.From, false); from != "" && entry.CreatedOn < from {
+		return false
+	}
+	if to := _NotebookFilterTime(filter.To, true); to != "" && (entry.CreatedOn == "" || entry.CreatedOn > to) {
+		return false
+	}
+	if filter.Text != "" {
+		text := strings.ToLower(filter.Text)
+		if !strings.Contains(strings.ToLower(entry.Quote), text) && !strings.Contains(strings.ToLower(entry.Note), text) {
+			return false
+		}
+	}
+	return true
+}
+
+// Highlights and notes of the user across all books, or a single book when
+// the filter has a file name. Sorting by position groups them by book in the
+// order they appear; by recency puts the newest first.
+func (e *Env) _GetNotebookEntries(userId int64, filter NotebookFilterStruct) []NotebookEntryStruct {
+	entries := []NotebookEntryStruct{}
+	for _, entry := range append(e._GetPDFNotebookEntries(userId, filter.FileName), e._GetEPUBNotebookEntries(userId, filter.FileName)...) {
+		if _MatchNotebookFilter(entry, filter) {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if filter.Sort == NotebookSortPosition {
+			if a.Title != b.Title {
+				return a.Title < b.Title
+			}
+			if a.FileName != b.FileName {
+				return a.FileName < b.FileName
+			}
+			return _ComparePositions(a.position, b.position) < 0
+		}
+		if a.CreatedOn != b.CreatedOn {
+			return a.CreatedOn > b.CreatedOn
+		}
+		return a.Id > b.Id
+	})
+
+	return entries
+}
+
+type NotebookBookStruct struct {
+	FileName string
+	Title    string
+}
+
+// Books with at least one highlight, for the book filter
+func (e *Env) _GetNotebookBooks(userId int64) []NotebookBookStruct {
+	rows, err := e.db.Query("SELECT `filename`, `title` FROM `book` WHERE `id` IN"+
+		" (SELECT `book_id` FROM `pdf_highlighter` WHERE `user_id` = ? UNION SELECT `book_id` FROM `epub_annotation` WHERE `user_id` = ?)"+
+		" AND `deleted_on` = '' ORDER BY `title`", userId, userId)
+	CheckError(err)
+
+	var books []NotebookBookStruct
+	for rows.Next() {
+		book := NotebookBookStruct{}
+		err := rows.Scan(&book.FileName, &book.Title)
+		CheckError(err)
+
+		books = append(books, book)
+	}
+	rows.Close()
+
+	return books
+}
+
+func (e *Env) GetNotebookEntries(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		c.JSON(200, e._GetNotebookEntries(userId, _GetNotebookFilter(c)))
+	} else {
+		c.JSON(200, "Not signed in")
+	}
+}
+
+func (e *Env) GetNotebook(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+		filter := _GetNotebookFilter(c)
+
+		var colors []string
+		for _, color := range highlightColors {
+			colors = append(colors, color.Name)
+		}
+
+		c.HTML(200, "notebook.html", gin.H{
+			"filter":  filter,
+			"books":   e._GetNotebookBooks(userId),
+			"colors":  colors,
+			"entries": e._GetNotebookEntries(userId, filter),
+		})
+	} else {
+		c.Redirect(302, "/signin")
+	}
+}
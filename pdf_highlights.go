@@ -0,0 +1,279 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Bounding rectangle of a highlight as fractions of the page width and height
+type PDFHighlightRectStruct struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// Part of a highlight on one page. Start and End count the non-whitespace
+// characters of the page text before the start and the end of the highlight,
+// so they don't depend on how the viewer splits the text into elements.
+// Highlights migrated from older versions may have no offsets (-1) or rects,
+// the viewer then looks for the quote.
+type PDFHighlightAnchorStruct struct {
+	HId   int64                    `json:"hid"`
+	Page  int64                    `json:"page"`
+	Quote string                   `json:"quote"`
+	Start int64                    `json:"start"`
+	End   int64                    `json:"end"`
+	Rects []PDFHighlightRectStruct `json:"rects"`
+}
+
+// Imported highlights keep their creation time
+func (e *Env) _InsertPDFHighlight(bookId int64, userId int64, color string, comment string, createdOn string) int64 {
+	stmt, err := e.db.Prepare("INSERT INTO `pdf_highlighter` (book_id, user_id, highlight_color, highlight_top, highlight_comment, created_on, updated_on) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	CheckError(err)
+
+	res, err := stmt.Exec(bookId, userId, color, "", comment, createdOn, createdOn)
+	CheckError(err)
+
+	id, err := res.LastInsertId()
+	CheckError(err)
+
+	return id
+}
+
+func (e *Env) _InsertPDFHighlightAnchor(highlighterId int64, anchor PDFHighlightAnchorStruct) {
+	if anchor.Rects == nil {
+		anchor.Rects = []PDFHighlightRectStruct{}
+	}
+	rects, err := json.Marshal(anchor.Rects)
+	CheckError(err)
+
+	stmt, err := e.db.Prepare("INSERT INTO `pdf_highlight_anchor` (highlighter_id, page, quote, start_offset, end_offset, rects) VALUES (?, ?, ?, ?, ?, ?)")
+	CheckError(err)
+
+	_, err = stmt.Exec(highlighterId, anchor.Page, anchor.Quote, anchor.Start, anchor.End, string(rects))
+	CheckError(err)
+}
+
+func (e *Env) _GetPDFHighlightAnchors(highlighterId int64) []PDFHighlightAnchorStruct {
+	rows, err := e.db.Query("SELECT `page`, `quote`, `start_offset`, `end_offset`, `rects` FROM `pdf_highlight_anchor` WHERE `highlighter_id` = ? ORDER BY `page`", highlighterId)
+	CheckError(err)
+
+	anchors := []PDFHighlightAnchorStruct{}
+	for rows.Next() {
+		var rects string
+		anchor := PDFHighlightAnchorStruct{HId: highlighterId}
+		err := rows.Scan(&anchor.Page, &anchor.Quote, &anchor.Start, &anchor.End, &rects)
+		CheckError(err)
+
+		err = json.Unmarshal([]byte(rects), &anchor.Rects)
+		CheckError(err)
+		if anchor.Rects == nil {
+			anchor.Rects = []PDFHighlightRectStruct{}
+		}
+
+		anchors = append(anchors, anchor)
+	}
+	rows.Close()
+
+	return anchors
+}
+
+func _StripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// Text of a page as extracted by poppler
+func _GetPDFPageText(filePath string, page int64) (string, error) {
+	p := strconv.Itoa(int(page))
+	cmd := exec.Command("pdftotext", "-f", p, "-l", p, "-enc", "UTF-8", filePath, "-")
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	err := cmd.Run()
+	return out.String(), err
+}
+
+var (
+	pdfHighlightedSpanRegexp = regexp.MustCompile(`(?s)<span[^>]*class="[^"]*highlighted[^"]*"[^>]*>(.*?)</span>`)
+	htmlTagRegexp            = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+func _HTMLToText(s string) string {
+	return html.UnescapeString(htmlTagRegexp.ReplaceAllString(s, ""))
+}
+
+// Split the saved HTML of a text layer element into the whole text, the text
+// before the highlight and the highlighted text
+func _ParsePDFHighlightHTML(content string) (string, string, string) {
+	matches := pdfHighlightedSpanRegexp.FindAllStringSubmatchIndex(content, -1)
+	if len(matches) == 0 {
+		return _HTMLToText(content), "", ""
+	}
+
+	var quote []string
+	for _, m := range matches {
+		quote = append(quote, _HTMLToText(content[m[2]:m[3]]))
+	}
+
+	return _HTMLToText(content), _HTMLToText(content[:matches[0][0]]), strings.Join(quote, "")
+}
+
+type pdfHighlightDetailStruct struct {
+	id          int64
+	hid         int64
+	page        int64
+	htmlContent string
+	filePath    string
+}
+
+// Highlights used to be saved as the HTML of the text layer elements they
+// cover, identified by their position on the page, which changes between
+// PDF.js versions. Convert them to text anchors by finding the text of each
+// element in the page text. Details are removed once converted, books which
+// can't be read are retried on the next start.
+func (e *Env) _MigratePDFHighlights() {
+	rows, err := e.db.Query("SELECT `pdf_highlighter_detail`.`id`, `pdf_highlighter_detail`.`highlighter_id`," +
+		" `pdf_highlighter_detail`.`page_index`, `pdf_highlighter_detail`.`html_content`, `book`.`file_path`" +
+		" FROM `pdf_highlighter_detail`" +
+		" JOIN `pdf_highlighter` ON `pdf_highlighter`.`id` = `pdf_highlighter_detail`.`highlighter_id`" +
+		" JOIN `book` ON `book`.`id` = `pdf_highlighter`.`book_id`" +
+		" ORDER BY `pdf_highlighter_detail`.`highlighter_id`, CAST(`pdf_highlighter_detail`.`page_index` AS INTEGER)," +
+		" CAST(`pdf_highlighter_detail`.`div_index` AS INTEGER)")
+	CheckError(err)
+
+	var details []pdfHighlightDetailStruct
+	for rows.Next() {
+		var (
+			detail pdfHighlightDetailStruct
+			page   string
+		)
+		err := rows.Scan(&detail.id, &detail.hid, &page, &detail.htmlContent, &detail.filePath)
+		CheckError(err)
+
+		detail.page, err = strconv.ParseInt(page, 10, 64)
+		CheckError(err)
+
+		details = append(details, detail)
+	}
+	rows.Close()
+
+	if len(details) == 0 {
+		return
+	}
+
+	fmt.Println("Migrating " + strconv.Itoa(len(details)) + " PDF highlight details")
+
+	pageTexts := make(map[string]string)
+	for i := 0; i < len(details); {
+		// Details of the same highlight on the same page become one anchor
+		j := i
+		for j < len(details) && details[j].hid == details[i].hid && details[j].page == details[i].page {
+			j++
+		}
+		group := details[i:j]
+		i = j
+
+		key := group[0].filePath + ":" + strconv.Itoa(int(group[0].page))
+		pageText, ok := pageTexts[key]
+		if !ok {
+			text, err := _GetPDFPageText(group[0].filePath, group[0].page)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			pageText = _StripWhitespace(text)
+			pageTexts[key] = pageText
+		}
+
+		anchor := PDFHighlightAnchorStruct{Page: group[0].page, Start: -1, End: -1}
+		var quote []string
+		for _, detail := range group {
+			text, prefix, highlighted := _ParsePDFHighlightHTML(detail.htmlContent)
+			if highlighted == "" {
+				continue
+			}
+			quote = append(quote, strings.TrimSpace(highlighted))
+
+			var start, end int64
+			if pos := strings.Index(pageText, _StripWhitespace(text)); pos >= 0 && text != "" {
+				start = int64(utf8.RuneCountInString(pageText[:pos]) + utf8.RuneCountInString(_StripWhitespace(prefix)))
+			} else if pos := strings.Index(pageText, _StripWhitespace(highlighted)); pos >= 0 {
+				start = int64(utf8.RuneCountInString(pageText[:pos]))
+			} else {
+				continue
+			}
+			end = start + int64(utf8.RuneCountInString(_StripWhitespace(highlighted)))
+
+			if anchor.Start < 0 || start < anchor.Start {
+				anchor.Start = start
+			}
+			if end > anchor.End {
+				anchor.End = end
+			}
+		}
+		anchor.Quote = strings.Join(quote, " ")
+
+		// Without a highlighted span, the text of the details is kept as the
+		// quote, which the viewer searches for when the offsets don't match
+		if anchor.Quote == "" {
+			var texts []string
+			for _, detail := range group {
+				if text := strings.TrimSpace(_HTMLToText(detail.htmlContent)); text != "" {
+					texts = append(texts, text)
+				}
+			}
+			anchor.Quote = strings.Join(texts, " ")
+			anchor.Start, anchor.End = -1, -1
+		}
+
+		// Nothing to anchor the highlight to, the details are kept
+		if anchor.Quote == "" {
+			fmt.Println("PDF highlight " + strconv.Itoa(int(group[0].hid)) + " on page " + strconv.Itoa(int(group[0].page)) + " could not be migrated")
+			continue
+		}
+
+		e._InsertPDFHighlightAnchor(group[0].hid, anchor)
+
+		for _, detail := range group {
+			stmt, err := e.db.Prepare("DELETE FROM `pdf_highlighter_detail` WHERE id=?")
+			CheckError(err)
+
+			_, err = stmt.Exec(detail.id)
+			CheckError(err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reading position of a user in a book. PDFs use page and scroll, EPUBs use
+// spine index, scroll and CFI. Scroll is the fraction (0 to 1) of the current
+// page or chapter which has been scrolled past.
+type ReadingProgressStruct struct {
+	FileName   string  `json:"fileName"`
+	Page       int64   `json:"page"`
+	Scroll     float64 `json:"scroll"`
+	SpineIndex int64   `json:"spineIndex"`
+	CFI        string  `json:"cfi"`
+	Percentage float64 `json:"percentage"`
+	CreatedOn  string  `json:"createdOn"`
+	UpdatedOn  string  `json:"updatedOn"`
+}
+
+// Total number of pages of a PDF or spine items of an EPUB
+func (e *Env) _GetBookLength(fileName string, format string) int64 {
+	if format == "pdf" {
+		rows, err := e.db.Query("SELECT `pages` FROM `book` WHERE `filename` = ?", fileName)
+		CheckError(err)
+
+		var pages int64
+		if rows.Next() {
+			err := rows.Scan(&pages)
+			CheckError(err)
+		}
+		rows.Close()
+
+		return pages
+	}
+
+	val, err := e.RedisClient.Get(fileName + "...total_pages...").Result()
+	CheckError(err)
+
+	totalPages, err := strconv.ParseInt(val, 10, 64)
+	CheckError(err)
+
+	return totalPages
+}
+
+func _ComputeReadingPercentage(format string, page int64, spineIndex int64, scroll float64, length int64) float64 {
+	if length <= 0 {
+		return 0
+	}
+
+	if scroll < 0 {
+		scroll = 0
+	} else if scroll > 1 {
+		scroll = 1
+	}
+
+	var position float64
+	if format == "pdf" {
+		position = float64(page-1) + scroll
+	} else {
+		position = float64(spineIndex) + scroll
+	}
+
+	percentage := position / float64(length) * 100
+	if percentage < 0 {
+		percentage = 0
+	} else if percentage > 100 {
+		percentage = 100
+	}
+
+	return percentage
+}
+
+func (e *Env) _GetReadingProgress(userId int64, bookId int64) (ReadingProgressStruct, bool) {
+	rows, err := e.db.Query("SELECT `page`, `scroll`, `spine_index`, `cfi`, `percentage`, `created_on`, `updated_on` FROM `reading_progress` WHERE `user_id` = ? AND `book_id` = ?", userId, bookId)
+	CheckError(err)
+
+	progress := ReadingProgressStruct{}
+	found := false
+	if rows.Next() {
+		err := rows.Scan(&progress.Page, &progress.Scroll, &progress.SpineIndex, &progress.CFI, &progress.Percentage, &progress.CreatedOn, &progress.UpdatedOn)
+		CheckError(err)
+		found = true
+	}
+	rows.Close()
+
+	return progress, found
+}
+
+func (e *Env) _SaveReadingProgress(userId int64, bookId int64, progress ReadingProgressStruct) {
+	updatedOn := _GetCurrentTime()
+
+	if _, found := e._GetReadingProgress(userId, bookId); found {
+		stmt, err := e.db.Prepare("UPDATE `reading_progress` SET page=?, scroll=?, spine_index=?, cfi=?, percentage=?, updated_on=? WHERE user_id=? AND book_id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(progress.Page, progress.Scroll, progress.SpineIndex, progress.CFI, progress.Percentage, updatedOn, userId, bookId)
+		CheckError(err)
+	} else {
+		stmt, err := e.db.Prepare("INSERT INTO `reading_progress` (user_id, book_id, page, scroll, spine_index, cfi, percentage, created_on, updated_on) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		CheckError(err)
+
+		_, err = stmt.Exec(userId, bookId, progress.Page, progress.Scroll, progress.SpineIndex, progress.CFI, progress.Percentage, updatedOn, updatedOn)
+		CheckError(err)
+	}
+}
+
+// Clamp the position to the book, compute the percentage and save it
+func (e *Env) _RecordReadingProgress(userId int64, bookId int64, format string, progress ReadingProgressStruct) ReadingProgressStruct {
+	length := e._GetBookLength(progress.FileName, format)
+	if format == "pdf" {
+		if progress.Page < 1 {
+			progress.Page = 1
+		}
+		progress.SpineIndex = 0
+		progress.CFI = ""
+	} else {
+		if progress.SpineIndex < 0 {
+			progress.SpineIndex = 0
+		}
+		progress.Page = progress.SpineIndex + 1
+	}
+	progress.Percentage = _ComputeReadingPercentage(format, progress.Page, progress.SpineIndex, progress.Scroll, length)
+
+	previous, found := e._GetReadingProgress(userId, bookId)
+	if !found {
+		previous = progress
+	}
+
+	e._SaveReadingProgress(userId, bookId, progress)
+	e._TouchReadingSession(userId, bookId, previous, progress)
+	e._AutoUpdateReadingStatus(userId, bookId, progress.Percentage)
+
+	return progress
+}
+
+func (e *Env) PostReadingProgress(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		progress := ReadingProgressStruct{}
+		err := c.BindJSON(&progress)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		bookId, format, _ := e._GetBookInfo(progress.FileName)
+		if !e._CanAccessBook(userId, bookId) {
+			c.String(404, "Book not found")
+			return
+		}
+
+		progress = e._RecordReadingProgress(userId, bookId, format, progress)
+
+		c.JSON(200, progress)
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) GetReadingProgress(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		fileName := c.Query("fileName")
+
+		userId := e._GetUserId(email.(string))
+		bookId, _, _ := e._GetBookInfo(fileName)
+		if !e._CanAccessBook(userId, bookId) {
+			c.String(404, "Book not found")
+			return
+		}
+
+		progress, _ := e._GetReadingProgress(userId, bookId)
+		progress.FileName = fileName
+
+		c.JSON(200, progress)
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
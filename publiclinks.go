@@ -0,0 +1,466 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/xml"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Public read-only links to a collection. Anyone with the link can see the
+// books' metadata and covers, and download the books if the link allows it.
+// The token is random and the link stops working once revoked or expired.
+type CollectionLinkStruct struct {
+	Id            int64  `json:"id"`
+	CollectionId  int64  `json:"collectionId"`
+	UserId        int64  `json:"-"`
+	Token         string `json:"token"`
+	URL           string `json:"url"`
+	ExpiresOn     string `json:"expiresOn"`
+	Expires       string `json:"expires"`
+	Expired       bool   `json:"expired"`
+	AllowDownload bool   `json:"allowDownload"`
+	OPDS          bool   `json:"opds"`
+	CreatedOn     string `json:"createdOn"`
+}
+
+type PublicBookStruct struct {
+	Id          int64
+	Title       string
+	Author      string
+	Format      string
+	Pages       int64
+	CoverURL    string
+	DownloadURL string
+	UploadedOn  string
+	fileName    string
+	cover       string
+}
+
+func _NewPublicLinkToken() string {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	CheckError(err)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func _PublicCollectionURL(serverURL string, token string) string {
+	return serverURL + "/public/collection/" + token
+}
+
+// Expiry of a link from a YYYY-MM-DD date, at the end of that day. An empty
+// date means the link doesn't expire.
+func _CollectionLinkExpiry(date string) string {
+	return _NotebookFilterTime(date, true)
+}
+
+func (e *Env) _ScanCollectionLinks(query string, args ...interface{}) []CollectionLinkStruct {
+	rows, err := e.db.Query("SELECT `id`, `collection_id`, `user_id`, `token`, `expires_on`, `allow_download`, `opds`, `created_on` FROM `collection_link` WHERE "+query, args...)
+	CheckError(err)
+
+	now := _GetCurrentTime()
+	links := []CollectionLinkStruct{}
+	for rows.Next() {
+		link := CollectionLinkStruct{}
+		err := rows.Scan(&link.Id, &link.CollectionId, &link.UserId, &link.Token, &link.ExpiresOn, &link.AllowDownload, &link.OPDS, &link.CreatedOn)
+		CheckError(err)
+
+		if link.ExpiresOn != "" {
+			link.Expires = _FormatDate(link.ExpiresOn)
+			link.Expired = link.ExpiresOn < now
+		}
+		links = append(links, link)
+	}
+	rows.Close()
+
+	return links
+}
+
+// Link of a token, if it exists and hasn't expired
+func (e *Env) _GetCollectionLink(token string) (CollectionLinkStruct, bool) {
+	links := e._ScanCollectionLinks("`token` = ?", token)
+	if len(links) == 0 || links[0].Expired {
+		return CollectionLinkStruct{}, false
+	}
+	return links[0], true
+}
+
+func (e *Env) _GetCollectionLinks(serverURL string, collectionId int64) []CollectionLinkStruct {
+	links := e._ScanCollectionLinks("`collection_id` = ? ORDER BY `id`", collectionId)
+	for i := range links {
+		links[i].URL = _PublicCollectionURL(serverURL, links[i].Token)
+	}
+	return links
+}
+
+// Books of the collection of a public link matching condition, in the order
+// of the collection. Books of other users and books in the trash are left out.
+func (e *Env) _QueryPublicCollectionBooks(serverURL string, link CollectionLinkStruct, condition string, args ...interface{}) []PublicBookStruct {
+	linkURL := _PublicCollectionURL(serverURL, link.Token)
+
+	args = append([]interface{}{link.CollectionId, link.UserId}, args...)
+	rows, err := e.db.Query("SELECT `book`.`id`, `book`.`title`, `book`.`author`, `book`.`format`, `book`.`pages`, `book`.`filename`, `book`.`cover`, `book`.`uploaded_on`"+
+		" FROM `collection_book` JOIN `book` ON `book`.`id` = `collection_book`.`book_id`"+
+		" WHERE `collection_book`.`collection_id` = ? AND `book`.`user_id` = ? AND `book`.`deleted_on` = ''"+condition+
+		" ORDER BY `collection_book`.`position`, `collection_book`.`id`", args...)
+	CheckError(err)
+
+	books := []PublicBookStruct{}
+	for rows.Next() {
+		book := PublicBookStruct{}
+		err := rows.Scan(&book.Id, &book.Title, &book.Author, &book.Format, &book.Pages, &book.fileName, &book.cover, &book.UploadedOn)
+		CheckError(err)
+
+		bookURL := linkURL + "/books/" + strconv.Itoa(int(book.Id))
+		if book.cover != "" {
+			book.CoverURL = bookURL + "/cover"
+		}
+		if link.AllowDownload {
+			book.DownloadURL = bookURL + "/download"
+		}
+		books = append(books, book)
+	}
+	rows.Close()
+
+	return books
+}
+
+// Books of the collection behind a public link, in the order of the
+// collection page
+func (e *Env) _GetPublicCollectionBooks(serverURL string, link CollectionLinkStruct) []PublicBookStruct {
+	return e._QueryPublicCollectionBooks(serverURL, link, "")
+}
+
+// Book of a public link by the id in the URL
+func (e *Env) _GetPublicCollectionBook(c *gin.Context) (PublicBookStruct, bool) {
+	link, ok := e._GetCollectionLink(c.Param("token"))
+	if !ok {
+		return PublicBookStruct{}, false
+	}
+
+	bookId, _ := strconv.ParseInt(c.Param("bookid"), 10, 64)
+	books := e._QueryPublicCollectionBooks(_GetServerURL(c), link, " AND `book`.`id` = ?", bookId)
+	if len(books) == 0 {
+		return PublicBookStruct{}, false
+	}
+	return books[0], true
+}
+
+// Cover file on disk: PDF covers are served from /cover/, EPUB covers from
+// the unzipped book
+func _GetCoverFilePath(cover string) string {
+	if strings.HasPrefix(cover, "/cover/") {
+		return "./uploads/img/" + strings.TrimPrefix(cover, "/cover/")
+	}
+	return cover
+}
+
+func (e *Env) GetPublicCollection(c *gin.Context) {
+	link, ok := e._GetCollectionLink(c.Param("token"))
+	if !ok {
+		c.String(404, "This link doesn't exist or has expired")
+		return
+	}
+
+	rows, err := e.db.Query("SELECT `title`, `description` FROM `collection` WHERE `id` = ?", link.CollectionId)
+	CheckError(err)
+
+	var title, description string
+	if rows.Next() {
+		err := rows.Scan(&title, &description)
+		CheckError(err)
+	}
+	rows.Close()
+
+	serverURL := _GetServerURL(c)
+	books := e._GetPublicCollectionBooks(serverURL, link)
+	for i := range books {
+		books[i].UploadedOn = _FormatDate(books[i].UploadedOn)
+	}
+
+	opdsURL := ""
+	if link.OPDS {
+		opdsURL = _PublicCollectionURL(serverURL, link.Token) + "/opds"
+	}
+
+	c.HTML(200, "public_collection.html", gin.H{
+		"title":       title,
+		"description": description,
+		"books":       books,
+		"opdsURL":     opdsURL,
+		"expires":     link.Expires,
+	})
+}
+
+func (e *Env) SendPublicCollectionCover(c *gin.Context) {
+	book, ok := e._GetPublicCollectionBook(c)
+	if !ok || book.cover == "" {
+		c.String(404, "Not found")
+		return
+	}
+
+	c.File(_GetCoverFilePath(book.cover))
+}
+
+func (e *Env) SendPublicCollectionBook(c *gin.Context) {
+	book, ok := e._GetPublicCollectionBook(c)
+	if !ok || book.DownloadURL == "" {
+		c.String(404, "Not found")
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=\""+strings.Replace(book.fileName, "\"", "", -1)+"\"")
+	c.File(path.Join("./uploads", book.fileName))
+}
+
+// OPDS 1.2 acquisition feed of a public link
+type OPDSLinkStruct struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type OPDSAuthorStruct struct {
+	Name string `xml:"name"`
+}
+
+type OPDSEntryStruct struct {
+	Title   string            `xml:"title"`
+	Id      string            `xml:"id"`
+	Updated string            `xml:"updated"`
+	Author  *OPDSAuthorStruct `xml:"author,omitempty"`
+	Links   []OPDSLinkStruct  `xml:"link"`
+}
+
+type OPDSFeedStruct struct {
+	XMLName  xml.Name          `xml:"feed"`
+	Xmlns    string            `xml:"xmlns,attr"`
+	Title    string            `xml:"title"`
+	Subtitle string            `xml:"subtitle,omitempty"`
+	Id       string            `xml:"id"`
+	Updated  string            `xml:"updated"`
+	Links    []OPDSLinkStruct  `xml:"link"`
+	Entries  []OPDSEntryStruct `xml:"entry"`
+}
+
+const OPDSAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+
+// Atom dates use the same format as the Web Annotation API
+func _OPDSTime(t string) string {
+	return _WebAnnotationTime(t)
+}
+
+func _BookMediaType(format string) string {
+	if format == "pdf" {
+		return "application/pdf"
+	}
+	return "application/epub+zip"
+}
+
+func _ImageMediaType(cover string) string {
+	switch strings.ToLower(path.Ext(cover)) {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".gif":
+		return "image/gif"
+	case ".svg":
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+func (e *Env) GetPublicCollectionOPDS(c *gin.Context) {
+	link, ok := e._GetCollectionLink(c.Param("token"))
+	if !ok || !link.OPDS {
+		c.String(404, "Not found")
+		return
+	}
+
+	rows, err := e.db.Query("SELECT `title`, `description` FROM `collection` WHERE `id` = ?", link.CollectionId)
+	CheckError(err)
+
+	var title, description string
+	if rows.Next() {
+		err := rows.Scan(&title, &description)
+		CheckError(err)
+	}
+	rows.Close()
+
+	serverURL := _GetServerURL(c)
+	linkURL := _PublicCollectionURL(serverURL, link.Token)
+
+	feed := OPDSFeedStruct{
+		Xmlns:    "http://www.w3.org/2005/Atom",
+		Title:    title,
+		Subtitle: description,
+		Id:       linkURL,
+		Updated:  _OPDSTime(link.CreatedOn),
+		Links: []OPDSLinkStruct{
+			{Rel: "self", Href: linkURL + "/opds", Type: OPDSAcquisitionType},
+			{Rel: "start", Href: linkURL + "/opds", Type: OPDSAcquisitionType},
+			{Rel: "alternate", Href: linkURL, Type: "text/html"},
+		},
+	}
+
+	for _, book := range e._GetPublicCollectionBooks(serverURL, link) {
+		entry := OPDSEntryStruct{
+			Title:   book.Title,
+			Id:      linkURL + "/books/" + strconv.Itoa(int(book.Id)),
+			Updated: _OPDSTime(book.UploadedOn),
+		}
+		if entry.Updated > feed.Updated {
+			feed.Updated = entry.Updated
+		}
+		if book.Author != "" {
+			entry.Author = &OPDSAuthorStruct{Name: book.Author}
+		}
+		if book.CoverURL != "" {
+			imageType := _ImageMediaType(book.cover)
+			entry.Links = append(entry.Links,
+				OPDSLinkStruct{Rel: "http://opds-spec.org/image", Href: book.CoverURL, Type: imageType},
+				OPDSLinkStruct{Rel: "http://opds-spec.org/image/thumbnail", Href: book.CoverURL, Type: imageType})
+		}
+		if book.DownloadURL != "" {
+			entry.Links = append(entry.Links, OPDSLinkStruct{Rel: "http://opds-spec.org/acquisition/open-access", Href: book.DownloadURL, Type: _BookMediaType(book.Format)})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	b, err := xml.MarshalIndent(feed, "", "  ")
+	CheckError(err)
+
+	c.Data(200, OPDSAcquisitionType+"; charset=utf-8", append([]byte(xml.Header), b...))
+}
+
+// Owner side: create, list, update and revoke the links of a collection
+
+type CollectionLinkPostStruct struct {
+	Id            int64  `json:"id"`
+	CollectionId  int64  `json:"collectionId"`
+	ExpiresOn     string `json:"expiresOn"`
+	AllowDownload bool   `json:"allowDownload"`
+	OPDS          bool   `json:"opds"`
+}
+
+func (e *Env) GetCollectionLinks(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+		collectionId, _ := strconv.ParseInt(c.Query("collectionId"), 10, 64)
+
+		if collectionId == 0 || e._GetCollectionOwner(collectionId) != userId {
+			c.String(404, "Collection not found")
+			return
+		}
+
+		c.JSON(200, e._GetCollectionLinks(_GetServerURL(c), collectionId))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) PostCollectionLink(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		post := CollectionLinkPostStruct{}
+		err := c.BindJSON(&post)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		if post.CollectionId == 0 || e._GetCollectionOwner(post.CollectionId) != userId {
+			c.String(404, "Collection not found")
+			return
+		}
+
+		stmt, err := e.db.Prepare("INSERT INTO `collection_link` (collection_id, user_id, token, expires_on, allow_download, opds, created_on) VALUES (?, ?, ?, ?, ?, ?, ?)")
+		CheckError(err)
+
+		_, err = stmt.Exec(post.CollectionId, userId, _NewPublicLinkToken(), _CollectionLinkExpiry(post.ExpiresOn), post.AllowDownload, post.OPDS, _GetCurrentTime())
+		CheckError(err)
+
+		c.JSON(200, e._GetCollectionLinks(_GetServerURL(c), post.CollectionId))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) PostCollectionLinkUpdate(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		post := CollectionLinkPostStruct{}
+		err := c.BindJSON(&post)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		links := e._ScanCollectionLinks("`id` = ? AND `user_id` = ?", post.Id, userId)
+		if len(links) == 0 {
+			c.String(404, "Link not found")
+			return
+		}
+
+		stmt, err := e.db.Prepare("UPDATE `collection_link` SET expires_on=?, allow_download=?, opds=? WHERE id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(_CollectionLinkExpiry(post.ExpiresOn), post.AllowDownload, post.OPDS, post.Id)
+		CheckError(err)
+
+		c.JSON(200, e._GetCollectionLinks(_GetServerURL(c), links[0].CollectionId))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) DeleteCollectionLink(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		post := CollectionLinkPostStruct{}
+		err := c.BindJSON(&post)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		stmt, err := e.db.Prepare("DELETE FROM `collection_link` WHERE id=? AND user_id=?")
+		CheckError(err)
+
+		res, err := stmt.Exec(post.Id, userId)
+		CheckError(err)
+
+		count, err := res.RowsAffected()
+		CheckError(err)
+
+		if count == 0 {
+			c.String(404, "Link not found")
+			return
+		}
+
+		c.String(200, "Link revoked successfully")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
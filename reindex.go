@@ -0,0 +1,505 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+)
+
+// Administrators are the users whose email is in LIBREREAD_ADMIN_EMAILS, a
+// comma separated list. There are none when it is empty.
+func _IsAdmin(email string) bool {
+	for _, admin := range strings.Split(AdminEmails, ",") {
+		if admin = strings.TrimSpace(admin); admin != "" && strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+type ReindexStatusStruct struct {
+	Running     bool     `json:"running"`
+	Total       int64    `json:"total"`
+	Done        int64    `json:"done"`
+	Current     string   `json:"current"`
+	Orphans     int64    `json:"orphans"`
+	Errors      []string `json:"errors"`
+	StartedOn   string   `json:"started_on"`
+	CompletedOn string   `json:"completed_on"`
+}
+
+var (
+	reindexMutex  sync.Mutex
+	reindexStatus = ReindexStatusStruct{Errors: []string{}}
+)
+
+func _UpdateReindexStatus(update func(status *ReindexStatusStruct)) {
+	reindexMutex.Lock()
+	defer reindexMutex.Unlock()
+
+	update(&reindexStatus)
+}
+
+func _GetReindexStatus() ReindexStatusStruct {
+	reindexMutex.Lock()
+	defer reindexMutex.Unlock()
+
+	status := reindexStatus
+	status.Errors = append([]string{}, reindexStatus.Errors...)
+
+	return status
+}
+
+// Reindex is the entry point of the `libreread reindex` subcommand.
+func Reindex(args []string) {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	recreate := flags.Bool("recreate", false, "delete the search index and build it again from the book table")
+	orphansOnly := flags.Bool("orphans-only", false, "only remove index entries of books which no longer exist")
+	flags.Parse(args)
+
+	db, err := sql.Open("sqlite3", path.Join(DBPath, "libreread.db"))
+	CheckError(err)
+
+	defer db.Close()
+
+	// The database may be older than the server
+	_CreateTables(db)
+
+	env := &Env{db: db, RedisClient: _NewRedisClient()}
+	env._MigrateData()
+	env._Reindex(*recreate, *orphansOnly)
+
+	status := _GetReindexStatus()
+	fmt.Printf("Reindexed %d of %d books, removed %d orphaned index entries\n", status.Done, status.Total, status.Orphans)
+	for _, e := range status.Errors {
+		fmt.Println("Error: " + e)
+	}
+}
+
+type ReindexBookStruct struct {
+	Id       int64
+	Title    string
+	FileName string
+	FilePath string
+	Author   string
+	URL      string
+	Cover    string
+	Pages    int64
+	Format   string
+	UserId   int64
+}
+
+func (e *Env) _GetAllBooks() []ReindexBookStruct {
+	return e._QueryReindexBooks("`deleted_on` = ''")
+}
+
+func (e *Env) _GetReindexBook(bookId int64) (ReindexBookStruct, bool) {
+	books := e._QueryReindexBooks("`id` = ?", bookId)
+	if len(books) == 0 {
+		return ReindexBookStruct{}, false
+	}
+	return books[0], true
+}
+
+func (e *Env) _QueryReindexBooks(condition string, args ...interface{}) []ReindexBookStruct {
+	rows, err := e.db.Query("SELECT `id`, `title`, `filename`, `file_path`, `author`, `url`, `cover`, `pages`, `format`, `user_id` FROM `book`"+
+		" WHERE "+condition+" ORDER BY `id`", args...)
+	CheckError(err)
+
+	books := []ReindexBookStruct{}
+	if err != nil {
+		return books
+	}
+	for rows.Next() {
+		book := ReindexBookStruct{}
+		err := rows.Scan(&book.Id, &book.Title, &book.FileName, &book.FilePath, &book.Author, &book.URL, &book.Cover, &book.Pages, &book.Format, &book.UserId)
+		CheckError(err)
+
+		books = append(books, book)
+	}
+	rows.Close()
+
+	return books
+}
+
+func (e *Env) _Reindex(recreate bool, orphansOnly bool) {
+	books := e._GetAllBooks()
+
+	_UpdateReindexStatus(func(status *ReindexStatusStruct) {
+		*status = ReindexStatusStruct{
+			Running:   true,
+			Total:     int64(len(books)),
+			Errors:    []string{},
+			StartedOn: _GetCurrentTime(),
+		}
+	})
+
+	if !orphansOnly {
+		blevePath := path.Join(DBPath, "lr_index.bleve")
+		if EnableES == "0" && !recreate {
+			// A corrupted bleve index can't be opened, build it again.
+			index, err := bleve.Open(blevePath)
+			if err != nil {
+				fmt.Println(err)
+				recreate = true
+			} else {
+				err = index.Close()
+				CheckError(err)
+			}
+		}
+
+		if recreate {
+			_RecreateSearchIndex()
+		}
+
+		for i, book := range books {
+			_UpdateReindexStatus(func(status *ReindexStatusStruct) {
+				status.Current = book.FileName
+			})
+			fmt.Printf("Reindexing [%d/%d] %s\n", i+1, len(books), book.FileName)
+
+			err := e._ReindexBook(book)
+			_UpdateReindexStatus(func(status *ReindexStatusStruct) {
+				if err != nil {
+					status.Errors = append(status.Errors, book.FileName+": "+err.Error())
+				}
+				status.Done = int64(i + 1)
+			})
+		}
+	}
+
+	var orphans int64
+	if EnableES == "0" {
+		orphans = _RemoveBleveOrphans(books)
+	} else {
+		orphans = _RemoveESOrphans(books)
+	}
+
+	_UpdateReindexStatus(func(status *ReindexStatusStruct) {
+		status.Running = false
+		status.Current = ""
+		status.Orphans = orphans
+		status.CompletedOn = _GetCurrentTime()
+	})
+}
+
+func _RecreateSearchIndex() {
+	if EnableES == "0" {
+		blevePath := path.Join(DBPath, "lr_index.bleve")
+
+		err := os.RemoveAll(blevePath)
+		CheckError(err)
+
+		index, err := bleve.New(blevePath, bleve.NewIndexMapping())
+		CheckError(err)
+		if index != nil {
+			err = index.Close()
+			CheckError(err)
+		}
+	} else {
+		DeleteHTTPRequest(ESPath + "/lr_index")
+		_InitElasticsearch()
+	}
+}
+
+func (e *Env) _ReindexBook(book ReindexBookStruct) error {
+	if _, err := os.Stat("./uploads/" + book.FileName); os.IsNotExist(err) {
+		return fmt.Errorf("book file is missing from ./uploads")
+	}
+
+	var (
+		opfMetadata OPFMetadataStruct
+		packagePath string
+	)
+	if book.Format == "epub" {
+		opfMetadata, packagePath = _LoadEPUBPackage(book.FileName)
+		if len(opfMetadata.Spine.ItemRef.IdRef) == 0 {
+			return fmt.Errorf("unable to read the EPUB package")
+		}
+		e._RepairEPUBRedisKeys(book.FileName, opfMetadata, packagePath)
+	} else {
+		e._RepairRedisKey(book.FileName+"...total_pages...", book.Pages)
+	}
+
+	if EnableES == "0" {
+		index, err := bleve.Open(path.Join(DBPath, "lr_index.bleve"))
+		if err != nil {
+			return err
+		}
+
+		message := e._GetBleveBook(book.UserId, book.Id, book.Title, book.Author, book.Cover, book.URL)
+
+		err = index.Index(message.Id, message)
+		CheckError(err)
+
+		return index.Close()
+	}
+
+	bookInfo := e._GetESBookInfo(book.Id, book.Title, book.Author, book.URL, book.Cover)
+
+	b, err := json.Marshal(bookInfo)
+	if err != nil {
+		return err
+	}
+
+	PutJSON(ESPath+"/lr_index/book_info/"+strconv.Itoa(int(book.UserId))+"_"+strconv.Itoa(int(book.Id)), b)
+
+	if book.Format == "pdf" {
+		FeedPDFContent(book.FilePath, book.UserId, book.Id, book.Title, book.Author, book.URL, book.Cover, book.Pages)
+	} else {
+		opfMetadata._FeedEPUBContent(packagePath, book.Title, book.Author, book.Cover, book.URL, book.UserId, book.Id)
+	}
+
+	return nil
+}
+
+// Read the OPF package of an uploaded EPUB back from its unzipped directory,
+// unzipping the stored file again if the directory is gone.
+func _LoadEPUBPackage(fileName string) (OPFMetadataStruct, string) {
+	opfMetadata := OPFMetadataStruct{}
+
+	epubUnzipPath := "./uploads/" + strings.Split(fileName, ".epub")[0]
+	if _, err := os.Stat(epubUnzipPath); os.IsNotExist(err) {
+		epubUnzipPath = _EPUBUnzip("./uploads/"+fileName, fileName)
+	}
+
+	containerXMLPath := epubUnzipPath + "/META-INF/container.xml"
+	if _, err := os.Stat(containerXMLPath); os.IsNotExist(err) {
+		return opfMetadata, ""
+	}
+
+	rootFilePath, opfFilePath := _FetchOPFFilePath(epubUnzipPath, containerXMLPath)
+
+	packagePath := epubUnzipPath
+	rootFilePathSplit := strings.Split(rootFilePath, "/")
+	if len(rootFilePathSplit) > 1 {
+		packagePath = epubUnzipPath + "/" + rootFilePathSplit[0]
+	}
+
+	opfMetadata._FetchEPUBMetadata(opfFilePath)
+
+	return opfMetadata, packagePath
+}
+
+func (e *Env) _RepairRedisKey(key string, value interface{}) {
+	_, err := e.RedisClient.Get(key).Result()
+	if err == redis.Nil {
+		err = e.RedisClient.Set(key, value, 0).Err()
+	}
+	CheckError(err)
+}
+
+// The EPUB viewer depends on these keys, so restore them when Redis has been
+// flushed or swapped.
+func (e *Env) _RepairEPUBRedisKeys(fileName string, opfMetadata OPFMetadataStruct, packagePath string) {
+	opfJSON, err := json.Marshal(opfMetadata)
+	CheckError(err)
+
+	e._RepairRedisKey(fileName, string(opfJSON))
+	e._RepairRedisKey(fileName+"...total_pages...", len(opfMetadata.Spine.ItemRef.IdRef))
+	e._RepairRedisKey(fileName+"...current_page...", 1)
+	e._RepairRedisKey(fileName+"...current_fragment...", 0)
+	e._RepairRedisKey(fileName+"...filepath...", "/uploads"+strings.Split(packagePath, "./uploads")[1])
+}
+
+func _RemoveBleveOrphans(books []ReindexBookStruct) int64 {
+	expected := map[string]bool{}
+	for _, book := range books {
+		expected[_GetBleveIndexId(book.UserId, book.Id, book.Title, book.Author, book.Cover, book.URL)] = true
+	}
+
+	index, err := bleve.Open(path.Join(DBPath, "lr_index.bleve"))
+	if err != nil {
+		fmt.Println(err)
+		return 0
+	}
+
+	defer index.Close()
+
+	count, err := index.DocCount()
+	CheckError(err)
+
+	search := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), int(count), 0, false)
+	searchResults, err := index.Search(search)
+	if err != nil {
+		fmt.Println(err)
+		return 0
+	}
+
+	var orphans int64
+	for _, hit := range searchResults.Hits {
+		if !expected[hit.ID] {
+			fmt.Println("Removing orphaned index entry: " + hit.ID)
+			err = index.Delete(hit.ID)
+			CheckError(err)
+			orphans += 1
+		}
+	}
+
+	return orphans
+}
+
+// struct for scrolling through elasticsearch document ids
+
+type ESScrollPayloadStruct struct {
+	Scroll   string `json:"scroll"`
+	ScrollId string `json:"scroll_id"`
+}
+
+type ESScrollResultStruct struct {
+	ScrollId string       `json:"_scroll_id"`
+	Hits     ESScrollHits `json:"hits"`
+}
+
+type ESScrollHits struct {
+	Hits []ESScrollHitsHits `json:"hits"`
+}
+
+type ESScrollHitsHits struct {
+	Id string `json:"_id"`
+}
+
+// Ids of the Elasticsearch documents of a type. On an error, returns the ids
+// listed until then with the error.
+func _ListESDocumentIds(docType string) ([]string, error) {
+	ids := []string{}
+
+	payload := []byte(`{"_source": false, "size": 500, "query": {"match_all": {}}}`)
+	res := GetJSONPassPayload(ESPath+"/lr_index/"+docType+"/_search?scroll=1m", payload)
+	for {
+		result := ESScrollResultStruct{}
+		err := json.Unmarshal(res, &result)
+		if err != nil {
+			return ids, fmt.Errorf("listing the %s index entries: %v", docType, err)
+		}
+
+		if len(result.Hits.Hits) == 0 {
+			break
+		}
+
+		for _, hit := range result.Hits.Hits {
+			ids = append(ids, hit.Id)
+		}
+
+		b, err := json.Marshal(ESScrollPayloadStruct{
+			Scroll:   "1m",
+			ScrollId: result.ScrollId,
+		})
+		CheckError(err)
+
+		res = GetJSONPassPayload(ESPath+"/_search/scroll", b)
+	}
+
+	return ids, nil
+}
+
+func _RemoveESOrphans(books []ReindexBookStruct) int64 {
+	// Elasticsearch document ids are <user id>_<book id> for book_info
+	// and <user id>_<book id>_<page> for book_detail.
+	expected := map[string]bool{}
+	for _, book := range books {
+		expected[strconv.Itoa(int(book.UserId))+"_"+strconv.Itoa(int(book.Id))] = true
+	}
+
+	var orphans int64
+	for _, docType := range []string{"book_info", "book_detail"} {
+		ids, err := _ListESDocumentIds(docType)
+		if err != nil {
+			fmt.Println(err)
+			_UpdateReindexStatus(func(status *ReindexStatusStruct) {
+				status.Errors = append(status.Errors, err.Error())
+			})
+		}
+
+		for _, id := range ids {
+			idSplit := strings.Split(id, "_")
+			if len(idSplit) >= 2 && expected[idSplit[0]+"_"+idSplit[1]] {
+				continue
+			}
+
+			fmt.Println("Removing orphaned index entry: " + docType + "/" + id)
+			DeleteHTTPRequest(ESPath + "/lr_index/" + docType + "/" + id)
+			orphans += 1
+		}
+	}
+
+	return orphans
+}
+
+func (e *Env) GetReindexStatus(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		if !_IsAdmin(email.(string)) {
+			c.String(403, "Only the administrator can rebuild the search index")
+			return
+		}
+
+		c.JSON(200, _GetReindexStatus())
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+type PostReindexStruct struct {
+	Recreate    bool `json:"recreate"`
+	OrphansOnly bool `json:"orphans_only"`
+}
+
+func (e *Env) PostReindex(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		if !_IsAdmin(email.(string)) {
+			c.String(403, "Only the administrator can rebuild the search index")
+			return
+		}
+
+		postReindex := PostReindexStruct{}
+		err := c.BindJSON(&postReindex)
+		CheckError(err)
+
+		started := false
+		_UpdateReindexStatus(func(status *ReindexStatusStruct) {
+			if !status.Running {
+				status.Running = true
+				started = true
+			}
+		})
+
+		if started {
+			go e._Reindex(postReindex.Recreate, postReindex.OrphansOnly)
+		}
+
+		c.JSON(202, _GetReindexStatus())
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
@@ -0,0 +1,333 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A book or a whole collection can be shared with other users of the
+// instance. The file is not copied: recipients read the owner's book and keep
+// their own highlights, progress and bookmarks in it.
+const (
+	SharePermissionRead     = "read"
+	SharePermissionAnnotate = "annotate"
+	// Not stored, returned by _GetBookPermission for the owner of a book
+	SharePermissionOwner = "owner"
+)
+
+type ShareStruct struct {
+	Id         int64  `json:"id"`
+	UserId     int64  `json:"userId"`
+	Name       string `json:"name"`
+	Email      string `json:"email"`
+	Permission string `json:"permission"`
+	CreatedOn  string `json:"createdOn"`
+	Date       string `json:"date"`
+}
+
+// Ids of the books of a collection, in the order of the collection
+func (e *Env) _GetCollectionBookIds(collectionId int64) []int64 {
+	rows, err := e.db.Query("SELECT `collection_book`.`book_id` FROM `collection_book` JOIN `book` ON `book`.`id` = `collection_book`.`book_id`"+
+		" WHERE `collection_book`.`collection_id` = ? AND `book`.`deleted_on` = '' ORDER BY `collection_book`.`position`, `collection_book`.`id`", collectionId)
+	CheckError(err)
+
+	var bookIds []int64
+	for rows.Next() {
+		var bookId int64
+		err := rows.Scan(&bookId)
+		CheckError(err)
+
+		bookIds = append(bookIds, bookId)
+	}
+	rows.Close()
+
+	return bookIds
+}
+
+func (e *Env) _GetBookOwner(bookId int64) int64 {
+	rows, err := e.db.Query("SELECT `user_id` FROM `book` WHERE `id` = ?", bookId)
+	CheckError(err)
+
+	var ownerId int64
+	if rows.Next() {
+		err := rows.Scan(&ownerId)
+		CheckError(err)
+	}
+	rows.Close()
+
+	return ownerId
+}
+
+func (e *Env) _GetCollectionOwner(collectionId int64) int64 {
+	rows, err := e.db.Query("SELECT `user_id` FROM `collection` WHERE `id` = ?", collectionId)
+	CheckError(err)
+
+	var ownerId int64
+	if rows.Next() {
+		err := rows.Scan(&ownerId)
+		CheckError(err)
+	}
+	rows.Close()
+
+	return ownerId
+}
+
+// Books shared with a user, directly or through a collection, with the
+// permission given. Annotate wins over read when a book is shared twice.
+func (e *Env) _GetSharedBooks(userId int64) map[int64]string {
+	rows, err := e.db.Query("SELECT `owner_id`, `book_id`, `collection_id`, `permission` FROM `book_share` WHERE `user_id` = ?", userId)
+	CheckError(err)
+
+	type share struct {
+		ownerId, bookId, collectionId int64
+		permission                    string
+	}
+	var shares []share
+	for rows.Next() {
+		s := share{}
+		err := rows.Scan(&s.ownerId, &s.bookId, &s.collectionId, &s.permission)
+		CheckError(err)
+
+		shares = append(shares, s)
+	}
+	rows.Close()
+
+	books := map[int64]string{}
+	for _, s := range shares {
+		bookIds := []int64{s.bookId}
+		if s.collectionId != 0 {
+			bookIds = e._GetCollectionBookIds(s.collectionId)
+		}
+		for _, bookId := range bookIds {
+			// Only the books the owner of the share can still give access to
+			if e._GetBookOwner(bookId) != s.ownerId {
+				continue
+			}
+			if books[bookId] != SharePermissionAnnotate {
+				books[bookId] = s.permission
+			}
+		}
+	}
+
+	return books
+}
+
+// Permission of a user on a book: owner, annotate, read, or an empty string
+// when the user can't read it
+func (e *Env) _GetBookPermission(userId int64, bookId int64) string {
+	if bookId == 0 {
+		return ""
+	}
+	// Books in the trash can only be restored or deleted for good
+	if e._IsBookTrashed(bookId) {
+		return ""
+	}
+	if e._GetBookOwner(bookId) == userId {
+		return SharePermissionOwner
+	}
+	return e._GetSharedBooks(userId)[bookId]
+}
+
+// Whether the user can highlight and comment in a book
+func (e *Env) _CanAnnotateBook(userId int64, bookId int64) bool {
+	permission := e._GetBookPermission(userId, bookId)
+	return permission == SharePermissionOwner || permission == SharePermissionAnnotate
+}
+
+// WHERE condition on the book table matching the library of a user: the
+// books they uploaded and the books shared with them
+func (e *Env) _GetLibraryCondition(userId int64) (string, []interface{}) {
+	condition := "`user_id` = ?"
+	args := []interface{}{userId}
+
+	var placeholders []string
+	for bookId := range e._GetSharedBooks(userId) {
+		placeholders = append(placeholders, "?")
+		args = append(args, bookId)
+	}
+	if len(placeholders) > 0 {
+		condition = "(" + condition + " OR `id` IN (" + strings.Join(placeholders, ", ") + "))"
+	}
+	condition += " AND `deleted_on` = ''"
+
+	return condition, args
+}
+
+func (e *Env) _GetShares(bookId int64, collectionId int64) []ShareStruct {
+	rows, err := e.db.Query("SELECT `book_share`.`id`, `book_share`.`user_id`, `user`.`name`, `user`.`email`, `book_share`.`permission`, `book_share`.`created_on`"+
+		" FROM `book_share` JOIN `user` ON `user`.`id` = `book_share`.`user_id` WHERE `book_share`.`book_id` = ? AND `book_share`.`collection_id` = ? ORDER BY `book_share`.`id`",
+		bookId, collectionId)
+	CheckError(err)
+
+	shares := []ShareStruct{}
+	for rows.Next() {
+		share := ShareStruct{}
+		err := rows.Scan(&share.Id, &share.UserId, &share.Name, &share.Email, &share.Permission, &share.CreatedOn)
+		CheckError(err)
+
+		share.Date = _FormatDate(share.CreatedOn)
+		shares = append(shares, share)
+	}
+	rows.Close()
+
+	return shares
+}
+
+func (e *Env) _DeleteShares(column string, id int64) {
+	stmt, err := e.db.Prepare("DELETE FROM `book_share` WHERE " + column + "=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(id)
+	CheckError(err)
+}
+
+type ShareTargetStruct struct {
+	FileName     string `json:"fileName"`
+	CollectionId int64  `json:"collectionId"`
+}
+
+// Book or collection to share, which must belong to the user. Returns false
+// when it doesn't exist or belongs to someone else.
+func (e *Env) _GetShareTarget(userId int64, target ShareTargetStruct) (int64, int64, bool) {
+	if target.CollectionId != 0 {
+		return 0, target.CollectionId, e._GetCollectionOwner(target.CollectionId) == userId
+	}
+
+	bookId, _, _ := e._GetBookInfo(target.FileName)
+	return bookId, 0, bookId != 0 && e._GetBookOwner(bookId) == userId
+}
+
+func (e *Env) GetShares(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		target := ShareTargetStruct{FileName: c.Query("fileName")}
+		target.CollectionId, _ = strconv.ParseInt(c.Query("collectionId"), 10, 64)
+
+		bookId, collectionId, ok := e._GetShareTarget(userId, target)
+		if !ok {
+			c.String(404, "Not found")
+			return
+		}
+
+		c.JSON(200, e._GetShares(bookId, collectionId))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+type SharePostStruct struct {
+	ShareTargetStruct
+	Email      string `json:"email"`
+	Permission string `json:"permission"`
+}
+
+// Share with a user, or change the permission of an existing share
+func (e *Env) PostShare(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		post := SharePostStruct{}
+		err := c.BindJSON(&post)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		bookId, collectionId, ok := e._GetShareTarget(userId, post.ShareTargetStruct)
+		if !ok {
+			c.String(404, "Not found")
+			return
+		}
+
+		if post.Permission != SharePermissionRead && post.Permission != SharePermissionAnnotate {
+			c.String(400, "Invalid permission")
+			return
+		}
+
+		recipientId := e._GetUserId(strings.TrimSpace(post.Email))
+		if recipientId == 0 {
+			c.String(404, "No user with this email")
+			return
+		}
+		if recipientId == userId {
+			c.String(400, "You can't share with yourself")
+			return
+		}
+
+		stmt, err := e.db.Prepare("UPDATE `book_share` SET permission=? WHERE user_id=? AND book_id=? AND collection_id=?")
+		CheckError(err)
+
+		res, err := stmt.Exec(post.Permission, recipientId, bookId, collectionId)
+		CheckError(err)
+
+		count, err := res.RowsAffected()
+		CheckError(err)
+
+		if count == 0 {
+			stmt, err := e.db.Prepare("INSERT INTO `book_share` (owner_id, user_id, book_id, collection_id, permission, created_on) VALUES (?, ?, ?, ?, ?, ?)")
+			CheckError(err)
+
+			_, err = stmt.Exec(userId, recipientId, bookId, collectionId, post.Permission, _GetCurrentTime())
+			CheckError(err)
+		}
+
+		c.JSON(200, e._GetShares(bookId, collectionId))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+type ShareDeleteStruct struct {
+	Id int64 `json:"id"`
+}
+
+// Revoke a share. The recipient can also remove a share from their library.
+func (e *Env) DeleteShare(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		share := ShareDeleteStruct{}
+		err := c.BindJSON(&share)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		stmt, err := e.db.Prepare("DELETE FROM `book_share` WHERE id=? AND (owner_id=? OR user_id=?)")
+		CheckError(err)
+
+		res, err := stmt.Exec(share.Id, userId, userId)
+		CheckError(err)
+
+		count, err := res.RowsAffected()
+		CheckError(err)
+
+		if count == 0 {
+			c.String(404, "Share not found")
+			return
+		}
+
+		c.String(200, "Share revoked successfully")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
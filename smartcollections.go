@@ -0,0 +1,347 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A smart collection holds the books of the library matching its rules. The
+// rules are saved as JSON and evaluated each time the collection is viewed.
+type SmartRuleStruct struct {
+	// title, author, format, series, language, publisher, tag, uploaded or
+	// status
+	Field string `json:"field"`
+	// contains, equals or not for text fields, within for uploaded (value in
+	// days), equals or not for status
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type SmartCollectionStruct struct {
+	Id          int64  `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// all or any of the rules
+	Match     string            `json:"match"`
+	Rules     []SmartRuleStruct `json:"rules"`
+	CreatedOn string            `json:"createdOn"`
+}
+
+// Matches the books without a reading status or on the to-read shelf
+const SmartStatusUnread = "unread"
+
+// WHERE condition on the book table for one rule
+func _SmartRuleCondition(userId int64, rule SmartRuleStruct) (string, []interface{}, error) {
+	value := strings.TrimSpace(rule.Value)
+
+	switch rule.Field {
+	case "title", "author", "format", "series", "language", "publisher":
+		column := "`" + rule.Field + "`"
+		switch rule.Operator {
+		case "contains":
+			return column + " LIKE ?", []interface{}{"%" + value + "%"}, nil
+		case "equals":
+			return "LOWER(" + column + ") = LOWER(?)", []interface{}{value}, nil
+		case "not":
+			return "LOWER(" + column + ") != LOWER(?)", []interface{}{value}, nil
+		}
+	case "tag":
+		switch rule.Operator {
+		case "contains":
+			return "`id` IN (SELECT `book_id` FROM `book_tag` WHERE `tag` LIKE ?)", []interface{}{"%" + value + "%"}, nil
+		case "equals":
+			return "`id` IN (SELECT `book_id` FROM `book_tag` WHERE LOWER(`tag`) = LOWER(?))", []interface{}{value}, nil
+		case "not":
+			return "`id` NOT IN (SELECT `book_id` FROM `book_tag` WHERE LOWER(`tag`) = LOWER(?))", []interface{}{value}, nil
+		}
+	case "uploaded":
+		days, err := strconv.Atoi(value)
+		if rule.Operator == "within" && err == nil && days >= 0 {
+			since := time.Now().AddDate(0, 0, -days).Format(timeLayout)
+			return "`uploaded_on` >= ?", []interface{}{since}, nil
+		}
+		return "", nil, errors.New("Uploaded needs a number of days")
+	case "status":
+		if value != SmartStatusUnread && !_IsValidReadingStatus(value) {
+			return "", nil, errors.New("Invalid reading status")
+		}
+
+		condition := "`id` IN (SELECT `book_id` FROM `reading_status` WHERE `user_id` = ? AND `status` = ?)"
+		args := []interface{}{userId, value}
+		if value == SmartStatusUnread {
+			condition = "`id` NOT IN (SELECT `book_id` FROM `reading_status` WHERE `user_id` = ? AND `status` != ?)"
+			args = []interface{}{userId, ReadingStatusToRead}
+		}
+
+		switch rule.Operator {
+		case "equals":
+			return condition, args, nil
+		case "not":
+			return "NOT " + condition, args, nil
+		}
+	default:
+		return "", nil, errors.New("Invalid field " + rule.Field)
+	}
+
+	return "", nil, errors.New("Invalid operator " + rule.Operator + " for " + rule.Field)
+}
+
+// WHERE condition on the book table for the books of a smart collection,
+// limited to the library of the user
+func (e *Env) _SmartCollectionCondition(userId int64, collection SmartCollectionStruct) (string, []interface{}, error) {
+	condition, args := e._GetLibraryCondition(userId)
+
+	var conditions []string
+	for _, rule := range collection.Rules {
+		ruleCondition, ruleArgs, err := _SmartRuleCondition(userId, rule)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, ruleCondition)
+		args = append(args, ruleArgs...)
+	}
+
+	if len(conditions) > 0 {
+		join := " AND "
+		if collection.Match == "any" {
+			join = " OR "
+		}
+		condition += " AND (" + strings.Join(conditions, join) + ")"
+	}
+
+	return condition, args, nil
+}
+
+// Books of a smart collection, most recently uploaded first
+func (e *Env) _GetSmartCollectionBooks(userId int64, collection SmartCollectionStruct) []CollectionBookStruct {
+	books := []CollectionBookStruct{}
+
+	condition, args, err := e._SmartCollectionCondition(userId, collection)
+	if err != nil {
+		return books
+	}
+
+	rows, err := e.db.Query("SELECT `id`, `title`, `url`, `cover` FROM `book` WHERE "+condition+" ORDER BY `uploaded_on` DESC, `id` DESC", args...)
+	CheckError(err)
+
+	for rows.Next() {
+		book := CollectionBookStruct{}
+		err := rows.Scan(&book.BookId, &book.Title, &book.URL, &book.Cover)
+		CheckError(err)
+
+		book.Position = int64(len(books))
+		books = append(books, book)
+	}
+	rows.Close()
+
+	return books
+}
+
+func (e *Env) _GetSmartCollections(userId int64, id int64) []SmartCollectionStruct {
+	query := "SELECT `id`, `title`, `description`, `rule_match`, `rules`, `created_on` FROM `smart_collection` WHERE `user_id` = ?"
+	args := []interface{}{userId}
+	if id != 0 {
+		query += " AND `id` = ?"
+		args = append(args, id)
+	}
+
+	rows, err := e.db.Query(query+" ORDER BY `id`", args...)
+	CheckError(err)
+
+	collections := []SmartCollectionStruct{}
+	for rows.Next() {
+		var (
+			collection SmartCollectionStruct
+			rules      string
+		)
+		err := rows.Scan(&collection.Id, &collection.Title, &collection.Description, &collection.Match, &rules, &collection.CreatedOn)
+		CheckError(err)
+
+		collection.Rules = []SmartRuleStruct{}
+		json.Unmarshal([]byte(rules), &collection.Rules)
+
+		collections = append(collections, collection)
+	}
+	rows.Close()
+
+	return collections
+}
+
+func (e *Env) _GetSmartCollection(userId int64, id int64) (SmartCollectionStruct, bool) {
+	collections := e._GetSmartCollections(userId, id)
+	if id == 0 || len(collections) == 0 {
+		return SmartCollectionStruct{}, false
+	}
+	return collections[0], true
+}
+
+func (e *Env) GetSmartCollection(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+
+		collection, ok := e._GetSmartCollection(userId, id)
+		if !ok {
+			c.String(404, "Collection not found")
+			return
+		}
+
+		b := BookStructList{}
+		for _, book := range e._GetSmartCollectionBooks(userId, collection) {
+			b = append(b, BookStruct{
+				Title: book.Title,
+				URL:   book.URL,
+				Cover: book.Cover,
+			})
+		}
+
+		c.HTML(302, "collection_item.html", gin.H{
+			"id":                 collection.Id,
+			"title":              collection.Title,
+			"description":        collection.Description,
+			"isOwner":            true,
+			"smart":              true,
+			"booksList":          _ConstructBooksWithCount(&b, 6),
+			"booksListMedium":    _ConstructBooksWithCount(&b, 3),
+			"booksListSmall":     _ConstructBooksWithCount(&b, 2),
+			"booksListXtraSmall": b,
+		})
+	} else {
+		c.Redirect(302, "/signin")
+	}
+}
+
+// Form to add a smart collection, or to edit one when the id is given
+func (e *Env) GetEditSmartCollection(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		collection := SmartCollectionStruct{Match: "all", Rules: []SmartRuleStruct{}}
+		if c.Param("id") != "" {
+			id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
+
+			var ok bool
+			collection, ok = e._GetSmartCollection(userId, id)
+			if !ok {
+				c.String(404, "Collection not found")
+				return
+			}
+		}
+
+		rules, err := json.Marshal(collection.Rules)
+		CheckError(err)
+
+		c.HTML(302, "smart_collection.html", gin.H{
+			"collection": collection,
+			"rules":      string(rules),
+		})
+	} else {
+		c.Redirect(302, "/signin")
+	}
+}
+
+// Create a smart collection, or update it when the id is set. Returns the id.
+func (e *Env) PostSmartCollection(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		collection := SmartCollectionStruct{}
+		err := c.BindJSON(&collection)
+		CheckError(err)
+
+		collection.Title = strings.TrimSpace(collection.Title)
+		if collection.Title == "" {
+			c.String(400, "Collection title is empty")
+			return
+		}
+		if collection.Match != "any" {
+			collection.Match = "all"
+		}
+		if len(collection.Rules) == 0 {
+			c.String(400, "Add at least one rule")
+			return
+		}
+		if _, _, err := e._SmartCollectionCondition(userId, collection); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+
+		rules, err := json.Marshal(collection.Rules)
+		CheckError(err)
+
+		if collection.Id != 0 {
+			stmt, err := e.db.Prepare("UPDATE `smart_collection` SET title=?, description=?, rule_match=?, rules=? WHERE id=? AND user_id=?")
+			CheckError(err)
+
+			res, err := stmt.Exec(collection.Title, collection.Description, collection.Match, string(rules), collection.Id, userId)
+			CheckError(err)
+
+			count, err := res.RowsAffected()
+			CheckError(err)
+
+			if count == 0 {
+				c.String(404, "Collection not found")
+				return
+			}
+		} else {
+			stmt, err := e.db.Prepare("INSERT INTO `smart_collection` (user_id, title, description, rule_match, rules, created_on) VALUES (?, ?, ?, ?, ?, ?)")
+			CheckError(err)
+
+			res, err := stmt.Exec(userId, collection.Title, collection.Description, collection.Match, string(rules), _GetCurrentTime())
+			CheckError(err)
+
+			collection.Id, err = res.LastInsertId()
+			CheckError(err)
+		}
+
+		c.String(200, strconv.Itoa(int(collection.Id)))
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) DeleteSmartCollection(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		CheckError(err)
+
+		stmt, err := e.db.Prepare("DELETE FROM `smart_collection` WHERE id=? AND user_id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(id, userId)
+		CheckError(err)
+
+		c.Redirect(302, "/collections")
+	} else {
+		c.Redirect(302, "/signin")
+	}
+}
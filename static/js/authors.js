@@ -0,0 +1,65 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Author page: the owner can rename the author, change how they are sorted
+// and merge a duplicate into another author.
+$(document).ready(function() {
+	var $info = $('.author-info')
+	if (!$info.length) return
+
+	var authorId = parseInt($info.attr('data-id'))
+
+	function post(url, data, success) {
+		$('.author-error').text('')
+		$.ajax({
+			url: url,
+			type: 'POST',
+			data: JSON.stringify(data),
+			contentType: 'application/json; charset=utf-8',
+			success: success,
+			error: function(xhr) {
+				$('.author-error').text(xhr.responseText)
+			}
+		})
+	}
+
+	$('.author-edit').submit(function(e) {
+		e.preventDefault()
+		post('/post-author', {
+			'id': authorId,
+			'name': $(this).children('.name').val(),
+			'sortName': $(this).children('.sort-name').val()
+		}, function() {
+			window.location.reload()
+		})
+	})
+
+	$('.author-merge').submit(function(e) {
+		e.preventDefault()
+		var $option = $(this).find('.into-id option:selected')
+		if (!confirm('Merge this author into ' + $option.text() + '?')) return
+
+		post('/merge-authors', {
+			'id': authorId,
+			'intoId': parseInt($option.val())
+		}, function(url) {
+			window.location.href = url
+		})
+	})
+})
@@ -0,0 +1,132 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Bookmarks panel, used by both viewers. The viewer tells where the reader
+// is (current) and how to go to a bookmark (jump); bookmarks are listed in
+// reading order and can be renamed or deleted.
+var BookmarkPanel = (function() {
+	var options = null
+	var panel = null
+
+	function render(bookmarks) {
+		var list = panel.children('.bm-list').empty()
+		if (!bookmarks.length) {
+			list.append('<p class="bm-empty">No bookmarks yet.</p>')
+			return
+		}
+		$.each(bookmarks, function(i, bookmark) {
+			var item = $('<div class="bm-item"><a class="bm-name"></a><div class="bm-meta"></div><div class="bm-links"><a class="bm-rename">Rename</a><a class="bm-delete">Delete</a></div></div>')
+			item.attr('data-id', bookmark.id).data('bookmark', bookmark)
+			item.find('.bm-name').text(bookmark.name)
+			item.children('.bm-meta').text((options.format == 'pdf' ? 'Page ' : 'Chapter ') + bookmark.page + ' · ' + bookmark.date)
+			list.append(item)
+		})
+	}
+
+	function load() {
+		$.ajax({
+			url: '/get-bookmarks',
+			type: 'GET',
+			data: {'fileName': options.fileName},
+			success: render
+		})
+	}
+
+	function post(url, data, success) {
+		$.ajax({
+			url: url,
+			type: 'POST',
+			data: JSON.stringify(data),
+			contentType: 'application/json; charset=utf-8',
+			success: success,
+			error: function(xhr) {
+				alert(xhr.responseText)
+			}
+		})
+	}
+
+	function bookmarkOf(el) {
+		return $(el).closest('.bm-item').data('bookmark')
+	}
+
+	function ensurePanel() {
+		if (panel) return
+		panel = $('<div class="bookmark-panel"><div class="bm-header"><span class="bm-title">Bookmarks</span><span class="bm-close">Close</span></div><div class="bm-form"><input type="text" placeholder="Name (optional)"><button class="bm-add">Bookmark this place</button></div><div class="bm-list"></div></div>')
+		$('body').append(panel)
+
+		panel.on('click', '.bm-close', close)
+
+		panel.on('click', '.bm-add', function() {
+			var input = $(this).siblings('input')
+			var data = options.current()
+			data.fileName = options.fileName
+			data.name = input.val()
+			post('/post-bookmark', data, render)
+			input.val('')
+		})
+
+		panel.on('keypress', '.bm-form input', function(e) {
+			if (e.which == 13) panel.find('.bm-add').click()
+		})
+
+		panel.on('click', '.bm-name', function() {
+			options.jump(bookmarkOf(this))
+		})
+
+		panel.on('click', '.bm-rename', function() {
+			var bookmark = bookmarkOf(this)
+			var name = prompt('Bookmark name', bookmark.name)
+			if (!name || !$.trim(name)) return
+			post('/post-bookmark-name', {'id': bookmark.id, 'name': name}, load)
+		})
+
+		panel.on('click', '.bm-delete', function() {
+			if (!confirm('Do you want to delete this bookmark?')) return
+			post('/delete-bookmark', {'id': bookmarkOf(this).id}, load)
+		})
+	}
+
+	// fileName and format of the book, current() returning the position
+	// ({page} or {spineIndex, cfi}) and jump(bookmark)
+	function init(viewerOptions) {
+		options = viewerOptions
+	}
+
+	function open() {
+		ensurePanel()
+		panel.show()
+		load()
+	}
+
+	function close() {
+		if (panel) panel.hide()
+	}
+
+	function toggle() {
+		if (panel && panel.is(':visible')) close()
+		else open()
+	}
+
+	return {
+		init: init,
+		open: open,
+		close: close,
+		toggle: toggle
+	}
+})()
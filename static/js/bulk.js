@@ -0,0 +1,148 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+$(function() {
+
+	// File names of the selected books, in the order they were picked
+	var selected = []
+
+	function bookLinks(fileName) {
+		return $('.books-container a[data-filename]').filter(function() {
+			return $(this).attr('data-filename') == fileName
+		})
+	}
+
+	function showSelection() {
+		$('.bulk-count').text(selected.length + ' selected')
+	}
+
+	function showFields() {
+		var action = $('.bulk-action').val()
+		$('.bulk-field').each(function() {
+			$(this).toggle($(this).data('action') == action)
+		})
+	}
+
+	$('.bulk-toggle').click(function(e) {
+		e.preventDefault()
+		var $container = $('.books-container').toggleClass('bulk-selecting')
+		if ($container.hasClass('bulk-selecting')) {
+			$(this).text('Cancel selection')
+		} else {
+			$(this).text('Select books')
+			$('.books-container a.bulk-selected').removeClass('bulk-selected')
+			selected = []
+			showSelection()
+		}
+	})
+
+	// While selecting, a click on a book selects it instead of opening it
+	$('.books-container').on('click', 'a[data-filename]', function(e) {
+		if (!$('.books-container').hasClass('bulk-selecting')) return
+
+		e.preventDefault()
+		e.stopPropagation()
+
+		var fileName = $(this).attr('data-filename')
+		var i = selected.indexOf(fileName)
+		if (i == -1) {
+			selected.push(fileName)
+			bookLinks(fileName).addClass('bulk-selected')
+		} else {
+			selected.splice(i, 1)
+			bookLinks(fileName).removeClass('bulk-selected')
+		}
+		showSelection()
+	})
+
+	$('.bulk-action').change(showFields)
+	showFields()
+
+	function showBulkJob(job) {
+		var $report = $('.bulk-report').empty()
+
+		var summary = job.done + ' of ' + job.total + ' books done'
+		if (job.failed) summary += ', ' + job.failed + ' failed'
+		if (job.running) summary += '...'
+		$('<p>').text(summary).appendTo($report)
+
+		var $list = $('<ul>').appendTo($report)
+		for (var i=0; i<job.results.length; i++) {
+			var result = job.results[i]
+			var text = (result.title || result.fileName)
+			if (!result.ok) text += ': ' + result.message
+			$('<li>').addClass(result.ok ? 'br-ok' : 'br-error').text(text).appendTo($list)
+		}
+
+		if (job.running) {
+			setTimeout(function() {
+				$.ajax({
+					url: '/bulk-jobs/' + job.id,
+					type: 'GET',
+					success: showBulkJob
+				})
+			}, 2000)
+			return
+		}
+
+		if (job.downloadURL) {
+			$('<a>').attr('href', job.downloadURL).text('Download the zip').appendTo($report)
+			window.location.href = job.downloadURL
+		} else {
+			$('<a>').attr('href', window.location.href).text('Reload the library').appendTo($report)
+		}
+	}
+
+	$('.bulk-apply').click(function(e) {
+		e.preventDefault()
+
+		var action = $('.bulk-action').val()
+		if (!action) {
+			alert('Choose an action')
+			return
+		}
+		if (!selected.length) {
+			alert('Select some books first')
+			return
+		}
+		if (action == 'delete' && !confirm('Move ' + selected.length + ' books to the trash?')) {
+			return
+		}
+
+		var data = {
+			'action': action,
+			'fileNames': selected,
+			'collection': parseInt($('.bulk-collection').val()) || 0,
+			'tags': $('.bulk-tags').val(),
+			'tagMode': $('.bulk-tag-mode').val(),
+			'status': $('.bulk-status').val()
+		}
+
+		$.ajax({
+			url: '/bulk-books',
+			type: 'POST',
+			data: JSON.stringify(data),
+			contentType: 'application/json; charset=utf-8',
+			success: showBulkJob,
+			error: function (xhr) {
+				alert(xhr.responseText)
+			}
+		})
+	})
+})
@@ -0,0 +1,223 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Edit page of a collection: title, description and cover are saved with the
+// form, books are added, removed and reordered right away.
+$(document).ready(function() {
+	var $form = $('.edit-collection-container')
+	if (!$form.length) return
+
+	var collectionId = parseInt($form.attr('data-id'))
+	var coverBookId = 0
+
+	function post(url, data, success) {
+		$.ajax({
+			url: url,
+			type: 'POST',
+			data: JSON.stringify(data),
+			contentType: 'application/json; charset=utf-8',
+			success: success,
+			error: function(xhr) {
+				alert(xhr.responseText)
+			}
+		})
+	}
+
+	function bookIds($items) {
+		return $items.map(function() {
+			return parseInt($(this).attr('data-id'))
+		}).get()
+	}
+
+	function markCover() {
+		var cover = $('.ec-list').attr('data-cover')
+		$('.ec-list .ec-item').each(function() {
+			var isCover = coverBookId ? parseInt($(this).attr('data-id')) == coverBookId : $(this).attr('data-cover') == cover
+			$(this).toggleClass('cover', isCover)
+		})
+	}
+
+	function render(books) {
+		var $list = $('.ec-list').empty()
+		$.each(books, function(i, book) {
+			var $item = $('<div class="ec-item"><img width="50" height="80"><span class="ec-title"></span><a class="ec-up">Up</a><a class="ec-down">Down</a><a class="ec-cover">Use as cover</a><a class="ec-remove">Remove</a></div>')
+			$item.attr('data-id', book.bookId).attr('data-cover', book.cover)
+			$item.children('img').attr('src', book.cover)
+			$item.children('.ec-title').text(book.title)
+			$list.append($item)
+		})
+		markCover()
+	}
+
+	$form.on('click', '.ec-up, .ec-down', function() {
+		var $item = $(this).closest('.ec-item')
+		if ($(this).hasClass('ec-up')) {
+			$item.insertBefore($item.prev())
+		} else {
+			$item.insertAfter($item.next())
+		}
+		post('/post-collection-reorder', {'id': collectionId, 'books': bookIds($('.ec-list .ec-item'))}, render)
+	})
+
+	$form.on('click', '.ec-cover', function() {
+		coverBookId = parseInt($(this).closest('.ec-item').attr('data-id'))
+		markCover()
+	})
+
+	$form.on('click', '.ec-remove', function() {
+		var $item = $(this).closest('.ec-item')
+		var $other = $('<div class="ab-item"><input type="checkbox"><img width="100" height="160"></div>')
+		$other.attr('data-id', $item.attr('data-id'))
+		$other.children('input').val($item.attr('data-id'))
+		$other.children('img').attr('src', $item.attr('data-cover')).attr('title', $item.children('.ec-title').text())
+
+		post('/post-collection-books-remove', {'id': collectionId, 'books': bookIds($item)}, function(books) {
+			$('.ec-other-list').append($other)
+			render(books)
+		})
+	})
+
+	$form.on('click', '.ec-add-button', function() {
+		var $checked = $('.ec-other-list .ab-item').filter(function() {
+			return $(this).children('input').is(':checked')
+		})
+		if (!$checked.length) return
+
+		post('/post-collection-books', {'id': collectionId, 'books': bookIds($checked)}, function(books) {
+			$checked.remove()
+			render(books)
+		})
+	})
+
+	$form.submit(function(e) {
+		e.preventDefault()
+
+		post('/post-collection-update', {
+			'id': collectionId,
+			'title': $form.children('.title').val(),
+			'description': $form.children('.description').val(),
+			'coverBookId': coverBookId
+		}, function() {
+			window.location.href = '/collection/' + collectionId
+		})
+	})
+
+	markCover()
+})
+
+// Add and edit page of a smart collection: each rule is a field, an operator
+// and a value. Operators and values depend on the field.
+$(document).ready(function() {
+	var $form = $('.smart-collection-container')
+	if (!$form.length) return
+
+	var fields = {
+		'title': {'label': 'Title', 'operators': {'contains': 'contains', 'equals': 'is', 'not': 'is not'}},
+		'author': {'label': 'Author', 'operators': {'contains': 'contains', 'equals': 'is', 'not': 'is not'}},
+		'format': {'label': 'Format', 'operators': {'equals': 'is', 'not': 'is not'}, 'values': {'epub': 'EPUB', 'pdf': 'PDF'}},
+		'tag': {'label': 'Tag', 'operators': {'equals': 'is', 'contains': 'contains', 'not': 'is not'}},
+		'series': {'label': 'Series', 'operators': {'contains': 'contains', 'equals': 'is', 'not': 'is not'}},
+		'language': {'label': 'Language', 'operators': {'equals': 'is', 'not': 'is not'}},
+		'publisher': {'label': 'Publisher', 'operators': {'contains': 'contains', 'equals': 'is', 'not': 'is not'}},
+		'uploaded': {'label': 'Uploaded', 'operators': {'within': 'in the last (days)'}},
+		'status': {'label': 'Reading status', 'operators': {'equals': 'is', 'not': 'is not'}, 'values': {'unread': 'Unread', 'to-read': 'To read', 'reading': 'Reading', 'finished': 'Finished', 'abandoned': 'Abandoned'}}
+	}
+
+	var fieldLabels = {}
+	$.each(fields, function(name, field) {
+		fieldLabels[name] = field.label
+	})
+
+	function options(values, selected) {
+		var html = ''
+		$.each(values, function(value, label) {
+			html += '<option value="' + value + '"' + (value == selected ? ' selected' : '') + '>' + label + '</option>'
+		})
+		return html
+	}
+
+	function renderRule($rule, rule) {
+		var field = fields[rule.field] || fields.title
+		$rule.children('.sc-field').html(options(fieldLabels, rule.field))
+		$rule.children('.sc-operator').html(options(field.operators, rule.operator))
+		$rule.children('.sc-value').remove()
+		var $value = field.values ? $('<select class="sc-value">' + options(field.values, rule.value) + '</select>') : $('<input type="text" class="sc-value">').val(rule.value || '')
+		$value.insertAfter($rule.children('.sc-operator'))
+	}
+
+	function addRule(rule) {
+		var $rule = $('<div class="sc-rule"><select class="sc-field"></select><select class="sc-operator"></select><a class="sc-remove-rule">Remove</a></div>')
+		renderRule($rule, rule)
+		$form.children('.sc-rules').append($rule)
+	}
+
+	function readRule($rule) {
+		return {
+			'field': $rule.children('.sc-field').val(),
+			'operator': $rule.children('.sc-operator').val(),
+			'value': $rule.children('.sc-value').val()
+		}
+	}
+
+	$form.on('change', '.sc-field', function() {
+		var $rule = $(this).closest('.sc-rule')
+		renderRule($rule, {'field': $(this).val()})
+	})
+
+	$form.on('click', '.sc-remove-rule', function() {
+		$(this).closest('.sc-rule').remove()
+	})
+
+	$form.on('click', '.sc-add-rule', function() {
+		addRule({'field': 'title'})
+	})
+
+	$form.submit(function(e) {
+		e.preventDefault()
+
+		var data = {
+			'id': parseInt($form.attr('data-id')),
+			'title': $form.children('.title').val(),
+			'description': $form.children('.description').val(),
+			'match': $form.find('.sc-match-select').val(),
+			'rules': $form.find('.sc-rule').map(function() {
+				return readRule($(this))
+			}).get()
+		}
+
+		$.ajax({
+			url: '/post-smart-collection',
+			type: 'POST',
+			data: JSON.stringify(data),
+			contentType: 'application/json; charset=utf-8',
+			success: function(id) {
+				window.location.href = '/smart-collection/' + id
+			},
+			error: function(xhr) {
+				alert(xhr.responseText)
+			}
+		})
+	})
+
+	var rules = JSON.parse($form.attr('data-rules') || '[]')
+	if (!rules.length) rules = [{'field': 'title'}]
+	$.each(rules, function(i, rule) {
+		addRule(rule)
+	})
+})
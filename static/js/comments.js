@@ -0,0 +1,201 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Discussion panel of a highlight, used by both viewers. Comments form a
+// tree of replies. They are written in Markdown and rendered by the server;
+// the author of a comment can edit it (earlier versions stay visible) or
+// delete it.
+var CommentThread = (function() {
+	var highlight = null
+	var panel = null
+
+	function send(url, data) {
+		$.ajax({
+			url: url,
+			type: 'POST',
+			data: JSON.stringify(data),
+			contentType: 'application/json; charset=utf-8',
+			success: render,
+			error: function(xhr) {
+				alert(xhr.responseText)
+			}
+		})
+	}
+
+	function load() {
+		$.ajax({
+			url: '/get-highlight-comments',
+			type: 'GET',
+			data: {
+				'type': highlight.type,
+				'id': highlight.id
+			},
+			success: render
+		})
+	}
+
+	function render(comments) {
+		var replies = {}
+		$.each(comments, function(i, comment) {
+			if (!replies[comment.parentId]) replies[comment.parentId] = []
+			replies[comment.parentId].push(comment)
+		})
+
+		function build(parentId) {
+			var list = $('<div class="ct-list"></div>')
+			$.each(replies[parentId] || [], function(i, comment) {
+				var item = $('<div class="ct-comment"><div class="ct-meta"><span class="ct-author"></span> <span class="ct-date"></span></div><div class="ct-text"></div><div class="ct-links"></div><div class="ct-history"></div></div>')
+				item.attr('data-id', comment.id).data('body', comment.body)
+				item.find('.ct-date').text(comment.date)
+
+				var links = item.children('.ct-links')
+				if (comment.deleted) {
+					item.addClass('deleted')
+					item.children('.ct-text').text('Comment deleted')
+				} else {
+					item.find('.ct-author').text(comment.author || 'Anonymous')
+					item.children('.ct-text').html(comment.html)
+					links.append('<a class="ct-reply">Reply</a>')
+					if (comment.own) links.append('<a class="ct-edit">Edit</a><a class="ct-delete">Delete</a>')
+					if (comment.edited) links.append('<a class="ct-show-history">Edited</a>')
+				}
+
+				item.append(build(comment.id))
+				list.append(item)
+			})
+			return list
+		}
+
+		var container = panel.children('.ct-comments').empty()
+		if (comments.length) container.append(build(0))
+		else container.append('<p class="ct-empty">No comments yet.</p>')
+	}
+
+	function commentId(el) {
+		return parseInt($(el).closest('.ct-comment').attr('data-id'))
+	}
+
+	function ensurePanel() {
+		if (panel) return
+		panel = $('<div class="comment-thread"><div class="ct-header"><span class="ct-title">Discussion</span><span class="ct-close">Close</span></div><blockquote class="ct-quote"></blockquote><div class="ct-comments"></div><div class="ct-form"><textarea placeholder="Add a comment (Markdown)"></textarea><button class="ct-post">Comment</button></div></div>')
+		$('body').append(panel)
+
+		panel.on('click', '.ct-close', close)
+
+		panel.on('click', '.ct-post', function() {
+			var textarea = $(this).siblings('textarea')
+			if (!$.trim(textarea.val())) return
+			send('/post-highlight-comment', {
+				'type': highlight.type,
+				'highlightId': highlight.id,
+				'parentId': 0,
+				'body': textarea.val()
+			})
+			textarea.val('')
+		})
+
+		panel.on('click', '.ct-reply', function() {
+			var item = $(this).closest('.ct-comment')
+			if (item.children('.ct-reply-form').length) return
+			$('<div class="ct-reply-form"><textarea placeholder="Reply (Markdown)"></textarea><button class="ct-send-reply">Reply</button><a class="ct-cancel">Cancel</a></div>').insertAfter(item.children('.ct-links'))
+			item.children('.ct-reply-form').children('textarea').focus()
+		})
+
+		panel.on('click', '.ct-send-reply', function() {
+			var textarea = $(this).siblings('textarea')
+			if (!$.trim(textarea.val())) return
+			send('/post-highlight-comment', {
+				'type': highlight.type,
+				'highlightId': highlight.id,
+				'parentId': commentId(this),
+				'body': textarea.val()
+			})
+		})
+
+		panel.on('click', '.ct-edit', function() {
+			var item = $(this).closest('.ct-comment')
+			if (item.children('.ct-edit-form').length) return
+			var form = $('<div class="ct-edit-form"><textarea></textarea><button class="ct-save">Save</button><a class="ct-cancel">Cancel</a></div>')
+			form.children('textarea').val(item.data('body'))
+			item.children('.ct-text').hide().after(form)
+		})
+
+		panel.on('click', '.ct-save', function() {
+			var textarea = $(this).siblings('textarea')
+			if (!$.trim(textarea.val())) return
+			send('/post-highlight-comment-edit', {
+				'id': commentId(this),
+				'body': textarea.val()
+			})
+		})
+
+		panel.on('click', '.ct-cancel', function() {
+			var item = $(this).closest('.ct-comment')
+			$(this).parent().remove()
+			item.children('.ct-text').show()
+		})
+
+		panel.on('click', '.ct-delete', function() {
+			if (!confirm('Do you want to delete this comment?')) return
+			send('/delete-highlight-comment', {'id': commentId(this)})
+		})
+
+		panel.on('click', '.ct-show-history', function() {
+			var history = $(this).closest('.ct-comment').children('.ct-history')
+			if (history.is(':visible')) {
+				history.hide()
+				return
+			}
+			$.ajax({
+				url: '/get-highlight-comment-history',
+				type: 'GET',
+				data: {'id': commentId(this)},
+				success: function(revisions) {
+					history.empty()
+					$.each(revisions, function(i, revision) {
+						var item = $('<div class="ct-revision"><div class="ct-date"></div><div class="ct-text"></div></div>')
+						item.children('.ct-date').text(revision.date)
+						item.children('.ct-text').html(revision.html)
+						history.append(item)
+					})
+					history.show()
+				}
+			})
+		})
+	}
+
+	function open(type, id, quote) {
+		ensurePanel()
+		highlight = {'type': type, 'id': parseInt(id)}
+		panel.children('.ct-quote').text(quote || '')
+		panel.children('.ct-comments').empty()
+		panel.show()
+		load()
+	}
+
+	function close() {
+		if (panel) panel.hide()
+		highlight = null
+	}
+
+	return {
+		open: open,
+		close: close
+	}
+})()
@@ -0,0 +1,192 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Minimal EPUB CFI support for the EPUB viewer.
+//
+// Element steps follow the CFI spec (even indexes over element children,
+// starting at the <html> element). Character offsets are counted over the
+// text content of the addressed element instead of a single text node, so a
+// CFI stays valid after highlights wrap parts of the text in <span>s.
+// Elements injected by the viewer are skipped when counting steps.
+var EPUBCFI = (function() {
+	var ignoredClasses = ['highlighted', 'shared-highlighted', 'epub-highlight-menu-wrap', 'annotation-layer']
+
+	function isIgnored(node) {
+		if (node.nodeType != 1) return true
+		for (var i = 0; i < ignoredClasses.length; i++) {
+			if (node.classList.contains(ignoredClasses[i])) return true
+		}
+		return false
+	}
+
+	function elementChildren(node) {
+		var children = []
+		for (var i = 0; i < node.childNodes.length; i++) {
+			var child = node.childNodes[i]
+			if (child.nodeType != 1) continue
+			if (isIgnored(child)) {
+				// Viewer spans are transparent, their element children count
+				// as children of the parent.
+				children = children.concat(elementChildren(child))
+			} else {
+				children.push(child)
+			}
+		}
+		return children
+	}
+
+	function closestElement(node) {
+		while (node && (node.nodeType != 1 || isIgnored(node))) {
+			node = node.parentNode
+		}
+		return node
+	}
+
+	function elementPath(element) {
+		var doc = element.ownerDocument
+		var steps = []
+		while (element && element != doc.documentElement) {
+			var parent = element.parentNode
+			while (parent && parent.nodeType == 1 && isIgnored(parent)) {
+				parent = parent.parentNode
+			}
+			var index = elementChildren(parent).indexOf(element)
+			steps.unshift('/' + ((index + 1) * 2))
+			element = parent
+		}
+		return steps.join('')
+	}
+
+	// Character offset of (node, offset) within the text content of element
+	function textOffset(element, node, offset) {
+		var range = element.ownerDocument.createRange()
+		range.setStart(element, 0)
+		range.setEnd(node, offset)
+		return range.toString().length
+	}
+
+	function spineStep(spineIndex) {
+		return '/6/' + ((parseInt(spineIndex) + 1) * 2)
+	}
+
+	// CFI of an element, optionally with a character offset into it
+	function fromElement(spineIndex, element, offset) {
+		element = closestElement(element)
+		var cfi = spineStep(spineIndex) + '!' + elementPath(element)
+		if (offset != null) cfi += ':' + offset
+		return 'epubcfi(' + cfi + ')'
+	}
+
+	// Range CFI of a DOM Range: epubcfi(parent,start,end)
+	function fromRange(spineIndex, range) {
+		var parent = closestElement(range.commonAncestorContainer)
+		var start = closestElement(range.startContainer)
+		var end = closestElement(range.endContainer)
+		var parentPath = elementPath(parent)
+		var startPath = elementPath(start).substring(parentPath.length)
+		var endPath = elementPath(end).substring(parentPath.length)
+		var startOffset = textOffset(start, range.startContainer, range.startOffset)
+		var endOffset = textOffset(end, range.endContainer, range.endOffset)
+		return 'epubcfi(' + spineStep(spineIndex) + '!' + parentPath + ',' + startPath + ':' + startOffset + ',' + endPath + ':' + endOffset + ')'
+	}
+
+	function parse(cfi) {
+		var match = /^epubcfi\((.*)\)$/.exec(cfi || '')
+		if (!match) return null
+		var parts = match[1].split('!')
+		if (parts.length != 2) return null
+		var spine = parts[0].split('/')
+		var result = {
+			spineIndex: parseInt(spine[spine.length - 1]) / 2 - 1
+		}
+		var sections = parts[1].split(',')
+		function parsePath(path) {
+			var offset = null
+			var offsetIndex = path.indexOf(':')
+			if (offsetIndex >= 0) {
+				offset = parseInt(path.substring(offsetIndex + 1))
+				path = path.substring(0, offsetIndex)
+			}
+			var steps = path.split('/').filter(function(s) { return s != '' }).map(function(s) { return parseInt(s) })
+			return { steps: steps, offset: offset }
+		}
+		result.path = parsePath(sections[0])
+		if (sections.length == 3) {
+			result.start = parsePath(sections[1])
+			result.end = parsePath(sections[2])
+		}
+		return result
+	}
+
+	function resolveSteps(doc, steps, element) {
+		element = element || doc.documentElement
+		for (var i = 0; i < steps.length; i++) {
+			var children = elementChildren(element)
+			var child = children[steps[i] / 2 - 1]
+			if (!child) return null
+			element = child
+		}
+		return element
+	}
+
+	// Text node and offset of a character offset within element
+	function resolveOffset(element, offset) {
+		var walker = element.ownerDocument.createTreeWalker(element, NodeFilter.SHOW_TEXT, null, false)
+		var current, last = null
+		while ((current = walker.nextNode())) {
+			if (offset <= current.textContent.length) {
+				return { node: current, offset: offset }
+			}
+			offset -= current.textContent.length
+			last = current
+		}
+		if (last) return { node: last, offset: last.textContent.length }
+		return { node: element, offset: 0 }
+	}
+
+	function toElement(doc, cfi) {
+		var parsed = parse(cfi)
+		if (!parsed) return null
+		return resolveSteps(doc, parsed.path.steps)
+	}
+
+	function toRange(doc, cfi) {
+		var parsed = parse(cfi)
+		if (!parsed || !parsed.start) return null
+		var parent = resolveSteps(doc, parsed.path.steps)
+		if (!parent) return null
+		var start = resolveSteps(doc, parsed.start.steps, parent)
+		var end = resolveSteps(doc, parsed.end.steps, parent)
+		if (!start || !end) return null
+		var startPoint = resolveOffset(start, parsed.start.offset || 0)
+		var endPoint = resolveOffset(end, parsed.end.offset || 0)
+		var range = doc.createRange()
+		range.setStart(startPoint.node, startPoint.offset)
+		range.setEnd(endPoint.node, endPoint.offset)
+		return range
+	}
+
+	return {
+		fromElement: fromElement,
+		fromRange: fromRange,
+		parse: parse,
+		toElement: toElement,
+		toRange: toRange
+	}
+})()
@@ -0,0 +1,125 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Online metadata lookup in the edit dialog of both viewers. The providers
+// propose metadata and covers, a proposal only fills the form: nothing is
+// saved until the form is submitted.
+var MetadataLookup = (function() {
+	var fields = {
+		'title': '.emwd-title',
+		'series': '.emwd-series',
+		'language': '.emwd-language',
+		'publishedOn': '.emwd-published-on',
+		'publisher': '.emwd-publisher',
+		'isbn': '.emwd-isbn',
+		'description': '.emwd-description'
+	}
+
+	function summary(proposal) {
+		return $.grep([proposal.publisher, proposal.publishedOn, proposal.isbn], function(value) {
+			return !!value
+		}).join(' · ')
+	}
+
+	function render(data) {
+		var list = $('.emwd-proposals').empty()
+		$.each(data.errors, function(i, error) {
+			list.append($('<p class="emwd-lookup-error">').text(error))
+		})
+		if (!data.proposals.length) {
+			list.append('<p class="emwd-lookup-error">No matching books found.</p>')
+			return
+		}
+		$.each(data.proposals, function(i, proposal) {
+			var item = $('<div class="emwd-proposal"><img><div class="emwdp-info"><div class="emwdp-title"></div><div class="emwdp-authors"></div><div class="emwdp-summary"></div><div class="emwdp-provider"></div><a class="emwdp-use">Use details</a><a class="emwdp-use-cover">Use cover</a></div></div>')
+			item.data('proposal', proposal)
+			item.find('.emwdp-title').text(proposal.title)
+			item.find('.emwdp-authors').text((proposal.authors || []).join(' & '))
+			item.find('.emwdp-summary').text(summary(proposal))
+			item.find('.emwdp-provider').text(proposal.provider)
+			if (proposal.coverURL) {
+				item.children('img').attr('src', proposal.coverURL)
+			} else {
+				item.children('img').remove()
+				item.find('.emwdp-use-cover').remove()
+			}
+			list.append(item)
+		})
+	}
+
+	function lookup(fileName) {
+		$('.emwd-proposals').html('<p class="emwd-lookup-error">Looking up..</p>')
+		$.ajax({
+			url: '/metadata-lookup',
+			type: 'GET',
+			data: {
+				'fileName': fileName,
+				'isbn': $('.emwd-isbn').val(),
+				'title': $('.emwd-title').val(),
+				'author': $('.emwd-author').val()
+			},
+			success: render,
+			error: function(xhr) {
+				$('.emwd-proposals').empty().append($('<p class="emwd-lookup-error">').text(xhr.responseText))
+			}
+		})
+	}
+
+	// Fields the provider knows replace the ones in the form, the others
+	// are left as they are
+	function use(proposal) {
+		$.each(fields, function(key, selector) {
+			if (proposal[key]) $(selector).val(proposal[key])
+		})
+		if (proposal.authors && proposal.authors.length) $('.emwd-author').val(proposal.authors.join(' & '))
+		if (proposal.tags && proposal.tags.length) $('.emwd-tags').val(proposal.tags.join(', '))
+	}
+
+	function useCover(proposal) {
+		$('.emwd-cover-upload').val('')
+		$('.emwd-cover-url').val(proposal.coverURL)
+		$('.emwd-cover').attr('src', proposal.coverURL)
+	}
+
+	function reset() {
+		$('.emwd-proposals').empty()
+		$('.emwd-cover-url').val('')
+	}
+
+	$(document).on('click', '.emwd-lookup', function() {
+		lookup($('.emw-dialog input[name="filename"]').val())
+	})
+
+	$(document).on('click', '.emwdp-use', function() {
+		use($(this).closest('.emwd-proposal').data('proposal'))
+	})
+
+	$(document).on('click', '.emwdp-use-cover', function() {
+		useCover($(this).closest('.emwd-proposal').data('proposal'))
+	})
+
+	// An uploaded cover wins over a proposed one
+	$(document).on('change', '.emwd-cover-upload', function() {
+		$('.emwd-cover-url').val('')
+	})
+
+	return {
+		reset: reset
+	}
+})()
@@ -260,6 +260,17 @@ $(function() {
 					}
 					$('.sd-title-list').html(html)
 
+					if ($('.sd-author-list').length == 0) {
+						$('.search-dropdown').prepend('<label>Authors</label><div class="sd-author-list"></div>')
+					}
+					html = ''
+					for (i in data['authors']) {
+						html += '<a href="' + data['authors'][i].url + '">' + $('<span>').text(data['authors'][i].name).html() + '</a>'
+					}
+					$('.sd-author-list').html(html)
+					$('.sd-author-list').prev('label').toggle(html != '')
+					$('.sd-author-list').toggle(html != '')
+
 					html = ''
 					console.log(data['book_detail'])
 					for (i in data['book_detail']) {
@@ -286,6 +297,12 @@ $(function() {
 		}
 	})
 
+	$('body').on('click', '.bc-author', function(e) {
+		e.preventDefault()
+		e.stopPropagation()
+		window.location.href = $(this).data('href')
+	})
+
 	$('.add-collection-container').submit(function(e) {
 		e.preventDefault()
 		var title = $(this).children('.title').val()
@@ -334,6 +351,16 @@ $(function() {
 		}
 	})
 
+	$('#changeKOReaderPassword').prop("checked", false)
+
+	$('#changeKOReaderPassword').change(function(){
+		if ($(this).is(":checked")) {
+			$('.kpb-item').fadeIn()
+		} else {
+			$('.kpb-item').hide()
+		}
+	})
+
 	$('.submit-settings').click(function(e) {
 		e.preventDefault()
 		var email = $('#sEmail').val()
@@ -350,6 +377,10 @@ $(function() {
 				'change_password': false
 			}
 		}
+		if ($('#changeKOReaderPassword').is(':checked')) {
+			data['change_koreader_password'] = true
+			data['koreader_password'] = $('#sKOReaderPassword').val()
+		}
 
 		$.ajax({
 			url: '/post-settings',
@@ -363,6 +394,87 @@ $(function() {
 		})
 	})
 
+	$('.submit-export-template').click(function(e) {
+		e.preventDefault()
+		$.ajax({
+			url: '/post-export-template',
+			type: 'POST',
+			data: JSON.stringify({'template': $('#sExportTemplate').val()}),
+			contentType: 'application/json; charset=utf-8',
+			success: function (data) {
+				alert(data)
+			},
+			error: function (xhr) {
+				alert(xhr.responseText)
+			}
+		})
+	})
+
+	$('.submit-import').click(function(e) {
+		e.preventDefault()
+		var dryRun = $(this).data('dry-run')
+		var formData = new FormData($('.import-form')[0])
+		formData.append('dryRun', dryRun)
+
+		$.ajax({
+			url: '/import-highlights',
+			type: 'POST',
+			data: formData,
+			cache: false,
+			contentType: false,
+			processData: false,
+			success: function (data) {
+				var $report = $('.import-report').empty()
+				var summary = data.total + ' entries, ' + data.duplicates + ' already highlighted, ' + data.unmatched + ' without a matching book'
+				if (!data.dryRun) summary = data.imported + ' imported. ' + summary
+				$('<p>').text(summary).appendTo($report)
+
+				var $list = $('<ul>').appendTo($report)
+				for (var i=0; i<data.items.length; i++) {
+					var item = data.items[i]
+					var book = item.status == 'unmatched' ? 'no match' : item.bookTitle
+					$('<li>').addClass('ir-' + item.status)
+						.text('[' + item.status + '] ' + item.title + ' (' + book + '): ' + item.quote.substring(0, 120))
+						.appendTo($list)
+				}
+			},
+			error: function (xhr) {
+				alert(xhr.responseText)
+			}
+		})
+	})
+
+	// Picking another sort also switches to its natural order
+	$('.library-view select[name=sort]').change(function() {
+		$('.library-view select[name=order]').val($(this).find(':selected').data('order'))
+	})
+
+	$('.library-view select').change(function() {
+		var $form = $('.library-view')
+		var data = {
+			'sort': $form.find('select[name=sort]').val(),
+			'order': $form.find('select[name=order]').val(),
+			'format': $form.find('select[name=format]').val(),
+			'status': $form.find('select[name=status]').val(),
+			'tag': $form.find('select[name=tag]').val() || '',
+			'collection': parseInt($form.find('select[name=collection]').val()) || 0,
+			'pageSize': parseInt($form.find('select[name=pageSize]').val())
+		}
+
+		$.ajax({
+			url: '/post-library-view',
+			type: 'POST',
+			data: JSON.stringify(data),
+			contentType: 'application/json; charset=utf-8',
+			success: function () {
+				window.location.href = '/'
+			},
+			error: function (xhr) {
+				alert(xhr.responseText)
+			}
+		})
+	})
+
 	$(document).click(function(e) {
 		if ( $(e.target).closest('.search-dropdown').length == 0 && $(e.target).closest('.search-box').length == 0 ) {
 			$('.search-dropdown').hide()
@@ -0,0 +1,171 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Dialog listing the users a book or collection is shared with. The owner
+// can share with another user by email, change the permission (read only or
+// annotate) or revoke the share. Collections can also be published with
+// public links, each with its own expiry, download and OPDS settings.
+var ShareDialog = (function() {
+	var target = null
+	var panel = null
+
+	function render(shares) {
+		var list = panel.children('.sh-list').empty()
+		if (!shares.length) {
+			list.append('<p class="sh-empty">Not shared with anyone yet.</p>')
+			return
+		}
+		$.each(shares, function(i, share) {
+			var item = $('<div class="sh-item"><div class="sh-user"><span class="sh-name"></span> <span class="sh-email"></span></div><select class="sh-permission"><option value="read">Read only</option><option value="annotate">Can annotate</option></select><a class="sh-revoke">Revoke</a></div>')
+			item.data('share', share)
+			item.find('.sh-name').text(share.name)
+			item.find('.sh-email').text(share.email)
+			item.children('.sh-permission').val(share.permission)
+			list.append(item)
+		})
+	}
+
+	function renderLinks(links) {
+		var list = panel.find('.sh-link-list').empty()
+		if (!links.length) {
+			list.append('<p class="sh-empty">No public links.</p>')
+			return
+		}
+		$.each(links, function(i, link) {
+			var item = $('<div class="sh-item sh-link"><input type="text" class="sh-url" readonly><label><input type="checkbox" class="sh-download"> Allow downloads</label><label><input type="checkbox" class="sh-opds"> OPDS feed</label><label>Expires <input type="date" class="sh-expires"></label><div class="sh-link-status"></div><a class="sh-revoke-link">Revoke</a></div>')
+			item.data('link', link)
+			item.find('.sh-url').val(link.url)
+			item.find('.sh-download').prop('checked', link.allowDownload)
+			item.find('.sh-opds').prop('checked', link.opds)
+			item.find('.sh-expires').val(link.expires)
+			if (link.expired) item.addClass('expired').children('.sh-link-status').text('Expired')
+			list.append(item)
+		})
+	}
+
+	function load() {
+		$.ajax({
+			url: '/get-shares',
+			type: 'GET',
+			data: target,
+			success: render
+		})
+		if (!target.collectionId) return
+		$.ajax({
+			url: '/get-collection-links',
+			type: 'GET',
+			data: target,
+			success: renderLinks
+		})
+	}
+
+	function post(url, data, success) {
+		$.ajax({
+			url: url,
+			type: 'POST',
+			data: JSON.stringify(data),
+			contentType: 'application/json; charset=utf-8',
+			success: success,
+			error: function(xhr) {
+				alert(xhr.responseText)
+			}
+		})
+	}
+
+	function share(email, permission) {
+		post('/post-share', $.extend({'email': email, 'permission': permission}, target), render)
+	}
+
+	function linkSettings(item) {
+		return {
+			'id': item.data('link').id,
+			'expiresOn': item.find('.sh-expires').val(),
+			'allowDownload': item.find('.sh-download').prop('checked'),
+			'opds': item.find('.sh-opds').prop('checked')
+		}
+	}
+
+	function ensurePanel() {
+		if (panel) return
+		panel = $('<div class="share-panel"><div class="sh-header"><span class="sh-title">Share</span><span class="sh-close">Close</span></div><div class="sh-form"><input type="email" placeholder="Email of a user"><select><option value="read">Read only</option><option value="annotate">Can annotate</option></select><button class="sh-add">Share</button></div><div class="sh-list"></div><div class="sh-links"><div class="sh-subtitle">Public links</div><div class="sh-link-form"><label><input type="checkbox" class="sh-download"> Allow downloads</label><label><input type="checkbox" class="sh-opds"> OPDS feed</label><label>Expires <input type="date" class="sh-expires"></label><button class="sh-add-link">Create link</button></div><div class="sh-link-list"></div></div></div>')
+		$('body').append(panel)
+
+		panel.on('click', '.sh-close', close)
+
+		panel.on('click', '.sh-add', function() {
+			var input = panel.find('.sh-form input')
+			if (!$.trim(input.val())) return
+			share(input.val(), panel.find('.sh-form select').val())
+			input.val('')
+		})
+
+		panel.on('change', '.sh-permission', function() {
+			share($(this).closest('.sh-item').data('share').email, $(this).val())
+		})
+
+		panel.on('click', '.sh-add-link', function() {
+			var form = panel.find('.sh-link-form')
+			post('/post-collection-link', {
+				'collectionId': target.collectionId,
+				'expiresOn': form.find('.sh-expires').val(),
+				'allowDownload': form.find('.sh-download').prop('checked'),
+				'opds': form.find('.sh-opds').prop('checked')
+			}, renderLinks)
+		})
+
+		panel.on('change', '.sh-link input', function() {
+			if ($(this).hasClass('sh-url')) return
+			post('/post-collection-link-update', linkSettings($(this).closest('.sh-link')), renderLinks)
+		})
+
+		panel.on('focus', '.sh-url', function() {
+			this.select()
+		})
+
+		panel.on('click', '.sh-revoke-link', function() {
+			if (!confirm('Do you want to revoke this link? It will stop working immediately.')) return
+			post('/delete-collection-link', {'id': $(this).closest('.sh-link').data('link').id}, load)
+		})
+
+		panel.on('click', '.sh-revoke', function() {
+			var item = $(this).closest('.sh-item')
+			if (!confirm('Do you want to stop sharing with ' + item.data('share').email + '?')) return
+			post('/delete-share', {'id': item.data('share').id}, load)
+		})
+	}
+
+	// {fileName: ...} for a book or {collectionId: ...} for a collection
+	function open(shareTarget) {
+		ensurePanel()
+		target = shareTarget
+		panel.children('.sh-links').toggle(!!target.collectionId)
+		panel.show()
+		load()
+	}
+
+	function close() {
+		if (panel) panel.hide()
+		target = null
+	}
+
+	return {
+		open: open,
+		close: close
+	}
+})()
@@ -0,0 +1,367 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A reading session ends when the viewer hasn't reported any activity for
+// this long. The viewers send a heartbeat every minute while visible.
+const ReadingSessionIdleTimeout = 5 * time.Minute
+
+const timeLayout = "20060102150405"
+
+func _ParseTime(t string) time.Time {
+	parsed, err := time.ParseInLocation(timeLayout, t, time.Local)
+	CheckError(err)
+
+	return parsed
+}
+
+type ReadingSessionStruct struct {
+	Id              int64
+	BookId          int64
+	StartedOn       string
+	EndedOn         string
+	Duration        int64
+	StartPage       int64
+	EndPage         int64
+	StartPercentage float64
+	EndPercentage   float64
+}
+
+func (e *Env) _GetLatestReadingSession(userId int64, bookId int64) (ReadingSessionStruct, bool) {
+	rows, err := e.db.Query("SELECT `id`, `started_on`, `ended_on`, `duration`, `start_page`, `end_page`, `start_percentage`, `end_percentage`"+
+		" FROM `reading_session` WHERE `user_id` = ? AND `book_id` = ? ORDER BY `id` DESC LIMIT 1", userId, bookId)
+	CheckError(err)
+
+	session := ReadingSessionStruct{
+		BookId: bookId,
+	}
+	found := false
+	if rows.Next() {
+		err := rows.Scan(&session.Id, &session.StartedOn, &session.EndedOn, &session.Duration, &session.StartPage, &session.EndPage, &session.StartPercentage, &session.EndPercentage)
+		CheckError(err)
+		found = true
+	}
+	rows.Close()
+
+	return session, found
+}
+
+// Extend the current reading session of a book, or start a new one if the
+// last session has been idle for too long. previous is the position at the
+// start of the activity and current the position after it.
+func (e *Env) _TouchReadingSession(userId int64, bookId int64, previous ReadingProgressStruct, current ReadingProgressStruct) {
+	now := time.Now()
+
+	session, found := e._GetLatestReadingSession(userId, bookId)
+	if found && now.Sub(_ParseTime(session.EndedOn)) <= ReadingSessionIdleTimeout {
+		duration := int64(now.Sub(_ParseTime(session.StartedOn)).Seconds())
+
+		stmt, err := e.db.Prepare("UPDATE `reading_session` SET ended_on=?, duration=?, end_page=?, end_percentage=? WHERE id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(now.Format(timeLayout), duration, current.Page, current.Percentage, session.Id)
+		CheckError(err)
+		return
+	}
+
+	stmt, err := e.db.Prepare("INSERT INTO `reading_session` (user_id, book_id, started_on, ended_on, duration, start_page, end_page, start_percentage, end_percentage) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	CheckError(err)
+
+	_, err = stmt.Exec(userId, bookId, now.Format(timeLayout), now.Format(timeLayout), 0, previous.Page, current.Page, previous.Percentage, current.Percentage)
+	CheckError(err)
+}
+
+// Heartbeat sent by the viewers while a book is open
+func (e *Env) PostReadingSession(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		progress := ReadingProgressStruct{}
+		err := c.BindJSON(&progress)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		bookId, _, _ := e._GetBookInfo(progress.FileName)
+		if !e._CanAccessBook(userId, bookId) {
+			c.String(404, "Book not found")
+			return
+		}
+
+		current, hasProgress := e._GetReadingProgress(userId, bookId)
+		if !hasProgress {
+			current.Page = 1
+		}
+		e._TouchReadingSession(userId, bookId, current, current)
+
+		c.String(200, "Session updated")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+type DayStatStruct struct {
+	Date    string `json:"date"`
+	Seconds int64  `json:"seconds"`
+}
+
+type BookStatStruct struct {
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	URL           string `json:"url"`
+	Format        string `json:"format"`
+	Seconds       int64  `json:"seconds"`
+	PagesAdvanced int64  `json:"pagesAdvanced"`
+	Sessions      int64  `json:"sessions"`
+	Status        string `json:"status"`
+	LastReadOn    string `json:"lastReadOn"`
+}
+
+type FinishedBookStruct struct {
+	Title      string `json:"title"`
+	Author     string `json:"author"`
+	URL        string `json:"url"`
+	FinishedOn string `json:"finishedOn"`
+}
+
+type ReadingStatsStruct struct {
+	TotalSeconds     int64                `json:"totalSeconds"`
+	Days             []DayStatStruct      `json:"days"`
+	BooksFinished    int64                `json:"booksFinished"`
+	FinishedBooks    []FinishedBookStruct `json:"finishedBooks"`
+	PagesPerHour     float64              `json:"pagesPerHour"`
+	ChaptersPerHour  float64              `json:"chaptersPerHour"`
+	CurrentStreak    int64                `json:"currentStreak"`
+	LongestStreak    int64                `json:"longestStreak"`
+	Books            []BookStatStruct     `json:"books"`
+	StatusCounts     map[string]int64     `json:"statusCounts"`
+	DaysInPeriod     int64                `json:"daysInPeriod"`
+	AveragePerDay    int64                `json:"averagePerDay"`
+	SessionsInPeriod int64                `json:"sessionsInPeriod"`
+}
+
+// Length of the longest run of consecutive days and of the run ending today
+// (or yesterday, so the streak isn't lost before today's reading).
+func _ComputeStreaks(readDays map[string]bool, today time.Time) (int64, int64) {
+	days := make([]string, 0, len(readDays))
+	for day := range readDays {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+
+	var longest, run int64
+	var previous time.Time
+	for i, day := range days {
+		t, err := time.ParseInLocation("2006-01-02", day, time.Local)
+		CheckError(err)
+
+		if i > 0 && t.Equal(previous.AddDate(0, 0, 1)) {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		previous = t
+	}
+
+	var current int64
+	day := today
+	if !readDays[day.Format("2006-01-02")] {
+		day = day.AddDate(0, 0, -1)
+	}
+	for readDays[day.Format("2006-01-02")] {
+		current++
+		day = day.AddDate(0, 0, -1)
+	}
+
+	return current, longest
+}
+
+// Statistics of the reading sessions of a user. Time per day covers the
+// given number of days, everything else covers all sessions.
+func (e *Env) _GetReadingStats(userId int64, period int64) ReadingStatsStruct {
+	stats := ReadingStatsStruct{
+		DaysInPeriod: period,
+		StatusCounts: make(map[string]int64),
+	}
+
+	today := time.Now()
+	periodStart := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, -int(period-1))
+
+	dayIndex := make(map[string]int)
+	for i := int64(0); i < period; i++ {
+		date := periodStart.AddDate(0, 0, int(i)).Format("2006-01-02")
+		dayIndex[date] = len(stats.Days)
+		stats.Days = append(stats.Days, DayStatStruct{Date: date})
+	}
+
+	condition, libraryArgs := e._GetLibraryCondition(userId)
+	args := append([]interface{}{userId}, libraryArgs...)
+
+	rows, err := e.db.Query("SELECT `reading_session`.`book_id`, `reading_session`.`started_on`, `reading_session`.`ended_on`, `reading_session`.`duration`,"+
+		" `reading_session`.`start_page`, `reading_session`.`end_page`, `book`.`title`, `book`.`author`, `book`.`url`, `book`.`format`"+
+		" FROM `reading_session` JOIN `book` ON `book`.`id` = `reading_session`.`book_id`"+
+		" WHERE `reading_session`.`user_id` = ? AND `book`.`id` IN (SELECT `id` FROM `book` WHERE "+condition+")"+
+		" ORDER BY `reading_session`.`started_on`", args...)
+	CheckError(err)
+
+	var (
+		pdfPages, pdfSeconds, epubChapters, epubSeconds int64
+	)
+	readDays := make(map[string]bool)
+	books := make(map[int64]*BookStatStruct)
+	for rows.Next() {
+		var (
+			session ReadingSessionStruct
+			book    BookStatStruct
+		)
+		err := rows.Scan(&session.BookId, &session.StartedOn, &session.EndedOn, &session.Duration, &session.StartPage, &session.EndPage, &book.Title, &book.Author, &book.URL, &book.Format)
+		CheckError(err)
+
+		advanced := session.EndPage - session.StartPage
+		if advanced < 0 {
+			advanced = 0
+		}
+
+		startedOn := _ParseTime(session.StartedOn)
+		day := startedOn.Format("2006-01-02")
+		readDays[day] = true
+
+		stats.TotalSeconds += session.Duration
+		if i, ok := dayIndex[day]; ok {
+			stats.Days[i].Seconds += session.Duration
+			stats.SessionsInPeriod++
+		}
+
+		if book.Format == "pdf" {
+			pdfPages += advanced
+			pdfSeconds += session.Duration
+		} else {
+			epubChapters += advanced
+			epubSeconds += session.Duration
+		}
+
+		bookStat, ok := books[session.BookId]
+		if !ok {
+			bookStat = &book
+			books[session.BookId] = bookStat
+		}
+		bookStat.Seconds += session.Duration
+		bookStat.PagesAdvanced += advanced
+		bookStat.Sessions++
+		bookStat.LastReadOn = session.EndedOn
+	}
+	rows.Close()
+
+	if pdfSeconds > 0 {
+		stats.PagesPerHour = float64(pdfPages) / (float64(pdfSeconds) / 3600)
+	}
+	if epubSeconds > 0 {
+		stats.ChaptersPerHour = float64(epubChapters) / (float64(epubSeconds) / 3600)
+	}
+
+	var periodSeconds int64
+	for _, day := range stats.Days {
+		periodSeconds += day.Seconds
+	}
+	if period > 0 {
+		stats.AveragePerDay = periodSeconds / period
+	}
+
+	stats.CurrentStreak, stats.LongestStreak = _ComputeStreaks(readDays, today)
+
+	for bookId, bookStat := range books {
+		bookStat.Status = e._GetReadingStatus(userId, bookId).Status
+		stats.Books = append(stats.Books, *bookStat)
+	}
+	sort.Slice(stats.Books, func(i, j int) bool {
+		return stats.Books[i].Seconds > stats.Books[j].Seconds
+	})
+
+	rows, err = e.db.Query("SELECT `reading_status`.`status`, `reading_status`.`date_finished`, `book`.`title`, `book`.`author`, `book`.`url`"+
+		" FROM `reading_status` JOIN `book` ON `book`.`id` = `reading_status`.`book_id`"+
+		" WHERE `reading_status`.`user_id` = ? AND `book`.`id` IN (SELECT `id` FROM `book` WHERE "+condition+")"+
+		" ORDER BY `reading_status`.`date_finished` DESC", args...)
+	CheckError(err)
+
+	for rows.Next() {
+		var (
+			status       string
+			finishedBook FinishedBookStruct
+		)
+		err := rows.Scan(&status, &finishedBook.FinishedOn, &finishedBook.Title, &finishedBook.Author, &finishedBook.URL)
+		CheckError(err)
+
+		stats.StatusCounts[status]++
+		if status == ReadingStatusFinished {
+			stats.FinishedBooks = append(stats.FinishedBooks, finishedBook)
+		}
+	}
+	rows.Close()
+
+	stats.BooksFinished = stats.StatusCounts[ReadingStatusFinished]
+
+	return stats
+}
+
+func _GetStatsPeriod(c *gin.Context) int64 {
+	period, err := strconv.ParseInt(c.DefaultQuery("days", "30"), 10, 64)
+	if err != nil || period < 1 {
+		period = 30
+	} else if period > 366 {
+		period = 366
+	}
+
+	return period
+}
+
+func (e *Env) GetReadingStats(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		stats := e._GetReadingStats(userId, _GetStatsPeriod(c))
+
+		c.JSON(200, stats)
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) GetStatistics(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		// The page loads the statistics from GetReadingStats
+		c.HTML(200, "statistics.html", gin.H{
+			"email": email.(string),
+		})
+	} else {
+		c.Redirect(302, "/signin")
+	}
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reading states of a book. A book without a reading_status record has no
+// state.
+const (
+	ReadingStatusToRead    = "to-read"
+	ReadingStatusReading   = "reading"
+	ReadingStatusFinished  = "finished"
+	ReadingStatusAbandoned = "abandoned"
+)
+
+func _IsValidReadingStatus(status string) bool {
+	switch status {
+	case ReadingStatusToRead, ReadingStatusReading, ReadingStatusFinished, ReadingStatusAbandoned:
+		return true
+	}
+	return false
+}
+
+type ReadingStatusStruct struct {
+	FileName     string `json:"fileName"`
+	Status       string `json:"status"`
+	DateStarted  string `json:"dateStarted"`
+	DateFinished string `json:"dateFinished"`
+	UpdatedOn    string `json:"updatedOn"`
+}
+
+func (e *Env) _GetReadingStatus(userId int64, bookId int64) ReadingStatusStruct {
+	rows, err := e.db.Query("SELECT `status`, `date_started`, `date_finished`, `updated_on` FROM `reading_status` WHERE `user_id` = ? AND `book_id` = ?", userId, bookId)
+	CheckError(err)
+
+	readingStatus := ReadingStatusStruct{}
+	if rows.Next() {
+		err := rows.Scan(&readingStatus.Status, &readingStatus.DateStarted, &readingStatus.DateFinished, &readingStatus.UpdatedOn)
+		CheckError(err)
+	}
+	rows.Close()
+
+	return readingStatus
+}
+
+// Set the reading status of a book. An empty status removes it. Starting a
+// book sets the date started, finishing it sets the date finished and moving
+// it back to the to-read shelf clears both.
+func (e *Env) _SetReadingStatus(userId int64, bookId int64, status string) {
+	if status == "" {
+		stmt, err := e.db.Prepare("DELETE FROM `reading_status` WHERE user_id=? AND book_id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(userId, bookId)
+		CheckError(err)
+		return
+	}
+
+	updatedOn := _GetCurrentTime()
+
+	current := e._GetReadingStatus(userId, bookId)
+	if current.Status == status {
+		return
+	}
+
+	dateStarted := current.DateStarted
+	dateFinished := current.DateFinished
+	switch status {
+	case ReadingStatusToRead:
+		dateStarted = ""
+		dateFinished = ""
+	case ReadingStatusReading:
+		dateStarted = updatedOn
+		dateFinished = ""
+	case ReadingStatusFinished:
+		if dateStarted == "" {
+			dateStarted = updatedOn
+		}
+		dateFinished = updatedOn
+	}
+
+	if current.Status != "" {
+		stmt, err := e.db.Prepare("UPDATE `reading_status` SET status=?, date_started=?, date_finished=?, updated_on=? WHERE user_id=? AND book_id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(status, dateStarted, dateFinished, updatedOn, userId, bookId)
+		CheckError(err)
+	} else {
+		stmt, err := e.db.Prepare("INSERT INTO `reading_status` (user_id, book_id, status, date_started, date_finished, updated_on) VALUES (?, ?, ?, ?, ?, ?)")
+		CheckError(err)
+
+		_, err = stmt.Exec(userId, bookId, status, dateStarted, dateFinished, updatedOn)
+		CheckError(err)
+	}
+}
+
+// Dates are given as YYYY-MM-DD, an empty date leaves it unchanged
+func (e *Env) _SetReadingStatusDates(userId int64, bookId int64, dateStarted string, dateFinished string) {
+	for column, date := range map[string]string{"date_started": dateStarted, "date_finished": dateFinished} {
+		if date == "" {
+			continue
+		}
+
+		t, err := time.ParseInLocation("2006-01-02", date, time.Local)
+		if err != nil {
+			CheckError(err)
+			continue
+		}
+
+		stmt, err := e.db.Prepare("UPDATE `reading_status` SET " + column + "=? WHERE user_id=? AND book_id=?")
+		CheckError(err)
+
+		_, err = stmt.Exec(t.Format(timeLayout), userId, bookId)
+		CheckError(err)
+	}
+}
+
+// Move a book to the reading shelf when its progress is first recorded and
+// to the finished shelf when the progress reaches 100%. Reading a finished
+// book again from the start moves it back to the reading shelf.
+func (e *Env) _AutoUpdateReadingStatus(userId int64, bookId int64, percentage float64) {
+	status := e._GetReadingStatus(userId, bookId).Status
+
+	switch {
+	case percentage >= 100:
+		if status != ReadingStatusFinished {
+			e._SetReadingStatus(userId, bookId, ReadingStatusFinished)
+		}
+	case status == "" || status == ReadingStatusToRead:
+		e._SetReadingStatus(userId, bookId, ReadingStatusReading)
+	case status == ReadingStatusFinished && percentage == 0:
+		e._SetReadingStatus(userId, bookId, ReadingStatusReading)
+	}
+}
+
+func (e *Env) PostReadingStatus(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		readingStatus := ReadingStatusStruct{}
+		err := c.BindJSON(&readingStatus)
+		CheckError(err)
+
+		if readingStatus.Status != "" && !_IsValidReadingStatus(readingStatus.Status) {
+			c.String(400, "Invalid status")
+			return
+		}
+
+		userId := e._GetUserId(email.(string))
+
+		bookId, _, _ := e._GetBookInfo(readingStatus.FileName)
+		if !e._CanAccessBook(userId, bookId) {
+			c.String(404, "Book not found")
+			return
+		}
+
+		e._SetReadingStatus(userId, bookId, readingStatus.Status)
+		if readingStatus.Status != "" {
+			e._SetReadingStatusDates(userId, bookId, readingStatus.DateStarted, readingStatus.DateFinished)
+		}
+
+		fileName := readingStatus.FileName
+		readingStatus = e._GetReadingStatus(userId, bookId)
+		readingStatus.FileName = fileName
+
+		c.JSON(200, readingStatus)
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) GetReadingStatus(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		fileName := c.Query("fileName")
+
+		userId := e._GetUserId(email.(string))
+		bookId, _, _ := e._GetBookInfo(fileName)
+		if !e._CanAccessBook(userId, bookId) {
+			c.String(404, "Book not found")
+			return
+		}
+
+		readingStatus := e._GetReadingStatus(userId, bookId)
+		readingStatus.FileName = fileName
+
+		c.JSON(200, readingStatus)
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+type ShelfBookStruct struct {
+	Title        string
+	Author       string
+	URL          string
+	Cover        string
+	Percentage   float64
+	DateStarted  string
+	DateFinished string
+}
+
+// YYYYMMDDhhmmss to YYYY-MM-DD
+func _FormatDate(t string) string {
+	if len(t) < 8 {
+		return ""
+	}
+	return t[0:4] + "-" + t[4:6] + "-" + t[6:8]
+}
+
+func (e *Env) _GetShelfBooks(userId int64, status string) []ShelfBookStruct {
+	condition, args := e._GetLibraryCondition(userId)
+	args = append([]interface{}{userId, status}, args...)
+	rows, err := e.db.Query("SELECT `book`.`title`, `book`.`author`, `book`.`url`, `book`.`cover`, `reading_status`.`date_started`,"+
+		" `reading_status`.`date_finished`, IFNULL(`reading_progress`.`percentage`, 0) FROM `reading_status`"+
+		" JOIN `book` ON `book`.`id` = `reading_status`.`book_id`"+
+		" LEFT JOIN `reading_progress` ON `reading_progress`.`book_id` = `reading_status`.`book_id` AND `reading_progress`.`user_id` = `reading_status`.`user_id`"+
+		" WHERE `reading_status`.`user_id` = ? AND `reading_status`.`status` = ?"+
+		" AND `book`.`id` IN (SELECT `id` FROM `book` WHERE "+condition+") ORDER BY `reading_status`.`updated_on` DESC", args...)
+	CheckError(err)
+
+	var books []ShelfBookStruct
+	for rows.Next() {
+		book := ShelfBookStruct{}
+		err := rows.Scan(&book.Title, &book.Author, &book.URL, &book.Cover, &book.DateStarted, &book.DateFinished, &book.Percentage)
+		CheckError(err)
+
+		book.DateStarted = _FormatDate(book.DateStarted)
+		book.DateFinished = _FormatDate(book.DateFinished)
+		books = append(books, book)
+	}
+	rows.Close()
+
+	return books
+}
+
+func (e *Env) GetShelf(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		status := c.Param("status")
+		if !_IsValidReadingStatus(status) {
+			c.Redirect(302, "/")
+			return
+		}
+
+		userId := e._GetUserId(email.(string))
+
+		c.HTML(200, "shelf.html", gin.H{
+			"status": status,
+			"books":  e._GetShelfBooks(userId, status),
+		})
+	} else {
+		c.Redirect(302, "/signin")
+	}
+}
@@ -0,0 +1,49 @@
+-- /mnt/onboard/Books/Dune.pdf
+return {
+    ["bookmarks"] = {
+        [1] = {
+            ["datetime"] = "2019-05-01 20:00:00",
+            ["highlighted"] = true,
+            ["notes"] = "Fear is the mind-killer.",
+            ["page"] = 9,
+            ["text"] = "The litany against fear",
+        },
+        [2] = {
+            ["datetime"] = "2019-05-02 21:00:00",
+            ["highlighted"] = true,
+            ["notes"] = "The spice must flow.",
+            ["page"] = 10,
+            ["text"] = "Page 10 The spice must flow. @ 2019-05-02 21:00:00",
+        },
+    },
+    ["doc_props"] = {
+        ["authors"] = "Frank Herbert\nBrian Herbert",
+        ["title"] = "",
+    },
+    ["highlight"] = {
+        [10] = {
+            [1] = {
+                ["chapter"] = "Book Two",
+                ["color"] = "green",
+                ["datetime"] = "2019-05-02 21:00:00",
+                ["drawer"] = "lighten",
+                ["pos0"] = { ["page"] = 10, ["x"] = 72.5, ["y"] = 301 },
+                ["pos1"] = { ["page"] = 10, ["x"] = 210, ["y"] = 301 },
+                ["text"] = "The spice must flow.",
+            },
+        },
+        [9] = {
+            [1] = {
+                ["datetime"] = "2019-05-01 20:00:00",
+                ["drawer"] = "lighten",
+                ["pos0"] = { ["page"] = 9, ["x"] = 70, ["y"] = 120.25 },
+                ["pos1"] = { ["page"] = 9, ["x"] = 300, ["y"] = 140 },
+                ["text"] = "Fear is the mind-killer.",
+            },
+            [2] = {
+                ["datetime"] = "2019-05-01 20:05:00",
+                ["text"] = "",
+            },
+        },
+    },
+}
@@ -0,0 +1,42 @@
+-- we can read Lua syntax here!
+return {
+    ["annotations"] = {
+        [1] = {
+            ["chapter"] = "Part One",
+            ["color"] = "yellow",
+            ["datetime"] = "2024-01-15 10:30:00",
+            ["drawer"] = "lighten",
+            ["note"] = "Opening line",
+            ["page"] = "/body/DocFragment[3]/body/p[2]/text().0",
+            ["pageno"] = 12,
+            ["pos0"] = "/body/DocFragment[3]/body/p[2]/text().0",
+            ["pos1"] = "/body/DocFragment[3]/body/p[2]/text().52",
+            ["text"] = "It was a bright cold day in April, and the clocks were striking thirteen.",
+        },
+        [2] = {
+            ["datetime"] = "2024-01-15 10:31:00",
+            ["page"] = "/body/DocFragment[4]/body/p[1]/text().0",
+            ["pageno"] = 20,
+        },
+        [10] = {
+            ["color"] = "red",
+            ["datetime"] = "2024-01-16 08:00:00",
+            ["drawer"] = "underscore",
+            ["page"] = "/body/DocFragment[10]/body/p[5]/text().3",
+            ["pageno"] = 88,
+            ["text"] = "War is peace.\nFreedom is slavery.\nIgnorance is \"strength\".",
+        },
+    },
+    ["doc_pages"] = 326,
+    ["doc_path"] = "/mnt/onboard/Books/1984.epub",
+    ["doc_props"] = {
+        ["authors"] = "George Orwell",
+        ["language"] = "en",
+        ["title"] = "Nineteen Eighty-Four",
+    },
+    ["percent_finished"] = 0.27,
+    ["summary"] = {
+        ["modified"] = "2024-01-16",
+        ["status"] = "reading",
+    },
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How often the trash is checked for books to delete for good
+const trashPurgeInterval = time.Hour
+
+type TrashBookStruct struct {
+	Title     string
+	Author    string
+	FileName  string
+	Cover     string
+	DeletedOn string
+	// Day the book will be deleted for good, empty when the trash is only
+	// emptied by hand
+	PurgeOn string
+}
+
+func (e *Env) _IsBookTrashed(bookId int64) bool {
+	var deletedOn string
+	err := e.db.QueryRow("SELECT `deleted_on` FROM `book` WHERE `id` = ?", bookId).Scan(&deletedOn)
+	if err != nil {
+		return false
+	}
+	return deletedOn != ""
+}
+
+// Move a book to the trash. It stays on disk but leaves the library and the
+// search index until it is restored or deleted for good.
+func (e *Env) _TrashBook(bookId int64) {
+	book, ok := e._GetReindexBook(bookId)
+	if !ok {
+		return
+	}
+
+	stmt, err := e.db.Prepare("UPDATE `book` SET deleted_on=? WHERE id=?")
+	CheckError(err)
+
+	_, err = stmt.Exec(_GetCurrentTime(), bookId)
+	CheckError(err)
+
+	e._RemoveBookFromIndex(book)
+}
+
+// Take a book out of the trash. Returns false when it couldn't be restored,
+// the error is from adding it back to the search index.
+func (e *Env) _RestoreBook(bookId int64) (bool, error) {
+	book, ok := e._GetReindexBook(bookId)
+	if !ok {
+		return false, nil
+	}
+
+	stmt, err := e.db.Prepare("UPDATE `book` SET deleted_on='' WHERE id=?")
+	CheckError(err)
+	if err != nil {
+		return false, nil
+	}
+
+	res, err := stmt.Exec(bookId)
+	CheckError(err)
+	if err != nil {
+		return false, nil
+	}
+
+	count, err := res.RowsAffected()
+	CheckError(err)
+	if count == 0 {
+		return false, nil
+	}
+
+	return true, e._ReindexBook(book)
+}
+
+// Remove the uploaded file of a book, its unzipped EPUB directory and its
+// cover images
+func (e *Env) _RemoveBookFiles(book ReindexBookStruct) {
+	if book.FileName == "" {
+		return
+	}
+
+	err := os.Remove(path.Join("./uploads", book.FileName))
+	CheckError(err)
+
+	if book.Format == "epub" {
+		// Only a directory right under ./uploads
+		epubUnzipPath := path.Join("./uploads", strings.Split(book.FileName, ".epub")[0])
+		if path.Dir(epubUnzipPath) == "uploads" {
+			err = os.RemoveAll(epubUnzipPath)
+			CheckError(err)
+		}
+	}
+
+	// Images extracted from a PDF and covers found by the metadata lookup
+	// start with the file name of the book
+	files, _ := ioutil.ReadDir("./uploads/img")
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), book.FileName+"-") {
+			os.Remove(path.Join("./uploads/img", file.Name()))
+		}
+	}
+
+	// An uploaded cover, unless another book uses the same file
+	coverPath := _GetCoverFilePath(book.Cover)
+	if strings.HasPrefix(coverPath, "./uploads/img/") {
+		var count int64
+		err = e.db.QueryRow("SELECT COUNT(*) FROM `book` WHERE `cover` = ?", book.Cover).Scan(&count)
+		CheckError(err)
+
+		if count == 0 {
+			os.Remove(coverPath)
+		}
+	}
+}
+
+func _GetTrashDays() int {
+	days, err := strconv.Atoi(TrashDays)
+	if err != nil || days < 0 {
+		return 0
+	}
+	return days
+}
+
+func (e *Env) _GetTrashBooks(userId int64) []TrashBookStruct {
+	rows, err := e.db.Query("SELECT `title`, `author`, `filename`, `cover`, `deleted_on` FROM `book`"+
+		" WHERE `user_id` = ? AND `deleted_on` != '' ORDER BY `deleted_on` DESC", userId)
+	CheckError(err)
+
+	days := _GetTrashDays()
+
+	books := []TrashBookStruct{}
+	for rows.Next() {
+		book := TrashBookStruct{}
+		err := rows.Scan(&book.Title, &book.Author, &book.FileName, &book.Cover, &book.DeletedOn)
+		CheckError(err)
+
+		if days > 0 {
+			t, err := time.ParseInLocation("20060102150405", book.DeletedOn, time.Local)
+			if err == nil {
+				book.PurgeOn = t.AddDate(0, 0, days).Format("2006-01-02")
+			}
+		}
+		book.DeletedOn = _FormatDate(book.DeletedOn)
+		books = append(books, book)
+	}
+	rows.Close()
+
+	return books
+}
+
+// Ids and owners of the books in the trash matching the condition
+func (e *Env) _QueryTrashBooks(condition string, args ...interface{}) map[int64]int64 {
+	rows, err := e.db.Query("SELECT `id`, `user_id` FROM `book` WHERE `deleted_on` != '' AND "+condition, args...)
+	CheckError(err)
+
+	books := map[int64]int64{}
+	for rows.Next() {
+		var bookId, userId int64
+		err := rows.Scan(&bookId, &userId)
+		CheckError(err)
+
+		books[bookId] = userId
+	}
+	rows.Close()
+
+	return books
+}
+
+func (e *Env) _PurgeExpiredTrash() {
+	days := _GetTrashDays()
+	if days == 0 {
+		return
+	}
+
+	expiredOn := time.Now().AddDate(0, 0, -days).Format("20060102150405")
+	for bookId, userId := range e._QueryTrashBooks("`deleted_on` < ?", expiredOn) {
+		e._DeleteBook(userId, bookId)
+	}
+}
+
+func (e *Env) _PurgeTrashPeriodically() {
+	for {
+		e._PurgeExpiredTrash()
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+func (e *Env) GetTrash(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		c.HTML(200, "trash.html", gin.H{
+			"books":     e._GetTrashBooks(userId),
+			"trashDays": _GetTrashDays(),
+		})
+	} else {
+		c.Redirect(302, "/signin")
+	}
+}
+
+type TrashPostStruct struct {
+	FileName string `json:"fileName"`
+}
+
+// Book in the trash of the user named in the request
+func (e *Env) _GetTrashPostBook(c *gin.Context, userId int64) (int64, bool) {
+	post := TrashPostStruct{}
+	err := c.BindJSON(&post)
+	if err != nil {
+		return 0, false
+	}
+
+	bookId, _, _ := e._GetBookInfo(post.FileName)
+	if bookId == 0 || e._GetBookOwner(bookId) != userId || !e._IsBookTrashed(bookId) {
+		return 0, false
+	}
+	return bookId, true
+}
+
+func (e *Env) PostRestoreBook(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		bookId, ok := e._GetTrashPostBook(c, userId)
+		if !ok {
+			c.String(404, "Book not found in the trash")
+			return
+		}
+
+		restored, err := e._RestoreBook(bookId)
+		if !restored {
+			c.String(500, "The book couldn't be restored")
+			return
+		}
+		if err != nil {
+			c.String(200, "Book restored, but it couldn't be added to the search index: "+err.Error())
+			return
+		}
+
+		c.String(200, "Book restored")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) PostPurgeBook(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		bookId, ok := e._GetTrashPostBook(c, userId)
+		if !ok {
+			c.String(404, "Book not found in the trash")
+			return
+		}
+
+		if !e._DeleteBook(userId, bookId) {
+			c.String(500, "The book couldn't be deleted")
+			return
+		}
+
+		c.String(200, "Book deleted")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
+
+func (e *Env) PostEmptyTrash(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		deleted := 0
+		for bookId := range e._QueryTrashBooks("`user_id` = ?", userId) {
+			if e._DeleteBook(userId, bookId) {
+				deleted++
+			}
+		}
+
+		c.String(200, strconv.Itoa(deleted)+" books deleted")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What happens to a file of the watched import folder once it is imported
+const (
+	WatchAfterImportKeep   = "keep"
+	WatchAfterImportMove   = "move"
+	WatchAfterImportDelete = "delete"
+)
+
+// Subfolders of the watched import folder where files are moved to. They
+// are not scanned.
+const (
+	watchImportedDir  = "imported"
+	watchDuplicateDir = "duplicates"
+)
+
+// Files modified more recently than this are still being copied into the
+// folder and are left for the next scan
+const watchSettleTime = 30 * time.Second
+
+// Content types of the books found in the folder, by file extension
+var watchContentTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".epub": "application/epub+zip",
+}
+
+func _GetWatchInterval() time.Duration {
+	seconds, err := strconv.Atoi(WatchInterval)
+	if err != nil || seconds < 1 {
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func _GetWatchAfterImport() string {
+	switch WatchAfterImport {
+	case WatchAfterImportMove, WatchAfterImportDelete:
+		return WatchAfterImport
+	}
+	return WatchAfterImportKeep
+}
+
+// Book of the user with the same content as the file, compared with the
+// partial MD5 KOReader uses. Books in the trash are found too, the returned
+// bool tells.
+func (e *Env) _GetBookByContent(userId int64, filePath string) (int64, string, bool) {
+	document := _KOReaderPartialMD5(filePath)
+	if document == "" {
+		return 0, "", false
+	}
+
+	rows, err := e.db.Query("SELECT `book`.`id`, `book`.`filename`, `book`.`deleted_on` FROM `kosync_document` JOIN `book` ON `book`.`id` = `kosync_document`.`book_id` "+
+		"WHERE `kosync_document`.`document` = ? AND `kosync_document`.`method` IN (?, ?) AND `book`.`user_id` = ? "+
+		"ORDER BY `book`.`deleted_on` = '' DESC", document, KOSyncMethodBinary, KOSyncMethodOriginal, userId)
+	CheckError(err)
+
+	var (
+		bookId    int64
+		fileName  string
+		deletedOn string
+	)
+	if rows.Next() {
+		err := rows.Scan(&bookId, &fileName, &deletedOn)
+		CheckError(err)
+	}
+	rows.Close()
+
+	return bookId, fileName, deletedOn != ""
+}
+
+// Move a file into a subfolder of the watched import folder, without
+// overwriting a file of the same name already there
+func _MoveWatchedFile(watchDir string, filePath string, dir string) (string, error) {
+	dir = filepath.Join(watchDir, dir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	ext := filepath.Ext(filePath)
+	base := strings.TrimSuffix(filepath.Base(filePath), ext)
+	target := filepath.Join(dir, base+ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			break
+		}
+		target = filepath.Join(dir, base+"-"+strconv.Itoa(i)+ext)
+	}
+
+	return target, os.Rename(filePath, target)
+}
+
+// Import one file of the watched folder and return what happened to it
+func (e *Env) _ImportWatchedFile(userId int64, watchDir string, filePath string, contentType string) string {
+	fileName := _ConstructFileNameForBook(filepath.Base(filePath), contentType)
+
+	imported := false
+	var outcome string
+	if bookId, existing, trashed := e._GetBookByContent(userId, filePath); bookId != 0 {
+		outcome = "duplicate of " + existing
+		if trashed {
+			outcome += ", which is in the trash"
+		}
+	} else {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return "failed: " + err.Error()
+		}
+		bookId, message := e._ImportBook(userId, fileName, contentType, file)
+		file.Close()
+
+		imported = bookId != 0
+		if imported {
+			outcome = "imported as " + fileName
+		} else {
+			outcome = "skipped: " + strings.TrimSpace(message)
+		}
+	}
+
+	// Duplicates are never deleted, their name may be all they have in
+	// common with the book in the library
+	switch after := _GetWatchAfterImport(); {
+	case after == WatchAfterImportKeep:
+	case imported && after == WatchAfterImportDelete:
+		err := os.Remove(filePath)
+		if err != nil {
+			return outcome + ", could not delete the file: " + err.Error()
+		}
+		outcome += ", file deleted"
+	default:
+		dir := watchDuplicateDir
+		if imported {
+			dir = watchImportedDir
+		}
+		target, err := _MoveWatchedFile(watchDir, filePath, dir)
+		if err != nil {
+			return outcome + ", could not move the file: " + err.Error()
+		}
+		outcome += ", file moved to " + target
+	}
+
+	return outcome
+}
+
+// Import the books found in the watched folder. Files left in the folder
+// are remembered in seen, by modification time, so they are imported and
+// logged once.
+func (e *Env) _ScanWatchDir(userId int64, watchDir string, seen map[string]time.Time) {
+	err := filepath.Walk(watchDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Println("Watch import: " + err.Error())
+			return nil
+		}
+
+		name := info.Name()
+		if info.IsDir() {
+			if filePath != watchDir && (strings.HasPrefix(name, ".") ||
+				filePath == filepath.Join(watchDir, watchImportedDir) ||
+				filePath == filepath.Join(watchDir, watchDuplicateDir)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		contentType, ok := watchContentTypes[strings.ToLower(filepath.Ext(name))]
+		if !ok || strings.HasPrefix(name, ".") {
+			return nil
+		}
+
+		if seenOn, ok := seen[filePath]; ok && seenOn.Equal(info.ModTime()) {
+			return nil
+		}
+		if time.Since(info.ModTime()) < watchSettleTime {
+			return nil
+		}
+
+		outcome := e._ImportWatchedFile(userId, watchDir, filePath, contentType)
+		fmt.Println("Watch import: " + filePath + " " + outcome)
+
+		if _, err := os.Stat(filePath); err == nil {
+			seen[filePath] = info.ModTime()
+		} else {
+			delete(seen, filePath)
+		}
+		return nil
+	})
+	CheckError(err)
+}
+
+// Import the books copied into the watch folder for the watch user, checking
+// the folder every watch interval
+func (e *Env) _WatchImportDir() {
+	if WatchDir == "" {
+		return
+	}
+
+	info, err := os.Stat(WatchDir)
+	if err != nil || !info.IsDir() {
+		fmt.Println("Watch import: " + WatchDir + " is not a directory, the folder is not watched")
+		return
+	}
+
+	userId := e._GetUserId(WatchUser)
+	if userId == 0 {
+		fmt.Println("Watch import: no user with the email " + WatchUser + ", the folder is not watched")
+		return
+	}
+
+	// Duplicates are found by the hashes stored for KOReader, which older
+	// books don't have yet
+	e._UpdateMissingKOSyncDocuments(userId)
+
+	watchDir := filepath.Clean(WatchDir)
+	interval := _GetWatchInterval()
+	seen := map[string]time.Time{}
+	for {
+		e._ScanWatchDir(userId, watchDir, seen)
+		time.Sleep(interval)
+	}
+}
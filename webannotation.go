@@ -0,0 +1,741 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Highlights and notes exposed through the W3C Web Annotation Protocol
+// (https://www.w3.org/TR/annotation-protocol/). Every book is an annotation
+// container at /annotations/<fileName>/, /annotations/ holds the whole
+// library. Annotations are named after their table, e.g. pdf-12 for a PDF
+// highlight and epub-5 for an EPUB annotation.
+//
+// PDF highlights have a target per page, selected with a FragmentSelector
+// (RFC 3778, page=N) refined by a TextQuoteSelector. EPUB annotations are
+// selected by their CFI. Both also have a plain TextQuoteSelector for clients
+// which only know about quotes.
+const (
+	WebAnnotationMediaType = `application/ld+json; profile="http://www.w3.org/ns/anno.jsonld"`
+	WebAnnotationPageSize  = 20
+
+	webAnnotationContext    = "http://www.w3.org/ns/anno.jsonld"
+	webAnnotationLDPContext = "http://www.w3.org/ns/ldp.jsonld"
+	preferContainedIRIs     = "http://www.w3.org/ns/oa#PreferContainedIRIs"
+	preferMinimalContainer  = "http://www.w3.org/ns/ldp#PreferMinimalContainer"
+	pdfFragmentConformsTo   = "http://tools.ietf.org/rfc/rfc3778"
+	epubCFIConformsTo       = "http://www.idpf.org/epub/linking/cfi/epub-cfi.html"
+)
+
+type WebAnnotationSelectorStruct struct {
+	Type       string                       `json:"type"`
+	ConformsTo string                       `json:"conformsTo,omitempty"`
+	Value      string                       `json:"value,omitempty"`
+	Exact      string                       `json:"exact,omitempty"`
+	Prefix     string                       `json:"prefix,omitempty"`
+	Suffix     string                       `json:"suffix,omitempty"`
+	RefinedBy  *WebAnnotationSelectorStruct `json:"refinedBy,omitempty"`
+}
+
+type WebAnnotationTargetStruct struct {
+	Source     string                        `json:"source"`
+	StyleClass string                        `json:"styleClass,omitempty"`
+	Selector   []WebAnnotationSelectorStruct `json:"selector,omitempty"`
+}
+
+type WebAnnotationBodyStruct struct {
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+	Format  string `json:"format,omitempty"`
+	Purpose string `json:"purpose,omitempty"`
+}
+
+type WebAnnotationStylesheetStruct struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type WebAnnotationStruct struct {
+	Context    interface{}                    `json:"@context,omitempty"`
+	Id         string                         `json:"id"`
+	Type       string                         `json:"type"`
+	Motivation string                         `json:"motivation"`
+	Created    string                         `json:"created,omitempty"`
+	Modified   string                         `json:"modified,omitempty"`
+	Body       []WebAnnotationBodyStruct      `json:"body,omitempty"`
+	Target     []WebAnnotationTargetStruct    `json:"target"`
+	Stylesheet *WebAnnotationStylesheetStruct `json:"stylesheet,omitempty"`
+}
+
+type WebAnnotationCollectionStruct struct {
+	Context interface{} `json:"@context,omitempty"`
+	Id      string      `json:"id"`
+	Type    interface{} `json:"type,omitempty"`
+	Label   string      `json:"label,omitempty"`
+	Total   int         `json:"total"`
+	First   interface{} `json:"first,omitempty"`
+	Last    string      `json:"last,omitempty"`
+}
+
+type WebAnnotationPageStruct struct {
+	Context    interface{}                    `json:"@context,omitempty"`
+	Id         string                         `json:"id"`
+	Type       string                         `json:"type"`
+	PartOf     *WebAnnotationCollectionStruct `json:"partOf,omitempty"`
+	StartIndex int                            `json:"startIndex"`
+	Next       string                         `json:"next,omitempty"`
+	Prev       string                         `json:"prev,omitempty"`
+	Items      []interface{}                  `json:"items"`
+}
+
+func _WebAnnotationContainerURL(serverURL string, fileName string) string {
+	if fileName == "" {
+		return serverURL + "/annotations/"
+	}
+	return serverURL + "/annotations/" + url.PathEscape(fileName) + "/"
+}
+
+func _WebAnnotationPageURL(containerURL string, page int, iris bool) string {
+	if iris {
+		return containerURL + "?iris=1&page=" + strconv.Itoa(page)
+	}
+	return containerURL + "?page=" + strconv.Itoa(page)
+}
+
+// YYYYMMDDhhmmss to xsd:dateTime
+func _WebAnnotationTime(t string) string {
+	if len(t) != len(timeLayout) {
+		return ""
+	}
+	return _ParseTime(t).Format(time.RFC3339)
+}
+
+func (e *Env) _ToWebAnnotation(serverURL string, entry NotebookEntryStruct) WebAnnotationStruct {
+	annotation := WebAnnotationStruct{
+		Id:         _WebAnnotationContainerURL(serverURL, entry.FileName) + entry.Format + "-" + strconv.Itoa(int(entry.Id)),
+		Type:       "Annotation",
+		Motivation: "highlighting",
+		Created:    _WebAnnotationTime(entry.CreatedOn),
+		Modified:   _WebAnnotationTime(entry.UpdatedOn),
+		Target:     []WebAnnotationTargetStruct{},
+	}
+
+	if entry.Note != "" {
+		annotation.Motivation = "commenting"
+		annotation.Body = []WebAnnotationBodyStruct{{Type: "TextualBody", Value: entry.Note, Format: "text/plain", Purpose: "commenting"}}
+	}
+
+	if entry.ColorName != "" {
+		annotation.Stylesheet = &WebAnnotationStylesheetStruct{
+			Type:  "CssStylesheet",
+			Value: "." + entry.ColorName + " { background-color: " + entry.Color + "; }",
+		}
+	}
+
+	source := serverURL + "/book/" + entry.FileName
+	if entry.Format == "pdf" {
+		for _, anchor := range e._GetPDFHighlightAnchors(entry.Id) {
+			quote := WebAnnotationSelectorStruct{Type: "TextQuoteSelector", Exact: anchor.Quote}
+			annotation.Target = append(annotation.Target, WebAnnotationTargetStruct{
+				Source:     source,
+				StyleClass: entry.ColorName,
+				Selector: []WebAnnotationSelectorStruct{
+					{Type: "FragmentSelector", ConformsTo: pdfFragmentConformsTo, Value: "page=" + strconv.Itoa(int(anchor.Page)), RefinedBy: &quote},
+					quote,
+				},
+			})
+		}
+	} else {
+		annotation.Target = append(annotation.Target, WebAnnotationTargetStruct{
+			Source:     source,
+			StyleClass: entry.ColorName,
+			Selector: []WebAnnotationSelectorStruct{
+				{Type: "FragmentSelector", ConformsTo: epubCFIConformsTo, Value: entry.CFI},
+				{Type: "TextQuoteSelector", Exact: entry.Quote},
+			},
+		})
+	}
+
+	return annotation
+}
+
+func _MarshalWebAnnotationJSON(v interface{}) []byte {
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(v)
+	CheckError(err)
+
+	return out.Bytes()
+}
+
+func _WebAnnotationETag(data []byte) string {
+	return "\"" + _MD5Hex(string(data)) + "\""
+}
+
+func _SendWebAnnotationJSON(c *gin.Context, status int, v interface{}, allow string) {
+	data := _MarshalWebAnnotationJSON(v)
+
+	c.Header("Allow", allow)
+	c.Header("ETag", _WebAnnotationETag(data))
+	c.Header("Vary", "Accept, Prefer")
+	c.Data(status, WebAnnotationMediaType, data)
+}
+
+// Items of a page of a container, as descriptions or as IRIs only
+func (e *Env) _GetWebAnnotationPage(serverURL string, containerURL string, entries []NotebookEntryStruct, page int, iris bool) WebAnnotationPageStruct {
+	start := page * WebAnnotationPageSize
+	end := start + WebAnnotationPageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	annotationPage := WebAnnotationPageStruct{
+		Id:         _WebAnnotationPageURL(containerURL, page, iris),
+		Type:       "AnnotationPage",
+		StartIndex: start,
+		Items:      []interface{}{},
+	}
+	for _, entry := range entries[start:end] {
+		annotation := e._ToWebAnnotation(serverURL, entry)
+		if iris {
+			annotationPage.Items = append(annotationPage.Items, annotation.Id)
+		} else {
+			annotationPage.Items = append(annotationPage.Items, annotation)
+		}
+	}
+
+	if page > 0 {
+		annotationPage.Prev = _WebAnnotationPageURL(containerURL, page-1, iris)
+	}
+	if end < len(entries) {
+		annotationPage.Next = _WebAnnotationPageURL(containerURL, page+1, iris)
+	}
+
+	return annotationPage
+}
+
+// Annotation of the user in a book from its name in the container
+func (e *Env) _GetWebAnnotationEntry(userId int64, fileName string, name string) (NotebookEntryStruct, bool) {
+	for _, entry := range e._GetNotebookEntries(userId, NotebookFilterStruct{FileName: fileName}) {
+		if entry.Format+"-"+strconv.Itoa(int(entry.Id)) == name {
+			return entry, true
+		}
+	}
+	return NotebookEntryStruct{}, false
+}
+
+// Part of a book an annotation targets, from the selectors of one target
+type webAnnotationLocationStruct struct {
+	Page  int64
+	CFI   string
+	Quote string
+}
+
+type webAnnotationRequestStruct struct {
+	Source    string
+	Note      string
+	ColorName string
+	Locations []webAnnotationLocationStruct
+}
+
+// JSON-LD properties may hold a single value or an array of values
+func _JSONLDValues(raw json.RawMessage) []json.RawMessage {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	if raw[0] != '[' {
+		return []json.RawMessage{raw}
+	}
+
+	var values []json.RawMessage
+	err := json.Unmarshal(raw, &values)
+	if err != nil {
+		return nil
+	}
+	return values
+}
+
+func _ReadWebAnnotationSelector(selector WebAnnotationSelectorStruct, location *webAnnotationLocationStruct) {
+	switch selector.Type {
+	case "FragmentSelector":
+		value := strings.TrimPrefix(selector.Value, "#")
+		if strings.HasPrefix(value, "epubcfi(") {
+			location.CFI = value
+		} else if query, err := url.ParseQuery(value); err == nil {
+			location.Page, _ = strconv.ParseInt(query.Get("page"), 10, 64)
+		}
+	case "TextQuoteSelector":
+		if location.Quote == "" {
+			location.Quote = selector.Exact
+		}
+	}
+
+	if selector.RefinedBy != nil {
+		_ReadWebAnnotationSelector(*selector.RefinedBy, location)
+	}
+}
+
+// Read the note, color and targets of an annotation sent by a client. The
+// note is the first textual body, the color the style class of the targets.
+func _ParseWebAnnotation(data []byte) (webAnnotationRequestStruct, error) {
+	var input struct {
+		BodyValue string          `json:"bodyValue"`
+		Body      json.RawMessage `json:"body"`
+		Target    json.RawMessage `json:"target"`
+	}
+	request := webAnnotationRequestStruct{}
+
+	err := json.Unmarshal(data, &input)
+	if err != nil {
+		return request, err
+	}
+
+	request.Note = input.BodyValue
+	for _, raw := range _JSONLDValues(input.Body) {
+		body := WebAnnotationBodyStruct{}
+		if json.Unmarshal(raw, &body) != nil {
+			// Bodies given by IRI aren't stored
+			continue
+		}
+		if request.Note == "" && (body.Purpose == "" || body.Purpose == "commenting" || body.Purpose == "describing") {
+			request.Note = body.Value
+		}
+	}
+
+	for _, raw := range _JSONLDValues(input.Target) {
+		var target struct {
+			Source     string          `json:"source"`
+			StyleClass string          `json:"styleClass"`
+			Selector   json.RawMessage `json:"selector"`
+		}
+		if json.Unmarshal(raw, &target) != nil {
+			json.Unmarshal(raw, &target.Source)
+		}
+		if request.Source == "" {
+			request.Source = target.Source
+		}
+		if request.ColorName == "" {
+			request.ColorName = target.StyleClass
+		}
+
+		location := webAnnotationLocationStruct{}
+		for _, rawSelector := range _JSONLDValues(target.Selector) {
+			selector := WebAnnotationSelectorStruct{}
+			err := json.Unmarshal(rawSelector, &selector)
+			if err != nil {
+				return request, err
+			}
+			_ReadWebAnnotationSelector(selector, &location)
+		}
+		if location.Quote != "" || location.CFI != "" {
+			request.Locations = append(request.Locations, location)
+		}
+	}
+
+	if len(request.Locations) == 0 {
+		return request, errors.New("the target needs a TextQuoteSelector or an EPUB CFI FragmentSelector")
+	}
+	return request, nil
+}
+
+// File name of a book from its viewer URL, e.g. http://host/book/name.pdf
+func _WebAnnotationSourceFileName(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || !strings.HasPrefix(u.Path, "/book/") {
+		return ""
+	}
+	return strings.TrimPrefix(u.Path, "/book/")
+}
+
+// Anchors of a PDF highlight or the chapter and CFI of an EPUB annotation for
+// the targets of a request. Quotes without a page or CFI are looked up in the
+// book.
+func (e *Env) _LocateWebAnnotation(fileName string, format string, filePath string, locations []webAnnotationLocationStruct) ([]PDFHighlightAnchorStruct, EPUBAnnotationStruct, error) {
+	if format == "pdf" {
+		var (
+			pages   []string
+			anchors []PDFHighlightAnchorStruct
+		)
+		for _, location := range locations {
+			if location.Quote == "" {
+				continue
+			}
+			if pages == nil {
+				pages = _GetPDFPagesText(filePath)
+			}
+
+			anchor := _LocatePDFQuote(pages, location.Quote, location.Page)
+			if anchor.Start < 0 && location.Page <= 0 {
+				continue
+			}
+			anchors = append(anchors, anchor)
+		}
+		if len(anchors) == 0 {
+			return nil, EPUBAnnotationStruct{}, errors.New("quote not found in the book")
+		}
+		return anchors, EPUBAnnotationStruct{}, nil
+	}
+
+	hrefs := e._GetEPUBSpineHrefs(fileName)
+	for _, location := range locations {
+		if location.CFI != "" {
+			position := _EPUBCFIPosition(location.CFI)
+			if len(position) > 0 && position[0] >= 0 && int(position[0]) < len(hrefs) {
+				return nil, EPUBAnnotationStruct{Href: hrefs[position[0]], CFI: location.CFI, Quote: location.Quote}, nil
+			}
+		}
+		if location.Quote != "" {
+			annotation := _LocateEPUBQuote(filePath, hrefs, location.Quote, -1)
+			if annotation.CFI != "" {
+				return nil, annotation, nil
+			}
+		}
+	}
+	return nil, EPUBAnnotationStruct{}, errors.New("target not found in the book")
+}
+
+// Whether the targets of a request are the pages and quotes a PDF highlight
+// already has, so its anchors and their rects can be kept
+func _SameWebAnnotationLocations(locations []webAnnotationLocationStruct, anchors []PDFHighlightAnchorStruct) bool {
+	if len(locations) != len(anchors) {
+		return false
+	}
+	for i, location := range locations {
+		if location.Page != anchors[i].Page || location.Quote != anchors[i].Quote {
+			return false
+		}
+	}
+	return true
+}
+
+// Updates and deletes can be made conditional with the ETag of the annotation
+func (e *Env) _MatchWebAnnotationETag(c *gin.Context, serverURL string, entry NotebookEntryStruct) bool {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+
+	annotation := e._ToWebAnnotation(serverURL, entry)
+	annotation.Context = webAnnotationContext
+	return strings.Contains(ifMatch, _WebAnnotationETag(_MarshalWebAnnotationJSON(annotation)))
+}
+
+func (e *Env) GetWebAnnotationContainer(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+		fileName := c.Param("bookname")
+
+		label := "LibreRead"
+		if fileName != "" {
+			bookId, _, _ := e._GetBookInfo(fileName)
+			if !e._CanAccessBook(userId, bookId) {
+				c.String(404, "Book not found")
+				return
+			}
+			label, _, _, _ = e._GetBookMetaData(fileName)
+		}
+
+		serverURL := _GetServerURL(c)
+		containerURL := _WebAnnotationContainerURL(serverURL, fileName)
+		entries := e._GetNotebookEntries(userId, NotebookFilterStruct{FileName: fileName, Sort: NotebookSortPosition})
+
+		prefer := c.GetHeader("Prefer")
+		iris := c.Query("iris") == "1" || strings.Contains(prefer, preferContainedIRIs)
+		lastPage := (len(entries) - 1) / WebAnnotationPageSize
+		if lastPage < 0 {
+			lastPage = 0
+		}
+
+		if c.Query("page") != "" {
+			page, err := strconv.Atoi(c.Query("page"))
+			if err != nil || page < 0 || page > lastPage {
+				c.String(404, "Page not found")
+				return
+			}
+
+			annotationPage := e._GetWebAnnotationPage(serverURL, containerURL, entries, page, iris)
+			annotationPage.Context = webAnnotationContext
+			annotationPage.PartOf = &WebAnnotationCollectionStruct{
+				Id:    containerURL,
+				Label: label,
+				Total: len(entries),
+			}
+
+			_SendWebAnnotationJSON(c, 200, annotationPage, "GET, HEAD, OPTIONS")
+			return
+		}
+
+		container := WebAnnotationCollectionStruct{
+			Context: []string{webAnnotationContext, webAnnotationLDPContext},
+			Id:      containerURL,
+			Type:    []string{"BasicContainer", "AnnotationCollection"},
+			Label:   label,
+			Total:   len(entries),
+		}
+		if len(entries) > 0 {
+			if strings.Contains(prefer, preferMinimalContainer) {
+				container.First = _WebAnnotationPageURL(containerURL, 0, iris)
+			} else {
+				container.First = e._GetWebAnnotationPage(serverURL, containerURL, entries, 0, iris)
+			}
+			container.Last = _WebAnnotationPageURL(containerURL, lastPage, iris)
+		}
+		if prefer != "" {
+			c.Header("Preference-Applied", "return=representation")
+		}
+
+		c.Header("Link", "<http://www.w3.org/ns/ldp#BasicContainer>; rel=\"type\", <http://www.w3.org/TR/annotation-protocol/>; rel=\"http://www.w3.org/ns/ldp#constrainedBy\"")
+		c.Header("Accept-Post", WebAnnotationMediaType)
+		_SendWebAnnotationJSON(c, 200, container, "GET, POST, HEAD, OPTIONS")
+	} else {
+		c.String(401, "Not signed in")
+	}
+}
+
+// Create an annotation in the container of a book. Annotations posted to the
+// library container go to the book of their target source.
+func (e *Env) PostWebAnnotation(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		data, err := ioutil.ReadAll(c.Request.Body)
+		CheckError(err)
+
+		request, err := _ParseWebAnnotation(data)
+		if err != nil {
+			c.String(400, "Invalid annotation: "+err.Error())
+			return
+		}
+
+		fileName := c.Param("bookname")
+		if fileName == "" {
+			fileName = _WebAnnotationSourceFileName(request.Source)
+		}
+
+		bookId, format, filePath := e._GetBookInfo(fileName)
+		if bookId == 0 {
+			c.String(404, "Book not found")
+			return
+		}
+
+		if !e._CanAnnotateBook(userId, bookId) {
+			c.String(403, "You can't annotate this book")
+			return
+		}
+
+		anchors, epubAnnotation, err := e._LocateWebAnnotation(fileName, format, filePath, request.Locations)
+		if err != nil {
+			c.String(400, "Invalid annotation: "+err.Error())
+			return
+		}
+
+		var id int64
+		if format == "pdf" {
+			id = e._InsertPDFHighlight(bookId, userId, _ImportColor(request.ColorName), request.Note, _GetCurrentTime())
+			for _, anchor := range anchors {
+				e._InsertPDFHighlightAnchor(id, anchor)
+			}
+		} else {
+			epubAnnotation.Color = _ImportColor(request.ColorName)
+			epubAnnotation.Note = request.Note
+			id = e._InsertEPUBAnnotation(userId, bookId, epubAnnotation)
+		}
+
+		serverURL := _GetServerURL(c)
+		entry, _ := e._GetWebAnnotationEntry(userId, fileName, format+"-"+strconv.Itoa(int(id)))
+		annotation := e._ToWebAnnotation(serverURL, entry)
+		annotation.Context = webAnnotationContext
+
+		c.Header("Location", annotation.Id)
+		c.Header("Link", "<http://www.w3.org/ns/ldp#Resource>; rel=\"type\"")
+		_SendWebAnnotationJSON(c, 201, annotation, "GET, PUT, DELETE, HEAD, OPTIONS")
+	} else {
+		c.String(401, "Not signed in")
+	}
+}
+
+func (e *Env) GetWebAnnotation(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		entry, ok := e._GetWebAnnotationEntry(userId, c.Param("bookname"), c.Param("id"))
+		if !ok {
+			c.String(404, "Annotation not found")
+			return
+		}
+
+		annotation := e._ToWebAnnotation(_GetServerURL(c), entry)
+		annotation.Context = webAnnotationContext
+
+		c.Header("Link", "<http://www.w3.org/ns/ldp#Resource>; rel=\"type\"")
+		_SendWebAnnotationJSON(c, 200, annotation, "GET, PUT, DELETE, HEAD, OPTIONS")
+	} else {
+		c.String(401, "Not signed in")
+	}
+}
+
+// Replace the note, color and targets of an annotation
+func (e *Env) PutWebAnnotation(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+		fileName := c.Param("bookname")
+		serverURL := _GetServerURL(c)
+
+		entry, ok := e._GetWebAnnotationEntry(userId, fileName, c.Param("id"))
+		if !ok {
+			c.String(404, "Annotation not found")
+			return
+		}
+		if !e._MatchWebAnnotationETag(c, serverURL, entry) {
+			c.String(412, "Annotation has been modified")
+			return
+		}
+
+		data, err := ioutil.ReadAll(c.Request.Body)
+		CheckError(err)
+
+		request, err := _ParseWebAnnotation(data)
+		if err != nil {
+			c.String(400, "Invalid annotation: "+err.Error())
+			return
+		}
+
+		color := entry.Color
+		if request.ColorName != "" {
+			color = _ImportColor(request.ColorName)
+		}
+
+		_, _, filePath := e._GetBookInfo(fileName)
+		if entry.Format == "pdf" {
+			if !_SameWebAnnotationLocations(request.Locations, e._GetPDFHighlightAnchors(entry.Id)) {
+				anchors, _, err := e._LocateWebAnnotation(fileName, entry.Format, filePath, request.Locations)
+				if err != nil {
+					c.String(400, "Invalid annotation: "+err.Error())
+					return
+				}
+
+				stmt, err := e.db.Prepare("DELETE FROM `pdf_highlight_anchor` WHERE highlighter_id=?")
+				CheckError(err)
+
+				_, err = stmt.Exec(entry.Id)
+				CheckError(err)
+
+				for _, anchor := range anchors {
+					e._InsertPDFHighlightAnchor(entry.Id, anchor)
+				}
+			}
+
+			stmt, err := e.db.Prepare("UPDATE `pdf_highlighter` SET highlight_color=?, highlight_comment=?, updated_on=? WHERE id=? AND user_id=?")
+			CheckError(err)
+
+			_, err = stmt.Exec(color, request.Note, _GetCurrentTime(), entry.Id, userId)
+			CheckError(err)
+		} else {
+			_, epubAnnotation, err := e._LocateWebAnnotation(fileName, entry.Format, filePath, request.Locations)
+			if err != nil {
+				c.String(400, "Invalid annotation: "+err.Error())
+				return
+			}
+
+			stmt, err := e.db.Prepare("UPDATE `epub_annotation` SET spine_href=?, cfi=?, quote=?, color=?, note=?, updated_on=? WHERE id=? AND user_id=?")
+			CheckError(err)
+
+			_, err = stmt.Exec(epubAnnotation.Href, epubAnnotation.CFI, epubAnnotation.Quote, color, request.Note, _GetCurrentTime(), entry.Id, userId)
+			CheckError(err)
+		}
+
+		entry, _ = e._GetWebAnnotationEntry(userId, fileName, c.Param("id"))
+		annotation := e._ToWebAnnotation(serverURL, entry)
+		annotation.Context = webAnnotationContext
+
+		c.Header("Link", "<http://www.w3.org/ns/ldp#Resource>; rel=\"type\"")
+		_SendWebAnnotationJSON(c, 200, annotation, "GET, PUT, DELETE, HEAD, OPTIONS")
+	} else {
+		c.String(401, "Not signed in")
+	}
+}
+
+func (e *Env) DeleteWebAnnotation(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		userId := e._GetUserId(email.(string))
+
+		entry, ok := e._GetWebAnnotationEntry(userId, c.Param("bookname"), c.Param("id"))
+		if !ok {
+			c.String(404, "Annotation not found")
+			return
+		}
+		if !e._MatchWebAnnotationETag(c, _GetServerURL(c), entry) {
+			c.String(412, "Annotation has been modified")
+			return
+		}
+
+		if entry.Format == "pdf" {
+			stmt, err := e.db.Prepare("DELETE FROM `pdf_highlighter` WHERE id=? AND user_id=?")
+			CheckError(err)
+
+			_, err = stmt.Exec(entry.Id, userId)
+			CheckError(err)
+
+			stmt, err = e.db.Prepare("DELETE FROM `pdf_highlight_anchor` WHERE highlighter_id=?")
+			CheckError(err)
+
+			_, err = stmt.Exec(entry.Id)
+			CheckError(err)
+		} else {
+			stmt, err := e.db.Prepare("DELETE FROM `epub_annotation` WHERE id=? AND user_id=?")
+			CheckError(err)
+
+			_, err = stmt.Exec(entry.Id, userId)
+			CheckError(err)
+		}
+		e._DeleteHighlightComments(entry.Format, entry.Id)
+
+		c.Status(204)
+	} else {
+		c.String(401, "Not signed in")
+	}
+}
+
+func OptionsWebAnnotation(c *gin.Context) {
+	if c.Param("id") != "" {
+		c.Header("Allow", "GET, PUT, DELETE, HEAD, OPTIONS")
+	} else {
+		c.Header("Allow", "GET, POST, HEAD, OPTIONS")
+		c.Header("Accept-Post", WebAnnotationMediaType)
+	}
+	c.Status(200)
+}
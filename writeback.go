@@ -0,0 +1,649 @@
+/*
+Copyright 2017 Nirmal Kumar
+
+This file is part of LibreRead.
+
+LibreRead is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+LibreRead is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with LibreRead.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package libreread
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The original file of a book is copied here before edited metadata is first
+// written into it, so it can be restored
+const versionsPath = "./uploads/versions"
+
+// Metadata of a book as it is written into its file
+type BookFileMetadataStruct struct {
+	Title   string
+	Authors []BookAuthorStruct
+	BookDetailsStruct
+	// Path of the cover image on disk, empty when the book has none
+	CoverPath string
+}
+
+func (e *Env) _GetBookFileMetadata(bookId int64) BookFileMetadataStruct {
+	rows, err := e.db.Query("SELECT `title`, `cover` FROM `book` WHERE `id` = ?", bookId)
+	CheckError(err)
+
+	var title, cover string
+	if rows.Next() {
+		err := rows.Scan(&title, &cover)
+		CheckError(err)
+	}
+	rows.Close()
+
+	meta := BookFileMetadataStruct{
+		Title:             title,
+		Authors:           e._GetBookAuthors(bookId),
+		BookDetailsStruct: e._GetBookDetails(bookId),
+	}
+	if cover != "" {
+		meta.CoverPath = _GetCoverFilePath(cover)
+	}
+	return meta
+}
+
+// MARC relator code of an author role, the inverse of _AuthorRole
+func _AuthorRelator(role string) string {
+	switch role {
+	case AuthorRoleEditor:
+		return "edt"
+	case AuthorRoleTranslator:
+		return "trl"
+	}
+	return "aut"
+}
+
+// Escaped for both element text and attribute values
+func _XMLText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+var (
+	opfMetadataRegexp       = regexp.MustCompile(`(?s)(<((?:[\w-]+:)?)metadata\b[^>]*>)(.*?)</(?:[\w-]+:)?metadata\s*>`)
+	opfManifestEndRegexp    = regexp.MustCompile(`</(?:[\w-]+:)?manifest\s*>`)
+	opfManifestItemRegexp   = regexp.MustCompile(`<(?:[\w-]+:)?item\b[^>]*>`)
+	opfMetaRegexp           = regexp.MustCompile(`(?s)[ \t]*<(?:[\w-]+:)?meta(\s[^>]*?)?(?:/>|>(.*?)</(?:[\w-]+:)?meta\s*>)[ \t]*\r?\n?`)
+	opfVersionRegexp        = regexp.MustCompile(`<(?:[\w-]+:)?package\b[^>]*\bversion\s*=\s*["'](\d)`)
+	opfUniqueIdRegexp       = regexp.MustCompile(`<(?:[\w-]+:)?package\b[^>]*\bunique-identifier\s*=\s*["']([^"']+)["']`)
+	dcNamespaceRegexp       = regexp.MustCompile(`xmlns:([\w-]+)\s*=\s*["']http://purl\.org/dc/elements/1\.1/?["']`)
+	opfNamespaceRegexp      = regexp.MustCompile(`xmlns:([\w-]+)\s*=\s*["']http://www\.idpf\.org/2007/opf["']`)
+	mediaTypeAttrRegexp     = regexp.MustCompile(`\bmedia-type\s*=\s*["'][^"']*["']`)
+	metadataIndentRegexp    = regexp.MustCompile(`\n([ \t]*)<`)
+	containerRootfileRegexp = regexp.MustCompile(`full-path\s*=\s*["']([^"']+)["']`)
+)
+
+// Value of an attribute in the attributes of a start tag
+func _XMLAttr(attrs string, name string) string {
+	re := regexp.MustCompile(`(?:^|\s)` + regexp.QuoteMeta(name) + `\s*=\s*["']([^"']*)["']`)
+	if match := re.FindStringSubmatch(attrs); match != nil {
+		return html.UnescapeString(match[1])
+	}
+	return ""
+}
+
+// Rewrite the metadata of an OPF package with the metadata of the book. The
+// elements LibreRead doesn't edit, such as the rights or the unique
+// identifier, are kept as they are.
+func _RewriteOPF(opf string, meta BookFileMetadataStruct) string {
+	loc := opfMetadataRegexp.FindStringSubmatchIndex(opf)
+	if loc == nil {
+		return opf
+	}
+	openTag := opf[loc[2]:loc[3]]
+	metaPrefix := opf[loc[4]:loc[5]]
+	inner := opf[loc[6]:loc[7]]
+
+	epub3 := false
+	if match := opfVersionRegexp.FindStringSubmatch(opf); match != nil {
+		epub3 = match[1] >= "3"
+	}
+	uniqueId := ""
+	if match := opfUniqueIdRegexp.FindStringSubmatch(opf); match != nil {
+		uniqueId = match[1]
+	}
+
+	dc := "dc"
+	if match := dcNamespaceRegexp.FindStringSubmatch(opf); match != nil {
+		dc = match[1]
+	} else {
+		openTag = strings.TrimSuffix(openTag, ">") + ` xmlns:dc="http://purl.org/dc/elements/1.1/">`
+	}
+	// EPUB 2 gives the role and sort name of creators in opf attributes
+	opfPrefix := "opf"
+	if match := opfNamespaceRegexp.FindStringSubmatch(opf); match != nil {
+		opfPrefix = match[1]
+	} else if !epub3 {
+		openTag = strings.TrimSuffix(openTag, ">") + ` xmlns:opf="http://www.idpf.org/2007/opf">`
+	}
+
+	indent := "    "
+	if match := metadataIndentRegexp.FindStringSubmatch(inner); match != nil {
+		indent = match[1]
+	}
+	closingIndent := inner[strings.LastIndex(inner, "\n")+1:]
+	if strings.TrimSpace(closingIndent) != "" {
+		closingIndent = ""
+	}
+
+	removedIds := map[string]bool{}
+	isbnKept := false
+
+	dcRegexp := regexp.MustCompile(`(?s)[ \t]*<` + regexp.QuoteMeta(dc) + `:(\w+)(\s[^>]*?)?(?:/>|>(.*?)</` + regexp.QuoteMeta(dc) + `:\w+\s*>)[ \t]*\r?\n?`)
+	inner = dcRegexp.ReplaceAllStringFunc(inner, func(element string) string {
+		match := dcRegexp.FindStringSubmatch(element)
+		name, attrs, text := match[1], match[2], html.UnescapeString(match[3])
+		id := _XMLAttr(attrs, "id")
+
+		switch name {
+		case "title", "creator", "subject", "description", "publisher", "date":
+		case "language":
+			if meta.Language == "" {
+				return element
+			}
+		case "identifier":
+			isbn := _NormalizeISBN(text)
+			if isbn == "" && !strings.EqualFold(_XMLAttr(attrs, opfPrefix+":scheme"), "isbn") {
+				return element
+			}
+			// The unique identifier names the book for reading systems
+			if id != "" && id == uniqueId {
+				isbnKept = isbnKept || isbn == meta.ISBN
+				return element
+			}
+		default:
+			return element
+		}
+
+		if id != "" {
+			removedIds[id] = true
+		}
+		return ""
+	})
+
+	inner = opfMetaRegexp.ReplaceAllStringFunc(inner, func(element string) string {
+		attrs := opfMetaRegexp.FindStringSubmatch(element)[1]
+		switch {
+		case _XMLAttr(attrs, "name") == "calibre:series", _XMLAttr(attrs, "name") == "calibre:series_index":
+		case _XMLAttr(attrs, "property") == "dcterms:modified":
+		case _XMLAttr(attrs, "property") == "belongs-to-collection":
+			removedIds[_XMLAttr(attrs, "id")] = true
+		default:
+			return element
+		}
+		return ""
+	})
+
+	// EPUB 3 refines the removed elements with meta elements
+	inner = opfMetaRegexp.ReplaceAllStringFunc(inner, func(element string) string {
+		attrs := opfMetaRegexp.FindStringSubmatch(element)[1]
+		if removedIds[strings.TrimPrefix(_XMLAttr(attrs, "refines"), "#")] {
+			return ""
+		}
+		return element
+	})
+
+	dcElement := func(name string, text string) string {
+		return "<" + dc + ":" + name + ">" + _XMLText(text) + "</" + dc + ":" + name + ">"
+	}
+	metaElement := func(attrs string, text string) string {
+		return "<" + metaPrefix + "meta " + attrs + ">" + _XMLText(text) + "</" + metaPrefix + "meta>"
+	}
+
+	elements := []string{dcElement("title", meta.Title)}
+	for i, author := range meta.Authors {
+		relator := _AuthorRelator(author.Role)
+		if epub3 {
+			id := "lr-creator-" + strconv.Itoa(i+1)
+			elements = append(elements,
+				"<"+dc+":creator id=\""+id+"\">"+_XMLText(author.Name)+"</"+dc+":creator>",
+				metaElement(`refines="#`+id+`" property="role" scheme="marc:relators"`, relator),
+				metaElement(`refines="#`+id+`" property="file-as"`, author.SortName))
+		} else {
+			elements = append(elements, "<"+dc+":creator "+opfPrefix+":role=\""+relator+"\" "+opfPrefix+":file-as=\""+_XMLText(author.SortName)+"\">"+_XMLText(author.Name)+"</"+dc+":creator>")
+		}
+	}
+	if meta.Language != "" {
+		elements = append(elements, dcElement("language", meta.Language))
+	}
+	if meta.Publisher != "" {
+		elements = append(elements, dcElement("publisher", meta.Publisher))
+	}
+	if meta.PublishedOn != "" {
+		elements = append(elements, dcElement("date", meta.PublishedOn))
+	}
+	if meta.Description != "" {
+		elements = append(elements, dcElement("description", meta.Description))
+	}
+	for _, tag := range meta.Tags {
+		elements = append(elements, dcElement("subject", tag))
+	}
+	if meta.ISBN != "" && !isbnKept {
+		if epub3 {
+			elements = append(elements, "<"+dc+":identifier id=\"lr-isbn\">urn:isbn:"+meta.ISBN+"</"+dc+":identifier>")
+		} else {
+			elements = append(elements, "<"+dc+":identifier "+opfPrefix+":scheme=\"ISBN\">"+meta.ISBN+"</"+dc+":identifier>")
+		}
+	}
+	if meta.Series != "" {
+		seriesIndex := strconv.FormatFloat(meta.SeriesIndex, 'f', -1, 64)
+		elements = append(elements, "<"+metaPrefix+"meta name=\"calibre:series\" content=\""+_XMLText(meta.Series)+"\"/>")
+		if meta.SeriesIndex > 0 {
+			elements = append(elements, "<"+metaPrefix+"meta name=\"calibre:series_index\" content=\""+seriesIndex+"\"/>")
+		}
+		if epub3 {
+			elements = append(elements,
+				metaElement(`property="belongs-to-collection" id="lr-series"`, meta.Series),
+				metaElement(`refines="#lr-series" property="collection-type"`, "series"))
+			if meta.SeriesIndex > 0 {
+				elements = append(elements, metaElement(`refines="#lr-series" property="group-position"`, seriesIndex))
+			}
+		}
+	}
+
+	if epub3 {
+		elements = append(elements, metaElement(`property="dcterms:modified"`, time.Now().UTC().Format("2006-01-02T15:04:05Z")))
+	}
+
+	inner = strings.TrimRight(inner, " \t\r\n") + "\n" + indent + strings.Join(elements, "\n"+indent) + "\n" + closingIndent
+
+	return opf[:loc[2]] + openTag + inner + opf[loc[7]:]
+}
+
+// Manifest item of the cover image: the item named by the cover meta of EPUB 2
+// or the one with the cover-image property of EPUB 3
+func _OPFCoverItem(opf string) (string, string, string) {
+	coverId := ""
+	if loc := opfMetadataRegexp.FindStringSubmatchIndex(opf); loc != nil {
+		for _, match := range opfMetaRegexp.FindAllStringSubmatch(opf[loc[6]:loc[7]], -1) {
+			if _XMLAttr(match[1], "name") == "cover" {
+				coverId = _XMLAttr(match[1], "content")
+			}
+		}
+	}
+
+	for _, item := range opfManifestItemRegexp.FindAllString(opf, -1) {
+		isCover := coverId != "" && _XMLAttr(item, "id") == coverId
+		for _, property := range strings.Fields(_XMLAttr(item, "properties")) {
+			isCover = isCover || property == "cover-image"
+		}
+		if isCover {
+			href, err := url.PathUnescape(_XMLAttr(item, "href"))
+			if err != nil {
+				href = _XMLAttr(item, "href")
+			}
+			return item, href, _XMLAttr(item, "media-type")
+		}
+	}
+	return "", "", ""
+}
+
+// Point the cover of an OPF package to an image of the given type. The image
+// of the existing cover item is replaced, otherwise a cover item is added.
+// Returns the package and the href of the image.
+func _SetOPFCover(opf string, mediaType string) (string, string) {
+	item, href, itemMediaType := _OPFCoverItem(opf)
+	if item != "" {
+		if itemMediaType != mediaType {
+			newItem := mediaTypeAttrRegexp.ReplaceAllString(item, `media-type="`+mediaType+`"`)
+			opf = strings.Replace(opf, item, newItem, 1)
+		}
+		return opf, href
+	}
+
+	href = "lr-cover." + strings.TrimPrefix(mediaType, "image/")
+	newItem := `<item id="lr-cover" href="` + href + `" media-type="` + mediaType + `"`
+	if match := opfVersionRegexp.FindStringSubmatch(opf); match != nil && match[1] >= "3" {
+		newItem += ` properties="cover-image"`
+	}
+	newItem += "/>"
+
+	if loc := opfManifestEndRegexp.FindStringIndex(opf); loc != nil {
+		opf = opf[:loc[0]] + newItem + opf[loc[0]:]
+	}
+	if loc := opfMetadataRegexp.FindStringSubmatchIndex(opf); loc != nil {
+		opf = opf[:loc[3]] + "<" + opf[loc[4]:loc[5]] + `meta name="cover" content="lr-cover"/>` + opf[loc[3]:]
+	}
+	return opf, href
+}
+
+func _ReadZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return ioutil.ReadAll(rc)
+}
+
+func _WriteZipFile(w *zip.Writer, name string, data []byte) error {
+	fw, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
+
+// Write the metadata and cover into the OPF package of an EPUB. The other
+// entries, the mimetype first, are copied unchanged.
+func _WriteEPUBMetadata(filePath string, meta BookFileMetadataStruct) error {
+	r, err := zip.OpenReader(filePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	files := make(map[string]*zip.File)
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	container, ok := files["META-INF/container.xml"]
+	if !ok {
+		return errors.New("META-INF/container.xml is missing")
+	}
+	data, err := _ReadZipFile(container)
+	if err != nil {
+		return err
+	}
+	match := containerRootfileRegexp.FindSubmatch(data)
+	if match == nil {
+		return errors.New("the container has no rootfile")
+	}
+	opfPath := string(match[1])
+
+	opfFile, ok := files[opfPath]
+	if !ok {
+		return errors.New(opfPath + " is missing")
+	}
+	data, err = _ReadZipFile(opfFile)
+	if err != nil {
+		return err
+	}
+
+	opf := _RewriteOPF(string(data), meta)
+
+	replaced := make(map[string][]byte)
+	if meta.CoverPath != "" {
+		cover, err := ioutil.ReadFile(meta.CoverPath)
+		if err == nil && strings.HasPrefix(http.DetectContentType(cover), "image/") {
+			var href string
+			opf, href = _SetOPFCover(opf, http.DetectContentType(cover))
+			replaced[path.Join(path.Dir(opfPath), href)] = cover
+		}
+	}
+	replaced[opfPath] = []byte(opf)
+
+	tmpPath := filePath + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := zip.NewWriter(out)
+	for _, f := range r.File {
+		if data, ok := replaced[f.Name]; ok {
+			err = _WriteZipFile(w, f.Name, data)
+			delete(replaced, f.Name)
+		} else {
+			err = w.Copy(f)
+		}
+		if err != nil {
+			break
+		}
+	}
+	// A cover added to a book which had none
+	for name, data := range replaced {
+		if err == nil {
+			err = _WriteZipFile(w, name, data)
+		}
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	out.Close()
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+// Write the metadata into the info dictionary and the XMP metadata of a PDF
+// with exiftool, which appends an incremental update. The series has no
+// standard field in PDF and isn't written.
+func _WritePDFMetadata(filePath string, meta BookFileMetadataStruct) error {
+	args := []string{"-overwrite_original", "-m",
+		"-PDF:Title=" + meta.Title,
+		"-XMP-dc:Title=" + meta.Title,
+		"-PDF:Author=" + _AuthorString(meta.Authors),
+		"-PDF:Subject=" + meta.Description,
+		"-XMP-dc:Description=" + meta.Description,
+		"-PDF:Keywords=" + strings.Join(meta.Tags, ", "),
+		"-XMP-dc:Publisher=" + meta.Publisher,
+		"-XMP-dc:Language=" + meta.Language,
+		"-XMP-dc:Date=" + strings.Replace(meta.PublishedOn, "-", ":", -1),
+		"-XMP-dc:Identifier=" + meta.ISBN,
+	}
+
+	// Each value of a list replaces the list, an empty value clears it
+	creators := []string{}
+	for _, author := range meta.Authors {
+		if author.Role == AuthorRoleAuthor {
+			creators = append(creators, "-XMP-dc:Creator="+author.Name)
+		}
+	}
+	if len(creators) == 0 {
+		creators = append(creators, "-XMP-dc:Creator=")
+	}
+	args = append(args, creators...)
+
+	if len(meta.Tags) == 0 {
+		args = append(args, "-XMP-dc:Subject=")
+	}
+	for _, tag := range meta.Tags {
+		args = append(args, "-XMP-dc:Subject="+tag)
+	}
+
+	out, err := exec.Command("exiftool", append(args, filePath)...).CombinedOutput()
+	if errors.Is(err, exec.ErrNotFound) {
+		return errors.New("exiftool is needed to write the metadata of PDF files")
+	}
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func _CopyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Path of the original file of a book, or an empty string when its file was
+// never rewritten
+func (e *Env) _GetOriginalVersion(bookId int64) string {
+	rows, err := e.db.Query("SELECT `file_path` FROM `book_version` WHERE `book_id` = ? ORDER BY `id` LIMIT 1", bookId)
+	CheckError(err)
+
+	var filePath string
+	if rows.Next() {
+		err := rows.Scan(&filePath)
+		CheckError(err)
+	}
+	rows.Close()
+
+	return filePath
+}
+
+func (e *Env) _KeepOriginalVersion(bookId int64, fileName string) error {
+	if e._GetOriginalVersion(bookId) != "" {
+		return nil
+	}
+
+	versionPath := path.Join(versionsPath, strconv.FormatInt(bookId, 10)+"-"+fileName)
+	err := _CopyFile("./uploads/"+fileName, versionPath)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := e.db.Prepare("INSERT INTO `book_version` (book_id, file_path, created_on) VALUES (?, ?, ?)")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId, versionPath, _GetCurrentTime())
+	CheckError(err)
+
+	return nil
+}
+
+// Write the metadata of a book into its file, keeping the original first
+func (e *Env) _WriteBookFile(bookId int64, fileName string, format string) error {
+	err := e._KeepOriginalVersion(bookId, fileName)
+	if err != nil {
+		return err
+	}
+
+	meta := e._GetBookFileMetadata(bookId)
+	filePath := "./uploads/" + fileName
+	if format == "epub" {
+		err = _WriteEPUBMetadata(filePath, meta)
+	} else {
+		err = _WritePDFMetadata(filePath, meta)
+	}
+	if err != nil {
+		return err
+	}
+
+	// KOReader matches books by a hash of their file. Devices may still
+	// have the original file.
+	e._KeepOriginalKOSyncDocument(bookId, e._GetOriginalVersion(bookId))
+	e._UpdateKOSyncDocuments(bookId, fileName)
+	return nil
+}
+
+func (e *Env) _DeleteBookVersions(bookId int64) {
+	rows, err := e.db.Query("SELECT `file_path` FROM `book_version` WHERE `book_id` = ?", bookId)
+	CheckError(err)
+
+	var filePaths []string
+	for rows.Next() {
+		var filePath string
+		err := rows.Scan(&filePath)
+		CheckError(err)
+
+		filePaths = append(filePaths, filePath)
+	}
+	rows.Close()
+
+	for _, filePath := range filePaths {
+		os.Remove(filePath)
+	}
+
+	stmt, err := e.db.Prepare("DELETE FROM `book_version` WHERE `book_id` = ?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId)
+	CheckError(err)
+
+	// The hash of the original file goes with it
+	stmt, err = e.db.Prepare("DELETE FROM `kosync_document` WHERE `book_id` = ? AND `method` = ?")
+	CheckError(err)
+
+	_, err = stmt.Exec(bookId, KOSyncMethodOriginal)
+	CheckError(err)
+}
+
+type RestoreBookFileStruct struct {
+	FileName string `json:"fileName"`
+}
+
+// Put the original file of a book back. The metadata in the library stays as
+// it was edited.
+func (e *Env) PostRestoreBookFile(c *gin.Context) {
+	email := _GetEmailFromSession(c)
+	if email != nil {
+		restore := RestoreBookFileStruct{}
+		err := c.BindJSON(&restore)
+		CheckError(err)
+
+		userId := e._GetUserId(email.(string))
+
+		bookId, _, _ := e._GetBookInfo(restore.FileName)
+		if bookId == 0 || e._GetBookOwner(bookId) != userId {
+			c.String(404, "Book not found")
+			return
+		}
+
+		versionPath := e._GetOriginalVersion(bookId)
+		if versionPath == "" {
+			c.String(400, "The file of this book was never changed")
+			return
+		}
+
+		err = _CopyFile(versionPath, "./uploads/"+restore.FileName)
+		if err != nil {
+			fmt.Println(err)
+			c.String(500, "The original file couldn't be restored")
+			return
+		}
+
+		e._DeleteBookVersions(bookId)
+		e._UpdateKOSyncDocuments(bookId, restore.FileName)
+
+		c.String(200, "The original file was restored")
+	} else {
+		c.String(200, "Not signed in")
+	}
+}